@@ -0,0 +1,89 @@
+// This is a short example on how to use flowpipeline as a library, i.e. how
+// to build a pipeline from Go, register a custom segment, and pass flows
+// through it from your own code.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/pipeline"
+	"github.com/bwNetFlow/flowpipeline/segments"
+
+	// Only the segments used below need to be imported. Importing
+	// github.com/bwNetFlow/flowpipeline/segments/all registers all of them.
+	_ "github.com/bwNetFlow/flowpipeline/segments/filter/flowfilter"
+)
+
+// A custom segment which counts the flows passing through it.
+type Counter struct {
+	segments.BaseSegment
+	count int
+}
+
+func (segment Counter) New(config map[string]string) (segments.Segment, error) {
+	return &Counter{}, nil
+}
+
+func (segment *Counter) Run(wg *sync.WaitGroup) {
+	defer func() {
+		log.Printf("[info] Counter: Saw %d flows.", segment.count)
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		segment.count += 1
+		segment.Out <- msg
+	}
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := segments.Register("counter", &Counter{}, &segments.Schema{Summary: "Counts flows."}); err != nil {
+		log.Fatalf("[error] %v", err)
+	}
+
+	// This is equivalent to calling pipeline.NewFromConfig with the YAML
+	//   - segment: flowfilter
+	//     config:
+	//       filter: proto tcp
+	//   - segment: counter
+	pipe, err := pipeline.NewFromRepr([]pipeline.SegmentRepr{
+		{Name: "flowfilter", Config: map[string]string{"filter": "proto tcp"}},
+		{Name: "counter"},
+	})
+	if err != nil {
+		log.Fatalf("[error] %v", err)
+	}
+	pipe.Start()
+
+	go func() { // feed flows until we are interrupted
+		defer pipe.Close()
+		for i := 0; ; i++ {
+			flow := &pb.EnrichedFlow{Proto: uint32(6 + 11*(i%2)), Bytes: uint64(i)} // alternate TCP and UDP
+			if err := pipe.Send(ctx, flow); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		flow, err := pipe.Receive(context.Background())
+		if err != nil { // io.EOF once the pipeline is closed
+			break
+		}
+		if flow.Bytes%100000 == 0 {
+			fmt.Printf("flow %d has protocol %d\n", flow.Bytes, flow.Proto)
+		}
+	}
+	if err := pipe.Err(); err != nil {
+		log.Fatalf("[error] %v", err)
+	}
+}
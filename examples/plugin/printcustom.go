@@ -19,10 +19,11 @@ type PrintCustom struct {
 	segments.BaseSegment
 }
 
-func (segment PrintCustom) New(config map[string]string) segments.Segment {
+func (segment PrintCustom) New(config map[string]string) (segments.Segment, error) {
 	// This space is for parsing configuration and failing early if
-	// something is wrong. It is left empty for now.
-	return &PrintCustom{}
+	// something is wrong, i.e. by returning
+	// segments.NewConfigError("param", "reason"). It is left empty for now.
+	return &PrintCustom{}, nil
 }
 
 func (segment *PrintCustom) Run(wg *sync.WaitGroup) {
@@ -55,4 +56,8 @@ func init() {
 	segment := &PrintCustom{}
 	// TODO: edit the name you'll use in your config file here.
 	segments.RegisterSegment("printcustom", segment)
+	// TODO: declare any parameters used in New here, using the same name.
+	segments.RegisterSchema("printcustom", segments.Schema{
+		Summary: "Prints a custom message for every flow.",
+	})
 }
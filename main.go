@@ -8,61 +8,25 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"plugin"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 
 	"github.com/bwNetFlow/flowpipeline/pipeline"
+	"github.com/bwNetFlow/flowpipeline/segments"
 	"github.com/hashicorp/logutils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	_ "github.com/bwNetFlow/flowpipeline/segments/alert/http"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/controlflow/branch"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/export/clickhouse"
-	_ "github.com/bwNetFlow/flowpipeline/segments/export/influx"
-	_ "github.com/bwNetFlow/flowpipeline/segments/export/prometheus"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/filter/drop"
-	_ "github.com/bwNetFlow/flowpipeline/segments/filter/elephant"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/filter/flowfilter"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/input/bpf"
-	_ "github.com/bwNetFlow/flowpipeline/segments/input/goflow"
-	_ "github.com/bwNetFlow/flowpipeline/segments/input/kafkaconsumer"
-	_ "github.com/bwNetFlow/flowpipeline/segments/input/packet"
-	_ "github.com/bwNetFlow/flowpipeline/segments/input/stdin"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/addcid"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/addrstrings"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/anonymize"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/aslookup"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/bgp"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/dropfields"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/geolocation"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/normalize"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/protomap"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/remoteaddress"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/reversedns"
-	_ "github.com/bwNetFlow/flowpipeline/segments/modify/snmp"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/pass"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/output/csv"
-	_ "github.com/bwNetFlow/flowpipeline/segments/output/json"
-	_ "github.com/bwNetFlow/flowpipeline/segments/output/kafkaproducer"
-	_ "github.com/bwNetFlow/flowpipeline/segments/output/lumberjack"
-	_ "github.com/bwNetFlow/flowpipeline/segments/output/sqlite"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/print/count"
-	_ "github.com/bwNetFlow/flowpipeline/segments/print/printdots"
-	_ "github.com/bwNetFlow/flowpipeline/segments/print/printflowdump"
-	_ "github.com/bwNetFlow/flowpipeline/segments/print/toptalkers"
-
-	_ "github.com/bwNetFlow/flowpipeline/segments/analysis/toptalkers_metrics"
+	_ "github.com/bwNetFlow/flowpipeline/segments/all"
 )
 
 var Version string
@@ -84,6 +48,10 @@ func main() {
 	loglevel := flag.String("l", "warning", "loglevel: one of 'debug', 'info', 'warning' or 'error'")
 	version := flag.Bool("v", false, "print version")
 	configfile := flag.String("c", "config.yml", "location of the config file in yml format")
+	check := flag.Bool("check", false, "validate the config file and exit, non-zero exit status indicates problems")
+	list := flag.Bool("list", false, "list all available segments and exit")
+	describe := flag.String("describe", "", "print all parameters of the given segment and exit")
+	admin := flag.String("admin", "", "address to serve runtime metrics of all segments on, e.g. ':9090', disabled by default")
 	flag.Parse()
 
 	if *version {
@@ -101,28 +69,171 @@ func main() {
 		_, err := plugin.Open(path)
 		if err != nil {
 			if err.Error() == "plugin: not implemented" {
-				log.Println("[error] Loading plugins is unsupported when running a static, not CGO-enabled binary.")
+				log.Println("[error] Loading plugins is unsupported when running a static, not CGO-enabled binary, consider the script, wasm, or exec segments instead.")
 			} else {
 				log.Printf("[error] Problem loading the specified plugin: %s", err)
 			}
+			if *check {
+				os.Exit(1)
+			}
 			return
 		} else {
 			log.Printf("[info] Loaded plugin: %s", path)
 		}
 	}
 
+	if *list {
+		listSegments(os.Stdout)
+		return
+	}
+
+	if *describe != "" {
+		if err := describeSegment(os.Stdout, *describe); err != nil {
+			log.Printf("[error] %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	config, err := os.ReadFile(*configfile)
 	if err != nil {
 		log.Printf("[error] reading config file: %s", err)
+		if *check {
+			os.Exit(1)
+		}
 		return
 	}
-	pipe := pipeline.NewFromConfig(config)
+
+	if *check {
+		errs := pipeline.CheckConfig(config)
+		for _, err := range errs {
+			log.Printf("[error] %s: %v", *configfile, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: configuration is valid\n", *configfile)
+		return
+	}
+
+	pipe, err := pipeline.NewFromConfig(config)
+	if err != nil {
+		log.Printf("[error] %s: %v", *configfile, err)
+		os.Exit(1)
+	}
+	if *admin != "" {
+		metrics := pipeline.NewMetrics()
+		pipe.Instrument(metrics)
+		if err := serveAdmin(*admin, metrics); err != nil {
+			log.Printf("[error] Admin: %v", err)
+			os.Exit(1)
+		}
+	}
 	pipe.Start()
 	pipe.AutoDrain()
 
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
-	<-sigs
+	signal.Notify(sigs, os.Interrupt, syscall.SIGHUP)
+loop:
+	for {
+		select {
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				break loop
+			}
+			log.Printf("[info] Received SIGHUP, reloading %s.", *configfile)
+			config, err := os.ReadFile(*configfile)
+			if err != nil {
+				log.Printf("[error] reading config file, keeping the current configuration: %s", err)
+				continue
+			}
+			newPipe, err := pipe.Reload(config)
+			if err != nil {
+				log.Printf("[error] %s: %v", *configfile, err)
+				log.Println("[error] Reload failed, keeping the current configuration.")
+				continue
+			}
+			pipe = newPipe
+			pipe.AutoDrain()
+			log.Println("[info] Reload finished.")
+		case <-pipe.Context().Done(): // a segment requested the end of the pipeline
+			break loop
+		}
+	}
 
 	pipe.Close()
+	if err := pipe.Err(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// Serves the pipeline's metrics along with the usual Go runtime and process
+// metrics on the given address. Listening errors are returned immediately,
+// the server itself runs in the background.
+func serveAdmin(addr string, metrics *pipeline.Metrics) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		metrics,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Printf("[error] Admin: HTTP server stopped: %v", err)
+	}()
+	log.Printf("[info] Admin: Serving metrics at %s/metrics.", listener.Addr())
+	return nil
+}
+
+// Prints the names of all available segments along with their summary.
+func listSegments(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range segments.ListSegments() {
+		schema, _ := segments.LookupSchema(name)
+		fmt.Fprintf(tw, "%s\t%s\n", name, schema.Summary)
+	}
+	tw.Flush()
+}
+
+// Prints the summary of a single segment and all of its parameters in a
+// format similar to the flag package's usage output.
+func describeSegment(w io.Writer, name string) error {
+	if _, err := segments.LookupSegment(name); err != nil {
+		return err
+	}
+	schema, ok := segments.LookupSchema(name)
+	if !ok {
+		fmt.Fprintf(w, "%s: this segment does not declare its parameters\n", name)
+		return nil
+	}
+	fmt.Fprintf(w, "%s: %s\n", name, schema.Summary)
+	if len(schema.Params) == 0 {
+		fmt.Fprintln(w, "This segment has no parameters.")
+		return nil
+	}
+	fmt.Fprintln(w, "Parameters:")
+	for _, param := range schema.Params {
+		paramType := param.Type
+		if paramType == "" {
+			paramType = segments.TypeString
+		}
+		details := []string{string(paramType)}
+		if param.Required {
+			details = append(details, "required")
+		}
+		if param.Default != "" {
+			details = append(details, fmt.Sprintf("default %q", param.Default))
+		}
+		if len(param.Options) > 0 {
+			details = append(details, "one of "+strings.Join(param.Options, "|"))
+		}
+		fmt.Fprintf(w, "  %s (%s)\n    \t%s\n", param.Name, strings.Join(details, ", "), param.Doc)
+	}
+	return nil
 }
@@ -0,0 +1,150 @@
+package pb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	oldpb "github.com/bwNetFlow/protobuf/go"
+	goflowpb "github.com/netsampler/goflow2/pb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// The encodings flows can be decoded from by input segments.
+type Format string
+
+const (
+	FormatEnrichedFlow    Format = "enrichedflow"     // an EnrichedFlow in protobuf encoding
+	FormatLegacy          Format = "bwnetflow-legacy" // a FlowMessage of the former bwNetFlow protobuf, see NewFromOld
+	FormatGoflow          Format = "goflow2"          // a FlowMessage of goflow2's protobuf, see NewFromGoflow
+	FormatJson            Format = "json"             // an EnrichedFlow in JSON encoding, as written by the json segment
+	FormatLengthDelimited Format = "length-delimited" // any number of EnrichedFlows in protobuf encoding, each prefixed by its varint encoded length
+)
+
+// All formats in the order they are documented in.
+var Formats = []Format{FormatEnrichedFlow, FormatLegacy, FormatGoflow, FormatJson, FormatLengthDelimited}
+
+// Returned by Decode and FlowReader.Read if a message is not valid in the
+// expected format. Any other messages can still be decoded.
+var ErrDecode = errors.New("could not decode flow")
+
+// Checks whether this is a known format.
+func (format Format) Check() error {
+	var valid []string
+	for _, known := range Formats {
+		if format == known {
+			return nil
+		}
+		valid = append(valid, string(known))
+	}
+	return fmt.Errorf("unknown format '%s', valid formats are %s", format, strings.Join(valid, ", "))
+}
+
+// Decodes the flows contained in a single message in this format. This is a
+// single flow for any format but FormatLengthDelimited.
+func (format Format) Decode(data []byte) ([]*EnrichedFlow, error) {
+	var msg *EnrichedFlow
+	var err error
+	switch format {
+	case FormatEnrichedFlow:
+		msg = &EnrichedFlow{}
+		err = proto.Unmarshal(data, msg)
+	case FormatLegacy:
+		old := &oldpb.FlowMessage{}
+		if err = proto.Unmarshal(data, old); err == nil {
+			msg = NewFromOld(old)
+		}
+	case FormatGoflow:
+		goflow := &goflowpb.FlowMessage{}
+		if err = proto.Unmarshal(data, goflow); err == nil {
+			msg = NewFromGoflow(goflow)
+		}
+	case FormatJson:
+		msg = &EnrichedFlow{}
+		err = protojson.Unmarshal(data, msg)
+	case FormatLengthDelimited:
+		var msgs []*EnrichedFlow
+		for len(data) > 0 {
+			size, n := protowire.ConsumeVarint(data)
+			if n < 0 || uint64(len(data)-n) < size {
+				return msgs, fmt.Errorf("%w: truncated length-delimited message", ErrDecode)
+			}
+			msg := &EnrichedFlow{}
+			if err := proto.Unmarshal(data[n:n+int(size)], msg); err != nil {
+				return msgs, fmt.Errorf("%w: %v", ErrDecode, err)
+			}
+			msgs = append(msgs, msg)
+			data = data[n+int(size):]
+		}
+		return msgs, nil
+	default:
+		return nil, format.Check()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return []*EnrichedFlow{msg}, nil
+}
+
+// The largest length-delimited flow accepted by FlowReader, anything larger
+// indicates a corrupt stream.
+const maxFlowSize = 64 << 20
+
+// Reads flows in a given format from a stream. Flows in JSON are expected one
+// per line, while those in any other format are expected to be prefixed by
+// their varint encoded length, which makes FormatEnrichedFlow and
+// FormatLengthDelimited equivalent.
+type FlowReader struct {
+	reader *bufio.Reader
+	format Format
+}
+
+func NewFlowReader(r io.Reader, format Format) *FlowReader {
+	if format == FormatLengthDelimited {
+		format = FormatEnrichedFlow
+	}
+	return &FlowReader{reader: bufio.NewReader(r), format: format}
+}
+
+// Returns the next flow, or io.EOF once the stream has ended. If the error is
+// ErrDecode, the next flow can be read nonetheless, while any other error
+// ends the stream.
+func (r *FlowReader) Read() (*EnrichedFlow, error) {
+	var data []byte
+	if r.format == FormatJson {
+		for len(data) == 0 { // skip empty lines
+			line, err := r.reader.ReadBytes('\n')
+			data = bytes.TrimSpace(line)
+			if err == io.EOF && len(data) > 0 {
+				break // the last line lacks a newline
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		size, err := binary.ReadUvarint(r.reader)
+		if err != nil {
+			return nil, err
+		} else if size > maxFlowSize {
+			return nil, fmt.Errorf("flow of %d bytes exceeds the limit of %d bytes, the stream is probably corrupt", size, maxFlowSize)
+		}
+		data = make([]byte, size)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	msgs, err := r.format.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return msgs[0], nil
+}
@@ -0,0 +1,67 @@
+package pb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	oldpb "github.com/bwNetFlow/protobuf/go"
+	goflowpb "github.com/netsampler/goflow2/pb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFormat_Decode(t *testing.T) {
+	flow, _ := proto.Marshal(&EnrichedFlow{Bytes: 42})
+	old, _ := proto.Marshal(&oldpb.FlowMessage{Bytes: 42})
+	goflow, _ := proto.Marshal(&goflowpb.FlowMessage{Bytes: 42})
+	delimited := protowire.AppendBytes(protowire.AppendBytes(nil, flow), flow)
+	for format, data := range map[Format][]byte{
+		FormatEnrichedFlow:    flow,
+		FormatLegacy:          old,
+		FormatGoflow:          goflow,
+		FormatJson:            []byte(`{"Bytes": "42"}`),
+		FormatLengthDelimited: delimited,
+	} {
+		msgs, err := format.Decode(data)
+		if err != nil || len(msgs) == 0 || msgs[0].Bytes != 42 {
+			t.Errorf("Format %s decoded %v with error %v.", format, msgs, err)
+		}
+	}
+	if msgs, _ := FormatLengthDelimited.Decode(delimited); len(msgs) != 2 {
+		t.Errorf("Format %s decoded %d instead of 2 flows.", FormatLengthDelimited, len(msgs))
+	}
+	if _, err := FormatLengthDelimited.Decode(delimited[:len(delimited)-1]); !errors.Is(err, ErrDecode) {
+		t.Errorf("Format %s decoded a truncated message with error %v.", FormatLengthDelimited, err)
+	}
+	if err := Format("protobuf").Check(); err == nil {
+		t.Error("Unknown format passed the check.")
+	}
+}
+
+func TestFlowReader(t *testing.T) {
+	reader := NewFlowReader(bytes.NewBufferString("{\"Bytes\": \"1\"}\n\nnot json\n{\"Bytes\": \"2\"}"), FormatJson)
+	for _, expected := range []uint64{1, 0, 2} {
+		msg, err := reader.Read()
+		if expected == 0 {
+			if !errors.Is(err, ErrDecode) {
+				t.Errorf("Reader returned %v instead of a decoding error.", err)
+			}
+		} else if err != nil || msg.Bytes != expected {
+			t.Errorf("Reader returned %v with error %v instead of flow %d.", msg, err, expected)
+		}
+	}
+	if _, err := reader.Read(); err != io.EOF {
+		t.Errorf("Reader returned %v instead of io.EOF.", err)
+	}
+
+	goflow, _ := proto.Marshal(&goflowpb.FlowMessage{Bytes: 3})
+	reader = NewFlowReader(bytes.NewBuffer(protowire.AppendBytes(nil, goflow)), FormatGoflow)
+	if msg, err := reader.Read(); err != nil || msg.Bytes != 3 {
+		t.Errorf("Reader returned %v with error %v instead of flow 3.", msg, err)
+	}
+	if _, err := reader.Read(); err != io.EOF {
+		t.Errorf("Reader returned %v instead of io.EOF.", err)
+	}
+}
@@ -1,28 +1,136 @@
 package pipeline
 
 import (
+	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/bwNetFlow/flowpipeline/segments"
 	"github.com/bwNetFlow/flowpipeline/segments/controlflow/branch"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/shard"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/switchcase"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/tee"
 	"gopkg.in/yaml.v2"
 )
 
 // A config representation of a segment. It is intended to look like this:
 //   - segment: pass
+//     id: passed
+//     from: [other, another]
 //     config:
 //       key: value
 //       foo: bar
+//     buffer: 1000
+//     overflow: drop-oldest
+//     workers: 4
+//     ordered: true
 // This struct has the appropriate yaml tags inline.
 type SegmentRepr struct {
-	Name   string            `yaml:"segment"`             // to be looked up with a registry
-	Config map[string]string `yaml:"config"`              // to be expanded by our instance
-	If     []SegmentRepr     `yaml:"if,omitempty,flow"`   // only used by group segment
-	Then   []SegmentRepr     `yaml:"then,omitempty,flow"` // only used by group segment
-	Else   []SegmentRepr     `yaml:"else,omitempty,flow"` // only used by group segment
+	Name     string            `yaml:"segment"`             // to be looked up with a registry
+	ID       string            `yaml:"id,omitempty"`        // to be referenced by other segments' From
+	From     []string          `yaml:"from,omitempty,flow"` // IDs of the segments to receive flows from, the previous one by default
+	Config   map[string]string `yaml:"config"`              // to be expanded by our instance
+	Buffer   int               `yaml:"buffer,omitempty"`    // size of the segment's input buffer
+	Overflow OverflowPolicy    `yaml:"overflow,omitempty"`  // applied when the input buffer is full
+	Workers  int               `yaml:"workers,omitempty"`   // number of instances to run concurrently
+	Ordered  bool              `yaml:"ordered,omitempty"`   // whether these instances keep the order of flows
+	If       []SegmentRepr     `yaml:"if,omitempty,flow"`   // only used by group segment
+	Then     []SegmentRepr     `yaml:"then,omitempty,flow"` // only used by group segment
+	Else     []SegmentRepr     `yaml:"else,omitempty,flow"` // only used by group segment
+	Branches []PipelineRepr    `yaml:"branches,omitempty"`  // only used by tee segment
+	Cases    []CaseRepr        `yaml:"cases,omitempty"`     // only used by switch segment
+	Default  []SegmentRepr     `yaml:"default,omitempty"`   // only used by switch segment
+	Segments []SegmentRepr     `yaml:"segments,omitempty"`  // only used by shard segment
+}
+
+// A config representation of a whole configuration. Usually, this is just the
+// list of segments, but it may also be a mapping with the key 'segments'
+// containing this list and the key 'deadletter' containing the list of
+// segments of the dead letter pipeline, see Pipeline.SetDeadLetter:
+//   segments:
+//     - segment: json
+//       config:
+//         filename: flows.json
+//   deadletter:
+//     - segment: json
+//       config:
+//         filename: failed.json
+type ConfigRepr struct {
+	Segments   []SegmentRepr `yaml:"segments"`
+	DeadLetter []SegmentRepr `yaml:"deadletter,omitempty"`
+}
+
+// Accepts both the list and the mapping form of a configuration.
+func (c *ConfigRepr) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var probe interface{}
+	if err := unmarshal(&probe); err != nil {
+		return err
+	}
+	if _, ok := probe.([]interface{}); ok || probe == nil {
+		return unmarshal(&c.Segments)
+	}
+	type plain ConfigRepr // without this method
+	return unmarshal((*plain)(c))
+}
+
+// A config representation of an embedded pipeline, as used in the list of
+// branches of the tee segment. Its only key 'segments' contains a list of
+// segments just as a regular configuration does.
+type PipelineRepr struct {
+	Segments []SegmentRepr `yaml:"segments"`
+}
+
+// A config representation of a single case of the switch segment. Its key
+// 'filter' contains a filter expression in flowfilter syntax, and its key
+// 'segments' contains a list of segments just as a regular configuration does.
+type CaseRepr struct {
+	Filter   string        `yaml:"filter"`
+	Segments []SegmentRepr `yaml:"segments"`
+}
+
+// Checks whether the keys describing embedded pipelines are supported by the
+// given segment.
+func (s *SegmentRepr) checkEmbedded(segment segments.Segment) error {
+	_, isBranch := segment.(*branch.Branch)
+	_, isTee := segment.(*tee.Tee)
+	_, isSwitch := segment.(*switchcase.Switch)
+	_, isShard := segment.(*shard.Shard)
+	switch {
+	case !isBranch && len(s.If)+len(s.Then)+len(s.Else) > 0:
+		return &segments.ConfigError{Segment: s.Name, Reason: "the keys 'if', 'then' and 'else' are only supported by the branch segment"}
+	case !isTee && len(s.Branches) > 0:
+		return &segments.ConfigError{Segment: s.Name, Reason: "the key 'branches' is only supported by the tee segment"}
+	case isTee && len(s.Branches) == 0:
+		return &segments.ConfigError{Segment: s.Name, Key: "branches", Reason: "the tee segment requires at least one branch"}
+	case !isSwitch && len(s.Cases)+len(s.Default) > 0:
+		return &segments.ConfigError{Segment: s.Name, Reason: "the keys 'cases' and 'default' are only supported by the switch segment"}
+	case isSwitch && len(s.Cases) == 0:
+		return &segments.ConfigError{Segment: s.Name, Key: "cases", Reason: "the switch segment requires at least one case"}
+	case !isShard && len(s.Segments) > 0:
+		return &segments.ConfigError{Segment: s.Name, Reason: "the key 'segments' is only supported by the shard segment"}
+	case isShard && len(s.Segments) == 0:
+		return &segments.ConfigError{Segment: s.Name, Key: "segments", Reason: "the shard segment requires at least one segment"}
+	case (isBranch || isTee || isSwitch || isShard) && s.Workers > 1:
+		return fmt.Errorf("workers are not supported by the %s segment", s.Name)
+	}
+	return nil
+}
+
+// Checks the keys handled by the pipeline itself rather than by the segment.
+func (s *SegmentRepr) check() error {
+	if err := s.Overflow.Check(s.Buffer); err != nil {
+		return err
+	}
+	if s.Workers < 0 {
+		return fmt.Errorf("number of workers %d is negative", s.Workers)
+	}
+	if s.Ordered && s.Workers <= 1 {
+		return errors.New("keeping flows ordered requires more than one worker")
+	}
+	return nil
 }
 
 // Returns the SegmentRepr's Config with all its variables expanded. It tries
@@ -47,44 +155,409 @@ func (s *SegmentRepr) ExpandedConfig() map[string]string {
 	return expandedConfig
 }
 
+// Describes a problem with a single segment of a configuration. The Path
+// identifies the segment by its index in the list of segments, prefixed by the
+// index and key of any enclosing segments, i.e. '2.then.0' is the first segment
+// in the 'then' branch of the third segment, and '2.branches.1.0' is the first
+// segment in the second of its 'branches'. A path such as '2.cases.1' refers to
+// a case of a switch segment itself. The segments of a shard segment are
+// identified by the shard they are in, i.e. '2.shards.3.0', and those of the
+// dead letter pipeline are prefixed by 'deadletter.'.
+type SegmentError struct {
+	Path string
+	Name string
+	Err  error
+}
+
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("segment %s: %v", e.Path, e.Err)
+}
+
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
 // Builds a list of Segment objects from raw configuration bytes and
-// initializes a Pipeline with them.
-func NewFromConfig(config []byte) *Pipeline {
-	// parse a list of SegmentReprs from yaml
-	segmentReprs := new([]SegmentRepr)
+// initializes a Pipeline with them. The returned error lists all segments
+// that could not be initialized.
+func NewFromConfig(config []byte) (*Pipeline, error) {
+	// parse the list of SegmentReprs, and possibly a dead letter list, from yaml
+	var configRepr ConfigRepr
 
-	err := yaml.Unmarshal(config, &segmentReprs)
+	err := yaml.Unmarshal(config, &configRepr)
 	if err != nil {
-		log.Fatalf("[error] Error parsing configuration YAML: %v", err)
+		return nil, fmt.Errorf("parsing configuration YAML: %w", err)
 	}
 
-	segments := SegmentsFromRepr(segmentReprs)
+	return NewFromConfigRepr(configRepr)
+}
+
+// Builds a list of Segment objects from their config representations and
+// initializes a Pipeline with them, exactly as NewFromConfig does for the
+// parsed YAML. This allows programs using flowpipeline as a library to
+// construct their configuration in Go. The returned error lists all segments
+// that could not be initialized.
+func NewFromRepr(segmentReprs []SegmentRepr) (*Pipeline, error) {
+	segments, err := SegmentsFromRepr(&segmentReprs)
+	if err != nil {
+		return nil, err
+	}
 
 	// we have SegmentReprs parsed, instanciate them as actual Segments
-	return New(segments...)
+	return newFromSegments(segments, segmentReprs, ""), nil
+}
+
+// Does the same as NewFromRepr, but additionally sets up the dead letter
+// pipeline if the given configuration contains one.
+func NewFromConfigRepr(configRepr ConfigRepr) (*Pipeline, error) {
+	segmentList, errs := segmentsFromRepr(&configRepr.Segments, "")
+	deadLetterList, deadLetterErrs := segmentsFromRepr(&configRepr.DeadLetter, "deadletter.")
+	if errs = append(errs, deadLetterErrs...); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	pipeline := newFromSegments(segmentList, configRepr.Segments, "")
+	if errs := pipeline.trackingErrors(); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(configRepr.DeadLetter) > 0 {
+		pipeline.SetDeadLetter(newFromSegments(deadLetterList, configRepr.DeadLetter, "deadletter."))
+	}
+	return pipeline, nil
+}
+
+// Validates raw configuration bytes by parsing them and instanciating every
+// segment therein, including those in embedded pipelines. No segment is
+// started. All problems found are returned, an empty list signifies a valid
+// configuration.
+func CheckConfig(config []byte) []error {
+	var configRepr ConfigRepr
+
+	err := yaml.Unmarshal(config, &configRepr)
+	if err != nil {
+		return []error{fmt.Errorf("parsing configuration YAML: %w", err)}
+	}
+
+	segmentList, errs := segmentsFromRepr(&configRepr.Segments, "")
+	_, deadLetterErrs := segmentsFromRepr(&configRepr.DeadLetter, "deadletter.")
+	if errs = append(errs, deadLetterErrs...); len(errs) > 0 {
+		return errs
+	}
+	// creating the Pipeline starts nothing, it only links the segments
+	return newFromSegments(segmentList, configRepr.Segments, "").trackingErrors()
 }
 
 // Creates a list of Segments from their config representations. Handles
-// recursive definitions found in Segments.
-func SegmentsFromRepr(segmentReprs *[]SegmentRepr) []segments.Segment {
+// recursive definitions found in Segments. The returned error joins a
+// *SegmentError for each segment that could not be initialized.
+func SegmentsFromRepr(segmentReprs *[]SegmentRepr) ([]segments.Segment, error) {
+	segmentList, errs := segmentsFromRepr(segmentReprs, "")
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return segmentList, nil
+}
+
+// Does the actual work for SegmentsFromRepr, but returns the list of errors
+// encountered. The pathPrefix is used to identify segments in embedded
+// pipelines in these errors.
+func segmentsFromRepr(segmentReprs *[]SegmentRepr, pathPrefix string) ([]segments.Segment, []error) {
+	var errs []error
 	segmentList := make([]segments.Segment, len(*segmentReprs))
 	for i, segmentrepr := range *segmentReprs {
-		segmentTemplate := segments.LookupSegment(segmentrepr.Name) // a typed nil instance
+		path := pathPrefix + strconv.Itoa(i)
+		if err := segmentrepr.check(); err != nil {
+			errs = append(errs, &SegmentError{Path: path, Name: segmentrepr.Name, Err: err})
+			continue
+		}
 		// the Segment's New method knows how to handle our config
-		segment := segmentTemplate.New(segmentrepr.ExpandedConfig())
+		segment, err := segments.NewSegment(segmentrepr.Name, segmentrepr.ExpandedConfig())
+		if err != nil {
+			errs = append(errs, &SegmentError{Path: path, Name: segmentrepr.Name, Err: err})
+			continue
+		}
+		if err := segmentrepr.checkEmbedded(segment); err != nil {
+			errs = append(errs, &SegmentError{Path: path, Name: segmentrepr.Name, Err: err})
+			continue
+		}
 		switch segment := segment.(type) { // handle special segments
 		case *branch.Branch:
-			segment.ImportBranches(
-				New(SegmentsFromRepr(&segmentrepr.If)...),
-				New(SegmentsFromRepr(&segmentrepr.Then)...),
-				New(SegmentsFromRepr(&segmentrepr.Else)...),
-			)
+			condition, ifErrs := segmentsFromRepr(&segmentrepr.If, path+".if.")
+			thenBranch, thenErrs := segmentsFromRepr(&segmentrepr.Then, path+".then.")
+			elseBranch, elseErrs := segmentsFromRepr(&segmentrepr.Else, path+".else.")
+			if len(ifErrs)+len(thenErrs)+len(elseErrs) > 0 {
+				errs = append(append(append(errs, ifErrs...), thenErrs...), elseErrs...)
+				continue
+			}
+			embedded := []*Pipeline{
+				newFromSegments(condition, segmentrepr.If, path+".if."),
+				newFromSegments(thenBranch, segmentrepr.Then, path+".then."),
+				newFromSegments(elseBranch, segmentrepr.Else, path+".else."),
+			}
+			if len(segmentrepr.If) > 0 && !embedded[0].canDrop() {
+				errs = append(errs, &SegmentError{Path: path, Name: segmentrepr.Name, Err: errors.New("none of the 'if' segments drops flows, thus no flow would take the 'else' branch")})
+				continue
+			}
+			for _, pipeline := range embedded {
+				pipeline.parentShutdown = segment.ShutdownParentPipelineWithError
+			}
+			segment.ImportBranches(embedded[0], embedded[1], embedded[2])
+		case *tee.Tee:
+			var branchErrs []error
+			embedded := make([]tee.Pipeline, len(segmentrepr.Branches))
+			for k, branchrepr := range segmentrepr.Branches {
+				prefix := fmt.Sprintf("%s.branches.%d.", path, k)
+				branchList, listErrs := segmentsFromRepr(&branchrepr.Segments, prefix)
+				if len(listErrs) > 0 {
+					branchErrs = append(branchErrs, listErrs...)
+					continue
+				}
+				pipeline := newFromSegments(branchList, branchrepr.Segments, prefix)
+				pipeline.parentShutdown = segment.ShutdownParentPipelineWithError
+				embedded[k] = pipeline
+			}
+			if len(branchErrs) > 0 {
+				errs = append(errs, branchErrs...)
+				continue
+			}
+			segment.ImportBranches(embedded...)
+		case *switchcase.Switch:
+			var caseErrs []error
+			for k, caserepr := range segmentrepr.Cases {
+				prefix := fmt.Sprintf("%s.cases.%d.", path, k)
+				caseList, listErrs := segmentsFromRepr(&caserepr.Segments, prefix)
+				if len(listErrs) > 0 {
+					caseErrs = append(caseErrs, listErrs...)
+					continue
+				}
+				pipeline := newFromSegments(caseList, caserepr.Segments, prefix)
+				pipeline.parentShutdown = segment.ShutdownParentPipelineWithError
+				if err := segment.AddCase(caserepr.Filter, pipeline); err != nil {
+					if configErr, ok := err.(*segments.ConfigError); ok {
+						configErr.Segment = segmentrepr.Name
+					}
+					caseErrs = append(caseErrs, &SegmentError{Path: fmt.Sprintf("%s.cases.%d", path, k), Name: segmentrepr.Name, Err: err})
+				}
+			}
+			defaultList, listErrs := segmentsFromRepr(&segmentrepr.Default, path+".default.")
+			if len(caseErrs)+len(listErrs) > 0 {
+				errs = append(append(errs, caseErrs...), listErrs...)
+				continue
+			}
+			pipeline := newFromSegments(defaultList, segmentrepr.Default, path+".default.")
+			pipeline.parentShutdown = segment.ShutdownParentPipelineWithError
+			segment.SetDefault(pipeline)
+		case *shard.Shard:
+			var shardErrs []error
+			embedded := make([]shard.Pipeline, segment.Shards)
+			for k := range embedded {
+				prefix := fmt.Sprintf("%s.shards.%d.", path, k)
+				shardList, listErrs := segmentsFromRepr(&segmentrepr.Segments, prefix)
+				if len(listErrs) > 0 { // all shards share the same config and problems
+					shardErrs = listErrs
+					break
+				}
+				pipeline := newFromSegments(shardList, segmentrepr.Segments, prefix)
+				pipeline.parentShutdown = segment.ShutdownParentPipelineWithError
+				if k > 0 {
+					pipeline.shareWith(embedded[0].(*Pipeline))
+				}
+				embedded[k] = pipeline
+			}
+			if len(shardErrs) > 0 {
+				errs = append(errs, shardErrs...)
+				continue
+			}
+			segment.ImportShards(embedded...)
+		}
+		if segmentrepr.Workers > 1 {
+			pool := &workerPool{instances: []segments.Segment{segment}, ordered: segmentrepr.Ordered}
+			for len(pool.instances) < segmentrepr.Workers {
+				instance, err := segments.NewSegment(segmentrepr.Name, segmentrepr.ExpandedConfig())
+				if err != nil {
+					errs = append(errs, &SegmentError{Path: path, Name: segmentrepr.Name, Err: err})
+					break
+				}
+				shareSegment(instance, segment)
+				pool.instances = append(pool.instances, instance)
+			}
+			segment = pool
+		}
+		segmentList[i] = segment
+	}
+	_, topologyErrs := sourcesFromRepr(*segmentReprs, pathPrefix)
+	return segmentList, append(errs, topologyErrs...)
+}
+
+// Lets the segments of this Pipeline use the resources of their counterparts in
+// the given Pipeline, which was created from the same config, see
+// segments.Sharer.
+func (pipeline *Pipeline) shareWith(first *Pipeline) {
+	for i, segment := range pipeline.SegmentList {
+		shareSegment(segment, first.SegmentList[i])
+	}
+}
+
+// Lets a segment, including all instances of a workerPool and the segments of
+// any embedded pipelines, use the resources of its counterpart created from
+// the same config.
+func shareSegment(segment segments.Segment, first segments.Segment) {
+	if pool, ok := first.(*workerPool); ok {
+		first = pool.instances[0]
+	}
+	if pool, ok := segment.(*workerPool); ok {
+		for _, instance := range pool.instances {
+			shareSegment(instance, first)
+		}
+		return
+	}
+	if sharer, ok := segment.(segments.Sharer); ok {
+		sharer.Share(first)
+	}
+	firstEmbedded := embeddedPipelines(first)
+	for j, embedded := range embeddedPipelines(segment) {
+		embedded.shareWith(firstEmbedded[j])
+	}
+}
+
+// Determines the sources of each segment's input from the IDs referenced in
+// their From lists, as expected by Pipeline.setSources. Segments without a
+// From list receive the output of the previous segment, or the Pipeline's
+// input if they are the first one. Segments whose output is not received by
+// any other segment pass it on to the Pipeline's output. The returned errors
+// describe unknown or duplicate IDs and cycles.
+func sourcesFromRepr(segmentReprs []SegmentRepr, pathPrefix string) ([][]int, []error) {
+	var errs []error
+	segmentError := func(i int, format string, a ...any) {
+		errs = append(errs, &SegmentError{Path: pathPrefix + strconv.Itoa(i), Name: segmentReprs[i].Name, Err: fmt.Errorf(format, a...)})
+	}
+	ids := make(map[string]int)
+	for i, segmentrepr := range segmentReprs {
+		if segmentrepr.ID == "" {
+			continue
+		}
+		if j, ok := ids[segmentrepr.ID]; ok {
+			segmentError(i, "id '%s' is already used by segment %s%d", segmentrepr.ID, pathPrefix, j)
+			continue
+		}
+		ids[segmentrepr.ID] = i
+	}
+
+	sources := make([][]int, len(segmentReprs)+1)
+	consumed := make([]bool, len(segmentReprs))
+	for i, segmentrepr := range segmentReprs {
+		if len(segmentrepr.From) == 0 {
+			sources[i] = []int{i - 1}
+		} else if i == 0 {
+			segmentError(i, "the first segment receives the pipeline's input and can not use 'from'")
+		}
+		for _, id := range segmentrepr.From {
+			j, ok := ids[id]
+			if !ok {
+				segmentError(i, "'from' references unknown id '%s'", id)
+				continue
+			}
+			if containsInt(sources[i], j) {
+				segmentError(i, "'from' references id '%s' more than once", id)
+				continue
+			}
+			sources[i] = append(sources[i], j)
 		}
-		if segment != nil {
-			segmentList[i] = segment
-		} else {
-			log.Fatalf("[error] Configured segment '%s' could not be initialized properly, see previous messages.", segmentrepr.Name)
+		for _, j := range sources[i] {
+			if j >= 0 {
+				consumed[j] = true
+			}
+		}
+	}
+	for i := range segmentReprs {
+		if !consumed[i] {
+			sources[len(segmentReprs)] = append(sources[len(segmentReprs)], i)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if cycle := findCycle(sources); cycle != nil {
+		paths := make([]string, len(cycle))
+		for k, i := range cycle { // in the direction flows would take
+			paths[len(cycle)-1-k] = pathPrefix + strconv.Itoa(i)
+		}
+		segmentError(cycle[0], "'from' creates a cycle, flows would pass segments %s endlessly", strings.Join(paths, " -> "))
+		return nil, errs
+	}
+	return sources, nil
+}
+
+// Returns the indexes of segments forming a cycle in the given sources,
+// starting and ending with the same segment, or nil if there is none.
+func findCycle(sources [][]int) []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(sources))
+	var path []int
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		state[i] = visiting
+		path = append(path, i)
+		for _, j := range sources[i] {
+			switch {
+			case j < 0 || state[j] == visited:
+			case state[j] == visiting:
+				for k := range path {
+					if path[k] == j {
+						return append(append([]int{}, path[k:]...), j)
+					}
+				}
+			default:
+				if cycle := visit(j); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range sources {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Initializes a Pipeline from Segments created by segmentsFromRepr, keeping
+// the config representations they were created from and setting up their
+// input buffers as configured.
+func newFromSegments(segmentList []segments.Segment, segmentReprs []SegmentRepr, pathPrefix string) *Pipeline {
+	pipeline := New(segmentList...)
+	if len(segmentList) == 0 { // New inserts a pass segment in this case
+		return pipeline
+	}
+	pipeline.reprs = segmentReprs
+	pipeline.pathPrefix = pathPrefix
+	if sources, _ := sourcesFromRepr(segmentReprs, pathPrefix); sources != nil { // already checked by segmentsFromRepr
+		pipeline.setSources(sources)
+	}
+	for i, segmentrepr := range segmentReprs {
+		if segmentrepr.Buffer > 0 || segmentrepr.Overflow != "" {
+			pipeline.SetBuffer(i, segmentrepr.Buffer, segmentrepr.Overflow) // already checked by segmentsFromRepr
 		}
 	}
-	return segmentList
+	return pipeline
 }
@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/branch"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/shard"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/switchcase"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/tee"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+// Receives the flows reported by segments using DeadLetter. It is shared by a
+// Pipeline and all of its embedded pipelines, such that flows reported within
+// any of them end up in the same dead letter pipeline.
+type deadLetterSink struct {
+	pipeline *Pipeline              // nil if no dead letter pipeline is configured
+	counter  *prometheus.CounterVec // nil if not instrumented
+}
+
+// Sets the Pipeline receiving the flows segments failed to process, which
+// includes the segments of any embedded pipelines. Each flow is a copy of the
+// one reported, with its Note field replaced by the segment's path and name as
+// well as the reason and error reported, such as:
+//
+//	segment 2 (json): marshal: <error message>
+//
+// The dead letter pipeline is started, instrumented and closed along with this
+// Pipeline, and anything emitted by it is discarded. Segments in the dead
+// letter pipeline can not report flows themselves. This needs to be called
+// before Instrument and Start.
+func (pipeline *Pipeline) SetDeadLetter(deadLetter *Pipeline) {
+	pipeline.deadLetter = deadLetter
+	pipeline.deadLetters.pipeline = deadLetter
+	deadLetter.parentShutdown = pipeline.Shutdown
+	deadLetter.pathPrefix = "deadletter."
+}
+
+// Returns the function passed to the i-th segment as its DeadLetter function.
+func (pipeline *Pipeline) deadLetterFunc(i int) func(msg *pb.EnrichedFlow, reason string, err error) {
+	return func(msg *pb.EnrichedFlow, reason string, err error) {
+		sink := pipeline.deadLetters
+		path := pipeline.pathPrefix + strconv.Itoa(i)
+		if sink.counter != nil {
+			sink.counter.WithLabelValues(path, pipeline.segmentName(i), reason).Inc()
+		}
+		if sink.pipeline == nil {
+			return
+		}
+		msg = proto.Clone(msg).(*pb.EnrichedFlow)
+		msg.Note = fmt.Sprintf("segment %s (%s): %s", path, pipeline.segmentName(i), reason)
+		if err != nil {
+			msg.Note += ": " + err.Error()
+		}
+		sink.pipeline.In <- msg
+	}
+}
+
+// Makes this Pipeline and all pipelines embedded in its segments use the given
+// dead letter sink and flow tracker.
+func (pipeline *Pipeline) share(sink *deadLetterSink, tracker *flowTracker) {
+	pipeline.deadLetters = sink
+	pipeline.tracker = tracker
+	for _, segment := range pipeline.SegmentList {
+		for _, embedded := range embeddedPipelines(segment) {
+			embedded.share(sink, tracker)
+		}
+	}
+}
+
+// Returns the pipelines embedded in a controlflow segment, if any.
+func embeddedPipelines(segment segments.Segment) []*Pipeline {
+	var embedded []*Pipeline
+	switch segment := segment.(type) {
+	case *branch.Branch:
+		condition, thenBranch, elseBranch := segment.Branches()
+		for _, p := range []branch.Pipeline{condition, thenBranch, elseBranch} {
+			if p, ok := p.(*Pipeline); ok {
+				embedded = append(embedded, p)
+			}
+		}
+	case *tee.Tee:
+		for _, p := range segment.Branches() {
+			if p, ok := p.(*Pipeline); ok {
+				embedded = append(embedded, p)
+			}
+		}
+	case *switchcase.Switch:
+		cases, defaultCase := segment.Cases()
+		for _, c := range cases {
+			if p, ok := c.Pipeline.(*Pipeline); ok {
+				embedded = append(embedded, p)
+			}
+		}
+		if defaultCase != nil {
+			if p, ok := defaultCase.Pipeline.(*Pipeline); ok {
+				embedded = append(embedded, p)
+			}
+		}
+	case *shard.Shard:
+		for _, p := range segment.ShardPipelines() {
+			if p, ok := p.(*Pipeline); ok {
+				embedded = append(embedded, p)
+			}
+		}
+	}
+	return embedded
+}
+
+// Starts the dead letter pipeline, if any, discarding its output.
+func (pipeline *Pipeline) startDeadLetter() {
+	if pipeline.deadLetter == nil {
+		return
+	}
+	pipeline.deadLetter.Start()
+	go func() {
+		for range pipeline.deadLetter.Out {
+		}
+	}()
+}
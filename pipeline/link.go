@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+)
+
+// Determines what happens to flows passed to a segment whose input buffer is
+// full.
+type OverflowPolicy string
+
+const (
+	OverflowBlock      OverflowPolicy = "block"       // wait for the segment, i.e. slow down any previous segments
+	OverflowDropNewest OverflowPolicy = "drop-newest" // discard the flow which did not fit into the buffer
+	OverflowDropOldest OverflowPolicy = "drop-oldest" // discard the oldest flow in the buffer to make room
+)
+
+// Checks whether this is a known policy and whether it can be used with the
+// given buffer size.
+func (policy OverflowPolicy) Check(buffer int) error {
+	switch policy {
+	case "", OverflowBlock:
+	case OverflowDropNewest, OverflowDropOldest:
+		if buffer <= 0 {
+			return fmt.Errorf("overflow policy '%s' requires a buffer", policy)
+		}
+	default:
+		return fmt.Errorf("unknown overflow policy '%s', valid policies are %s, %s, %s", policy, OverflowBlock, OverflowDropNewest, OverflowDropOldest)
+	}
+	if buffer < 0 {
+		return fmt.Errorf("buffer size %d is negative", buffer)
+	}
+	return nil
+}
+
+// Relays flows between two segments, or a segment and the Pipeline's In or
+// Out channel. Links are only inserted where needed, that is to implement an
+// OverflowPolicy other than blocking, or to account for flows in the stats of
+// either segment if the Pipeline is instrumented.
+type link struct {
+	from       <-chan *pb.EnrichedFlow
+	to         chan *pb.EnrichedFlow
+	policy     OverflowPolicy
+	name       string                // describes the downstream segment in log messages
+	upstream   *segmentStats         // nil for the Pipeline's In channel or if not instrumented
+	downstream *segmentStats         // nil for the Pipeline's Out channel or if not instrumented
+	drops      chan *pb.EnrichedFlow // the upstream segment's drops, if any
+	tracker    *flowTracker          // set by the Pipeline's Start method
+	final      bool                  // set if flows passed on leave the outermost Pipeline
+	holding    atomic.Bool
+	overflows  atomic.Uint64
+}
+
+// Runs the relay until the upstream channel is closed, it is started by the
+// Pipeline's Start method.
+func (l *link) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for msg := range l.from {
+		if l.upstream != nil {
+			l.upstream.left(msg, l.upstream.out)
+		}
+		if l.downstream != nil {
+			l.downstream.entered(msg)
+		}
+		l.forward(msg)
+		if l.final {
+			l.tracker.Done(msg)
+		}
+	}
+	close(l.to)
+	if l.drops != nil { // the upstream segment has finished and won't drop any more flows
+		close(l.drops)
+	}
+	if overflows := l.overflows.Load(); overflows > 0 {
+		log.Printf("[warning] Pipeline: %s discarded %d flows in total due to its full buffer.", l.name, overflows)
+	}
+}
+
+// Passes a single flow on according to this link's policy.
+func (l *link) forward(msg *pb.EnrichedFlow) {
+	switch l.policy {
+	case OverflowDropNewest:
+		select {
+		case l.to <- msg:
+		default:
+			l.overflow(msg)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case l.to <- msg:
+				return
+			default:
+			}
+			select {
+			case oldest := <-l.to:
+				l.overflow(oldest)
+			default: // the segment has just taken the oldest flow itself
+			}
+		}
+	default:
+		l.holding.Store(true)
+		l.to <- msg
+		l.holding.Store(false)
+	}
+}
+
+// Accounts for a flow discarded from or instead of being put into the
+// buffer.
+func (l *link) overflow(msg *pb.EnrichedFlow) {
+	if l.overflows.Add(1) == 1 {
+		log.Printf("[warning] Pipeline: The buffer of %s is full, discarding flows according to policy '%s'.", l.name, l.policy)
+	}
+	if l.downstream != nil {
+		l.downstream.discarded(msg)
+	}
+	if l.tracker != nil {
+		l.tracker.Done(msg)
+	}
+}
+
+// Returns the number of flows waiting for the downstream segment.
+func (l *link) queued() int {
+	queued := len(l.from) + len(l.to)
+	if l.holding.Load() {
+		queued += 1
+	}
+	return queued
+}
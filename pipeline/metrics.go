@@ -0,0 +1,304 @@
+package pipeline
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/branch"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/shard"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/switchcase"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/tee"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Flows sampled for the duration metric which do not leave their segment
+// within this time, for instance because they were aggregated, are given up
+// on and the next flow is sampled instead.
+const sampleTimeout = time.Minute
+
+// Collects runtime metrics about all segments of instrumented Pipelines and
+// exposes them as a prometheus.Collector. The metrics are labelled with the
+// segment's name and its path, which has the same format as the one used by
+// SegmentError. Metrics keep counting across reloads as long as a segment
+// keeps its path and name. Additionally, the metrics of any segments
+// implementing segments.MetricsSource are collected. As these depend on the
+// configuration, Metrics should be registered after instrumenting a Pipeline
+// to have them described.
+type Metrics struct {
+	flowsIn         *prometheus.CounterVec
+	flowsOut        *prometheus.CounterVec
+	flowsDropped    *prometheus.CounterVec
+	flowsOverflowed *prometheus.CounterVec
+	flowsFailed     *prometheus.CounterVec
+	flowDuration    *prometheus.HistogramVec
+	queuedFlows     *prometheus.Desc
+	caseFlows       *prometheus.CounterVec
+
+	lock    sync.Mutex
+	queues  map[[2]string]*link                // the current input of any segment by path and name
+	sources map[[2]string]prometheus.Collector // the collectors of any segments with metrics of their own by path and name
+}
+
+func NewMetrics() *Metrics {
+	labels := []string{"path", "segment"}
+	return &Metrics{
+		flowsIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flowpipeline_segment_flows_in_total",
+			Help: "Number of flows passed to a segment.",
+		}, labels),
+		flowsOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flowpipeline_segment_flows_out_total",
+			Help: "Number of flows forwarded by a segment.",
+		}, labels),
+		flowsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flowpipeline_segment_flows_dropped_total",
+			Help: "Number of flows dropped by a filter segment.",
+		}, labels),
+		flowsOverflowed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flowpipeline_segment_flows_overflowed_total",
+			Help: "Number of flows discarded because a segment's input buffer was full.",
+		}, labels),
+		flowsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flowpipeline_segment_flows_failed_total",
+			Help: "Number of flows a segment failed to process, by reason.",
+		}, append(labels, "reason")),
+		flowDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "flowpipeline_segment_flow_duration_seconds",
+			Help:    "Time a sample of flows spent waiting for and being processed by a segment.",
+			Buckets: prometheus.ExponentialBuckets(1e-6, 4, 12),
+		}, labels),
+		queuedFlows: prometheus.NewDesc(
+			"flowpipeline_segment_queued_flows",
+			"Number of flows waiting to be accepted by a segment.",
+			labels, nil,
+		),
+		caseFlows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flowpipeline_switch_case_flows_total",
+			Help: "Number of flows passed to a case of a switch segment.",
+		}, []string{"path", "case"}),
+		queues:  make(map[[2]string]*link),
+		sources: make(map[[2]string]prometheus.Collector),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.flowsIn.Describe(ch)
+	m.flowsOut.Describe(ch)
+	m.flowsDropped.Describe(ch)
+	m.flowsOverflowed.Describe(ch)
+	m.flowsFailed.Describe(ch)
+	m.flowDuration.Describe(ch)
+	m.caseFlows.Describe(ch)
+	ch <- m.queuedFlows
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, source := range m.sources {
+		source.Describe(ch)
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.flowsIn.Collect(ch)
+	m.flowsOut.Collect(ch)
+	m.flowsDropped.Collect(ch)
+	m.flowsOverflowed.Collect(ch)
+	m.flowsFailed.Collect(ch)
+	m.flowDuration.Collect(ch)
+	m.caseFlows.Collect(ch)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keys := make([][2]string, 0, len(m.queues))
+	for key := range m.queues {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i][0] < keys[j][0] })
+	for _, key := range keys {
+		ch <- prometheus.MustNewConstMetric(m.queuedFlows, prometheus.GaugeValue, float64(m.queues[key].queued()), key[0], key[1])
+	}
+	for _, source := range m.sources {
+		source.Collect(ch)
+	}
+}
+
+// Inserts relays between all segments of this Pipeline and those of any
+// embedded pipelines to collect metrics about them, which includes the dead
+// letter pipeline. This needs to be called before Start, and is retained by
+// the Pipeline returned from Reload.
+func (pipeline *Pipeline) Instrument(metrics *Metrics) {
+	metrics.lock.Lock()
+	metrics.queues = make(map[[2]string]*link) // forget any segments from previous configurations
+	metrics.sources = make(map[[2]string]prometheus.Collector)
+	metrics.lock.Unlock()
+	pipeline.deadLetters.counter = metrics.flowsFailed
+	pipeline.instrument(metrics, "")
+	if pipeline.deadLetter != nil {
+		pipeline.deadLetter.deadLetters.counter = metrics.flowsFailed
+		pipeline.deadLetter.instrument(metrics, "deadletter.")
+	}
+}
+
+// Does the actual work for Instrument, the pathPrefix identifies embedded
+// pipelines as it does in segmentsFromRepr.
+func (pipeline *Pipeline) instrument(metrics *Metrics, pathPrefix string) {
+	pipeline.metrics = metrics
+	stats := make([]*segmentStats, len(pipeline.SegmentList))
+	drops := make([]chan *pb.EnrichedFlow, len(pipeline.SegmentList))
+	for i, segment := range pipeline.SegmentList {
+		path := pathPrefix + strconv.Itoa(i)
+		labels := prometheus.Labels{"path": path, "segment": pipeline.segmentName(i)}
+		stats[i] = &segmentStats{
+			in:         metrics.flowsIn.With(labels),
+			out:        metrics.flowsOut.With(labels),
+			dropped:    metrics.flowsDropped.With(labels),
+			overflowed: metrics.flowsOverflowed.With(labels),
+			duration:   metrics.flowDuration.With(labels),
+		}
+		if source, ok := segment.(segments.MetricsSource); ok {
+			metrics.lock.Lock()
+			metrics.sources[[2]string{path, pipeline.segmentName(i)}] = source.Collector(labels)
+			metrics.lock.Unlock()
+		}
+		switch segment := segment.(type) { // handle special segments
+		case *branch.Branch:
+			condition, thenBranch, elseBranch := segment.Branches()
+			condition.(*Pipeline).instrument(metrics, path+".if.")
+			thenBranch.(*Pipeline).instrument(metrics, path+".then.")
+			elseBranch.(*Pipeline).instrument(metrics, path+".else.")
+		case *tee.Tee:
+			for k, branch := range segment.Branches() {
+				branch.(*Pipeline).instrument(metrics, fmt.Sprintf("%s.branches.%d.", path, k))
+			}
+		case *switchcase.Switch:
+			cases, defaultCase := segment.Cases()
+			counters := make([]prometheus.Counter, len(cases)+1)
+			for k, c := range cases {
+				c.Pipeline.(*Pipeline).instrument(metrics, fmt.Sprintf("%s.cases.%d.", path, k))
+				counters[k] = metrics.caseFlows.WithLabelValues(path, strconv.Itoa(k))
+			}
+			defaultCase.Pipeline.(*Pipeline).instrument(metrics, path+".default.")
+			counters[len(cases)] = metrics.caseFlows.WithLabelValues(path, "default")
+			segment.OnMatch(func(i int) { counters[i].Inc() })
+		case *shard.Shard:
+			for k, shardPipeline := range segment.ShardPipelines() {
+				shardPipeline.(*Pipeline).instrument(metrics, fmt.Sprintf("%s.shards.%d.", path, k))
+			}
+		}
+		segmentDrops := make(chan *pb.EnrichedFlow)
+		if subscribeDrops(segment, segmentDrops) {
+			drops[i] = segmentDrops
+			pipeline.relays = append(pipeline.relays, pipeline.relayDrops(segmentDrops, stats[i]))
+		}
+		// whatever reads the segment's output accounts for it
+		if junction := pipeline.junctions[i]; junction != nil {
+			junction.stats = stats[i]
+			junction.drops = drops[i]
+		}
+	}
+
+	// the link in front of each segment relays its input, the last one
+	// relays the output of the Pipeline as a whole
+	for i := range pipeline.channels {
+		l := pipeline.links[i]
+		if l == nil { // any buffer remains in the channel in front of the link
+			l = &link{from: pipeline.channels[i], to: make(chan *pb.EnrichedFlow)}
+			pipeline.links[i] = l
+		}
+		if producer := pipeline.directSource(i); producer >= 0 {
+			l.upstream = stats[producer]
+			l.drops = drops[producer]
+		}
+		if i < len(pipeline.SegmentList) {
+			l.downstream = stats[i]
+			metrics.lock.Lock()
+			metrics.queues[[2]string{pathPrefix + strconv.Itoa(i), pipeline.segmentName(i)}] = l
+			metrics.lock.Unlock()
+		}
+	}
+	pipeline.rewire()
+}
+
+// Returns the name of the i-th segment as found in the configuration, or a
+// name derived from its type if this Pipeline was not built from one.
+func (pipeline *Pipeline) segmentName(i int) string {
+	if i < len(pipeline.reprs) {
+		return pipeline.reprs[i].Name
+	}
+	segmentType := reflect.TypeOf(pipeline.SegmentList[i])
+	if segmentType.Kind() == reflect.Pointer {
+		segmentType = segmentType.Elem()
+	}
+	return strings.ToLower(segmentType.Name())
+}
+
+// Returns a relay counting the flows dropped by a segment and forwarding them
+// to this Pipeline's Drop channel, if anyone has subscribed to it.
+func (pipeline *Pipeline) relayDrops(drops <-chan *pb.EnrichedFlow, stats *segmentStats) func(wg *sync.WaitGroup) {
+	return func(wg *sync.WaitGroup) {
+		defer wg.Done()
+		for msg := range drops {
+			stats.left(msg, stats.dropped)
+			pipeline.dropLock.Lock()
+			drop := pipeline.Drop
+			pipeline.dropLock.Unlock()
+			if drop != nil {
+				drop <- msg
+			}
+		}
+	}
+}
+
+// The counters of a single segment along with the flow currently sampled for
+// its duration metric.
+type segmentStats struct {
+	in         prometheus.Counter
+	out        prometheus.Counter
+	dropped    prometheus.Counter
+	overflowed prometheus.Counter
+	duration   prometheus.Observer
+
+	lock      sync.Mutex
+	sampled   *pb.EnrichedFlow
+	sampledAt time.Time
+}
+
+// Called for each flow passed to the segment.
+func (s *segmentStats) entered(msg *pb.EnrichedFlow) {
+	s.in.Inc()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sampled == nil || time.Since(s.sampledAt) > sampleTimeout {
+		s.sampled = msg
+		s.sampledAt = time.Now()
+	}
+}
+
+// Called for each flow forwarded or dropped by the segment, the counter
+// determines which of both happened.
+func (s *segmentStats) left(msg *pb.EnrichedFlow, counter prometheus.Counter) {
+	counter.Inc()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sampled == msg {
+		s.duration.Observe(time.Since(s.sampledAt).Seconds())
+		s.sampled = nil
+	}
+}
+
+// Called for each flow discarded from the segment's full input buffer.
+func (s *segmentStats) discarded(msg *pb.EnrichedFlow) {
+	s.overflowed.Inc()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sampled == msg {
+		s.sampled = nil
+	}
+}
@@ -2,14 +2,18 @@
 package pipeline
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"reflect"
 	"sync"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
-	"github.com/bwNetFlow/flowpipeline/segments/filter/drop"
-	"github.com/bwNetFlow/flowpipeline/segments/filter/elephant"
-	"github.com/bwNetFlow/flowpipeline/segments/filter/flowfilter"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/branch"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/shard"
+	"github.com/bwNetFlow/flowpipeline/segments/controlflow/switchcase"
 	"github.com/bwNetFlow/flowpipeline/segments/pass"
 )
 
@@ -22,6 +26,25 @@ type Pipeline struct {
 	Drop        chan *pb.EnrichedFlow
 	wg          *sync.WaitGroup
 	SegmentList []segments.Segment
+	reprs       []SegmentRepr // the config this Pipeline was built from, if any
+
+	ctx            context.Context
+	cancel         context.CancelCauseFunc
+	done           chan struct{}
+	finish         sync.Once
+	parentShutdown func(err error) // passes shutdown requests on if this Pipeline is embedded in a segment
+	pathPrefix     string          // identifies embedded pipelines in log messages
+	deadLetter     *Pipeline       // owned by this Pipeline, see SetDeadLetter
+	deadLetters    *deadLetterSink // shared with any embedded pipelines
+	tracker        *flowTracker    // shared with any embedded pipelines
+
+	channels  []chan *pb.EnrichedFlow    // the input of each segment, followed by the Pipeline's output
+	sources   [][]int                    // the segments feeding each of these channels, see setSources
+	junctions []*junction                // distributing the output of each segment, nil where unused
+	links     []*link                    // relays between these channels and the segments, nil where unused
+	relays    []func(wg *sync.WaitGroup) // additional relays started along with the segments
+	metrics   *Metrics
+	dropLock  sync.Mutex
 }
 
 func (pipeline *Pipeline) GetInput() chan *pb.EnrichedFlow {
@@ -33,27 +56,104 @@ func (pipeline *Pipeline) GetOutput() <-chan *pb.EnrichedFlow {
 }
 
 func (pipeline *Pipeline) GetDrop() <-chan *pb.EnrichedFlow {
+	pipeline.dropLock.Lock()
+	defer pipeline.dropLock.Unlock()
 	if pipeline.Drop != nil {
 		return pipeline.Drop
 	}
 	pipeline.Drop = make(chan *pb.EnrichedFlow)
-	// Subscribe to drops from special segments, namely all based on
-	// BaseFilterSegment grouped in the filter directory.
-	for _, segment := range pipeline.SegmentList {
-		switch typedSegment := segment.(type) {
-		case *drop.Drop:
-			typedSegment.SubscribeDrops(pipeline.Drop)
-		case *elephant.Elephant:
-			typedSegment.SubscribeDrops(pipeline.Drop)
-		case *flowfilter.FlowFilter:
-			typedSegment.SubscribeDrops(pipeline.Drop)
+	// Instrumented Pipelines are subscribed already and forward drops as
+	// soon as this channel exists.
+	if pipeline.metrics == nil {
+		for _, segment := range pipeline.SegmentList {
+			subscribeDrops(segment, pipeline.Drop)
 		}
 	}
-	// If there are no filter/* segments, this channel will never have
+	// If there are no segments dropping flows, this channel will never have
 	// messages available.
 	return pipeline.Drop
 }
 
+// Subscribes to drops from segments implementing segments.DropSubscriber,
+// which notably includes all based on BaseFilterSegment grouped in the filter
+// directory. Reports whether the given segment is one of them.
+func subscribeDrops(segment segments.Segment, drops chan<- *pb.EnrichedFlow) bool {
+	if !canDrop(segment) {
+		return false
+	}
+	segment.(segments.DropSubscriber).SubscribeDrops(drops)
+	return true
+}
+
+// Reports whether the given segment may drop flows. This is the case for any
+// segments.DropSubscriber, except for controlflow segments whose embedded
+// pipelines contain no such segment, and worker pools of other segments.
+func canDrop(segment segments.Segment) bool {
+	switch segment := segment.(type) {
+	case *workerPool:
+		return canDrop(segment.instances[0])
+	case *branch.Branch:
+		_, thenBranch, elseBranch := segment.Branches()
+		return thenBranch != nil && (thenBranch.(*Pipeline).canDrop() || elseBranch.(*Pipeline).canDrop())
+	case *switchcase.Switch:
+		cases, defaultCase := segment.Cases()
+		for _, c := range cases {
+			if c.Pipeline.(*Pipeline).canDrop() {
+				return true
+			}
+		}
+		return defaultCase != nil && defaultCase.Pipeline.(*Pipeline).canDrop()
+	case *shard.Shard:
+		for _, shardPipeline := range segment.ShardPipelines() {
+			if shardPipeline.(*Pipeline).canDrop() {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := segment.(segments.DropSubscriber)
+	return ok
+}
+
+// Reports whether any segment of this Pipeline may drop flows, see canDrop.
+func (pipeline *Pipeline) canDrop() bool {
+	for _, segment := range pipeline.SegmentList {
+		if canDrop(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// Passes a flow into this Pipeline, blocking until its first segment accepts
+// it or the given Context is canceled, in which case the Context's error is
+// returned. Like sending to the In channel directly, this must not be called
+// after Close.
+func (pipeline *Pipeline) Send(ctx context.Context, msg *pb.EnrichedFlow) error {
+	select {
+	case pipeline.In <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the next flow emitted by this Pipeline, blocking until there is one
+// or the given Context is canceled, in which case the Context's error is
+// returned. Once the Pipeline has been closed and all flows have been
+// received, io.EOF is returned.
+func (pipeline *Pipeline) Receive(ctx context.Context) (*pb.EnrichedFlow, error) {
+	select {
+	case msg, ok := <-pipeline.Out:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // Starts up a goroutine specific to this Pipeline which reads any message from
 // the Out channel and discards it. This is a convenience function to enable
 // having a segment at the end of the pipeline handle all results, i.e. having
@@ -68,16 +168,110 @@ func (pipeline *Pipeline) AutoDrain() {
 
 // Closes down a Pipeline by closing its In channel and waiting for all
 // segments to propagate this close event through the full pipeline,
-// terminating all segment goroutines and thus releasing the waitgroup.
-// Blocking.
+// terminating all segment goroutines and thus releasing the waitgroup. The
+// dead letter pipeline, if any, the Drop channel, if any, and the Done channel
+// are closed afterwards. Blocking.
 func (pipeline *Pipeline) Close() {
 	defer func() {
 		recover() // in case In is already closed
 		pipeline.wg.Wait()
+		pipeline.finish.Do(func() {
+			// all segments have finished and won't drop any more flows
+			pipeline.dropLock.Lock()
+			if pipeline.Drop != nil {
+				close(pipeline.Drop)
+			}
+			pipeline.dropLock.Unlock()
+			if pipeline.deadLetter != nil { // no segment will report any more flows
+				pipeline.deadLetter.Close()
+			}
+			close(pipeline.done)
+		})
 	}()
 	close(pipeline.In)
 }
 
+// Requests this Pipeline to shut down by canceling its Context, using the
+// given error as the cause. A nil error signifies a regular end, such as the
+// end of an input file. Segments do this using ShutdownParentPipeline, and the
+// owner of the Pipeline is responsible for closing it in response. Only the
+// first request is recorded, any further ones are ignored.
+func (pipeline *Pipeline) Shutdown(err error) {
+	if pipeline.ctx.Err() != nil {
+		return
+	}
+	pipeline.cancel(err)
+	if pipeline.parentShutdown != nil { // leave any logging to the parent
+		pipeline.parentShutdown(err)
+		return
+	}
+	if err != nil {
+		log.Printf("[error] Pipeline: Shutdown requested due to an error: %v", err)
+	} else {
+		log.Println("[info] Pipeline: Shutdown requested.")
+	}
+}
+
+// Returns a Context which is canceled once a shutdown of this Pipeline was
+// requested.
+func (pipeline *Pipeline) Context() context.Context {
+	return pipeline.ctx
+}
+
+// Returns a channel which is closed once this Pipeline has been closed and all
+// of its segments have finished.
+func (pipeline *Pipeline) Done() <-chan struct{} {
+	return pipeline.done
+}
+
+// Returns the error a shutdown of this Pipeline was requested with, nil if no
+// shutdown was requested or it was a regular one.
+func (pipeline *Pipeline) Err() error {
+	if cause := context.Cause(pipeline.ctx); cause != context.Canceled {
+		return cause
+	}
+	return nil
+}
+
+// Replaces this Pipeline by a new one built from the given raw configuration
+// bytes. If the new configuration is invalid, an error is returned and this
+// Pipeline keeps running unchanged. Otherwise, any segments of the new Pipeline
+// implementing segments.Retainer take over the resources of their counterpart
+// in this Pipeline, provided both are on the top level and configured
+// identically. This Pipeline is then closed, which drains all flows in transit
+// through its segments, and the new one is started in its place. As with
+// Close, the caller needs to keep reading from this Pipeline's Out channel
+// until then, and is responsible for reading the new Pipeline's Out channel
+// afterwards. Blocking.
+func (pipeline *Pipeline) Reload(config []byte) (*Pipeline, error) {
+	successor, err := NewFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	retained := make([]bool, len(pipeline.reprs))
+	for i, repr := range successor.reprs {
+		retainer, ok := successor.SegmentList[i].(segments.Retainer)
+		if !ok {
+			continue
+		}
+		for j, predecessorRepr := range pipeline.reprs {
+			if retained[j] || repr.Name != predecessorRepr.Name || !reflect.DeepEqual(repr.Config, predecessorRepr.Config) {
+				continue
+			}
+			retainer.Retain(pipeline.SegmentList[j])
+			retained[j] = true
+			log.Printf("[info] Pipeline: Segment %d (%s) retained its resources from the previous configuration.", i, repr.Name)
+			break
+		}
+	}
+	if pipeline.metrics != nil {
+		successor.Instrument(pipeline.metrics)
+	}
+	pipeline.Close()
+	successor.Start()
+	return successor, nil
+}
+
 // Initializes a new Pipeline object and then starts all segment goroutines
 // therein. Initialization includes creating any intermediate channels and
 // wiring up the segments in the segmentList with them.
@@ -86,16 +280,97 @@ func New(segmentList ...segments.Segment) *Pipeline {
 		segmentList = []segments.Segment{&pass.Pass{}}
 	}
 	channels := make([]chan *pb.EnrichedFlow, len(segmentList)+1)
-	channels[0] = make(chan *pb.EnrichedFlow)
+	for i := range channels {
+		channels[i] = make(chan *pb.EnrichedFlow)
+	}
+	pipeline := &Pipeline{wg: &sync.WaitGroup{}, SegmentList: segmentList, channels: channels, links: make([]*link, len(channels))}
+	pipeline.ctx, pipeline.cancel = context.WithCancelCause(context.Background())
+	pipeline.done = make(chan struct{})
 	for i, segment := range segmentList {
-		channels[i+1] = make(chan *pb.EnrichedFlow)
-		segment.Rewire(channels[i], channels[i+1])
+		if segment, ok := segment.(segments.Shutdowner); ok {
+			segment.SetShutdownFunc(pipeline.Shutdown)
+		}
+		if segment, ok := segment.(segments.DeadLetterer); ok {
+			segment.SetDeadLetterFunc(pipeline.deadLetterFunc(i))
+		}
+		if segment, ok := segment.(segments.Tracked); ok {
+			segment.SetFlowTracker(segmentTracker{pipeline})
+		}
+	}
+	pipeline.share(&deadLetterSink{}, newFlowTracker(pipeline))
+	if pipeline.tracker.enabled { // flows are done once they leave through this link
+		pipeline.links[len(segmentList)] = &link{from: channels[len(segmentList)], to: make(chan *pb.EnrichedFlow)}
+	}
+	sources := make([][]int, len(channels)) // a linear chain of segments
+	for i := range sources {
+		sources[i] = []int{i - 1}
 	}
-	return &Pipeline{In: channels[0], Out: channels[len(channels)-1], wg: &sync.WaitGroup{}, SegmentList: segmentList}
+	pipeline.setSources(sources)
+	return pipeline
+}
+
+// Sets the size of the i-th segment's input buffer and the policy applied when
+// it is full. The default is an unbuffered input, which blocks any previous
+// segments until a flow is accepted. This needs to be called before Instrument
+// and Start.
+func (pipeline *Pipeline) SetBuffer(i int, size int, policy OverflowPolicy) error {
+	if err := policy.Check(size); err != nil {
+		return err
+	}
+	if i < 0 || i >= len(pipeline.SegmentList) {
+		return fmt.Errorf("there is no segment at index %d", i)
+	}
+	switch policy {
+	case "", OverflowBlock:
+		pipeline.channels[i] = make(chan *pb.EnrichedFlow, size)
+		pipeline.links[i] = nil
+	default: // dropping flows requires a relay to decide when to do so
+		pipeline.channels[i] = make(chan *pb.EnrichedFlow)
+		pipeline.links[i] = &link{
+			from:   pipeline.channels[i],
+			to:     make(chan *pb.EnrichedFlow, size),
+			policy: policy,
+			name:   fmt.Sprintf("Segment %s%d (%s)", pipeline.pathPrefix, i, pipeline.segmentName(i)),
+		}
+	}
+	pipeline.rewire()
+	return nil
+}
+
+// Wires up all segments with the channels between them, taking into account
+// any links in place. Also updates the In and Out channels accordingly.
+func (pipeline *Pipeline) rewire() {
+	for i, segment := range pipeline.SegmentList {
+		segment.Rewire(pipeline.input(i), pipeline.output(i))
+	}
+	pipeline.In = pipeline.channels[0]
+	pipeline.Out = pipeline.input(len(pipeline.SegmentList))
+}
+
+// Returns the channel the i-th segment reads from, or the Pipeline's Out
+// channel for the index after the last segment.
+func (pipeline *Pipeline) input(i int) chan *pb.EnrichedFlow {
+	if pipeline.links[i] != nil {
+		return pipeline.links[i].to
+	}
+	return pipeline.channels[i]
 }
 
 // Starts the Pipeline by starting all segment goroutines therein.
 func (pipeline *Pipeline) Start() {
+	pipeline.startTracking()
+	pipeline.startDeadLetter()
+	pipeline.startJunctions()
+	for _, link := range pipeline.links {
+		if link != nil {
+			pipeline.wg.Add(1)
+			go link.run(pipeline.wg)
+		}
+	}
+	for _, relay := range pipeline.relays {
+		pipeline.wg.Add(1)
+		go relay(pipeline.wg)
+	}
 	for _, segment := range pipeline.SegmentList {
 		pipeline.wg.Add(1)
 		go segment.Run(pipeline.wg)
@@ -1,18 +1,285 @@
 package pipeline
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
 	"github.com/bwNetFlow/flowpipeline/segments/pass"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
+	_ "github.com/bwNetFlow/flowpipeline/segments/export/prometheus"
 	_ "github.com/bwNetFlow/flowpipeline/segments/filter/drop"
 	_ "github.com/bwNetFlow/flowpipeline/segments/filter/flowfilter"
 	_ "github.com/bwNetFlow/flowpipeline/segments/modify/dropfields"
+	_ "github.com/bwNetFlow/flowpipeline/segments/output/csv"
+	_ "github.com/bwNetFlow/flowpipeline/segments/output/json"
+	_ "github.com/bwNetFlow/flowpipeline/segments/print/printdots"
+	_ "github.com/bwNetFlow/flowpipeline/segments/print/toptalkers"
 	_ "github.com/bwNetFlow/flowpipeline/segments/testing/generator"
 )
 
+// The flows recorded by the testsegments configured with its name, and the
+// notes of the flows they acknowledged.
+type recorder struct {
+	name      string
+	acked     chan string
+	lock      sync.Mutex
+	instances [][]*pb.EnrichedFlow
+}
+
+var (
+	recorders     = make(map[string]*recorder)
+	recordersLock sync.Mutex
+)
+
+// Returns a recorder named uniquely for the current test, which is removed
+// once the test has finished.
+func newRecorder(t *testing.T, name string) *recorder {
+	r := &recorder{name: t.Name() + "/" + name, acked: make(chan string, 16)}
+	recordersLock.Lock()
+	recorders[r.name] = r
+	recordersLock.Unlock()
+	t.Cleanup(func() {
+		recordersLock.Lock()
+		delete(recorders, r.name)
+		recordersLock.Unlock()
+	})
+	return r
+}
+
+// Returns the recorder with the name configured for the given key.
+func lookupRecorder(config map[string]string, key string) (*recorder, error) {
+	if config[key] == "" {
+		return nil, nil
+	}
+	recordersLock.Lock()
+	defer recordersLock.Unlock()
+	r, ok := recorders[config[key]]
+	if !ok {
+		return nil, segments.NewConfigError(key, "no recorder named '%s'", config[key])
+	}
+	return r, nil
+}
+
+// Adds a segment instance recording flows, and returns its index.
+func (r *recorder) addInstance() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.instances = append(r.instances, nil)
+	return len(r.instances) - 1
+}
+
+func (r *recorder) record(instance int, msg *pb.EnrichedFlow) {
+	r.lock.Lock()
+	r.instances[instance] = append(r.instances[instance], msg)
+	r.lock.Unlock()
+}
+
+// Returns the flows recorded by all instances.
+func (r *recorder) recorded() []*pb.EnrichedFlow {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var flows []*pb.EnrichedFlow
+	for _, instance := range r.instances {
+		flows = append(flows, instance...)
+	}
+	return flows
+}
+
+// Returns the flows recorded by each instance.
+func (r *recorder) recordedInstances() [][]*pb.EnrichedFlow {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([][]*pb.EnrichedFlow(nil), r.instances...)
+}
+
+// A Segment passing on flows, which is configured to behave like the various
+// kinds of segments the Pipeline has to handle, see its schema.
+type testSegment struct {
+	segments.BaseFilterSegment
+	recorder    *recorder
+	instance    int
+	tracker     *recorder
+	hold        bool
+	drop        bool
+	fail        bool
+	jitter      bool
+	replace     bool
+	shutdown    bool
+	flowType    *pb.EnrichedFlow_FlowType
+	gate        chan struct{} // if set, no flows are accepted until it is closed
+	counter     prometheus.Counter
+	predecessor segments.Segment
+}
+
+// A testSegment claiming to consume flows early.
+type earlyTestSegment struct {
+	*testSegment
+}
+
+func (segment *earlyTestSegment) ConsumesEarly() {}
+
+func (segment *testSegment) New(config map[string]string) (segments.Segment, error) {
+	flag := func(key string) bool {
+		value, _ := strconv.ParseBool(config[key]) // checked by the schema
+		return value
+	}
+	newSegment := &testSegment{
+		hold:     flag("hold"),
+		drop:     flag("drop"),
+		fail:     flag("fail"),
+		jitter:   flag("jitter"),
+		replace:  flag("replace"),
+		shutdown: flag("shutdown"),
+	}
+	var err error
+	if newSegment.recorder, err = lookupRecorder(config, "record"); err != nil {
+		return nil, err
+	}
+	if newSegment.recorder != nil {
+		newSegment.instance = newSegment.recorder.addInstance()
+	}
+	if newSegment.tracker, err = lookupRecorder(config, "track"); err != nil {
+		return nil, err
+	}
+	if config["type"] != "" {
+		flowType, _ := strconv.Atoi(config["type"]) // checked by the schema
+		newSegment.flowType = pb.EnrichedFlow_FlowType(flowType).Enum()
+	}
+	if flag("early") {
+		return &earlyTestSegment{newSegment}, nil
+	}
+	return newSegment, nil
+}
+
+func (segment *testSegment) TracksFlows() bool {
+	return segment.tracker != nil
+}
+
+func (segment *testSegment) Retain(predecessor segments.Segment) {
+	segment.predecessor = predecessor
+}
+
+func (segment *testSegment) Collector(labels prometheus.Labels) prometheus.Collector {
+	segment.counter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "testsegment_flows_total",
+		Help:        "Number of flows passing a testsegment segment.",
+		ConstLabels: labels,
+	})
+	return segment.counter
+}
+
+func (segment *testSegment) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	if segment.gate != nil {
+		<-segment.gate
+	}
+	var held []func()
+	for msg := range segment.In {
+		if segment.counter != nil {
+			segment.counter.Inc()
+		}
+		if segment.recorder != nil {
+			segment.recorder.record(segment.instance, msg)
+		}
+		if segment.tracker != nil {
+			note := msg.Note
+			segment.Track(msg, func() { segment.tracker.acked <- note })
+		}
+		if segment.jitter {
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+		}
+		if segment.flowType != nil {
+			msg.Type = *segment.flowType
+		}
+		if msg.Bytes%2 == 1 && segment.drop {
+			if segment.Drops != nil {
+				segment.Drops <- msg
+			}
+			continue
+		}
+		if msg.Bytes%2 == 1 && segment.fail {
+			segment.DeadLetter(msg, "odd", errors.New("odd number of bytes"))
+			continue
+		}
+		if segment.hold {
+			held = append(held, segment.Hold(msg))
+		}
+		if segment.replace {
+			segment.replaceFlow(msg)
+			continue
+		}
+		segment.Out <- msg
+		if segment.shutdown {
+			segment.ShutdownParentPipelineWithError(errors.New("done"))
+		}
+	}
+	for _, release := range held {
+		release()
+	}
+}
+
+// Replaces a flow by two new ones for every fifth sequence number and by none
+// for every seventh.
+func (segment *testSegment) replaceFlow(msg *pb.EnrichedFlow) {
+	copies := 1
+	if msg.SequenceNum%7 == 0 {
+		copies = 0
+	} else if msg.SequenceNum%5 == 0 {
+		copies = 2
+	}
+	var results []*pb.EnrichedFlow
+	for i := 0; i < copies; i++ {
+		result := &pb.EnrichedFlow{SequenceNum: msg.SequenceNum}
+		segment.Copied(msg, result)
+		results = append(results, result)
+	}
+	segment.Consumed(msg)
+	for _, result := range results {
+		segment.Out <- result
+	}
+}
+
+func init() {
+	err := segments.Register("testsegment", &testSegment{}, &segments.Schema{
+		Summary: "Passes on flows, behaving like other kinds of segments as configured.",
+		Params: []segments.Param{
+			{Name: "record", Doc: "name of a recorder to record the flows passing each instance in"},
+			{Name: "track", Doc: "name of a recorder to acknowledge flows to, as a source requesting it"},
+			{Name: "hold", Type: segments.TypeBool, Doc: "hold all flows until the input is closed, as a sink writing them in one batch"},
+			{Name: "drop", Type: segments.TypeBool, Doc: "drop flows with an odd number of bytes"},
+			{Name: "fail", Type: segments.TypeBool, Doc: "fail to process flows with an odd number of bytes"},
+			{Name: "jitter", Type: segments.TypeBool, Doc: "take a varying amount of time to process flows"},
+			{Name: "replace", Type: segments.TypeBool, Doc: "replace flows by new ones, see replaceFlow"},
+			{Name: "shutdown", Type: segments.TypeBool, Doc: "request a shutdown after passing on the first flow"},
+			{Name: "early", Type: segments.TypeBool, Doc: "claim to consume flows early, see segments.EarlyConsumer"},
+			{Name: "type", Type: segments.TypeInt, Doc: "set the type of all flows"},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
 func TestPipelineBuild(t *testing.T) {
 	segmentList := []segments.Segment{&pass.Pass{}, &pass.Pass{}}
 	pipeline := New(segmentList...)
@@ -34,11 +301,14 @@ func TestPipelineTeardown(t *testing.T) {
 }
 
 func TestPipelineConfigSuccess(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: pass
   config:
     foo: $baz
     bar: $0`))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Type: 3}
 	fmsg := <-pipeline.Out
@@ -48,7 +318,7 @@ func TestPipelineConfigSuccess(t *testing.T) {
 }
 
 func Test_Branch_passthrough(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: branch
   if:
   - segment: flowfilter
@@ -65,6 +335,9 @@ func Test_Branch_passthrough(t *testing.T) {
       policy: drop
       fields: OutIf
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 6, InIf: 1, OutIf: 1}
 	fmsg := <-pipeline.Out
@@ -79,7 +352,7 @@ func Test_Branch_passthrough(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: branch
   if:
   - segment: generator
@@ -92,6 +365,9 @@ func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
       policy: drop
       fields: Bytes
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -105,11 +381,14 @@ func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_Then(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: branch
   then:
   - segment: generator
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -119,11 +398,14 @@ func Test_Branch_DeadlockFreeGeneration_Then(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_Else(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: branch
   else:
   - segment: generator
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -131,3 +413,1038 @@ func Test_Branch_DeadlockFreeGeneration_Else(t *testing.T) {
 		<-pipeline.Out
 	}
 }
+
+func TestPipelineCheckConfig(t *testing.T) {
+	errs := CheckConfig([]byte(`---
+- segment: pass
+- segment: branch
+  if:
+  - segment: flowfilter
+    config:
+      filter: proto tcp
+  then:
+  - segment: dropfields
+    config:
+      policy: drop
+      fields: InIf
+`))
+	if len(errs) != 0 {
+		t.Errorf("Valid configuration did not pass the check: %v", errs)
+	}
+
+	errs = CheckConfig([]byte(`---
+- segment: nosuchsegment
+- segment: pass
+  then:
+  - segment: pass
+- segment: branch
+  if:
+  - segment: flowfilter
+    config:
+      filter: proto tcp
+  then:
+  - segment: flowfilter
+    config:
+      filter: "this is no filter"
+`))
+	if len(errs) != 3 {
+		t.Fatalf("Invalid configuration produced %d instead of 3 errors: %v", len(errs), errs)
+	}
+	for i, path := range []string{"0", "1", "2.then.0"} {
+		if segmentErr, ok := errs[i].(*SegmentError); !ok || segmentErr.Path != path {
+			t.Errorf("Error %d does not reference segment %s: %v", i, path, errs[i])
+		}
+	}
+}
+
+func TestPipelineCheckConfigSchema(t *testing.T) {
+	errs := CheckConfig([]byte(`---
+- segment: dropfields
+  config:
+    policy: drop
+    field: InIf
+- segment: printdots
+  config:
+    flowsperdot: many
+- segment: dropfields
+  config:
+    policy: ignore
+    fields: InIf
+`))
+	if len(errs) != 3 {
+		t.Fatalf("Invalid configuration produced %d instead of 3 errors: %v", len(errs), errs)
+	}
+	for i, key := range []string{"field", "flowsperdot", "policy"} {
+		var configErr *segments.ConfigError
+		if !errors.As(errs[i], &configErr) || configErr.Key != key {
+			t.Errorf("Error %d does not reference parameter %s: %v", i, key, errs[i])
+		}
+	}
+}
+
+func TestPipelineCheckConfigOutputFiles(t *testing.T) {
+	dir := t.TempDir()
+	var filenames []string
+	for _, name := range []string{"flows.json", "flows.csv", "toptalkers.log"} {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte("existing output\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	errs := CheckConfig([]byte(fmt.Sprintf(`---
+- segment: json
+  config:
+    filename: %s
+- segment: csv
+  config:
+    filename: %s
+- segment: toptalkers
+  config:
+    filename: %s
+`, filenames[0], filenames[1], filenames[2])))
+	if len(errs) != 0 {
+		t.Errorf("Valid configuration did not pass the check: %v", errs)
+	}
+	for _, filename := range filenames {
+		if content, err := os.ReadFile(filename); err != nil || string(content) != "existing output\n" {
+			t.Errorf("Checking the configuration modified the output file %s: %v %q", filename, err, content)
+		}
+	}
+}
+
+func TestPipelineReload(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: testsegment
+- segment: testsegment
+  config:
+    jitter: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	pipeline.AutoDrain()
+
+	_, err = pipeline.Reload([]byte(`---
+- segment: nosuchsegment
+`))
+	if err == nil {
+		t.Error("Pipeline reloaded an invalid configuration.")
+	}
+
+	successor, err := pipeline.Reload([]byte(`---
+- segment: testsegment
+  config:
+    jitter: false
+- segment: testsegment
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if successor.SegmentList[0].(*testSegment).predecessor != nil {
+		t.Error("Segment with changed configuration retained its predecessor.")
+	}
+	if successor.SegmentList[1].(*testSegment).predecessor != pipeline.SegmentList[0] {
+		t.Error("Segment with unchanged configuration did not retain its predecessor.")
+	}
+
+	successor.In <- &pb.EnrichedFlow{Type: 3}
+	if fmsg := <-successor.Out; fmsg.Type != 3 {
+		t.Error("Reloaded pipeline is not working.")
+	}
+	successor.AutoDrain()
+	successor.Close()
+}
+
+func TestPipelineInstrument(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: pass
+- segment: branch
+  if:
+  - segment: flowfilter
+    config:
+      filter: proto tcp
+  then:
+  - segment: drop
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMetrics()
+	pipeline.Instrument(metrics)
+	pipeline.Start()
+	for _, proto := range []uint32{6, 17, 17} {
+		pipeline.In <- &pb.EnrichedFlow{Proto: proto}
+		if proto != 6 {
+			<-pipeline.Out
+		}
+	}
+	pipeline.AutoDrain()
+	pipeline.Close()
+
+	for _, expected := range []struct {
+		counter string
+		path    string
+		segment string
+		value   float64
+	}{
+		{"in", "0", "pass", 3},
+		{"out", "0", "pass", 3},
+		{"in", "1.if.0", "flowfilter", 3},
+		{"out", "1.if.0", "flowfilter", 1},
+		{"dropped", "1.if.0", "flowfilter", 2},
+		{"dropped", "1.then.0", "drop", 1},
+		{"out", "1.else.0", "pass", 2},
+		{"out", "1", "branch", 2},
+	} {
+		var value float64
+		switch expected.counter {
+		case "in":
+			value = testutil.ToFloat64(metrics.flowsIn.WithLabelValues(expected.path, expected.segment))
+		case "out":
+			value = testutil.ToFloat64(metrics.flowsOut.WithLabelValues(expected.path, expected.segment))
+		case "dropped":
+			value = testutil.ToFloat64(metrics.flowsDropped.WithLabelValues(expected.path, expected.segment))
+		}
+		if value != expected.value {
+			t.Errorf("Segment %s (%s) counted %v flows %s, expected %v.", expected.path, expected.segment, value, expected.counter, expected.value)
+		}
+	}
+	if count := testutil.CollectAndCount(metrics, "flowpipeline_segment_queued_flows"); count != 5 {
+		t.Errorf("Metrics contain %d instead of 5 queues.", count)
+	}
+}
+
+func TestPipelineSetBuffer(t *testing.T) {
+	for _, test := range []struct {
+		policy   OverflowPolicy
+		expected []uint64
+	}{
+		{OverflowBlock, []uint64{1, 2}},
+		{OverflowDropNewest, []uint64{1, 2}},
+		{OverflowDropOldest, []uint64{4, 5}},
+	} {
+		segment := &testSegment{gate: make(chan struct{})}
+		pipeline := New(segment)
+		if err := pipeline.SetBuffer(0, 2, test.policy); err != nil {
+			t.Fatal(err)
+		}
+		metrics := NewMetrics()
+		pipeline.Instrument(metrics)
+		pipeline.Start()
+
+		sent := 2
+		if test.policy != OverflowBlock { // blocking would not return
+			sent = 5
+		}
+		for i := 1; i <= sent; i++ {
+			pipeline.In <- &pb.EnrichedFlow{SequenceNum: uint32(i)}
+		}
+		close(segment.gate)
+		var received []uint64
+		done := make(chan struct{})
+		go func() {
+			for msg := range pipeline.Out {
+				received = append(received, uint64(msg.SequenceNum))
+			}
+			close(done)
+		}()
+		pipeline.Close()
+		<-done
+
+		if !reflect.DeepEqual(received, test.expected) {
+			t.Errorf("Policy %s passed flows %v, expected %v.", test.policy, received, test.expected)
+		}
+		overflowed := testutil.ToFloat64(metrics.flowsOverflowed.WithLabelValues("0", "testsegment"))
+		if int(overflowed) != sent-len(test.expected) {
+			t.Errorf("Policy %s counted %v discarded flows, expected %d.", test.policy, overflowed, sent-len(test.expected))
+		}
+	}
+
+	if _, err := NewFromConfig([]byte(`---
+- segment: pass
+  overflow: drop-newest
+`)); err == nil {
+		t.Error("Dropping policy without a buffer was accepted.")
+	}
+	if _, err := NewFromConfig([]byte(`---
+- segment: pass
+  buffer: 10
+  overflow: sometimes
+`)); err == nil {
+		t.Error("Unknown policy was accepted.")
+	}
+}
+
+func TestPipelineWorkers(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: testsegment
+  config:
+    jitter: true
+  workers: 4
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	go func() {
+		for i := 1; i <= 1000; i++ {
+			pipeline.In <- &pb.EnrichedFlow{SequenceNum: uint32(i)}
+		}
+		close(pipeline.In)
+	}()
+	seen := make(map[uint32]bool)
+	for msg := range pipeline.Out {
+		seen[msg.SequenceNum] = true
+	}
+	if len(seen) != 1000 {
+		t.Errorf("Workers emitted %d instead of 1000 flows.", len(seen))
+	}
+
+	for _, config := range []string{"workers: -1", "ordered: true", "workers: 2\n  if:\n  - segment: pass"} {
+		if _, err := NewFromConfig([]byte("---\n- segment: branch\n  " + config)); err == nil {
+			t.Errorf("Invalid configuration '%s' was accepted.", config)
+		}
+	}
+}
+
+func TestPipelineWorkersOrdered(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: testsegment
+  config:
+    jitter: true
+  workers: 4
+  ordered: true
+- segment: branch
+  if:
+  - segment: flowfilter
+    config:
+      filter: proto tcp
+    workers: 3
+    ordered: true
+  then:
+  - segment: testsegment
+    config:
+      jitter: true
+    workers: 2
+    ordered: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	go func() {
+		for i := 1; i <= 1000; i++ {
+			proto := uint32(6)
+			if i%3 == 0 {
+				proto = 17
+			}
+			pipeline.In <- &pb.EnrichedFlow{SequenceNum: uint32(i), Proto: proto}
+		}
+		close(pipeline.In)
+	}()
+	seen := make(map[uint32]bool)
+	var lastTcp uint32
+	for msg := range pipeline.Out {
+		seen[msg.SequenceNum] = true
+		if msg.Proto == 6 {
+			if msg.SequenceNum < lastTcp {
+				t.Fatalf("Flow %d was emitted after flow %d.", msg.SequenceNum, lastTcp)
+			}
+			lastTcp = msg.SequenceNum
+		}
+	}
+	if len(seen) != 1000 {
+		t.Errorf("Workers emitted %d instead of 1000 flows.", len(seen))
+	}
+}
+
+func TestPipelineWorkersOrderedReplacing(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: testsegment
+  config:
+    jitter: true
+    replace: true
+  workers: 4
+  ordered: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	go func() {
+		for i := 1; i <= 1000; i++ {
+			pipeline.In <- &pb.EnrichedFlow{SequenceNum: uint32(i)}
+		}
+		close(pipeline.In)
+	}()
+	var count int
+	var last uint32
+	for msg := range pipeline.Out {
+		if msg.SequenceNum < last {
+			t.Fatalf("Flow %d was emitted after flow %d.", msg.SequenceNum, last)
+		}
+		last = msg.SequenceNum
+		count++
+	}
+	// 1000 flows, plus one for each multiple of 5, minus those of 7, of
+	// which the multiples of 35 would have had two copies
+	if expected := 1000 + 200 - 142 - 28; count != expected {
+		t.Errorf("Workers emitted %d instead of %d flows.", count, expected)
+	}
+}
+
+func TestPipelineShutdown(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: branch
+  then:
+  - segment: testsegment
+    config:
+      shutdown: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	pipeline.AutoDrain()
+	if pipeline.Err() != nil {
+		t.Error("Pipeline reports an error before any shutdown was requested.")
+	}
+	pipeline.In <- &pb.EnrichedFlow{}
+	select {
+	case <-pipeline.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown request of an embedded segment did not reach the Pipeline.")
+	}
+	pipeline.Close()
+	<-pipeline.Done()
+	if err := pipeline.Err(); err == nil || err.Error() != "done" {
+		t.Errorf("Pipeline reports error %v instead of the one the shutdown was requested with.", err)
+	}
+}
+
+func TestPipelineNewFromRepr(t *testing.T) {
+	if err := segments.Register("testsegment", &testSegment{}, nil); err == nil {
+		t.Error("Registering a conflicting segment name did not fail.")
+	}
+	if _, err := NewFromRepr([]SegmentRepr{{Name: "testsegment", Config: map[string]string{"type": "foo"}}}); err == nil {
+		t.Error("Building a Pipeline with an invalid config did not fail.")
+	}
+
+	pipeline, err := NewFromRepr([]SegmentRepr{{Name: "pass"}, {Name: "testsegment", Config: map[string]string{"type": "3"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pipeline.Send(ctx, &pb.EnrichedFlow{}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := pipeline.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != 3 {
+		t.Errorf("Segment set type %v instead of 3.", msg.Type)
+	}
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := pipeline.Receive(canceled); err != context.Canceled {
+		t.Errorf("Receiving with a canceled Context returned %v instead of its error.", err)
+	}
+	go pipeline.Close()
+	if _, err := pipeline.Receive(ctx); err != io.EOF {
+		t.Errorf("Receiving from a closed Pipeline returned %v instead of io.EOF.", err)
+	}
+}
+
+func TestPipelineTopology(t *testing.T) {
+	config := []byte(`---
+- segment: flowfilter
+  id: tcp
+  config:
+    filter: proto tcp
+- segment: dropfields
+  config:
+    policy: drop
+    fields: Bytes
+- segment: pass
+  id: copy
+  from: [tcp]
+- segment: pass
+  from: [copy, tcp]
+`)
+	for _, instrumented := range []bool{false, true} {
+		pipeline, err := NewFromConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics := NewMetrics()
+		if instrumented {
+			pipeline.Instrument(metrics)
+		}
+		pipeline.Start()
+		go func() {
+			for i := 0; i < 10; i++ {
+				pipeline.In <- &pb.EnrichedFlow{Proto: uint32(6 + 11*(i%2)), Bytes: 1}
+			}
+			pipeline.Close()
+		}()
+		var stripped, unchanged int
+		for msg := range pipeline.Out {
+			if msg.Bytes == 0 {
+				stripped += 1
+			} else {
+				unchanged += 1
+			}
+		}
+		if stripped != 5 || unchanged != 10 {
+			t.Errorf("Pipeline emitted %d stripped and %d unchanged flows instead of 5 and 10.", stripped, unchanged)
+		}
+		if !instrumented {
+			continue
+		}
+		if value := testutil.ToFloat64(metrics.flowsOut.WithLabelValues("0", "flowfilter")); value != 5 {
+			t.Errorf("Segment 0 (flowfilter) counted %v instead of 5 flows out.", value)
+		}
+		if value := testutil.ToFloat64(metrics.flowsDropped.WithLabelValues("0", "flowfilter")); value != 5 {
+			t.Errorf("Segment 0 (flowfilter) counted %v instead of 5 flows dropped.", value)
+		}
+		if value := testutil.ToFloat64(metrics.flowsIn.WithLabelValues("3", "pass")); value != 10 {
+			t.Errorf("Segment 3 (pass) counted %v instead of 10 flows in.", value)
+		}
+	}
+}
+
+func TestPipelineCheckConfigTopology(t *testing.T) {
+	errs := CheckConfig([]byte(`---
+- segment: pass
+  id: a
+  from: [b]
+- segment: pass
+  id: b
+- segment: pass
+  id: b
+- segment: pass
+  from: [c]
+- segment: pass
+  from: [b, b]
+`))
+	if len(errs) != 4 {
+		t.Fatalf("Invalid configuration produced %d instead of 4 errors: %v", len(errs), errs)
+	}
+	for i, path := range []string{"2", "0", "3", "4"} {
+		if segmentErr, ok := errs[i].(*SegmentError); !ok || segmentErr.Path != path {
+			t.Errorf("Error %d does not reference segment %s: %v", i, path, errs[i])
+		}
+	}
+
+	errs = CheckConfig([]byte(`---
+- segment: pass
+- segment: pass
+  id: a
+  from: [c]
+- segment: pass
+  id: b
+- segment: pass
+  id: c
+  from: [b]
+`))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "1 -> 2 -> 3 -> 1") {
+		t.Errorf("Configuration containing a cycle produced unexpected errors: %v", errs)
+	}
+}
+
+func TestPipelineTee(t *testing.T) {
+	stripped, full := newRecorder(t, "stripped"), newRecorder(t, "full")
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: tee
+  branches:
+  - segments:
+    - segment: dropfields
+      config:
+        policy: drop
+        fields: Bytes
+    - segment: testsegment
+      config:
+        record: ` + stripped.name + `
+  - segments:
+    - segment: testsegment
+      config:
+        record: ` + full.name + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	for i := 0; i < 3; i++ {
+		pipeline.In <- &pb.EnrichedFlow{Bytes: 1}
+		if msg := <-pipeline.Out; msg.Bytes != 1 {
+			t.Error("Segment Tee did not pass on the original flow unchanged.")
+		}
+	}
+	pipeline.Close()
+
+	for r, bytes := range map[*recorder]uint64{stripped: 0, full: 1} {
+		recorded := r.recorded()
+		if len(recorded) != 3 {
+			t.Errorf("Branch %s received %d instead of 3 flows.", r.name, len(recorded))
+		}
+		for _, msg := range recorded {
+			if msg.Bytes != bytes {
+				t.Errorf("Branch %s received a flow with %d instead of %d bytes.", r.name, msg.Bytes, bytes)
+			}
+		}
+	}
+}
+
+func TestPipelineSwitch(t *testing.T) {
+	for _, mode := range []string{"first", "all"} {
+		tcp := newRecorder(t, "tcp-"+mode)
+		pipeline, err := NewFromConfig([]byte(`---
+- segment: switch
+  config:
+    mode: ` + mode + `
+  cases:
+  - filter: proto tcp
+    segments:
+    - segment: testsegment
+      config:
+        record: ` + tcp.name + `
+  - filter: port 80
+    segments:
+    - segment: dropfields
+      config:
+        policy: drop
+        fields: Bytes
+  default:
+  - segment: drop
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics := NewMetrics()
+		pipeline.Instrument(metrics)
+		pipeline.Start()
+		go func() {
+			pipeline.In <- &pb.EnrichedFlow{Proto: 6, DstPort: 80, Bytes: 1}
+			pipeline.In <- &pb.EnrichedFlow{Proto: 17, DstPort: 80, Bytes: 1}
+			pipeline.In <- &pb.EnrichedFlow{Proto: 17, DstPort: 53, Bytes: 1}
+			pipeline.Close()
+		}()
+		var stripped, unchanged int
+		for msg := range pipeline.Out {
+			if msg.Bytes == 0 {
+				stripped += 1
+			} else {
+				unchanged += 1
+			}
+		}
+
+		expected := map[string]int{"0": 1, "1": 1, "default": 1}
+		if mode == "all" {
+			expected["1"] = 2
+		}
+		if stripped != expected["1"] || unchanged != 1 {
+			t.Errorf("Switch in mode %s emitted %d stripped and %d unchanged flows instead of %d and 1.", mode, stripped, unchanged, expected["1"])
+		}
+		for label, count := range expected {
+			if value := testutil.ToFloat64(metrics.caseFlows.WithLabelValues("0", label)); value != float64(count) {
+				t.Errorf("Switch in mode %s counted %v instead of %d flows for case %s.", mode, value, count, label)
+			}
+		}
+		if recorded := tcp.recorded(); len(recorded) != 1 || recorded[0].Bytes != 1 {
+			t.Errorf("Switch in mode %s passed unexpected flows to its first case: %v", mode, recorded)
+		}
+	}
+
+	errs := CheckConfig([]byte(`---
+- segment: switch
+  cases:
+  - filter: "this is no filter"
+  - filter: proto tcp
+    segments:
+    - segment: nosuchsegment
+- segment: switch
+- segment: pass
+  default:
+  - segment: pass
+`))
+	if len(errs) != 4 {
+		t.Fatalf("Invalid configuration produced %d instead of 4 errors: %v", len(errs), errs)
+	}
+	for i, path := range []string{"0.cases.0", "0.cases.1.0", "1", "2"} {
+		if segmentErr, ok := errs[i].(*SegmentError); !ok || segmentErr.Path != path {
+			t.Errorf("Error %d does not reference segment %s: %v", i, path, errs[i])
+		}
+	}
+}
+
+func TestPipelineDropSubscriber(t *testing.T) {
+	for _, condition := range []string{`
+  - segment: testsegment
+    config:
+      drop: true`, `
+  - segment: branch
+    if:
+    - segment: flowfilter
+      config:
+        filter: proto tcp
+    else:
+    - segment: testsegment
+      config:
+        drop: true`} {
+		pipeline, err := NewFromConfig([]byte(`---
+- segment: branch
+  if:` + condition + `
+  then:
+  - segment: dropfields
+    config:
+      policy: drop
+      fields: Proto
+  else:
+  - segment: dropfields
+    config:
+      policy: drop
+      fields: Bytes
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline.Start()
+		for _, bytes := range []uint64{2, 3} {
+			pipeline.In <- &pb.EnrichedFlow{Proto: 17, Bytes: bytes}
+			msg := <-pipeline.Out
+			if bytes == 2 && msg.Proto != 0 || bytes == 3 && msg.Bytes != 0 {
+				t.Errorf("Flow with %d bytes took the wrong branch for condition %s", bytes, condition)
+			}
+		}
+		pipeline.Close()
+	}
+
+	errs := CheckConfig([]byte(`---
+- segment: branch
+  if:
+  - segment: pass
+`))
+	if len(errs) != 1 {
+		t.Errorf("Branch with a condition never dropping flows produced %d instead of 1 error: %v", len(errs), errs)
+	}
+}
+
+func TestPipelineShard(t *testing.T) {
+	shards := newRecorder(t, "shards")
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: shard
+  config:
+    fields: DstPort
+    shards: 4
+  segments:
+  - segment: testsegment
+    config:
+      record: ` + shards.name + `
+  - segment: flowfilter
+    config:
+      filter: proto tcp
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drops := pipeline.GetDrop()
+	pipeline.Start()
+	go func() {
+		for i := 0; i < 1000; i++ {
+			pipeline.In <- &pb.EnrichedFlow{DstPort: uint32(i % 50), Proto: uint32(6 + 11*(i%2))}
+		}
+		pipeline.Close()
+	}()
+	var forwarded, dropped int
+	for forwarded+dropped < 1000 {
+		select {
+		case <-pipeline.Out:
+			forwarded += 1
+		case <-drops:
+			dropped += 1
+		}
+	}
+	if forwarded != 500 || dropped != 500 {
+		t.Errorf("Shards forwarded %d and dropped %d instead of 500 flows each.", forwarded, dropped)
+	}
+	<-pipeline.Done()
+
+	instances := shards.recordedInstances()
+	if len(instances) != 4 {
+		t.Fatalf("Segment Shard created %d instead of 4 shards.", len(instances))
+	}
+	owner := make(map[uint32]int)
+	for k, recorded := range instances {
+		if len(recorded) == 0 {
+			t.Errorf("Shard %d did not receive any flows.", k)
+		}
+		for _, msg := range recorded {
+			if other, ok := owner[msg.DstPort]; ok && other != k {
+				t.Errorf("Flows with destination port %d were passed to shards %d and %d.", msg.DstPort, other, k)
+			}
+			owner[msg.DstPort] = k
+		}
+	}
+}
+
+func TestPipelineSharedMetrics(t *testing.T) {
+	for name, config := range map[string]string{
+		"shard": `---
+- segment: shard
+  config:
+    fields: DstPort
+    shards: 4
+  segments:
+  - segment: prometheus
+    config:
+      endpoint: %s
+      labels: Proto
+`,
+		"workers": `---
+- segment: prometheus
+  config:
+    endpoint: %s
+    labels: Proto
+  workers: 4
+`,
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint := listener.Addr().String()
+		listener.Close()
+		pipeline, err := NewFromConfig([]byte(fmt.Sprintf(config, endpoint)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline.Start()
+		for i := 0; i < 100; i++ {
+			pipeline.In <- &pb.EnrichedFlow{DstPort: uint32(i), Proto: 6, Bytes: 1}
+			<-pipeline.Out
+		}
+		pipeline.AutoDrain()
+
+		var body []byte
+		resp, err := http.Get("http://" + endpoint + "/flowdata")
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		pipeline.Close()
+		if err != nil {
+			t.Errorf("Failed to scrape the prometheus segments in %s: %v", name, err)
+		} else if !strings.Contains(string(body), `flow_bits{Proto="6"} 800`) {
+			t.Errorf("The prometheus segments in %s did not share their metrics:\n%s", name, body)
+		}
+		if err := pipeline.Err(); err != nil {
+			t.Errorf("The prometheus segments in %s failed to share their endpoint: %v", name, err)
+		}
+	}
+}
+
+func TestPipelineDeadLetter(t *testing.T) {
+	deadLetter, embeddedDeadLetter := newRecorder(t, "deadletter"), newRecorder(t, "deadletter-embedded")
+	pipeline, err := NewFromConfig([]byte(`---
+segments:
+- segment: testsegment
+  config:
+    fail: true
+  workers: 2
+- segment: branch
+  then:
+  - segment: testsegment
+    config:
+      fail: true
+deadletter:
+- segment: testsegment
+  config:
+    record: ` + deadLetter.name + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMetrics()
+	pipeline.Instrument(metrics)
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{Bytes: 1, Note: "original"}
+	pipeline.In <- &pb.EnrichedFlow{Bytes: 2}
+	if msg := <-pipeline.Out; msg.Bytes != 2 {
+		t.Errorf("Pipeline passed on the wrong flow: %v", msg)
+	}
+	pipeline.AutoDrain()
+	pipeline.Close()
+
+	deadLetters := deadLetter.recorded()
+	if len(deadLetters) != 1 || deadLetters[0].Bytes != 1 || deadLetters[0].Note != "segment 0 (testsegment): odd: odd number of bytes" {
+		t.Errorf("Dead letter pipeline received unexpected flows: %v", deadLetters)
+	}
+	if value := testutil.ToFloat64(metrics.flowsFailed.WithLabelValues("0", "testsegment", "odd")); value != 1 {
+		t.Errorf("Metrics counted %v instead of 1 failed flow.", value)
+	}
+	if value := testutil.ToFloat64(metrics.flowsIn.WithLabelValues("deadletter.0", "testsegment")); value != 1 {
+		t.Errorf("Metrics counted %v instead of 1 flow in the dead letter pipeline.", value)
+	}
+
+	// flows reported within embedded pipelines use the same dead letter pipeline
+	pipeline, err = NewFromConfig([]byte(`---
+segments:
+- segment: branch
+  then:
+  - segment: testsegment
+    config:
+      fail: true
+deadletter:
+- segment: testsegment
+  config:
+    record: ` + embeddedDeadLetter.name + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{Bytes: 3}
+	pipeline.Close()
+	deadLetters = embeddedDeadLetter.recorded()
+	if len(deadLetters) != 1 || deadLetters[0].Note != "segment 0.then.0 (testsegment): odd: odd number of bytes" {
+		t.Errorf("Dead letter pipeline did not receive the flow from the embedded pipeline: %v", deadLetters)
+	}
+
+	errs := CheckConfig([]byte(`---
+segments:
+- segment: pass
+deadletter:
+- segment: nonexistent
+`))
+	var segmentErr *SegmentError
+	if len(errs) != 1 || !errors.As(errs[0], &segmentErr) || segmentErr.Path != "deadletter.0" {
+		t.Errorf("Invalid dead letter pipeline produced unexpected errors: %v", errs)
+	}
+}
+
+func TestPipelineTracking(t *testing.T) {
+	source := newRecorder(t, "source")
+	pipeline, err := NewFromConfig([]byte(`---
+segments:
+- segment: testsegment
+  config:
+    track: ` + source.name + `
+- segment: flowfilter
+  config:
+    filter: proto tcp
+- segment: tee
+  branches:
+  - segments:
+    - segment: testsegment
+      config:
+        hold: true
+  - segments:
+    - segment: drop
+- segment: pass
+  workers: 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{Proto: 17, Note: "udp"}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 6, Note: "tcp"}
+	if msg := <-pipeline.Out; msg.Note != "tcp" {
+		t.Errorf("Pipeline passed on the wrong flow: %v", msg)
+	}
+	// dropped flows are acknowledged right away
+	if note := <-source.acked; note != "udp" {
+		t.Errorf("Pipeline acknowledged flow %q instead of the dropped one.", note)
+	}
+	select {
+	case note := <-source.acked:
+		t.Errorf("Pipeline acknowledged flow %q although a copy is held.", note)
+	default:
+	}
+	pipeline.AutoDrain()
+	pipeline.Close()
+	select {
+	case note := <-source.acked:
+		if note != "tcp" {
+			t.Errorf("Pipeline acknowledged flow %q instead of the held one.", note)
+		}
+	default:
+		t.Error("Pipeline did not acknowledge the flow once released.")
+	}
+
+	// without a segment requesting it, flows are acknowledged right away
+	newFlowTracker(New(&pass.Pass{})).Track(&pb.EnrichedFlow{}, func() { source.acked <- "untracked" })
+	if note := <-source.acked; note != "untracked" {
+		t.Errorf("Pipeline acknowledged flow %q instead of the untracked one.", note)
+	}
+}
+
+func TestPipelineTrackingEarlyConsumer(t *testing.T) {
+	source := newRecorder(t, "source")
+	config := []byte(`---
+- segment: testsegment
+  config:
+    track: ` + source.name + `
+- segment: branch
+  then:
+  - segment: testsegment
+    config:
+      early: true
+`)
+	_, err := NewFromConfig(config)
+	var segmentErr *SegmentError
+	if !errors.As(err, &segmentErr) || segmentErr.Path != "1.then.0" || segmentErr.Name != "testsegment" {
+		t.Errorf("Pipeline did not reject a segment consuming flows early, got: %v", err)
+	}
+	if errs := CheckConfig(config); len(errs) != 1 || !errors.As(errs[0], &segmentErr) || segmentErr.Path != "1.then.0" {
+		t.Errorf("CheckConfig did not reject a segment consuming flows early, got: %v", errs)
+	}
+
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: pass
+- segment: testsegment
+  config:
+    early: true
+`))
+	if err != nil {
+		t.Fatalf("Pipeline rejected a segment consuming flows early without tracking: %v", err)
+	}
+	pipeline.Start()
+	pipeline.AutoDrain()
+	pipeline.Close()
+}
+
+func TestPipelineMetricsSource(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: testsegment
+- segment: branch
+  then:
+  - segment: testsegment
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMetrics()
+	pipeline.Instrument(metrics)
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{}
+	<-pipeline.Out
+	pipeline.AutoDrain()
+	pipeline.Close()
+
+	expected := `
+# HELP testsegment_flows_total Number of flows passing a testsegment segment.
+# TYPE testsegment_flows_total counter
+testsegment_flows_total{path="0",segment="testsegment"} 1
+testsegment_flows_total{path="1.then.0",segment="testsegment"} 1
+`
+	if err := testutil.CollectAndCompare(metrics, strings.NewReader(expected), "testsegment_flows_total"); err != nil {
+		t.Error(err)
+	}
+}
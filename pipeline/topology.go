@@ -0,0 +1,126 @@
+package pipeline
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Distributes the output of a single segment among all segments consuming it
+// and, for the last segments, the Pipeline's Out channel. Any consumer but the
+// first receives a copy of each flow, as segments may modify the flows passed
+// to them. Junctions are only inserted where a segment's output is not passed
+// on directly, that is if it has several consumers or if its consumer has
+// several producers.
+type junction struct {
+	from      chan *pb.EnrichedFlow
+	consumers []int                 // indexes of the channels to pass flows to
+	stats     *segmentStats         // of the producing segment, nil if not instrumented
+	drops     chan *pb.EnrichedFlow // the producing segment's drops, if any
+	tracker   *flowTracker          // set by the Pipeline's Start method
+}
+
+// Runs the junction until the producing segment closes its output. Each
+// consumer's channel is closed once all of its producers have finished, the
+// remaining slice counts them down.
+func (j *junction) run(wg *sync.WaitGroup, channels []chan *pb.EnrichedFlow, remaining []atomic.Int32) {
+	defer wg.Done()
+	copies := make([]*pb.EnrichedFlow, len(j.consumers))
+	for msg := range j.from {
+		if j.stats != nil {
+			j.stats.left(msg, j.stats.out)
+		}
+		// copy before passing on the original, which may be modified
+		// by its consumer right away
+		copies[0] = msg
+		for k := 1; k < len(copies); k++ {
+			copies[k] = proto.Clone(msg).(*pb.EnrichedFlow)
+			if j.tracker != nil {
+				j.tracker.Copied(msg, copies[k])
+			}
+		}
+		for k, consumer := range j.consumers {
+			channels[consumer] <- copies[k]
+		}
+	}
+	if j.drops != nil { // the producing segment has finished and won't drop any more flows
+		close(j.drops)
+	}
+	for _, consumer := range j.consumers {
+		if remaining[consumer].Add(-1) == 0 {
+			close(channels[consumer])
+		}
+	}
+}
+
+// Wires up the segments according to the given sources, which list the
+// indexes of the segments producing each segment's input, followed by those
+// producing the Pipeline's output. The Pipeline's In channel is denoted by -1
+// and may only be the source of the first segment. The sources need to be
+// free of cycles. This needs to be called before SetBuffer, Instrument and
+// Start.
+func (pipeline *Pipeline) setSources(sources [][]int) {
+	pipeline.sources = sources
+	consumers := make([][]int, len(pipeline.SegmentList))
+	for consumer, producers := range sources {
+		for _, producer := range producers {
+			if producer >= 0 {
+				consumers[producer] = append(consumers[producer], consumer)
+			}
+		}
+	}
+	pipeline.junctions = make([]*junction, len(pipeline.SegmentList))
+	for producer := range pipeline.SegmentList {
+		consumer := consumers[producer][0]
+		if len(consumers[producer]) == 1 && len(sources[consumer]) == 1 {
+			continue // the output is passed on directly
+		}
+		pipeline.junctions[producer] = &junction{
+			from:      make(chan *pb.EnrichedFlow),
+			consumers: consumers[producer],
+		}
+	}
+	pipeline.rewire()
+}
+
+// Returns the channel the i-th segment writes to.
+func (pipeline *Pipeline) output(i int) chan *pb.EnrichedFlow {
+	if pipeline.junctions[i] != nil {
+		return pipeline.junctions[i].from
+	}
+	for consumer, producers := range pipeline.sources {
+		if len(producers) == 1 && producers[0] == i {
+			return pipeline.channels[consumer]
+		}
+	}
+	return nil // not reached, every segment has a consumer
+}
+
+// Returns the index of the segment whose output is passed on directly to the
+// i-th channel, or -1 if there is none.
+func (pipeline *Pipeline) directSource(i int) int {
+	if len(pipeline.sources[i]) != 1 {
+		return -1
+	}
+	producer := pipeline.sources[i][0]
+	if producer < 0 || pipeline.junctions[producer] != nil {
+		return -1
+	}
+	return producer
+}
+
+// Starts all junctions, counting the producers of each channel they feed.
+func (pipeline *Pipeline) startJunctions() {
+	remaining := make([]atomic.Int32, len(pipeline.channels))
+	for i, producers := range pipeline.sources {
+		remaining[i].Store(int32(len(producers)))
+	}
+	for _, junction := range pipeline.junctions {
+		if junction != nil {
+			pipeline.wg.Add(1)
+			go junction.run(pipeline.wg, pipeline.channels, remaining)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package pipeline
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+// Keeps track of the flows registered by segments using Track until they are
+// fully processed, and acknowledges them to their source then. It is shared
+// by a Pipeline and all of its embedded pipelines, as flows are only done
+// once they leave the outermost one.
+type flowTracker struct {
+	root    *Pipeline // the outermost Pipeline, whose output and drops are done
+	enabled bool      // set if any segment of the root Pipeline requests tracking
+
+	lock  sync.Mutex
+	flows map[*pb.EnrichedFlow]*trackedFlow
+}
+
+// A flow registered using Track, along with the number of its copies and
+// holds which are not done yet.
+type trackedFlow struct {
+	refs int
+	ack  func()
+}
+
+func newFlowTracker(root *Pipeline) *flowTracker {
+	return &flowTracker{
+		root:    root,
+		enabled: root.tracksFlows(),
+		flows:   make(map[*pb.EnrichedFlow]*trackedFlow),
+	}
+}
+
+func (tracker *flowTracker) Track(msg *pb.EnrichedFlow, ack func()) {
+	if !tracker.enabled {
+		ack()
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.flows[msg] = &trackedFlow{refs: 1, ack: ack}
+}
+
+func (tracker *flowTracker) Copied(msg *pb.EnrichedFlow, copy *pb.EnrichedFlow) {
+	if !tracker.enabled {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if flow, ok := tracker.flows[msg]; ok {
+		flow.refs++
+		tracker.flows[copy] = flow
+	}
+}
+
+func (tracker *flowTracker) Hold(msg *pb.EnrichedFlow) func() {
+	if !tracker.enabled {
+		return func() {}
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	flow, ok := tracker.flows[msg]
+	if !ok {
+		return func() {}
+	}
+	flow.refs++
+	return func() {
+		tracker.lock.Lock()
+		ack := tracker.release(flow)
+		tracker.lock.Unlock()
+		if ack != nil {
+			ack()
+		}
+	}
+}
+
+func (tracker *flowTracker) Done(msg *pb.EnrichedFlow) {
+	if !tracker.enabled {
+		return
+	}
+	tracker.lock.Lock()
+	flow, ok := tracker.flows[msg]
+	if !ok {
+		tracker.lock.Unlock()
+		return
+	}
+	delete(tracker.flows, msg)
+	ack := tracker.release(flow)
+	tracker.lock.Unlock()
+	if ack != nil {
+		ack()
+	}
+}
+
+// Drops a reference to a flow while holding the lock, returning its ack
+// function if this was the last one. It is called after unlocking, as it may
+// take locks of the flow's source.
+func (tracker *flowTracker) release(flow *trackedFlow) func() {
+	flow.refs--
+	if flow.refs > 0 {
+		return nil
+	}
+	return flow.ack
+}
+
+// Passes the calls of the segments of a Pipeline on to its current tracker,
+// which is replaced if the Pipeline is embedded into another one after the
+// segments have been set up.
+type segmentTracker struct {
+	pipeline *Pipeline
+}
+
+func (t segmentTracker) Track(msg *pb.EnrichedFlow, ack func()) {
+	t.pipeline.tracker.Track(msg, ack)
+}
+
+func (t segmentTracker) Copied(msg *pb.EnrichedFlow, copy *pb.EnrichedFlow) {
+	t.pipeline.tracker.Copied(msg, copy)
+}
+
+func (t segmentTracker) Hold(msg *pb.EnrichedFlow) func() {
+	return t.pipeline.tracker.Hold(msg)
+}
+
+func (t segmentTracker) Done(msg *pb.EnrichedFlow) {
+	t.pipeline.tracker.Done(msg)
+}
+
+// Reports whether any segment of this Pipeline or any embedded pipeline
+// requests its flows to be tracked, see segments.TrackingSource.
+func (pipeline *Pipeline) tracksFlows() bool {
+	for _, segment := range pipeline.SegmentList {
+		if pool, ok := segment.(*workerPool); ok {
+			segment = pool.instances[0]
+		}
+		if source, ok := segment.(segments.TrackingSource); ok && source.TracksFlows() {
+			return true
+		}
+		for _, embedded := range embeddedPipelines(segment) {
+			if embedded.tracksFlows() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns an error for each segment of this Pipeline or any embedded pipeline
+// which declares flows as done early, see segments.EarlyConsumer, if flows are
+// tracked. These would be acknowledged before the results are processed.
+func (pipeline *Pipeline) trackingErrors() []error {
+	if !pipeline.tracker.enabled {
+		return nil
+	}
+	return pipeline.earlyConsumerErrors()
+}
+
+// Does the actual work for trackingErrors, descending into embedded pipelines.
+func (pipeline *Pipeline) earlyConsumerErrors() []error {
+	var errs []error
+	for i, segment := range pipeline.SegmentList {
+		if pool, ok := segment.(*workerPool); ok {
+			segment = pool.instances[0]
+		}
+		if _, ok := segment.(segments.EarlyConsumer); ok {
+			errs = append(errs, &SegmentError{
+				Path: pipeline.pathPrefix + strconv.Itoa(i),
+				Name: pipeline.segmentName(i),
+				Err:  errors.New("acknowledges flows before the flows it emits in their place are processed, thus it can not be used along with acknowledgements"),
+			})
+		}
+		for _, embedded := range embeddedPipelines(segment) {
+			errs = append(errs, embedded.earlyConsumerErrors()...)
+		}
+	}
+	return errs
+}
+
+// Sets up the tracking of flows before the Pipeline is started. The links and
+// junctions of any Pipeline account for flows discarded and copied by them,
+// while only the outermost one marks flows as done once they leave it or are
+// dropped. The Drop channel of such a Pipeline is drained by itself.
+func (pipeline *Pipeline) startTracking() {
+	for _, link := range pipeline.links {
+		if link != nil {
+			link.tracker = pipeline.tracker
+		}
+	}
+	for _, junction := range pipeline.junctions {
+		if junction != nil {
+			junction.tracker = pipeline.tracker
+		}
+	}
+	if pipeline.tracker.root != pipeline || !pipeline.tracker.enabled {
+		return
+	}
+	pipeline.links[len(pipeline.SegmentList)].final = true // inserted by New
+	drops := pipeline.GetDrop()
+	go func() {
+		for msg := range drops {
+			pipeline.tracker.Done(msg)
+		}
+	}()
+}
@@ -0,0 +1,325 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+// Runs multiple instances of a Segment concurrently, each created from the
+// same config. Flows are distributed among the instances and their results
+// are merged into a single output. By default, this output is in no particular
+// order. If ordered, flows are emitted in the order they arrived in instead,
+// which requires the instances to forward, drop or consume every flow they
+// receive, or to replace it by flows declared using Copied. Flows emitted by an
+// instance without being derived from a flow passed to it are forwarded
+// immediately in both cases.
+type workerPool struct {
+	segments.BaseFilterSegment
+	instances []segments.Segment
+	ordered   bool
+	tracker   segments.FlowTracker // the Pipeline's tracker, wrapped for instances if ordered
+}
+
+// A flow passed to a specific instance, as recorded for resequencing.
+type dispatched struct {
+	worker int
+	seq    uint64
+}
+
+// Lets all instances shut down the Pipeline as well.
+func (segment *workerPool) SetShutdownFunc(shutdown func(err error)) {
+	segment.BaseFilterSegment.SetShutdownFunc(shutdown)
+	for _, instance := range segment.instances {
+		if instance, ok := instance.(segments.Shutdowner); ok {
+			instance.SetShutdownFunc(shutdown)
+		}
+	}
+}
+
+// Lets all instances report flows they failed to process as well.
+func (segment *workerPool) SetDeadLetterFunc(deadLetter func(msg *pb.EnrichedFlow, reason string, err error)) {
+	segment.BaseFilterSegment.SetDeadLetterFunc(deadLetter)
+	for _, instance := range segment.instances {
+		if instance, ok := instance.(segments.DeadLetterer); ok {
+			instance.SetDeadLetterFunc(deadLetter)
+		}
+	}
+}
+
+// Lets all instances take part in tracking flows as well.
+func (segment *workerPool) SetFlowTracker(tracker segments.FlowTracker) {
+	segment.BaseFilterSegment.SetFlowTracker(tracker)
+	segment.tracker = tracker
+	for _, instance := range segment.instances {
+		if instance, ok := instance.(segments.Tracked); ok {
+			instance.SetFlowTracker(tracker)
+		}
+	}
+}
+
+func (segment *workerPool) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	if segment.ordered {
+		segment.runOrdered()
+	} else {
+		segment.runUnordered()
+	}
+}
+
+// Lets all instances read from a shared input and merges their outputs.
+func (segment *workerPool) runUnordered() {
+	in := make(chan *pb.EnrichedFlow)
+	go func() {
+		for msg := range segment.In {
+			in <- msg
+		}
+		close(in)
+	}()
+	instanceWg := &sync.WaitGroup{}
+	mergeWg := &sync.WaitGroup{}
+	for _, instance := range segment.instances {
+		out := make(chan *pb.EnrichedFlow)
+		instance.Rewire(in, out)
+		if segment.Drops != nil {
+			subscribeDrops(instance, segment.Drops)
+		}
+		instanceWg.Add(1)
+		go instance.Run(instanceWg)
+		mergeWg.Add(1)
+		go func() {
+			defer mergeWg.Done()
+			for msg := range out {
+				segment.Out <- msg
+			}
+		}()
+	}
+	instanceWg.Wait()
+	mergeWg.Wait()
+}
+
+// Distributes flows to all instances in turn while recording which instance
+// got which flow, and collects their results in that same order. The flows
+// derived from an input are recognized by means of a sequencingTracker, such
+// that instances may replace flows as well.
+func (segment *workerPool) runOrdered() {
+	sequencer := &sequencer{
+		seqs:   make(map[*pb.EnrichedFlow]uint64),
+		inputs: make(map[uint64]*sequencedInput),
+	}
+	ins := make([]chan *pb.EnrichedFlow, len(segment.instances))
+	outs := make([]chan *pb.EnrichedFlow, len(segment.instances))
+	drops := make([]chan *pb.EnrichedFlow, len(segment.instances))
+	signals := make([]chan struct{}, len(segment.instances))
+	instanceWg := &sync.WaitGroup{}
+	for i, instance := range segment.instances {
+		ins[i] = make(chan *pb.EnrichedFlow)
+		outs[i] = make(chan *pb.EnrichedFlow)
+		drops[i] = make(chan *pb.EnrichedFlow)
+		signals[i] = make(chan struct{}, 1)
+		instance.Rewire(ins[i], outs[i])
+		subscribeDrops(instance, drops[i])
+		if instance, ok := instance.(segments.Tracked); ok {
+			instance.SetFlowTracker(&sequencingTracker{tracker: segment.tracker, sequencer: sequencer, signal: signals[i]})
+		}
+		instanceWg.Add(1)
+		go instance.Run(instanceWg)
+	}
+
+	// the capacity limits how far instances can get ahead of each other
+	order := make(chan dispatched, 64*len(segment.instances))
+	go func() {
+		worker := 0
+		for msg := range segment.In {
+			seq := sequencer.add(msg)
+			ins[worker] <- msg
+			order <- dispatched{worker, seq}
+			worker = (worker + 1) % len(ins)
+		}
+		for _, in := range ins {
+			close(in)
+		}
+		close(order)
+	}()
+
+	// an output of a later input per instance, read while waiting for an
+	// earlier one, which shows the earlier one to be finished
+	held := make([]*pb.EnrichedFlow, len(segment.instances))
+	heldSeqs := make([]uint64, len(segment.instances))
+	for next := range order {
+		w := next.worker
+		for later := false; !later; {
+			if held[w] != nil && heldSeqs[w] == next.seq {
+				segment.Out <- held[w]
+				held[w] = nil
+			}
+			if held[w] != nil || outs[w] == nil || sequencer.finished(next.seq) {
+				break
+			}
+			select {
+			case msg, ok := <-outs[w]:
+				if !ok { // the instance has finished unexpectedly
+					outs[w] = nil
+				} else if seq, ok := sequencer.passed(msg); ok && seq > next.seq {
+					held[w], heldSeqs[w] = msg, seq
+				} else {
+					segment.Out <- msg
+				}
+			case msg := <-drops[w]:
+				seq, ok := sequencer.passed(msg)
+				later = ok && seq > next.seq
+				if segment.Drops != nil {
+					segment.Drops <- msg
+				}
+			case <-signals[w]: // consumed by the instance, check again
+			}
+		}
+		sequencer.forget(next.seq)
+	}
+
+	// pass on anything still emitted by instances shutting down
+	for i := range segment.instances {
+		if held[i] != nil {
+			segment.Out <- held[i]
+		}
+		if outs[i] == nil {
+			continue
+		}
+		instanceWg.Add(1)
+		go func(out <-chan *pb.EnrichedFlow, drop <-chan *pb.EnrichedFlow) {
+			defer instanceWg.Done()
+			for {
+				select {
+				case msg, ok := <-out:
+					if !ok { // drops are sent before this close
+						return
+					}
+					segment.Out <- msg
+				case msg := <-drop:
+					if segment.Drops != nil {
+						segment.Drops <- msg
+					}
+				}
+			}
+		}(outs[i], drops[i])
+	}
+	instanceWg.Wait()
+}
+
+// Tags the flows passed to the instances of an ordered workerPool with
+// sequence numbers, which carry over to any flows derived from them.
+type sequencer struct {
+	lock   sync.Mutex
+	next   uint64
+	seqs   map[*pb.EnrichedFlow]uint64 // the input each flow within an instance belongs to
+	inputs map[uint64]*sequencedInput
+}
+
+// The state of an input within an instance.
+type sequencedInput struct {
+	msg    *pb.EnrichedFlow
+	passed bool // set once the input itself has been passed on, dropped or consumed
+	copies int  // the number of flows derived from the input which have not been yet
+}
+
+func (s *sequencer) add(msg *pb.EnrichedFlow) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seq := s.next
+	s.next++
+	s.seqs[msg] = seq
+	s.inputs[seq] = &sequencedInput{msg: msg}
+	return seq
+}
+
+func (s *sequencer) copied(msg *pb.EnrichedFlow, copy *pb.EnrichedFlow) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if seq, ok := s.seqs[msg]; ok {
+		s.seqs[copy] = seq
+		s.inputs[seq].copies++
+	}
+}
+
+// Records a flow as passed on, dropped or consumed by an instance, and
+// returns the input it belongs to if it is known.
+func (s *sequencer) passed(msg *pb.EnrichedFlow) (uint64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seq, ok := s.seqs[msg]
+	if !ok {
+		return 0, false
+	}
+	delete(s.seqs, msg)
+	if input := s.inputs[seq]; input == nil {
+		// forgotten already
+	} else if input.msg == msg {
+		input.passed = true
+	} else {
+		input.copies--
+	}
+	return seq, true
+}
+
+// Returns whether all flows belonging to an input have left its instance.
+func (s *sequencer) finished(seq uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	input := s.inputs[seq]
+	return input.passed && input.copies <= 0
+}
+
+func (s *sequencer) forget(seq uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if input, ok := s.inputs[seq]; ok {
+		delete(s.seqs, input.msg)
+		delete(s.inputs, seq)
+	}
+}
+
+// Wraps the Pipeline's FlowTracker for an instance of an ordered workerPool,
+// in order to learn about flows it derives from or consumes.
+type sequencingTracker struct {
+	tracker   segments.FlowTracker // nil if the Pipeline did not set one
+	sequencer *sequencer
+	signal    chan struct{} // notifies the workerPool of consumed flows
+}
+
+func (t *sequencingTracker) Track(msg *pb.EnrichedFlow, ack func()) {
+	if t.tracker == nil {
+		ack()
+		return
+	}
+	t.tracker.Track(msg, ack)
+}
+
+func (t *sequencingTracker) Copied(msg *pb.EnrichedFlow, copy *pb.EnrichedFlow) {
+	t.sequencer.copied(msg, copy)
+	if t.tracker != nil {
+		t.tracker.Copied(msg, copy)
+	}
+}
+
+func (t *sequencingTracker) Hold(msg *pb.EnrichedFlow) func() {
+	if t.tracker == nil {
+		return func() {}
+	}
+	return t.tracker.Hold(msg)
+}
+
+func (t *sequencingTracker) Done(msg *pb.EnrichedFlow) {
+	if _, ok := t.sequencer.passed(msg); ok {
+		select {
+		case t.signal <- struct{}{}:
+		default:
+		}
+	}
+	if t.tracker != nil {
+		t.tracker.Done(msg)
+	}
+}
@@ -3,6 +3,7 @@ package http
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -23,17 +24,15 @@ type Http struct {
 	// TODO: add ability to limit data sent?
 }
 
-func (segment Http) New(config map[string]string) segments.Segment {
+func (segment Http) New(config map[string]string) (segments.Segment, error) {
 	requestUrl, err := url.Parse(config["url"])
 	if err != nil {
-		log.Printf("[error] Http: error parsing url parameter: %e", err)
-		return nil
+		return nil, segments.NewConfigError("url", "could not be parsed: %v", err)
 	}
 	if !(requestUrl.Scheme == "http" || requestUrl.Scheme == "https") {
-		log.Printf("[error] Http: error parsing url parameter, scheme must be 'http://' or 'https://'")
-		return nil
+		return nil, segments.NewConfigError("url", "scheme must be 'http://' or 'https://'")
 	}
-	return &Http{Url: config["url"]}
+	return &Http{Url: config["url"]}, nil
 }
 
 func (segment *Http) Run(wg *sync.WaitGroup) {
@@ -46,6 +45,7 @@ func (segment *Http) Run(wg *sync.WaitGroup) {
 		data, err := protojson.Marshal(msg)
 		if err != nil {
 			log.Printf("[warning] Http: Skipping a flow, failed to recode protobuf as JSON: %v", err)
+			segment.DeadLetter(msg, "marshal", err)
 			continue
 		}
 
@@ -54,10 +54,12 @@ func (segment *Http) Run(wg *sync.WaitGroup) {
 			log.Printf("[error] Http: Request setup error, skipping at least one flow: %v", err)
 			log.Print("[error] Above message will not repeat for every flow and is effective until resolved.")
 			limitLog = true
+			segment.DeadLetter(msg, "post", err)
 		} else if !(resp.StatusCode-200 < 100) {
 			log.Printf("[error] Http: Server endpoint error, skipping at least one flow. Code %s.", resp.Status)
 			log.Print("[error] Above message will not repeat for every flow and is effective until resolved.")
 			limitLog = true
+			segment.DeadLetter(msg, "post", fmt.Errorf("server responded with %s", resp.Status))
 		} else if limitLog {
 			log.Print("[resolved] Http: Previous error is resolved, flows are being posted to configured url successfully again.")
 			limitLog = false
@@ -69,4 +71,10 @@ func (segment *Http) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Http{}
 	segments.RegisterSegment("http", segment)
+	segments.RegisterSchema("http", segments.Schema{
+		Summary: "Sends all flows to a HTTP endpoint using POST requests.",
+		Params: []segments.Param{
+			{Name: "url", Required: true, Doc: "The URL to send flows to, using either http or https."},
+		},
+	})
 }
@@ -0,0 +1,63 @@
+// Importing this package registers all segments shipped with flowpipeline,
+// as done by the flowpipeline utility itself. Programs using flowpipeline as a
+// library may import only the segment packages they need instead, which spares
+// them the dependencies of all others. The segments the pipeline package
+// relies on, such as branch and pass, are always registered.
+package all
+
+import (
+	_ "github.com/bwNetFlow/flowpipeline/segments/alert/http"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/controlflow/branch"
+	_ "github.com/bwNetFlow/flowpipeline/segments/controlflow/shard"
+	_ "github.com/bwNetFlow/flowpipeline/segments/controlflow/switchcase"
+	_ "github.com/bwNetFlow/flowpipeline/segments/controlflow/tee"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/export/clickhouse"
+	_ "github.com/bwNetFlow/flowpipeline/segments/export/influx"
+	_ "github.com/bwNetFlow/flowpipeline/segments/export/prometheus"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/filter/drop"
+	_ "github.com/bwNetFlow/flowpipeline/segments/filter/elephant"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/filter/flowfilter"
+	_ "github.com/bwNetFlow/flowpipeline/segments/filter/sample"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/input/bpf"
+	_ "github.com/bwNetFlow/flowpipeline/segments/input/goflow"
+	_ "github.com/bwNetFlow/flowpipeline/segments/input/kafkaconsumer"
+	_ "github.com/bwNetFlow/flowpipeline/segments/input/packet"
+	_ "github.com/bwNetFlow/flowpipeline/segments/input/stdin"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/addcid"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/addrstrings"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/anonymize"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/aslookup"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/bgp"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/dropfields"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/exec"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/geolocation"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/normalize"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/protomap"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/remoteaddress"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/reversedns"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/script"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/set"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/snmp"
+	_ "github.com/bwNetFlow/flowpipeline/segments/modify/wasm"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/pass"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/output/csv"
+	_ "github.com/bwNetFlow/flowpipeline/segments/output/json"
+	_ "github.com/bwNetFlow/flowpipeline/segments/output/kafkaproducer"
+	_ "github.com/bwNetFlow/flowpipeline/segments/output/lumberjack"
+	_ "github.com/bwNetFlow/flowpipeline/segments/output/sqlite"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/print/count"
+	_ "github.com/bwNetFlow/flowpipeline/segments/print/printdots"
+	_ "github.com/bwNetFlow/flowpipeline/segments/print/printflowdump"
+	_ "github.com/bwNetFlow/flowpipeline/segments/print/toptalkers"
+
+	_ "github.com/bwNetFlow/flowpipeline/segments/analysis/toptalkers_metrics"
+)
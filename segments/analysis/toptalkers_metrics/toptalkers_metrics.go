@@ -2,7 +2,9 @@ package flowpipeline
 
 import (
 	"bufio"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"sync"
@@ -43,6 +45,12 @@ type ToptalkersMetrics struct {
 	MetricsPath      string // optional, default is "/metrics"
 	FlowdataPath     string // optional, default is "/flowdata"
 	RelevantAddress  string // optional, default is "destination", options are "destination", "source", "both"
+
+	exporter    *PrometheusExporter
+	server      *http.Server       // set once the endpoint is served
+	shared      bool               // set if the endpoint is served by another instance
+	predecessor *ToptalkersMetrics // set if the endpoint and database are taken over on Run
+	retained    atomic.Bool        // set if the endpoint and database are kept after Run
 }
 
 type Database struct {
@@ -54,6 +62,7 @@ type Database struct {
 	thresholdBuckets int
 	cleanupCounter   int
 	promExporter     PrometheusExporter
+	reportedSize     int // the size last added to the promExporter's dbSize
 	stopOnce         sync.Once
 	stopCleanupC     chan struct{}
 	stopClockC       chan struct{}
@@ -208,7 +217,9 @@ func (db *Database) cleanup() {
 					}
 				}
 			}
-			db.promExporter.dbSize.Set(float64(len(db.database)))
+			// the gauge might be shared with other databases
+			db.promExporter.dbSize.Add(float64(len(db.database) - db.reportedSize))
+			db.reportedSize = len(db.database)
 			db.Unlock()
 		case <-db.stopCleanupC:
 			return
@@ -216,6 +227,14 @@ func (db *Database) cleanup() {
 	}
 }
 
+// Stops the clock and cleanup goroutines.
+func (db *Database) stop() {
+	db.stopOnce.Do(func() {
+		close(db.stopClockC)
+		close(db.stopCleanupC)
+	})
+}
+
 func (db *Database) GetAllRecords() <-chan struct {
 	key    string
 	record *Record
@@ -245,17 +264,18 @@ type PrometheusExporter struct {
 	MetaReg *prometheus.Registry
 	FlowReg *prometheus.Registry
 
-	kafkaMessageCount prometheus.Counter
-	dbSize            prometheus.Gauge
+	flowCount prometheus.Counter
+	dbSize    prometheus.Gauge
+	collector *PrometheusCollector
 }
 
 // Initialize Prometheus Exporter
 func (e *PrometheusExporter) Initialize(collector *PrometheusCollector) {
-	// The Kafka metrics are added to the global registry.
-	e.kafkaMessageCount = prometheus.NewCounter(
+	// The segment's own metrics are served separately from the flow data.
+	e.flowCount = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "kafka_messages_total",
-			Help: "Number of Kafka messages",
+			Name: "flows_total",
+			Help: "Number of flows received",
 		})
 	e.dbSize = prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -263,15 +283,18 @@ func (e *PrometheusExporter) Initialize(collector *PrometheusCollector) {
 			Help: "Number of Keys in the current toptalkers database",
 		})
 	e.MetaReg = prometheus.NewRegistry()
-	e.MetaReg.MustRegister(e.kafkaMessageCount)
+	e.MetaReg.MustRegister(e.flowCount)
 	e.MetaReg.MustRegister(e.dbSize)
 
+	e.collector = collector
 	e.FlowReg = prometheus.NewRegistry()
 	e.FlowReg.MustRegister(collector)
 }
 
-// listen on given endpoint addr with Handler for metricPath and flowdataPath
-func (e *PrometheusExporter) ServeEndpoints(segment *ToptalkersMetrics) {
+// listen on given endpoint addr with Handler for metricPath and flowdataPath,
+// listening errors are returned immediately and the server runs in the
+// background until it is closed
+func (e *PrometheusExporter) ServeEndpoints(segment *ToptalkersMetrics) (*http.Server, error) {
 	mux := http.NewServeMux()
 	mux.Handle(segment.MetricsPath, promhttp.HandlerFor(e.MetaReg, promhttp.HandlerOpts{}))
 	mux.Handle(segment.FlowdataPath, promhttp.HandlerFor(e.FlowReg, promhttp.HandlerOpts{}))
@@ -285,13 +308,21 @@ func (e *PrometheusExporter) ServeEndpoints(segment *ToptalkersMetrics) {
 			</body>
 		</html>`))
 	})
+	listener, err := net.Listen("tcp", segment.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: mux}
 	go func() {
-		http.ListenAndServe(segment.Endpoint, mux)
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("[error] ToptalkersMetrics: HTTP server stopped: %v", err)
+		}
 	}()
 	log.Printf("Enabled metrics on %s and %s, listening at %s.", segment.MetricsPath, segment.FlowdataPath, segment.Endpoint)
+	return server, nil
 }
 
-func (segment ToptalkersMetrics) New(config map[string]string) segments.Segment {
+func (segment *ToptalkersMetrics) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &ToptalkersMetrics{
 		Buckets:          60,
 		ThresholdBuckets: 60,
@@ -308,8 +339,7 @@ func (segment ToptalkersMetrics) New(config map[string]string) segments.Segment
 		if parsedBuckets, err := strconv.ParseInt(config["buckets"], 10, 64); err == nil {
 			newsegment.Buckets = int(parsedBuckets)
 			if newsegment.Buckets <= 0 {
-				log.Println("[error] : Buckets has to be >0.")
-				return nil
+				return nil, segments.NewConfigError("buckets", "has to be >0")
 			}
 		} else {
 			log.Println("[error] ToptalkersMetrics: Could not parse 'buckets' parameter, using default 60.")
@@ -318,12 +348,24 @@ func (segment ToptalkersMetrics) New(config map[string]string) segments.Segment
 		log.Println("[info] ToptalkersMetrics: 'buckets' set to default 60.")
 	}
 
+	if config["bucketduration"] != "" {
+		if parsedBucketDuration, err := strconv.ParseInt(config["bucketduration"], 10, 64); err == nil {
+			newsegment.BucketDuration = int(parsedBucketDuration)
+			if newsegment.BucketDuration <= 0 {
+				return nil, segments.NewConfigError("bucketduration", "has to be >0")
+			}
+		} else {
+			log.Println("[error] ToptalkersMetrics: Could not parse 'bucketduration' parameter, using default 1.")
+		}
+	} else {
+		log.Println("[info] ToptalkersMetrics: 'bucketduration' set to default 1.")
+	}
+
 	if config["thresholdbuckets"] != "" {
 		if parsedThresholdBuckets, err := strconv.ParseInt(config["thresholdbuckets"], 10, 64); err == nil {
 			newsegment.ThresholdBuckets = int(parsedThresholdBuckets)
 			if newsegment.ThresholdBuckets <= 0 {
-				log.Println("[error] : thresholdbuckets has to be >0.")
-				return nil
+				return nil, segments.NewConfigError("thresholdbuckets", "has to be >0")
 			}
 		} else {
 			log.Println("[error] ToptalkersMetrics: Could not parse 'thresholdbuckets' parameter, using default (60 buckets).")
@@ -336,8 +378,7 @@ func (segment ToptalkersMetrics) New(config map[string]string) segments.Segment
 		if parsedReportBuckets, err := strconv.ParseInt(config["reportbuckets"], 10, 64); err == nil {
 			newsegment.ReportBuckets = int(parsedReportBuckets)
 			if newsegment.ReportBuckets <= 0 {
-				log.Println("[error] : reportbuckets has to be >0.")
-				return nil
+				return nil, segments.NewConfigError("reportbuckets", "has to be >0")
 			}
 		} else {
 			log.Println("[error] ReportPrometheus: Could not parse 'reportbuckets' parameter, using default (60 buckets).")
@@ -381,7 +422,7 @@ func (segment ToptalkersMetrics) New(config map[string]string) segments.Segment
 	if config["metricspath"] == "" {
 		log.Println("[info] ToptalkersMetrics: Missing configuration parameter 'metricspath'. Using default path \"/metrics\"")
 	} else {
-		newsegment.FlowdataPath = config["metricspath"]
+		newsegment.MetricsPath = config["metricspath"]
 	}
 	if config["flowdatapath"] == "" {
 		log.Println("[info] ThresholdToptalkersMetrics: Missing configuration parameter 'flowdatapath'. Using default path \"/flowdata\"")
@@ -400,37 +441,79 @@ func (segment ToptalkersMetrics) New(config map[string]string) segments.Segment
 	default:
 		log.Println("[error] ToptalkersMetrics: Could not parse 'relevantaddress', using default value 'destination'.")
 	}
-	return newsegment
+
+	newsegment.exporter = &PrometheusExporter{}
+	newsegment.exporter.Initialize(&PrometheusCollector{[]*ToptalkersMetrics{newsegment}})
+	newsegment.database = &Database{
+		database:         map[string]*Record{},
+		thresholdBps:     newsegment.ThresholdBps,
+		thresholdPps:     newsegment.ThresholdPps,
+		thresholdBuckets: newsegment.ThresholdBuckets,
+		cleanupCounter:   newsegment.Buckets * cleanupWindowSizes, // cleanup every N windows
+		promExporter:     *newsegment.exporter,
+		buckets:          newsegment.Buckets,
+		bucketDuration:   newsegment.BucketDuration,
+		stopCleanupC:     make(chan struct{}),
+		stopClockC:       make(chan struct{}),
+	}
+	return newsegment, nil
+}
+
+// Takes over the endpoint and database of the predecessor, which keeps the
+// endpoint available and the current traffic levels intact during a reload.
+func (segment *ToptalkersMetrics) Retain(predecessor segments.Segment) {
+	if predecessor, ok := predecessor.(*ToptalkersMetrics); ok {
+		predecessor.retained.Store(true)
+		segment.predecessor = predecessor
+	}
+}
+
+// Reports this instance's database on the endpoint of the first instance,
+// instead of serving it itself.
+func (segment *ToptalkersMetrics) Share(first segments.Segment) {
+	if first, ok := first.(*ToptalkersMetrics); ok && first != segment {
+		first.exporter.collector.segments = append(first.exporter.collector.segments, segment)
+		segment.exporter = first.exporter
+		segment.database.promExporter = *first.exporter
+		segment.shared = true
+	}
 }
 
 func (segment *ToptalkersMetrics) Run(wg *sync.WaitGroup) {
 	defer func() {
+		if !segment.retained.Load() {
+			if segment.server != nil {
+				segment.server.Close()
+			}
+			segment.database.stop()
+		}
 		close(segment.Out)
 		wg.Done()
 	}()
 
-	var promExporter = PrometheusExporter{}
-	collector := &PrometheusCollector{segment}
-	promExporter.Initialize(collector)
-	promExporter.ServeEndpoints(segment)
-
-	segment.database = &Database{
-		database:         map[string]*Record{},
-		thresholdBps:     segment.ThresholdBps,
-		thresholdPps:     segment.ThresholdPps,
-		thresholdBuckets: segment.ThresholdBuckets,
-		cleanupCounter:   segment.Buckets * cleanupWindowSizes, // cleanup every N windows
-		promExporter:     promExporter,
-		buckets:          segment.Buckets,
-		bucketDuration:   segment.BucketDuration,
-		stopCleanupC:     make(chan struct{}),
-		stopClockC:       make(chan struct{}),
+	if segment.predecessor != nil {
+		// the predecessor's collector keeps reporting the database, as
+		// both are configured identically
+		segment.exporter = segment.predecessor.exporter
+		segment.server = segment.predecessor.server
+		segment.database = segment.predecessor.database
+		segment.predecessor = nil
+		log.Printf("[info] ToptalkersMetrics: Took over endpoint %s from the previous configuration.", segment.Endpoint)
+	} else {
+		if !segment.shared {
+			var err error
+			segment.server, err = segment.exporter.ServeEndpoints(segment)
+			if err != nil {
+				segment.ShutdownParentPipelineWithError(fmt.Errorf("ToptalkersMetrics: %w", err))
+			}
+		}
+		go segment.database.clock()
+		go segment.database.cleanup()
 	}
-	go segment.database.clock()
-	go segment.database.cleanup()
+	promExporter := segment.exporter
 
 	for msg := range segment.In {
-		promExporter.kafkaMessageCount.Inc()
+		promExporter.flowCount.Inc()
 		var keys []string
 		if segment.RelevantAddress == "source" {
 			keys = []string{msg.SrcAddrObj().String()}
@@ -468,8 +551,10 @@ var (
 	)
 )
 
+// Reports the database of an instance, along with those of any instances
+// sharing its endpoint.
 type PrometheusCollector struct {
-	segment *ToptalkersMetrics
+	segments []*ToptalkersMetrics
 }
 
 func (collector *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -477,37 +562,44 @@ func (collector *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- trafficPpsDesc
 }
 func (collector *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
-	for entry := range collector.segment.database.GetAllRecords() {
+	for _, segment := range collector.segments {
+		collector.collect(ch, segment)
+	}
+}
+
+// Reports the records of a single instance's database.
+func (collector *PrometheusCollector) collect(ch chan<- prometheus.Metric, segment *ToptalkersMetrics) {
+	for entry := range segment.database.GetAllRecords() {
 		key := entry.key
 		record := entry.record
 		// check if thresholds are exceeded
-		buckets := collector.segment.ReportBuckets
-		bucketDuration := collector.segment.BucketDuration
+		buckets := segment.ReportBuckets
+		bucketDuration := segment.BucketDuration
 		if record.aboveThreshold.Load() == true {
 			sumFwdBps, sumFwdPps, sumDropBps, sumDropPps := record.GetMetrics(buckets, bucketDuration)
 			ch <- prometheus.MustNewConstMetric(
 				trafficBpsDesc,
 				prometheus.GaugeValue,
 				sumFwdBps,
-				collector.segment.TrafficType, key, "forwarded",
+				segment.TrafficType, key, "forwarded",
 			)
 			ch <- prometheus.MustNewConstMetric(
 				trafficBpsDesc,
 				prometheus.GaugeValue,
 				sumDropBps,
-				collector.segment.TrafficType, key, "dropped",
+				segment.TrafficType, key, "dropped",
 			)
 			ch <- prometheus.MustNewConstMetric(
 				trafficPpsDesc,
 				prometheus.GaugeValue,
 				sumFwdPps,
-				collector.segment.TrafficType, key, "forwarded",
+				segment.TrafficType, key, "forwarded",
 			)
 			ch <- prometheus.MustNewConstMetric(
 				trafficPpsDesc,
 				prometheus.GaugeValue,
 				sumDropPps,
-				collector.segment.TrafficType, key, "dropped",
+				segment.TrafficType, key, "dropped",
 			)
 		}
 	}
@@ -516,4 +608,20 @@ func (collector *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
 func init() {
 	segment := &ToptalkersMetrics{}
 	segments.RegisterSegment("toptalkers_metrics", segment)
+	segments.RegisterSchema("toptalkers_metrics", segments.Schema{
+		Summary: "Exports traffic levels per IP address as OpenMetrics via HTTP.",
+		Params: []segments.Param{
+			{Name: "traffictype", Doc: "A label added to all metrics, used to distinguish multiple instances of this segment."},
+			{Name: "buckets", Type: segments.TypeUint, Default: "60", Doc: "The number of buckets making up the sliding window."},
+			{Name: "bucketduration", Type: segments.TypeUint, Default: "1", Doc: "The duration of a single bucket in seconds."},
+			{Name: "thresholdbuckets", Type: segments.TypeUint, Default: "60", Doc: "The number of buckets used to check the thresholds."},
+			{Name: "reportbuckets", Type: segments.TypeUint, Default: "60", Doc: "The number of buckets used to calculate the exported metrics."},
+			{Name: "thresholdbps", Type: segments.TypeUint, Default: "0", Doc: "Only addresses exceeding this many bits per second are exported and passed."},
+			{Name: "thresholdpps", Type: segments.TypeUint, Default: "0", Doc: "Only addresses exceeding this many packets per second are exported and passed."},
+			{Name: "endpoint", Default: ":8080", Doc: "The address to serve metrics on."},
+			{Name: "metricspath", Default: "/metrics", Doc: "The path to serve this segment's own metrics on."},
+			{Name: "flowdatapath", Default: "/flowdata", Doc: "The path to serve the flow metrics on."},
+			{Name: "relevantaddress", Default: "destination", Options: []string{"destination", "source", "both"}, Doc: "Which address of a flow to account its traffic to."},
+		},
+	})
 }
@@ -18,15 +18,17 @@ type Pipeline interface {
 	GetDrop() <-chan *pb.EnrichedFlow
 }
 
+// Flows dropped within the then and else branches are considered dropped by
+// this segment, which makes it usable as a condition of another Branch.
 type Branch struct {
-	segments.BaseSegment
+	segments.BaseFilterSegment
 	condition   Pipeline
 	then_branch Pipeline
 	else_branch Pipeline
 }
 
-func (segment Branch) New(config map[string]string) segments.Segment {
-	return &Branch{}
+func (segment Branch) New(config map[string]string) (segments.Segment, error) {
+	return &Branch{}, nil
 }
 
 func (segment *Branch) ImportBranches(condition interface{}, then_branch interface{}, else_branch interface{}) {
@@ -35,24 +37,47 @@ func (segment *Branch) ImportBranches(condition interface{}, then_branch interfa
 	segment.else_branch = else_branch.(Pipeline)
 }
 
+// Returns the pipelines previously set using ImportBranches.
+func (segment *Branch) Branches() (condition Pipeline, then_branch Pipeline, else_branch Pipeline) {
+	return segment.condition, segment.then_branch, segment.else_branch
+}
+
 func (segment *Branch) Run(wg *sync.WaitGroup) {
 	if segment.condition == nil || segment.then_branch == nil || segment.else_branch == nil {
 		log.Println("[error] Branch: Uninitialized branches. This is expected during standalone testing of this package. The actual test is done as part of the pipeline package, as this segment embeds further pipelines.")
 		return
 	}
+	conditionWg := &sync.WaitGroup{} // moves flows from conditional to branches
+	outputWg := &sync.WaitGroup{}    // moves flows from branches to our output
 	defer func() {
 		segment.condition.Close()
+		conditionWg.Wait()
 		segment.then_branch.Close()
 		segment.else_branch.Close()
+		outputWg.Wait()
 		close(segment.Out)
 		wg.Done()
 	}()
 
-	go segment.condition.Start()
-	go segment.then_branch.Start()
-	go segment.else_branch.Start()
+	from_condition_drop := segment.condition.GetDrop() // subscribe before starting
+	if segment.Drops != nil {
+		for _, branch := range []Pipeline{segment.then_branch, segment.else_branch} {
+			outputWg.Add(1)
+			go func(from_drop <-chan *pb.EnrichedFlow) { // pass on drops from our branches
+				defer outputWg.Done()
+				for msg := range from_drop {
+					segment.Drops <- msg
+				}
+			}(branch.GetDrop())
+		}
+	}
+	segment.condition.Start()
+	segment.then_branch.Start()
+	segment.else_branch.Start()
 
+	outputWg.Add(1)
 	go func() { // drain our output
+		defer outputWg.Done()
 		from_then := segment.then_branch.GetOutput()
 		from_else := segment.else_branch.GetOutput()
 		for {
@@ -75,9 +100,10 @@ func (segment *Branch) Run(wg *sync.WaitGroup) {
 			}
 		}
 	}()
+	conditionWg.Add(1)
 	go func() { // move anything from conditional to our two branches
+		defer conditionWg.Done()
 		from_condition_out := segment.condition.GetOutput()
-		from_condition_drop := segment.condition.GetDrop()
 		for {
 			select {
 			case msg, ok := <-from_condition_out:
@@ -106,4 +132,7 @@ func (segment *Branch) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Branch{}
 	segments.RegisterSegment("branch", segment)
+	segments.RegisterSchema("branch", segments.Schema{
+		Summary: "Passes flows to the 'then' or 'else' segments depending on whether they pass the 'if' segments.",
+	})
 }
@@ -16,9 +16,9 @@ import (
 // confirms that it fails silently, and this segment is instead tested from the
 // pipeline package test files.
 func TestSegment_Branch_passthrough(t *testing.T) {
-	segment := segments.LookupSegment("branch").New(map[string]string{}).(*Branch)
-	if segment == nil {
-		log.Fatal("[error] Configured segment 'branch' could not be initialized properly, see previous messages.")
+	segment, err := segments.NewSegment("branch", map[string]string{})
+	if err != nil {
+		log.Fatalf("[error] %v", err)
 	}
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
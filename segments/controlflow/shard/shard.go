@@ -0,0 +1,175 @@
+// Distributes flows among several copies of a subpipeline by hashing some of
+// their fields, which allows stateful segments to run in parallel.
+package shard
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+var (
+	FieldSplitRegex = regexp.MustCompile(`[\s,;:]+`)
+)
+
+// This mirrors the proper implementation in the pipeline package. This
+// duplication is to avoid the import cycle.
+type Pipeline interface {
+	Start()
+	Close()
+	GetInput() chan *pb.EnrichedFlow
+	GetOutput() <-chan *pb.EnrichedFlow
+	GetDrop() <-chan *pb.EnrichedFlow
+}
+
+// Flows dropped within any shard are considered dropped by this segment.
+type Shard struct {
+	segments.BaseFilterSegment
+	Fields []string // required, the names of the fields determining the shard of a flow
+	Shards int      // optional, default is the number of CPUs
+
+	fieldIndexes [][]int
+	shards       []Pipeline
+}
+
+func (segment Shard) New(config map[string]string) (segments.Segment, error) {
+	newsegment := &Shard{Shards: runtime.NumCPU()}
+
+	if strings.TrimSpace(config["fields"]) == "" {
+		return nil, segments.NewConfigError("fields", "can not be empty")
+	}
+	newsegment.Fields = FieldSplitRegex.Split(strings.TrimSpace(config["fields"]), -1)
+	flowType := reflect.TypeOf(pb.EnrichedFlow{})
+	for _, fieldName := range newsegment.Fields {
+		field, ok := flowType.FieldByName(fieldName)
+		if !ok || !field.IsExported() {
+			return nil, segments.NewConfigError("fields", "field '%s' does not exist", fieldName)
+		}
+		switch field.Type.Kind() {
+		case reflect.Bool, reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.Uint8 {
+				return nil, segments.NewConfigError("fields", "field '%s' is a list and can not be used", fieldName)
+			}
+		default:
+			return nil, segments.NewConfigError("fields", "field '%s' is of unsupported type %s", fieldName, field.Type)
+		}
+		newsegment.fieldIndexes = append(newsegment.fieldIndexes, field.Index)
+	}
+
+	if config["shards"] != "" {
+		shards, err := strconv.Atoi(config["shards"])
+		if err != nil || shards < 1 {
+			return nil, segments.NewConfigError("shards", "needs to be a positive number")
+		}
+		newsegment.Shards = shards
+	}
+	return newsegment, nil
+}
+
+// Sets the pipelines to distribute flows among, the pipeline package creates
+// as many as configured in Shards.
+func (segment *Shard) ImportShards(shards ...Pipeline) {
+	segment.shards = shards
+}
+
+// Returns the pipelines previously set using ImportShards.
+func (segment *Shard) ShardPipelines() []Pipeline {
+	return segment.shards
+}
+
+// Returns the index of the shard a flow belongs to.
+func (segment *Shard) shardOf(msg *pb.EnrichedFlow) int {
+	hash := fnv.New64a()
+	buf := make([]byte, 8)
+	reflectedMsg := reflect.ValueOf(msg).Elem()
+	for _, index := range segment.fieldIndexes {
+		field := reflectedMsg.FieldByIndex(index)
+		switch field.Kind() {
+		case reflect.Bool:
+			if field.Bool() {
+				buf[0] = 1
+			} else {
+				buf[0] = 0
+			}
+			hash.Write(buf[:1])
+		case reflect.String:
+			binary.LittleEndian.PutUint64(buf, uint64(field.Len()))
+			hash.Write(buf)
+			hash.Write([]byte(field.String()))
+		case reflect.Slice:
+			binary.LittleEndian.PutUint64(buf, uint64(field.Len()))
+			hash.Write(buf)
+			hash.Write(field.Bytes())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			binary.LittleEndian.PutUint64(buf, uint64(field.Int()))
+			hash.Write(buf)
+		default:
+			binary.LittleEndian.PutUint64(buf, field.Uint())
+			hash.Write(buf)
+		}
+	}
+	return int(hash.Sum64() % uint64(len(segment.shards)))
+}
+
+func (segment *Shard) Run(wg *sync.WaitGroup) {
+	outputWg := &sync.WaitGroup{} // moves flows from all shards to our output
+	defer func() {
+		for _, shard := range segment.shards {
+			shard.Close()
+		}
+		outputWg.Wait()
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	for _, shard := range segment.shards {
+		if segment.Drops != nil {
+			outputWg.Add(1)
+			go func(drop <-chan *pb.EnrichedFlow) { // pass on drops from all shards
+				defer outputWg.Done()
+				for msg := range drop {
+					segment.Drops <- msg
+				}
+			}(shard.GetDrop()) // subscribe before starting
+		}
+		shard.Start()
+		outputWg.Add(1)
+		go func(out <-chan *pb.EnrichedFlow) {
+			defer outputWg.Done()
+			for msg := range out {
+				segment.Out <- msg
+			}
+		}(shard.GetOutput())
+	}
+
+	for msg := range segment.In {
+		if len(segment.shards) == 0 {
+			segment.Out <- msg
+			continue
+		}
+		segment.shards[segment.shardOf(msg)].GetInput() <- msg
+	}
+}
+
+func init() {
+	segment := &Shard{}
+	segments.RegisterSegment("shard", segment)
+	segments.RegisterSchema("shard", segments.Schema{
+		Summary: "Distributes flows among copies of the subpipeline in 'segments' by hashing some of their fields.",
+		Params: []segments.Param{
+			{Name: "fields", Required: true, Doc: "A list of field names whose values determine the shard of a flow, separated by commas or whitespace."},
+			{Name: "shards", Type: segments.TypeUint, Doc: "The number of copies of the subpipeline, defaults to the number of CPUs."},
+		},
+	})
+}
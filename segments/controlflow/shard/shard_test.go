@@ -0,0 +1,48 @@
+package shard
+
+import (
+	"testing"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+// Shard Segment test, passthrough test. Without any shards, which are set up
+// by the pipeline package, this segment behaves like the pass segment. The
+// shards are tested from the pipeline package test files.
+func TestSegment_Shard_passthrough(t *testing.T) {
+	result := segments.TestSegment("shard", map[string]string{"fields": "DstAddr"},
+		&pb.EnrichedFlow{Type: 3})
+	if result.Type != 3 {
+		t.Error("Segment Shard is not working.")
+	}
+}
+
+func TestSegment_Shard_fields(t *testing.T) {
+	for fields, valid := range map[string]bool{
+		"SrcAddr,DstAddr": true,
+		"Proto DstPort":   true,
+		"Type":            true,
+		"NoSuchField":     false,
+		"state":           false,
+		"ASPath":          false,
+	} {
+		if _, err := segments.NewSegment("shard", map[string]string{"fields": fields}); (err == nil) != valid {
+			t.Errorf("Segment Shard with fields '%s' returned unexpected error: %v", fields, err)
+		}
+	}
+}
+
+func TestSegment_Shard_shardOf(t *testing.T) {
+	segment, err := Shard{}.New(map[string]string{"fields": "SrcAddr,DstAddr", "shards": "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := segment.(*Shard)
+	shard.shards = make([]Pipeline, shard.Shards)
+	first := shard.shardOf(&pb.EnrichedFlow{SrcAddr: []byte{10, 0, 0, 1}, DstAddr: []byte{10, 0, 0, 2}, Bytes: 1})
+	second := shard.shardOf(&pb.EnrichedFlow{SrcAddr: []byte{10, 0, 0, 1}, DstAddr: []byte{10, 0, 0, 2}, Bytes: 2})
+	if first != second {
+		t.Error("Segment Shard assigned flows with identical fields to different shards.")
+	}
+}
@@ -0,0 +1,191 @@
+// Routes flows into one of several subpipelines depending on ordered filter
+// expressions. Reuses our own https://github.com/bwNetFlow/flowfilter project,
+// see the docs there. This package is registered as the switch segment, its
+// name merely avoids the Go keyword.
+package switchcase
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bwNetFlow/flowfilter/parser"
+	"github.com/bwNetFlow/flowfilter/visitors"
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"google.golang.org/protobuf/proto"
+)
+
+// This mirrors the proper implementation in the pipeline package. This
+// duplication is to avoid the import cycle.
+type Pipeline interface {
+	Start()
+	Close()
+	GetInput() chan *pb.EnrichedFlow
+	GetOutput() <-chan *pb.EnrichedFlow
+	GetDrop() <-chan *pb.EnrichedFlow
+}
+
+// Flows dropped within any case are considered dropped by this segment, which
+// makes it usable as a condition of a branch segment.
+type Switch struct {
+	segments.BaseFilterSegment
+	All bool // optional, default is false, sends flows to all matching cases instead of the first one
+
+	cases       []*Case
+	defaultCase *Case
+	onMatch     func(i int) // called with the index of each case a flow is sent to, len(cases) for the default
+}
+
+// A single case, consisting of a filter expression and the pipeline receiving
+// any matching flows.
+type Case struct {
+	Filter   string
+	Pipeline Pipeline
+
+	expression *parser.Expression
+	matched    atomic.Uint64
+}
+
+func (segment Switch) New(config map[string]string) (segments.Segment, error) {
+	newSegment := &Switch{}
+	switch config["mode"] {
+	case "", "first":
+	case "all":
+		newSegment.All = true
+	default:
+		return nil, segments.NewConfigError("mode", "needs to be one of 'first' or 'all'")
+	}
+	return newSegment, nil
+}
+
+// Adds a case sending flows matching the given filter expression to the given
+// pipeline. Cases are checked in the order they were added in. Returns a
+// *segments.ConfigError if the filter expression is invalid.
+func (segment *Switch) AddCase(filter string, pipeline Pipeline) error {
+	expression, err := parser.Parse(filter)
+	if err != nil {
+		return segments.NewConfigError("filter", "syntax error in filter expression: %v", err)
+	}
+	if _, err := (&visitors.Filter{}).CheckFlow(expression, &pb.EnrichedFlow{}); err != nil {
+		return segments.NewConfigError("filter", "semantic error in filter expression: %v", err)
+	}
+	segment.cases = append(segment.cases, &Case{Filter: filter, Pipeline: pipeline, expression: expression})
+	return nil
+}
+
+// Sets the pipeline receiving all flows not matching any case. Without one,
+// these flows are passed on unchanged.
+func (segment *Switch) SetDefault(pipeline Pipeline) {
+	segment.defaultCase = &Case{Pipeline: pipeline}
+}
+
+// Returns the cases previously added using AddCase and the default case, if
+// any.
+func (segment *Switch) Cases() ([]*Case, *Case) {
+	return segment.cases, segment.defaultCase
+}
+
+// Sets a function called for each flow sent to a case, with the index of the
+// case or the number of cases for the default case. This is used to count
+// flows per case in metrics.
+func (segment *Switch) OnMatch(onMatch func(i int)) {
+	segment.onMatch = onMatch
+}
+
+func (segment *Switch) Run(wg *sync.WaitGroup) {
+	pipelines := make([]Pipeline, 0, len(segment.cases)+1)
+	for _, c := range segment.cases {
+		pipelines = append(pipelines, c.Pipeline)
+	}
+	if segment.defaultCase != nil {
+		pipelines = append(pipelines, segment.defaultCase.Pipeline)
+	}
+
+	outputWg := &sync.WaitGroup{} // moves flows from all cases to our output
+	defer func() {
+		for _, pipeline := range pipelines {
+			pipeline.Close()
+		}
+		outputWg.Wait()
+		close(segment.Out)
+		for i, c := range segment.cases {
+			log.Printf("[info] Switch: Case %d (%s) received %d flows.", i, c.Filter, c.matched.Load())
+		}
+		if segment.defaultCase != nil {
+			log.Printf("[info] Switch: Default case received %d flows.", segment.defaultCase.matched.Load())
+		}
+		wg.Done()
+	}()
+
+	for _, pipeline := range pipelines {
+		if segment.Drops != nil {
+			outputWg.Add(1)
+			go func(drop <-chan *pb.EnrichedFlow) { // pass on drops from all cases
+				defer outputWg.Done()
+				for msg := range drop {
+					segment.Drops <- msg
+				}
+			}(pipeline.GetDrop()) // subscribe before starting
+		}
+		pipeline.Start()
+		outputWg.Add(1)
+		go func(out <-chan *pb.EnrichedFlow) {
+			defer outputWg.Done()
+			for msg := range out {
+				segment.Out <- msg
+			}
+		}(pipeline.GetOutput())
+	}
+
+	filter := &visitors.Filter{}
+	matches := make([]int, 0, len(segment.cases)+1)
+	copies := make([]*pb.EnrichedFlow, len(segment.cases)+1)
+	for msg := range segment.In {
+		matches = matches[:0]
+		for i, c := range segment.cases {
+			if match, _ := filter.CheckFlow(c.expression, msg); match {
+				matches = append(matches, i)
+				if !segment.All {
+					break
+				}
+			}
+		}
+		if len(matches) == 0 {
+			if segment.defaultCase == nil {
+				segment.Out <- msg
+				continue
+			}
+			matches = append(matches, len(segment.cases))
+		}
+		// copy before passing on anything, as any case may modify its
+		// flow right away
+		copies[0] = msg
+		for k := 1; k < len(matches); k++ {
+			copies[k] = proto.Clone(msg).(*pb.EnrichedFlow)
+			segment.Copied(msg, copies[k])
+		}
+		for k, i := range matches {
+			c := segment.defaultCase
+			if i < len(segment.cases) {
+				c = segment.cases[i]
+			}
+			c.matched.Add(1)
+			if segment.onMatch != nil {
+				segment.onMatch(i)
+			}
+			c.Pipeline.GetInput() <- copies[k]
+		}
+	}
+}
+
+func init() {
+	segment := &Switch{}
+	segments.RegisterSegment("switch", segment)
+	segments.RegisterSchema("switch", segments.Schema{
+		Summary: "Passes flows to the subpipeline of the first case in 'cases' whose filter matches them, or to 'default'.",
+		Params: []segments.Param{
+			{Name: "mode", Default: "first", Options: []string{"first", "all"}, Doc: "Whether to pass flows to the first matching case only, or a copy to each matching case."},
+		},
+	})
+}
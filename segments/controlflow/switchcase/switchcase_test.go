@@ -0,0 +1,39 @@
+package switchcase
+
+import (
+	"testing"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+// Switch Segment test, passthrough test. Without any cases, which are set up
+// by the pipeline package, this segment behaves like the pass segment. The
+// cases are tested from the pipeline package test files.
+func TestSegment_Switch_passthrough(t *testing.T) {
+	result := segments.TestSegment("switch", map[string]string{"mode": "all"},
+		&pb.EnrichedFlow{Type: 3})
+	if result.Type != 3 {
+		t.Error("Segment Switch is not working.")
+	}
+}
+
+func TestSegment_Switch_invalidFilter(t *testing.T) {
+	segment := &Switch{}
+	if err := segment.AddCase("proto tcp", nil); err != nil {
+		t.Errorf("Valid filter expression was rejected: %v", err)
+	}
+	if err := segment.AddCase("this is no filter", nil); err == nil {
+		t.Error("Invalid filter expression was accepted.")
+	}
+}
+
+func TestSegment_Switch_mode(t *testing.T) {
+	segment, err := segments.NewSegment("switch", map[string]string{"mode": "All"})
+	if err != nil || !segment.(*Switch).All {
+		t.Errorf("Mode 'All' was not accepted as 'all': %v", err)
+	}
+	if _, err := (Switch{}).New(map[string]string{"mode": "some"}); err == nil {
+		t.Error("Unknown mode was accepted.")
+	}
+}
@@ -0,0 +1,83 @@
+package tee
+
+import (
+	"sync"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"google.golang.org/protobuf/proto"
+)
+
+// This mirrors the proper implementation in the pipeline package. This
+// duplication is to avoid the import cycle.
+type Pipeline interface {
+	Start()
+	Close()
+	GetInput() chan *pb.EnrichedFlow
+	GetOutput() <-chan *pb.EnrichedFlow
+	GetDrop() <-chan *pb.EnrichedFlow
+}
+
+type Tee struct {
+	segments.BaseSegment
+	branches []Pipeline
+}
+
+func (segment Tee) New(config map[string]string) (segments.Segment, error) {
+	return &Tee{}, nil
+}
+
+func (segment *Tee) ImportBranches(branches ...Pipeline) {
+	segment.branches = branches
+}
+
+// Returns the pipelines previously set using ImportBranches.
+func (segment *Tee) Branches() []Pipeline {
+	return segment.branches
+}
+
+func (segment *Tee) Run(wg *sync.WaitGroup) {
+	drainWg := &sync.WaitGroup{} // discards the output and drops of our branches
+	defer func() {
+		for _, branch := range segment.branches {
+			branch.Close()
+		}
+		drainWg.Wait()
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	drain := func(flows <-chan *pb.EnrichedFlow) {
+		defer drainWg.Done()
+		for msg := range flows {
+			segment.Consumed(msg)
+		}
+	}
+	for _, branch := range segment.branches {
+		drainWg.Add(2)
+		go drain(branch.GetDrop()) // subscribe before starting
+		branch.Start()
+		go drain(branch.GetOutput())
+	}
+	copies := make([]*pb.EnrichedFlow, len(segment.branches))
+	for msg := range segment.In {
+		// copy before passing on anything, as any branch may modify
+		// its copy right away
+		for i := range copies {
+			copies[i] = proto.Clone(msg).(*pb.EnrichedFlow)
+			segment.Copied(msg, copies[i])
+		}
+		for i, branch := range segment.branches {
+			branch.GetInput() <- copies[i]
+		}
+		segment.Out <- msg
+	}
+}
+
+func init() {
+	segment := &Tee{}
+	segments.RegisterSegment("tee", segment)
+	segments.RegisterSchema("tee", segments.Schema{
+		Summary: "Passes flows on unchanged and sends a copy of each to all subpipelines in 'branches'.",
+	})
+}
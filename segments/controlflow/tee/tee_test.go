@@ -0,0 +1,19 @@
+package tee
+
+import (
+	"testing"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+// Tee Segment test, passthrough test. Without any branches, which are set up
+// by the pipeline package, this segment behaves like the pass segment. The
+// branches are tested from the pipeline package test files.
+func TestSegment_Tee_passthrough(t *testing.T) {
+	result := segments.TestSegment("tee", map[string]string{},
+		&pb.EnrichedFlow{Type: 3})
+	if result.Type != 3 {
+		t.Error("Segment Tee is not working.")
+	}
+}
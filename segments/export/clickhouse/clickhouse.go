@@ -14,7 +14,7 @@ import (
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
 
-	_ "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2"
 )
 
 type Clickhouse struct {
@@ -32,12 +32,13 @@ type Clickhouse struct {
 
 // Every Segment must implement a New method, even if there isn't any config
 // it is interested in.
-func (segment Clickhouse) New(config map[string]string) segments.Segment {
+func (segment Clickhouse) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &Clickhouse{}
 
 	if config["dsn"] == "" {
-		log.Println("[error] Clickhouse: Parameter 'dsn' is required.")
-		return nil
+		return nil, segments.NewConfigError("dsn", "is required")
+	} else if _, err := clickhouse.ParseDSN(config["dsn"]); err != nil {
+		return nil, segments.NewConfigError("dsn", "could not be parsed: %v", err)
 	} else {
 		newsegment.DSN = config["dsn"]
 	}
@@ -46,8 +47,7 @@ func (segment Clickhouse) New(config map[string]string) segments.Segment {
 	if config["batchsize"] != "" {
 		if parsedBatchSize, err := strconv.ParseUint(config["batchsize"], 10, 32); err == nil {
 			if parsedBatchSize == 0 {
-				log.Println("[error] Clickhouse: Batch size 0 is not allowed. Set this in relation to the expected flows per second.")
-				return nil
+				return nil, segments.NewConfigError("batchsize", "0 is not allowed, set this in relation to the expected flows per second")
 			}
 			newsegment.BatchSize = int(parsedBatchSize)
 		} else {
@@ -111,11 +111,10 @@ func (segment Clickhouse) New(config map[string]string) segments.Segment {
 		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? , ?, ?, ?)`
 		newsegment.bulkInsert = newsegment.bulkInsertFlowhouse
 	default:
-		log.Printf("[error] Clickhouse: Unknown preset selected.")
-		return nil
+		return nil, segments.NewConfigError("preset", "unknown preset '%s'", newsegment.Preset)
 	}
 
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *Clickhouse) Run(wg *sync.WaitGroup) {
@@ -142,19 +141,28 @@ func (segment *Clickhouse) Run(wg *sync.WaitGroup) {
 	tx.Commit()
 
 	var unsaved []*pb.EnrichedFlow
+	var held []func() // releases the unsaved flows once they are inserted
 
 	for msg := range segment.In {
 		unsaved = append(unsaved, msg)
+		held = append(held, segment.Hold(msg))
 		if len(unsaved) >= segment.BatchSize {
 			err := segment.bulkInsert(unsaved)
 			if err != nil {
 				log.Printf("[error] %s", err)
 			}
 			unsaved = []*pb.EnrichedFlow{}
+			for _, release := range held {
+				release()
+			}
+			held = held[:0]
 		}
 		segment.Out <- msg
 	}
 	segment.bulkInsert(unsaved)
+	for _, release := range held {
+		release()
+	}
 }
 
 func (segment Clickhouse) bulkInsertFlowhouse(unsavedFlows []*pb.EnrichedFlow) error {
@@ -208,4 +216,12 @@ func (segment Clickhouse) bulkInsertFlowhouse(unsavedFlows []*pb.EnrichedFlow) e
 func init() {
 	segment := &Clickhouse{}
 	segments.RegisterSegment("clickhouse", segment)
+	segments.RegisterSchema("clickhouse", segments.Schema{
+		Summary: "Exports flows to a Clickhouse database.",
+		Params: []segments.Param{
+			{Name: "dsn", Required: true, Doc: "The DSN of the Clickhouse database to export to."},
+			{Name: "preset", Required: true, Options: []string{"flowhouse"}, Doc: "The table layout to use."},
+			{Name: "batchsize", Type: segments.TypeUint, Default: "1000", Doc: "The number of flows to insert at once."},
+		},
+	})
 }
@@ -26,7 +26,7 @@ type Influx struct {
 	Fields  []string // optional, list of Fields to be created, default is "Bytes,Packets"
 }
 
-func (segment Influx) New(config map[string]string) segments.Segment {
+func (segment Influx) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &Influx{}
 
 	// TODO: add paramteres for Influx endpoint and eval vars
@@ -43,22 +43,19 @@ func (segment Influx) New(config map[string]string) segments.Segment {
 	}
 
 	if config["org"] == "" {
-		log.Println("[error] Influx: Missing configuration parameter 'org'. Please set the organization to use.")
-		return nil
+		return nil, segments.NewConfigError("org", "is required, please set the organization to use")
 	} else {
 		newsegment.Org = config["org"]
 	}
 
 	if config["bucket"] == "" {
-		log.Println("[error] Influx: Missing configuration parameter 'bucket'. Please set the bucket to use.")
-		return nil
+		return nil, segments.NewConfigError("bucket", "is required, please set the bucket to use")
 	} else {
 		newsegment.Bucket = config["bucket"]
 	}
 
 	if config["token"] == "" {
-		log.Println("[error] Influx: Missing configuration parameter 'token'. Please set the token to use.")
-		return nil
+		return nil, segments.NewConfigError("token", "is required, please set the token to use")
 	} else {
 		newsegment.Token = config["token"]
 	}
@@ -74,8 +71,7 @@ func (segment Influx) New(config map[string]string) segments.Segment {
 			tagname = strings.TrimSpace(tagname)
 			_, found := protomembers.FieldByName(tagname)
 			if !found {
-				log.Printf("[error] Influx: Unknown name '%s' specified in 'tags'.", tagname)
-				return nil
+				return nil, segments.NewConfigError("tags", "unknown field '%s'", tagname)
 			}
 		}
 	}
@@ -90,13 +86,12 @@ func (segment Influx) New(config map[string]string) segments.Segment {
 			protomembers := reflect.TypeOf(pb.EnrichedFlow{})
 			_, found := protomembers.FieldByName(fieldname)
 			if !found {
-				log.Printf("[error] Influx: Unknown name '%s' specified in 'fields'.", fieldname)
-				return nil
+				return nil, segments.NewConfigError("fields", "unknown field '%s'", fieldname)
 			}
 		}
 	}
 
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *Influx) Run(wg *sync.WaitGroup) {
@@ -137,4 +132,15 @@ func (segment *Influx) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Influx{}
 	segments.RegisterSegment("influx", segment)
+	segments.RegisterSchema("influx", segments.Schema{
+		Summary: "Exports flows to an InfluxDB instance.",
+		Params: []segments.Param{
+			{Name: "org", Required: true, Doc: "The InfluxDB organization to use."},
+			{Name: "bucket", Required: true, Doc: "The InfluxDB bucket to write to."},
+			{Name: "token", Required: true, Doc: "The token to authenticate with."},
+			{Name: "address", Default: "http://127.0.0.1:8086", Doc: "The URL of the InfluxDB instance."},
+			{Name: "tags", Default: "ProtoName", Doc: "A comma separated list of flow fields to use as tags."},
+			{Name: "fields", Default: "Bytes,Packets", Doc: "A comma separated list of flow fields to use as fields."},
+		},
+	})
 }
@@ -1,8 +1,8 @@
 package prometheus
 
 import (
-	"fmt"
 	"log"
+	"net"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,9 +14,8 @@ type Exporter struct {
 	MetaReg *prometheus.Registry
 	FlowReg *prometheus.Registry
 
-	kafkaMessageCount prometheus.Counter
-	kafkaOffsets      *prometheus.CounterVec
-	flowBits          *prometheus.CounterVec
+	flowCount prometheus.Counter
+	flowBits  *prometheus.CounterVec
 
 	labels []string
 }
@@ -25,19 +24,14 @@ type Exporter struct {
 func (e *Exporter) Initialize(labels []string) {
 	e.labels = labels
 
-	// The Kafka metrics are added to the global registry.
-	e.kafkaMessageCount = prometheus.NewCounter(
+	// The segment's own metrics are served separately from the flow data.
+	e.flowCount = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "kafka_messages_total",
-			Help: "Number of Kafka messages",
+			Name: "flows_total",
+			Help: "Number of flows received",
 		})
-	e.kafkaOffsets = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "kafka_offset_current",
-			Help: "Current Kafka Offset of the consumer",
-		}, []string{"topic", "partition"})
 	e.MetaReg = prometheus.NewRegistry()
-	e.MetaReg.MustRegister(e.kafkaMessageCount, e.kafkaOffsets)
+	e.MetaReg.MustRegister(e.flowCount)
 
 	// Flows are stored in a separate Registry
 	e.flowBits = prometheus.NewCounterVec(
@@ -51,8 +45,10 @@ func (e *Exporter) Initialize(labels []string) {
 
 }
 
-// listen on given endpoint addr with Handler for metricPath and flowdataPath
-func (e *Exporter) ServeEndpoints(segment *Prometheus) {
+// listen on given endpoint addr with Handler for metricPath and flowdataPath,
+// listening errors are returned immediately and the server runs in the
+// background until it is closed
+func (e *Exporter) ServeEndpoints(segment *Prometheus) (*http.Server, error) {
 	mux := http.NewServeMux()
 	mux.Handle(segment.MetricsPath, promhttp.HandlerFor(e.MetaReg, promhttp.HandlerOpts{}))
 	mux.Handle(segment.FlowdataPath, promhttp.HandlerFor(e.FlowReg, promhttp.HandlerOpts{}))
@@ -66,23 +62,23 @@ func (e *Exporter) ServeEndpoints(segment *Prometheus) {
 			</body>
 		</html>`))
 	})
+	listener, err := net.Listen("tcp", segment.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: mux}
 	go func() {
-		http.ListenAndServe(segment.Endpoint, mux)
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("[error] prometheus: HTTP server stopped: %v", err)
+		}
 	}()
 	log.Printf("Enabled metrics on %s and %s, listening at %s.", segment.MetricsPath, segment.FlowdataPath, segment.Endpoint)
+	return server, nil
 }
 
 func (e *Exporter) Increment(bytes uint64, packets uint64, labelset prometheus.Labels) {
-	e.kafkaMessageCount.Inc()
+	e.flowCount.Inc()
 	// e.flowNumber.With(labels).Inc()
 	// flowPackets.With(labels).Add(float64(flow.GetPackets()))
 	e.flowBits.With(labelset).Add(float64(bytes) * 8)
 }
-
-func (e *Exporter) IncrementCtrl(topic string, partition int32, offset int64) {
-	labels := prometheus.Labels{
-		"topic":     topic,
-		"partition": fmt.Sprint(partition),
-	}
-	e.kafkaOffsets.With(labels).Add(float64(offset))
-}
@@ -19,10 +19,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
@@ -34,9 +36,15 @@ type Prometheus struct {
 	MetricsPath  string   // optional, default is "/metrics"
 	FlowdataPath string   // optional, default is "/flowdata"
 	Labels       []string // optional, list of labels to be exported
+
+	exporter    *Exporter
+	server      *http.Server // set once the endpoint is served
+	shared      bool         // set if the endpoint is served by another instance
+	predecessor *Prometheus  // set if the endpoint is taken over on Run
+	retained    atomic.Bool  // set if the endpoint is kept open after Run
 }
 
-func (segment Prometheus) New(config map[string]string) segments.Segment {
+func (segment *Prometheus) New(config map[string]string) (segments.Segment, error) {
 	var endpoint string = ":8080"
 	if config["endpoint"] == "" {
 		log.Println("[info] prometheus: Missing configuration parameter 'endpoint'. Using default port \":8080\"")
@@ -75,23 +83,55 @@ func (segment Prometheus) New(config map[string]string) segments.Segment {
 		field = strings.TrimSpace(field)
 		_, found := protofields.FieldByName(field)
 		if !found {
-			log.Printf("[error] Prometheus: Field '%s' specified in 'labels' does not exist.", field)
-			return nil
+			return nil, segments.NewConfigError("labels", "field '%s' does not exist", field)
 		}
 		newsegment.Labels = append(newsegment.Labels, field)
 	}
-	return newsegment
+	newsegment.exporter = &Exporter{}
+	newsegment.exporter.Initialize(newsegment.Labels)
+	return newsegment, nil
+}
+
+// Takes over the endpoint and metrics of the predecessor, which keeps the
+// endpoint available and the counters intact during a reload.
+func (segment *Prometheus) Retain(predecessor segments.Segment) {
+	if predecessor, ok := predecessor.(*Prometheus); ok {
+		predecessor.retained.Store(true)
+		segment.predecessor = predecessor
+	}
+}
+
+// Counts flows using the metrics of the first instance, which serves them on
+// its endpoint, instead of serving them itself.
+func (segment *Prometheus) Share(first segments.Segment) {
+	if first, ok := first.(*Prometheus); ok && first != segment {
+		segment.exporter = first.exporter
+		segment.shared = true
+	}
 }
 
 func (segment *Prometheus) Run(wg *sync.WaitGroup) {
 	defer func() {
+		if segment.server != nil && !segment.retained.Load() {
+			segment.server.Close()
+		}
 		close(segment.Out)
 		wg.Done()
 	}()
 
-	var promExporter = Exporter{}
-	promExporter.Initialize(segment.Labels)
-	promExporter.ServeEndpoints(segment)
+	if segment.predecessor != nil {
+		segment.exporter = segment.predecessor.exporter
+		segment.server = segment.predecessor.server
+		segment.predecessor = nil
+		log.Printf("[info] prometheus: Took over endpoint %s from the previous configuration.", segment.Endpoint)
+	} else if !segment.shared {
+		var err error
+		segment.server, err = segment.exporter.ServeEndpoints(segment)
+		if err != nil {
+			segment.ShutdownParentPipelineWithError(fmt.Errorf("prometheus: %w", err))
+		}
+	}
+	promExporter := segment.exporter
 
 	for msg := range segment.In {
 		labelset := make(map[string]string)
@@ -123,4 +163,13 @@ func (segment *Prometheus) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Prometheus{}
 	segments.RegisterSegment("prometheus", segment)
+	segments.RegisterSchema("prometheus", segments.Schema{
+		Summary: "Exports flow metrics in Prometheus format via HTTP.",
+		Params: []segments.Param{
+			{Name: "endpoint", Default: ":8080", Doc: "The address to serve metrics on."},
+			{Name: "labels", Default: "Etype,Proto", Doc: "A comma separated list of flow fields to use as metric labels."},
+			{Name: "metricspath", Default: "/metrics", Doc: "The path to serve this segment's own metrics on."},
+			{Name: "flowdatapath", Default: "/flowdata", Doc: "The path to serve the flow metrics on."},
+		},
+	})
 }
@@ -1,6 +1,11 @@
 package prometheus
 
 import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
@@ -15,3 +20,75 @@ func TestSegment_PrometheusExporter_passthrough(t *testing.T) {
 		t.Error("Segment Prometheus is not passing through flows.")
 	}
 }
+
+// Prometheus Segment test, the endpoint is kept for a successor, closed
+// afterwards, and bind errors are reported
+func TestSegment_PrometheusExporter_retain(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := listener.Addr().String()
+	listener.Close()
+	config := map[string]string{"endpoint": endpoint, "labels": "Proto"}
+	start := func(segment segments.Segment) (chan *pb.EnrichedFlow, chan *pb.EnrichedFlow, *sync.WaitGroup) {
+		in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+		segment.Rewire(in, out)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go segment.Run(wg)
+		return in, out, wg
+	}
+	scrape := func(path string) (string, error) {
+		resp, err := http.Get("http://" + endpoint + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	predecessor, err := segments.NewSegment("prometheus", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out, wg := start(predecessor)
+	in <- &pb.EnrichedFlow{Proto: 6, Bytes: 1}
+	<-out
+
+	conflicting, err := segments.NewSegment("prometheus", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shutdownErr error
+	conflicting.(segments.Shutdowner).SetShutdownFunc(func(err error) { shutdownErr = err })
+	conflictingIn, _, conflictingWg := start(conflicting)
+	close(conflictingIn)
+	conflictingWg.Wait()
+	if shutdownErr == nil {
+		t.Error("Segment Prometheus did not report the endpoint being in use.")
+	}
+
+	successor, err := segments.NewSegment("prometheus", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	successor.(segments.Retainer).Retain(predecessor)
+	close(in)
+	wg.Wait()
+	in, out, wg = start(successor)
+	in <- &pb.EnrichedFlow{Proto: 6, Bytes: 1}
+	<-out
+	if body, err := scrape("/flowdata"); err != nil || !strings.Contains(body, `flow_bits{Proto="6"} 16`) {
+		t.Errorf("Segment Prometheus did not keep its endpoint and metrics: %v\n%s", err, body)
+	}
+	if body, err := scrape("/metrics"); err != nil || !strings.Contains(body, "flows_total 2") {
+		t.Errorf("Segment Prometheus did not count the flows received: %v\n%s", err, body)
+	}
+	close(in)
+	wg.Wait()
+	if _, err := scrape("/flowdata"); err == nil {
+		t.Error("Segment Prometheus did not close its endpoint.")
+	}
+}
@@ -12,8 +12,8 @@ type Aggregate struct {
 	cache FlowExporter
 }
 
-func (segment Aggregate) New(config map[string]string) segments.Segment {
-	return &Aggregate{cache: FlowExporter{}}
+func (segment Aggregate) New(config map[string]string) (segments.Segment, error) {
+	return &Aggregate{cache: FlowExporter{}}, nil
 }
 
 func (segment *Aggregate) Run(wg *sync.WaitGroup) {
@@ -29,6 +29,7 @@ func (segment *Aggregate) Run(wg *sync.WaitGroup) {
 				return
 			}
 			segment.cache.InsertFlow(msg)
+			segment.Consumed(msg) // the aggregated flows are new ones, see ConsumesEarly
 		case msg, ok := <-segment.cache.Flows:
 			if !ok {
 				return
@@ -38,7 +39,15 @@ func (segment *Aggregate) Run(wg *sync.WaitGroup) {
 	}
 }
 
+// Flows are declared done once added to an aggregate, thus inputs waiting for
+// acknowledgements would lose any aggregates not passed on yet on a crash. The
+// pipeline rejects this segment if flows are tracked.
+func (segment *Aggregate) ConsumesEarly() {}
+
 func init() {
 	segment := &Aggregate{}
 	segments.RegisterSegment("aggregate", segment)
+	segments.RegisterSchema("aggregate", segments.Schema{
+		Summary: "Aggregates flows in a flow cache before passing them on.",
+	})
 }
@@ -10,8 +10,8 @@ type Drop struct {
 	segments.BaseFilterSegment
 }
 
-func (segment Drop) New(config map[string]string) segments.Segment {
-	return &Drop{}
+func (segment Drop) New(config map[string]string) (segments.Segment, error) {
+	return &Drop{}, nil
 }
 
 func (segment *Drop) Run(wg *sync.WaitGroup) {
@@ -30,4 +30,7 @@ func (segment *Drop) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Drop{}
 	segments.RegisterSegment("drop", segment)
+	segments.RegisterSchema("drop", segments.Schema{
+		Summary: "Drops all flows.",
+	})
 }
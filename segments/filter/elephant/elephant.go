@@ -22,7 +22,7 @@ type Elephant struct {
 	RampupTime int  // optional, default is 0, sets the time to wait for analyzing flows. All flows within this Timerange are dropped.
 }
 
-func (segment Elephant) New(config map[string]string) segments.Segment {
+func (segment Elephant) New(config map[string]string) (segments.Segment, error) {
 	var aspect = "bytes"
 	if config["aspect"] != "" {
 		if strings.ToLower(config["aspect"]) == "bytes" || strings.ToLower(config["aspect"]) == "packets" || strings.ToLower(config["aspect"]) == "bps" || strings.ToLower(config["aspect"]) == "pps" {
@@ -39,8 +39,7 @@ func (segment Elephant) New(config map[string]string) segments.Segment {
 		if parsedPercentile, err := strconv.ParseFloat(config["percentile"], 64); err == nil {
 			percentile = parsedPercentile
 			if percentile == 0 {
-				log.Println("[error] Elephant: Using 0-Percentile corresponds to no-op. Remove this segment or use a higher value.")
-				return nil
+				return nil, segments.NewConfigError("percentile", "using the 0-percentile corresponds to no-op, remove this segment or use a higher value")
 			}
 		} else {
 			log.Println("[error] Elephant: Could not parse 'percentile' parameter, using default 99.00.")
@@ -65,8 +64,7 @@ func (segment Elephant) New(config map[string]string) segments.Segment {
 		if parsedWindow, err := strconv.ParseInt(config["window"], 10, 64); err == nil {
 			window = int(parsedWindow)
 			if window <= 0 {
-				log.Println("[error] Elephant: Window has to be >0.")
-				return nil
+				return nil, segments.NewConfigError("window", "has to be >0")
 			}
 		} else {
 			log.Println("[error] Elephant: Could not parse 'window' parameter, using default 300.")
@@ -80,8 +78,7 @@ func (segment Elephant) New(config map[string]string) segments.Segment {
 		if ramptime, err := strconv.ParseInt(config["rampuptime"], 10, 64); err == nil {
 			rampuptime = int(ramptime)
 			if rampuptime < 0 {
-				log.Println("[error] Elephant: Rampuptime has to be >= 0.")
-				return nil
+				return nil, segments.NewConfigError("rampuptime", "has to be >= 0")
 			}
 		} else {
 			log.Println("[error] Elephant: Could not parse 'rampuptime' parameter, using default 0.")
@@ -96,7 +93,7 @@ func (segment Elephant) New(config map[string]string) segments.Segment {
 		Exact:      exact,
 		Window:     window,
 		RampupTime: rampuptime,
-	}
+	}, nil
 }
 
 func (segment *Elephant) Run(wg *sync.WaitGroup) {
@@ -169,4 +166,14 @@ func (segment *Elephant) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Elephant{}
 	segments.RegisterSegment("elephant", segment)
+	segments.RegisterSchema("elephant", segments.Schema{
+		Summary: "Drops all flows below a percentile of the configured aspect in a sliding window.",
+		Params: []segments.Param{
+			{Name: "aspect", Default: "bytes", Options: []string{"bytes", "bps", "packets", "pps"}, Doc: "The flow aspect to compare."},
+			{Name: "percentile", Type: segments.TypeFloat, Default: "99.00", Doc: "The percentile a flow has to exceed to be passed on."},
+			{Name: "exact", Type: segments.TypeBool, Default: "false", Doc: "Whether to calculate exact percentiles instead of P-square estimates."},
+			{Name: "window", Type: segments.TypeUint, Default: "300", Doc: "The size of the sliding window in seconds."},
+			{Name: "rampuptime", Type: segments.TypeUint, Default: "0", Doc: "The number of seconds after startup during which all flows are dropped."},
+		},
+	})
 }
@@ -13,9 +13,9 @@ import (
 
 // Elephant Segment test, passthrough test
 func TestSegment_Elephant_passthrough(t *testing.T) {
-	segment := segments.LookupSegment("elephant").New(map[string]string{})
-	if segment == nil {
-		log.Fatal("[error] Configured segment 'elephant' could not be initialized properly, see previous messages.")
+	segment, err := segments.NewSegment("elephant", map[string]string{})
+	if err != nil {
+		log.Fatalf("[error] %v", err)
 	}
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
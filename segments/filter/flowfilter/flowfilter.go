@@ -20,7 +20,7 @@ type FlowFilter struct {
 	expression *parser.Expression
 }
 
-func (segment FlowFilter) New(config map[string]string) segments.Segment {
+func (segment FlowFilter) New(config map[string]string) (segments.Segment, error) {
 	var err error
 
 	newSegment := &FlowFilter{
@@ -29,15 +29,13 @@ func (segment FlowFilter) New(config map[string]string) segments.Segment {
 
 	newSegment.expression, err = parser.Parse(config["filter"])
 	if err != nil {
-		log.Printf("[error] FlowFilter: Syntax error in filter expression: %v", err)
-		return nil
+		return nil, segments.NewConfigError("filter", "syntax error in filter expression: %v", err)
 	}
 	filter := &visitors.Filter{}
 	if _, err := filter.CheckFlow(newSegment.expression, &pb.EnrichedFlow{}); err != nil {
-		log.Printf("[error] FlowFilter: Semantic error in filter expression: %v", err)
-		return nil
+		return nil, segments.NewConfigError("filter", "semantic error in filter expression: %v", err)
 	}
-	return newSegment
+	return newSegment, nil
 }
 
 func (segment *FlowFilter) Run(wg *sync.WaitGroup) {
@@ -61,4 +59,10 @@ func (segment *FlowFilter) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &FlowFilter{}
 	segments.RegisterSegment("flowfilter", segment)
+	segments.RegisterSchema("flowfilter", segments.Schema{
+		Summary: "Drops all flows not matching a filter expression.",
+		Params: []segments.Param{
+			{Name: "filter", Doc: "The filter expression in flowfilter syntax, an empty filter passes all flows."},
+		},
+	})
 }
@@ -31,8 +31,8 @@ func TestSegment_FlowFilter_deny(t *testing.T) {
 
 func TestSegment_FlowFilter_syntax(t *testing.T) {
 	filter := &FlowFilter{}
-	result := filter.New(map[string]string{"filter": "protoo 4"})
-	if result != nil {
+	_, err := filter.New(map[string]string{"filter": "protoo 4"})
+	if err == nil {
 		t.Error("Segment FlowFilter did something with a syntax error present.")
 	}
 }
@@ -42,7 +42,7 @@ func BenchmarkFlowFilter(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := FlowFilter{}.New(map[string]string{"filter": "port <50"})
+	segment, _ := FlowFilter{}.New(map[string]string{"filter": "port <50"})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
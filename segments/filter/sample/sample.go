@@ -0,0 +1,114 @@
+// Keeps one in a configurable number of flows and adjusts the kept flows'
+// sampling related fields to account for the dropped ones.
+package sample
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+type Sample struct {
+	segments.BaseFilterSegment
+	Rate uint64 // required, keep one in this many flows
+	Mode string // optional, one of "random" or "hash", default is "random", determines how kept flows are chosen
+}
+
+func (segment Sample) New(config map[string]string) (segments.Segment, error) {
+	if config["rate"] == "" {
+		return nil, segments.NewConfigError("rate", "is required")
+	}
+	rate, err := strconv.ParseUint(config["rate"], 10, 32)
+	if err != nil || rate == 0 {
+		return nil, segments.NewConfigError("rate", "needs to be a positive number")
+	}
+
+	var mode = "random"
+	switch config["mode"] {
+	case "", "random":
+	case "hash":
+		mode = "hash"
+	default:
+		return nil, segments.NewConfigError("mode", "needs to be one of 'random' or 'hash'")
+	}
+
+	return &Sample{
+		Rate: rate,
+		Mode: mode,
+	}, nil
+}
+
+func (segment *Sample) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		if segment.keep(msg) {
+			segment.renormalize(msg)
+			segment.Out <- msg
+		} else if segment.Drops != nil {
+			segment.Drops <- msg
+		}
+	}
+}
+
+func (segment *Sample) keep(msg *pb.EnrichedFlow) bool {
+	if segment.Mode == "hash" {
+		return hashConnection(msg)%segment.Rate == 0
+	}
+	return rand.Int63n(int64(segment.Rate)) == 0
+}
+
+// Scales a kept flow to represent the dropped ones too. Flows without a
+// sampling rate are considered unsampled. Flows which have not been
+// normalized yet only get their sampling rate adjusted, as the normalize
+// segment multiplies their counters by it later on.
+func (segment *Sample) renormalize(msg *pb.EnrichedFlow) {
+	if msg.SamplingRate == 0 {
+		msg.SamplingRate = 1
+	}
+	msg.SamplingRate *= segment.Rate
+	if msg.Normalized == 1 {
+		msg.Bytes *= segment.Rate
+		msg.Packets *= segment.Rate
+	}
+}
+
+// Hashes a flow's 5-tuple regardless of its direction, such that both
+// directions of a connection are kept or dropped together.
+func hashConnection(msg *pb.EnrichedFlow) uint64 {
+	first, second := endpoint(msg.SrcAddr, msg.SrcPort), endpoint(msg.DstAddr, msg.DstPort)
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	hash := fnv.New64a()
+	hash.Write(first)
+	hash.Write(second)
+	hash.Write(binary.LittleEndian.AppendUint32(nil, msg.Proto))
+	return hash.Sum64()
+}
+
+func endpoint(addr []byte, port uint32) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(addr)))
+	buf = append(buf, addr...)
+	return binary.LittleEndian.AppendUint32(buf, port)
+}
+
+func init() {
+	segment := &Sample{}
+	segments.RegisterSegment("sample", segment)
+	segments.RegisterSchema("sample", segments.Schema{
+		Summary: "Keeps one in a number of flows and adjusts their sampling rate, bytes and packets accordingly.",
+		Params: []segments.Param{
+			{Name: "rate", Type: segments.TypeUint, Required: true, Doc: "Keep one in this many flows."},
+			{Name: "mode", Default: "random", Options: []string{"random", "hash"}, Doc: "Whether to choose flows randomly or by hashing their 5-tuple, which keeps both directions of a connection together."},
+		},
+	})
+}
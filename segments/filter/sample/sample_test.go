@@ -0,0 +1,80 @@
+package sample
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+// Sample Segment test, a rate of 1 keeps every flow
+func TestSegment_Sample_keepAll(t *testing.T) {
+	result := segments.TestSegment("sample", map[string]string{"rate": "1"},
+		&pb.EnrichedFlow{Bytes: 10, Packets: 2})
+	if result == nil {
+		t.Fatal("Segment Sample dropped a flow with a rate of 1.")
+	}
+	if result.SamplingRate != 1 || result.Bytes != 10 || result.Packets != 2 {
+		t.Errorf("Segment Sample modified a flow incorrectly: %v", result)
+	}
+}
+
+func TestSegment_Sample_config(t *testing.T) {
+	for _, config := range []map[string]string{
+		{},
+		{"rate": "0"},
+		{"rate": "ten"},
+		{"rate": "10", "mode": "sometimes"},
+	} {
+		if _, err := (&Sample{}).New(config); err == nil {
+			t.Errorf("Segment Sample accepted the invalid config %v.", config)
+		}
+	}
+}
+
+func TestSegment_Sample_renormalize(t *testing.T) {
+	segment := &Sample{Rate: 10}
+
+	msg := &pb.EnrichedFlow{SamplingRate: 32, Bytes: 100, Packets: 2}
+	segment.renormalize(msg)
+	if msg.SamplingRate != 320 || msg.Bytes != 100 || msg.Packets != 2 {
+		t.Errorf("Segment Sample renormalized an unnormalized flow incorrectly: %v", msg)
+	}
+
+	msg = &pb.EnrichedFlow{SamplingRate: 32, Bytes: 3200, Packets: 64, Normalized: 1}
+	segment.renormalize(msg)
+	if msg.SamplingRate != 320 || msg.Bytes != 32000 || msg.Packets != 640 {
+		t.Errorf("Segment Sample renormalized a normalized flow incorrectly: %v", msg)
+	}
+}
+
+func TestSegment_Sample_hash(t *testing.T) {
+	segment := &Sample{Rate: 4, Mode: "hash"}
+	kept := 0
+	for port := uint32(1024); port < 2048; port++ {
+		forward := &pb.EnrichedFlow{
+			SrcAddr: net.ParseIP("192.0.2.1").To4(),
+			DstAddr: net.ParseIP("198.51.100.1").To4(),
+			SrcPort: port,
+			DstPort: 443,
+			Proto:   6,
+		}
+		backward := &pb.EnrichedFlow{
+			SrcAddr: forward.DstAddr,
+			DstAddr: forward.SrcAddr,
+			SrcPort: forward.DstPort,
+			DstPort: forward.SrcPort,
+			Proto:   forward.Proto,
+		}
+		if segment.keep(forward) != segment.keep(backward) {
+			t.Fatalf("Segment Sample treated both directions of port %d differently.", port)
+		}
+		if segment.keep(forward) {
+			kept++
+		}
+	}
+	if kept < 192 || kept > 320 {
+		t.Errorf("Segment Sample kept %d of 1024 connections at a rate of 4.", kept)
+	}
+}
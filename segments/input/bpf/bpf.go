@@ -4,6 +4,7 @@
 package bpf
 
 import (
+	"fmt"
 	"log"
 	"strconv"
 	"sync"
@@ -27,14 +28,13 @@ type Bpf struct {
 	BufferSize      int    // optional, default is 65536 (64kB)
 }
 
-func (segment Bpf) New(config map[string]string) segments.Segment {
+func (segment Bpf) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &Bpf{}
 
 	var ok bool
 	newsegment.Device, ok = config["device"]
 	if !ok {
-		log.Printf("[error] Bpf: setting the config parameter 'device' is required.")
-		return nil
+		return nil, segments.NewConfigError("device", "is required")
 	}
 
 	newsegment.BufferSize = 65536
@@ -42,8 +42,7 @@ func (segment Bpf) New(config map[string]string) segments.Segment {
 		if parsedBufferSize, err := strconv.ParseInt(config["buffersize"], 10, 32); err == nil {
 			newsegment.BufferSize = int(parsedBufferSize)
 			if newsegment.BufferSize <= 0 {
-				log.Println("[error] Bpf: Buffer size needs to be at least 1 and will be rounded up to the nearest multiple of the current page size.")
-				return nil
+				return nil, segments.NewConfigError("buffersize", "needs to be at least 1 and will be rounded up to the nearest multiple of the current page size")
 			}
 		} else {
 			log.Println("[error] Bpf: Could not parse 'buffersize' parameter, using default 65536 (64kB).")
@@ -57,8 +56,7 @@ func (segment Bpf) New(config map[string]string) segments.Segment {
 
 	err := newsegment.dumper.Setup(newsegment.Device)
 	if err != nil {
-		log.Printf("[error] Bpf: error setting up BPF dumping: %s", err)
-		return nil
+		return nil, &segments.ConfigError{Reason: fmt.Sprintf("error setting up BPF dumping: %v", err)}
 	}
 
 	// setup flow export
@@ -84,23 +82,26 @@ func (segment Bpf) New(config map[string]string) segments.Segment {
 		}
 		newsegment.InactiveTimeout = "15s"
 	} else {
-		newsegment.ActiveTimeout = config["inactivetimeout"]
+		newsegment.InactiveTimeout = config["inactivetimeout"]
 		log.Printf("[info] Bpf: 'inactivetimeout' set to '%s'.", config["inactivetimeout"])
 	}
 
 	newsegment.exporter, err = flowexport.NewFlowExporter(newsegment.ActiveTimeout, newsegment.InactiveTimeout)
 	if err != nil {
-		log.Printf("[error] Bpf: error setting up exporter: %s", err)
-		return nil
+		return nil, &segments.ConfigError{Reason: fmt.Sprintf("error setting up exporter: %v", err)}
 	}
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *Bpf) Run(wg *sync.WaitGroup) {
 	err := segment.dumper.Start()
 	if err != nil {
-		log.Printf("[error] Bpf: error starting up BPF dumping: %s", err)
-		segment.ShutdownParentPipeline()
+		segment.ShutdownParentPipelineWithError(fmt.Errorf("Bpf: error starting up BPF dumping: %w", err))
+		for msg := range segment.In { // keep passing flows until we are closed
+			segment.Out <- msg
+		}
+		close(segment.Out)
+		wg.Done()
 		return
 	}
 	segment.exporter.Start(segment.dumper.SamplerAddress)
@@ -132,4 +133,13 @@ func (segment *Bpf) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Bpf{}
 	segments.RegisterSegment("bpf", segment)
+	segments.RegisterSchema("bpf", segments.Schema{
+		Summary: "Captures packets from an interface using BPF and emits flows from them.",
+		Params: []segments.Param{
+			{Name: "device", Required: true, Doc: "The interface to capture packets on."},
+			{Name: "activetimeout", Type: segments.TypeDuration, Default: "30m", Doc: "The time after which active flows are exported."},
+			{Name: "inactivetimeout", Type: segments.TypeDuration, Default: "15s", Doc: "The time after which inactive flows are exported."},
+			{Name: "buffersize", Type: segments.TypeUint, Default: "65536", Doc: "The size of the kernel perf buffer in bytes."},
+		},
+	})
 }
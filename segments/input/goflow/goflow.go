@@ -6,12 +6,15 @@ package goflow
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
@@ -26,10 +29,21 @@ type Goflow struct {
 	Listen  []url.URL // optional, default config value for this slice is "sflow://:6343,netflow://:2055"
 	Workers uint64    // optional, amunt of workers to spawn for each endpoint, default is 1
 
-	goflow_in chan *pb.EnrichedFlow
+	goflow_in   chan *pb.EnrichedFlow
+	stopped     chan struct{} // closed once the listeners are shut down
+	listeners   []*listener
+	predecessor *Goflow     // set if the listeners are taken over on Run
+	retained    atomic.Bool // set if the listeners are kept open after Run
 }
 
-func (segment Goflow) New(config map[string]string) segments.Segment {
+// A UDP socket along with the goroutines decoding its packets. These replace
+// goflow's own FlowRoutine, which can not be stopped reliably.
+type listener struct {
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+}
+
+func (segment *Goflow) New(config map[string]string) (segments.Segment, error) {
 
 	var listen = "sflow://:6343,netflow://:2055"
 	if config["listen"] != "" {
@@ -40,22 +54,19 @@ func (segment Goflow) New(config map[string]string) segments.Segment {
 	for _, listenAddress := range strings.Split(listen, ",") {
 		listenAddrUrl, err := url.Parse(listenAddress)
 		if err != nil {
-			log.Printf("[error] Goflow: error parsing listenAddresses: %e", err)
-			return nil
+			return nil, segments.NewConfigError("listen", "could not be parsed: %v", err)
 		}
 		// Check if given Port can be parsed to int
 		_, err = strconv.ParseUint(listenAddrUrl.Port(), 10, 64)
 		if err != nil {
-			log.Printf("[error] Goflow: Port %s could not be converted to integer", listenAddrUrl.Port())
-			return nil
+			return nil, segments.NewConfigError("listen", "port '%s' could not be converted to integer", listenAddrUrl.Port())
 		}
 
 		switch listenAddrUrl.Scheme {
 		case "netflow", "sflow", "nfl":
 			log.Printf("[info] Goflow: Scheme %s supported.", listenAddrUrl.Scheme)
 		default:
-			log.Printf("[error] Goflow: Scheme %s not supported.", listenAddrUrl.Scheme)
-			return nil
+			return nil, segments.NewConfigError("listen", "scheme '%s' is not supported", listenAddrUrl.Scheme)
 		}
 
 		listenAddressesSlice = append(listenAddressesSlice, *listenAddrUrl)
@@ -67,8 +78,7 @@ func (segment Goflow) New(config map[string]string) segments.Segment {
 		if parsedWorkers, err := strconv.ParseUint(config["workers"], 10, 32); err == nil {
 			workers = parsedWorkers
 			if workers == 0 {
-				log.Println("[error] Goflow: Limiting workers to 0 will not work. Remove this segment or use a higher value >= 1.")
-				return nil
+				return nil, segments.NewConfigError("workers", "limiting workers to 0 will not work, use a value >= 1")
 			}
 		} else {
 			log.Println("[error] Goflow: Could not parse 'workers' parameter, using default 1.")
@@ -80,25 +90,51 @@ func (segment Goflow) New(config map[string]string) segments.Segment {
 	return &Goflow{
 		Listen:  listenAddressesSlice,
 		Workers: workers,
+	}, nil
+}
+
+// Takes over the listeners of the predecessor instead of opening new ones,
+// which keeps their sockets open during a reload.
+func (segment *Goflow) Retain(predecessor segments.Segment) {
+	if predecessor, ok := predecessor.(*Goflow); ok {
+		predecessor.retained.Store(true)
+		segment.predecessor = predecessor
 	}
 }
 
 func (segment *Goflow) Run(wg *sync.WaitGroup) {
 	defer func() {
+		if !segment.retained.Load() {
+			segment.stopGoFlow()
+		}
 		close(segment.Out)
 		wg.Done()
 	}()
-	segment.goflow_in = make(chan *pb.EnrichedFlow)
-	segment.startGoFlow(&channelDriver{segment.goflow_in})
+
+	if segment.predecessor != nil {
+		segment.goflow_in = segment.predecessor.goflow_in
+		segment.stopped = segment.predecessor.stopped
+		segment.listeners = segment.predecessor.listeners
+		segment.predecessor = nil
+		log.Println("[info] Goflow: Took over listeners from the previous configuration.")
+	} else {
+		segment.goflow_in = make(chan *pb.EnrichedFlow)
+		segment.stopped = make(chan struct{})
+		if err := segment.startGoFlow(&channelDriver{segment.goflow_in, segment.stopped}); err != nil {
+			segment.ShutdownParentPipelineWithError(fmt.Errorf("Goflow: %w", err))
+		}
+	}
+	goflow_in := segment.goflow_in
 	for {
 		select {
-		case msg, ok := <-segment.goflow_in:
+		case msg, ok := <-goflow_in:
 			if !ok {
 				// do not return here, as this might leave the
 				// segment.In channel blocking in our
 				// predecessor segment
-				segment.goflow_in = nil // make unavailable for select
+				goflow_in = nil // make unavailable for select
 				// TODO: think about restarting goflow?
+				continue
 			}
 			segment.Out <- msg
 		case msg, ok := <-segment.In:
@@ -111,7 +147,8 @@ func (segment *Goflow) Run(wg *sync.WaitGroup) {
 }
 
 type channelDriver struct {
-	out chan *pb.EnrichedFlow
+	out     chan *pb.EnrichedFlow
+	stopped chan struct{} // discards any flows once closed
 }
 
 func (d *channelDriver) Send(key, data []byte) error {
@@ -121,7 +158,10 @@ func (d *channelDriver) Send(key, data []byte) error {
 		log.Println("[error] Goflow: Conversion error for received flow.")
 		return nil
 	}
-	d.out <- msg
+	select {
+	case d.out <- msg:
+	case <-d.stopped:
+	}
 	return nil
 }
 
@@ -146,48 +186,116 @@ func (d *myProtobufDriver) Format(data interface{}) ([]byte, []byte, error) {
 func (d *myProtobufDriver) Prepare() error             { return nil }
 func (d *myProtobufDriver) Init(context.Context) error { return nil }
 
-func (segment *Goflow) startGoFlow(transport transport.TransportInterface) {
+// Opens a listener for each configured URL. If any of them fails, those
+// opened already are closed again.
+func (segment *Goflow) startGoFlow(transport transport.TransportInterface) error {
 	formatter := &myProtobufDriver{}
 
 	for _, listenAddrUrl := range segment.Listen {
-		go func(listenAddrUrl url.URL) {
-
-			hostname := listenAddrUrl.Hostname()
-			port, _ := strconv.ParseUint(listenAddrUrl.Port(), 10, 64)
-
-			var err error
-			switch scheme := listenAddrUrl.Scheme; scheme {
-			case "netflow":
-				sNF := &utils.StateNetFlow{
-					Format:    formatter,
-					Transport: transport,
-				}
-				log.Printf("[info] Goflow: Listening for Netflow v9 on port %d...", port)
-				err = sNF.FlowRoutine(int(segment.Workers), hostname, int(port), false)
-			case "sflow":
-				sSFlow := &utils.StateSFlow{
-					Format:    formatter,
-					Transport: transport,
-				}
-				log.Printf("[info] Goflow: Listening for sflow on port %d...", port)
-				err = sSFlow.FlowRoutine(int(segment.Workers), hostname, int(port), false)
-			case "nfl":
-				sNFL := &utils.StateNFLegacy{
-					Format:    formatter,
-					Transport: transport,
-				}
-				log.Printf("[info] Goflow: Listening for netflow legacy on port %d...", port)
-				err = sNFL.FlowRoutine(int(segment.Workers), hostname, int(port), false)
+		hostname := listenAddrUrl.Hostname()
+		port, _ := strconv.ParseUint(listenAddrUrl.Port(), 10, 64)
+
+		var decodeFlow func(msg interface{}) error
+		var protocol string
+		switch scheme := listenAddrUrl.Scheme; scheme {
+		case "netflow":
+			sNF := &utils.StateNetFlow{
+				Format:    formatter,
+				Transport: transport,
+			}
+			sNF.InitTemplates()
+			decodeFlow = sNF.DecodeFlow
+			protocol = "Netflow v9"
+		case "sflow":
+			sSFlow := &utils.StateSFlow{
+				Format:    formatter,
+				Transport: transport,
 			}
-			if err != nil {
-				log.Fatalf("[error] Goflow: %s", err.Error())
+			decodeFlow = sSFlow.DecodeFlow
+			protocol = "sflow"
+		case "nfl":
+			sNFL := &utils.StateNFLegacy{
+				Format:    formatter,
+				Transport: transport,
 			}
+			decodeFlow = sNFL.DecodeFlow
+			protocol = "netflow legacy"
+		}
+		listener, err := listen(hostname, int(port), int(segment.Workers), decodeFlow)
+		if err != nil {
+			segment.stopGoFlow()
+			return fmt.Errorf("could not listen for %s on port %d: %w", protocol, port, err)
+		}
+		segment.listeners = append(segment.listeners, listener)
+		log.Printf("[info] Goflow: Listening for %s on port %d...", protocol, port)
+	}
+	return nil
+}
+
+// Closes all listeners and waits for their goroutines to exit, discarding any
+// flows they are about to send.
+func (segment *Goflow) stopGoFlow() {
+	if segment.stopped == nil { // stopped already
+		return
+	}
+	close(segment.stopped)
+	segment.stopped = nil
+	for _, listener := range segment.listeners {
+		listener.conn.Close()
+		listener.wg.Wait()
+	}
+	segment.listeners = nil
+}
 
-		}(listenAddrUrl)
+// Opens a UDP socket and decodes its packets using the given number of
+// workers, until the socket is closed.
+func listen(addr string, port int, workers int, decodeFlow func(msg interface{}) error) (*listener, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(addr), Port: port})
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{conn: conn}
+	packets := make(chan utils.BaseMessage)
+	l.wg.Add(1 + workers)
+	go func() {
+		defer l.wg.Done()
+		defer close(packets)
+		payload := make([]byte, 9000)
+		for {
+			size, pktAddr, err := conn.ReadFromUDP(payload)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil || size == 0 {
+				continue
+			}
+			packets <- utils.BaseMessage{
+				Src:     pktAddr.IP,
+				Port:    pktAddr.Port,
+				Payload: append([]byte(nil), payload[:size]...),
+			}
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer l.wg.Done()
+			for packet := range packets {
+				// errors are not logged, just as with goflow's
+				// default settings
+				_ = decodeFlow(packet)
+			}
+		}()
 	}
+	return l, nil
 }
 
 func init() {
 	segment := &Goflow{}
 	segments.RegisterSegment("goflow", segment)
+	segments.RegisterSchema("goflow", segments.Schema{
+		Summary: "Collects sFlow, Netflow and IPFIX flows using goflow2.",
+		Params: []segments.Param{
+			{Name: "listen", Default: "sflow://:6343,netflow://:2055", Doc: "A comma separated list of URLs to listen on, using the schemes sflow, netflow or nfl."},
+			{Name: "workers", Type: segments.TypeUint, Default: "1", Doc: "The number of workers per listen address."},
+		},
+	})
 }
@@ -1,6 +1,10 @@
 package goflow
 
 import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
 	"testing"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
@@ -9,9 +13,87 @@ import (
 
 // Goflow Segment test, passthrough test only, functionality is tested by Goflow package
 func TestSegment_Goflow_passthrough(t *testing.T) {
-	result := segments.TestSegment("goflow", map[string]string{"port": "2055"},
+	result := segments.TestSegment("goflow", map[string]string{"listen": "netflow://:2055"},
 		&pb.EnrichedFlow{})
 	if result == nil {
 		t.Error("Segment Goflow is not passing through flows.")
 	}
 }
+
+// Returns a Netflow v5 packet containing a single flow from the given address.
+func netflowV5Packet(srcAddr net.IP) []byte {
+	packet := make([]byte, 24+48)
+	binary.BigEndian.PutUint16(packet[0:], 5) // version
+	binary.BigEndian.PutUint16(packet[2:], 1) // count
+	copy(packet[24:], srcAddr.To4())
+	return packet
+}
+
+func newTestGoflow(t *testing.T, port int) (*Goflow, chan *pb.EnrichedFlow, chan *pb.EnrichedFlow, *error) {
+	segment, err := segments.NewSegment("goflow", map[string]string{"listen": fmt.Sprintf("nfl://127.0.0.1:%d", port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shutdownErr error
+	segment.(*Goflow).SetShutdownFunc(func(err error) { shutdownErr = err })
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	return segment.(*Goflow), in, out, &shutdownErr
+}
+
+func TestSegment_Goflow_reload(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	wg := &sync.WaitGroup{}
+	first, in, out, _ := newTestGoflow(t, port)
+	wg.Add(1)
+	go first.Run(wg)
+	in <- &pb.EnrichedFlow{} // wait for the listener to be opened
+	<-out
+
+	// a conflicting segment fails to listen and shuts down its pipeline
+	conflicting, conflictingIn, conflictingOut, shutdownErr := newTestGoflow(t, port)
+	conflictingWg := &sync.WaitGroup{}
+	conflictingWg.Add(1)
+	go conflicting.Run(conflictingWg)
+	conflictingIn <- &pb.EnrichedFlow{}
+	<-conflictingOut
+	close(conflictingIn)
+	conflictingWg.Wait()
+	if *shutdownErr == nil {
+		t.Error("Segment Goflow did not report a port in use.")
+	}
+
+	// a successor takes over the listener
+	successor, successorIn, successorOut, _ := newTestGoflow(t, port)
+	successor.Retain(first)
+	close(in)
+	wg.Wait()
+	wg.Add(1)
+	go successor.Run(wg)
+	sender, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(netflowV5Packet(net.IPv4(192, 0, 2, 1))); err != nil {
+		t.Fatal(err)
+	}
+	if flow := <-successorOut; !net.IP(flow.SrcAddr).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("Segment Goflow did not decode the flow received by the retained listener, got %v", flow)
+	}
+
+	// the port is released once the successor is done
+	close(successorIn)
+	wg.Wait()
+	conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatalf("Segment Goflow did not release its port: %v", err)
+	}
+	conn.Close()
+}
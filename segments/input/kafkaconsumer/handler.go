@@ -2,25 +2,63 @@ package kafkaconsumer
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/bwNetFlow/flowpipeline/pb"
-	"google.golang.org/protobuf/proto"
 )
 
 // Handler represents a Sarama consumer group consumer
 type Handler struct {
-	ready  chan bool
-	flows  chan *pb.EnrichedFlow
-	cancel context.CancelFunc
+	ready      chan bool
+	flows      chan consumedFlow
+	cancel     context.CancelFunc
+	formats    map[string]pb.Format // the format of the messages in each topic
+	ack        bool                 // whether to mark messages only once their flows are acknowledged
+	ackTimeout time.Duration        // how long to wait for acknowledgements when a session ends
+	metrics    *consumerMetrics
+
+	client    sarama.Client           // used to look up offsets
+	group     string                  // the consumer group, used to look up its offsets
+	startAt   int64                   // a time in milliseconds to start claims without offsets at, or sarama.OffsetOldest or sarama.OffsetNewest to leave this to Sarama
+	reset     bool                    // whether to reset the offset of each partition to startAt when it is first claimed
+	wasReset  map[topicPartition]bool // the partitions reset already
+	endAt     time.Time               // zero unless claims end at this time
+	ended     chan struct{}           // closed once all claims of a session have ended
+	endedOnce sync.Once
+	remaining atomic.Int32 // the claims of the current session which have not ended
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// A flow decoded from a Kafka message, along with the function acknowledging
+// it if the handler waits for acknowledgements.
+type consumedFlow struct {
+	msg *pb.EnrichedFlow
+	ack func()
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
 func (h *Handler) Setup(session sarama.ConsumerGroupSession) error {
 	log.Println("[info] KafkaConsumer: Received new partition set to claim:", session.Claims()) // TODO: print those
+	if err := h.position(session); err != nil {
+		return err
+	}
+	h.metrics.sessionStarted(session.Claims())
+	claims := 0
+	for _, partitions := range session.Claims() {
+		claims += len(partitions)
+	}
+	h.remaining.Store(int32(claims))
 	// reopen flows channel
-	h.flows = make(chan *pb.EnrichedFlow)
+	h.flows = make(chan consumedFlow)
 	// Mark the consumer as ready
 	close(h.ready)
 	return nil
@@ -34,18 +72,261 @@ func (h *Handler) Cleanup(sarama.ConsumerGroupSession) error {
 
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
 func (h *Handler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	var pending *pendingOffsets
+	if h.ack {
+		pending = &pendingOffsets{session: session, topic: claim.Topic(), partition: claim.Partition()}
+		defer pending.wait(h.ackTimeout)
+	}
+	format := h.formats[claim.Topic()]
+	endOffset, endTimer := h.endOffset(claim)
+	next := claim.InitialOffset()
+	h.metrics.claimed(claim.Topic(), claim.Partition(), next)
+consume:
 	for {
+		if endOffset >= 0 && next < 0 { // a new claim starting at oldest or newest
+			next, _ = h.client.GetOffset(claim.Topic(), claim.Partition(), next)
+		}
+		if endOffset >= 0 && next >= endOffset {
+			h.claimEnded(claim)
+			break
+		}
 		select {
-		case message := <-claim.Messages():
-			session.MarkMessage(message, "")
-			flowMsg := new(pb.EnrichedFlow)
-			if err := proto.Unmarshal(message.Value, flowMsg); err == nil {
-				h.flows <- flowMsg
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if !h.endAt.IsZero() && !message.Timestamp.Before(h.endAt) {
+				h.claimEnded(claim)
+				break consume
+			}
+			next = message.Offset + 1
+			h.metrics.consumed(claim.Topic(), claim.Partition(), message.Offset, claim.HighWaterMarkOffset())
+			var entry *pendingOffset
+			if pending != nil {
+				entry = pending.add(message.Offset)
 			} else {
-				log.Printf("[warning] KafkaConsumer: Error decoding flow, this might be due to the use of Goflow custom fields. Original error:\n  %s", err)
+				session.MarkMessage(message, "")
+			}
+			flows, err := format.Decode(message.Value)
+			if err != nil { // pass on anything decoded before the error nonetheless
+				h.metrics.decodeFailed(claim.Topic())
+				log.Printf("[warning] KafkaConsumer: Error decoding flow from topic '%s' as %s, this might be due to a wrong format or the use of Goflow custom fields. Original error:\n  %s", claim.Topic(), format, err)
+			}
+			var ack func()
+			if entry != nil && len(flows) == 0 {
+				pending.ack(entry)
+			} else if entry != nil {
+				ack = ackAfter(len(flows), func() { pending.ack(entry) })
+			}
+			for _, flowMsg := range flows {
+				select {
+				case h.flows <- consumedFlow{msg: flowMsg, ack: ack}:
+				case <-session.Context().Done():
+					if entry != nil { // not handed off completely, consume it again next time
+						pending.abandon(entry)
+					}
+					return nil
+				}
+			}
+		case <-endTimer:
+			if offset, err := h.offsetAt(claim.Topic(), claim.Partition(), h.endAt.UnixMilli()); err == nil {
+				endOffset = offset
+			} else {
+				log.Printf("[warning] KafkaConsumer: Could not look up the end of partition %d of topic '%s', ending at the first flow after it instead: %v", claim.Partition(), claim.Topic(), err)
 			}
 		case <-session.Context().Done():
 			return nil
 		}
 	}
+	// Discard anything after the end instead of returning, which would end
+	// the session, until the session ends anyways.
+	for {
+		select {
+		case _, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Moves the claims of a new session to startAt, if they are to be reset or
+// have no offset yet and startAt is a time.
+func (h *Handler) position(session sarama.ConsumerGroupSession) error {
+	if !h.reset && h.startAt < 0 {
+		return nil
+	}
+	var committed *sarama.OffsetFetchResponse
+	if h.startAt >= 0 {
+		admin, err := sarama.NewClusterAdminFromClient(h.client) // not closed, as this would close the client
+		if err == nil {
+			committed, err = admin.ListConsumerGroupOffsets(h.group, session.Claims())
+		}
+		if err != nil {
+			return fmt.Errorf("could not fetch the offsets of consumer group '%s': %w", h.group, err)
+		}
+	}
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			key := topicPartition{topic: topic, partition: partition}
+			if h.reset && !h.wasReset[key] {
+				log.Printf("[info] KafkaConsumer: Resetting the offset of partition %d of topic '%s'.", partition, topic)
+			} else if committed == nil {
+				continue
+			} else if block := committed.GetBlock(topic, partition); block == nil || block.Offset >= 0 {
+				continue // only claims without an offset start at the given time
+			}
+			offset, err := h.offsetAt(topic, partition, h.startAt)
+			if err != nil {
+				return fmt.Errorf("could not look up the starting offset of partition %d of topic '%s': %w", partition, topic, err)
+			}
+			// only one of these moves the offset, depending on the direction
+			session.MarkOffset(topic, partition, offset, "")
+			session.ResetOffset(topic, partition, offset, "")
+			h.wasReset[key] = true
+		}
+	}
+	return nil
+}
+
+// Returns the offset of the first message at or after the given time in
+// milliseconds, or the newest offset if there is none yet. The time can also
+// be sarama.OffsetOldest or sarama.OffsetNewest.
+func (h *Handler) offsetAt(topic string, partition int32, time int64) (int64, error) {
+	offset, err := h.client.GetOffset(topic, partition, time)
+	if err == nil && offset < 0 {
+		offset, err = h.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+	return offset, err
+}
+
+// Returns the offset a claim ends at, if endAt has passed already. Otherwise,
+// it returns a channel signaling when to look it up, which is nil if claims do
+// not end at all.
+func (h *Handler) endOffset(claim sarama.ConsumerGroupClaim) (int64, <-chan time.Time) {
+	if h.endAt.IsZero() {
+		return -1, nil
+	} else if wait := time.Until(h.endAt); wait > 0 {
+		return -1, time.After(wait)
+	}
+	offset, err := h.offsetAt(claim.Topic(), claim.Partition(), h.endAt.UnixMilli())
+	if err != nil {
+		log.Printf("[warning] KafkaConsumer: Could not look up the end of partition %d of topic '%s', ending at the first flow after it instead: %v", claim.Partition(), claim.Topic(), err)
+		return -1, nil
+	}
+	return offset, nil
+}
+
+func (h *Handler) claimEnded(claim sarama.ConsumerGroupClaim) {
+	log.Printf("[info] KafkaConsumer: Reached the end of partition %d of topic '%s'.", claim.Partition(), claim.Topic())
+	if h.remaining.Add(-1) == 0 {
+		log.Println("[info] KafkaConsumer: Reached the end of all claimed partitions, closing pipeline.")
+		h.endedOnce.Do(func() { close(h.ended) })
+	}
+}
+
+// Returns a function calling ack once it has been called n times, which
+// acknowledges a message once all flows decoded from it are acknowledged.
+func ackAfter(n int, ack func()) func() {
+	var remaining atomic.Int32
+	remaining.Store(int32(n))
+	return func() {
+		if remaining.Add(-1) == 0 {
+			ack()
+		}
+	}
+}
+
+// Keeps track of the messages of a single claim whose flows have been handed
+// off, but not acknowledged yet. The offset marked for the claim is the one of
+// the first message not acknowledged, such that a crash leads to any messages
+// from there on being consumed again.
+type pendingOffsets struct {
+	session   sarama.ConsumerGroupSession
+	topic     string
+	partition int32
+
+	lock    sync.Mutex
+	offsets []*pendingOffset // in the order the messages were consumed in
+	idle    chan struct{}    // closed once offsets is empty, if someone waits for it
+	closed  bool             // set once the session has ended, see wait
+}
+
+// A single message handed off by a claim.
+type pendingOffset struct {
+	offset int64
+	acked  bool
+}
+
+func (p *pendingOffsets) add(offset int64) *pendingOffset {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry := &pendingOffset{offset: offset}
+	p.offsets = append(p.offsets, entry)
+	return entry
+}
+
+// Acknowledges a message and marks the offset after all messages
+// acknowledged in a row, starting from the oldest pending one.
+func (p *pendingOffsets) ack(entry *pendingOffset) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry.acked = true
+	done := 0
+	for done < len(p.offsets) && p.offsets[done].acked {
+		done++
+	}
+	if done == 0 {
+		return
+	}
+	if !p.closed {
+		p.session.MarkOffset(p.topic, p.partition, p.offsets[done-1].offset+1, "")
+	}
+	p.offsets = p.offsets[done:]
+	p.notifyIdle()
+}
+
+// Forgets about a message which was not handed off completely.
+func (p *pendingOffsets) abandon(entry *pendingOffset) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, pending := range p.offsets {
+		if pending == entry {
+			p.offsets = append(p.offsets[:i], p.offsets[i+1:]...)
+			break
+		}
+	}
+	p.notifyIdle()
+}
+
+func (p *pendingOffsets) notifyIdle() {
+	if len(p.offsets) == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// Waits up to the given timeout for all pending messages to be acknowledged,
+// such that their offsets are committed at the end of the session. Any later
+// acknowledgements are ignored, and the messages are consumed again by
+// whoever claims the partition next.
+func (p *pendingOffsets) wait(timeout time.Duration) {
+	p.lock.Lock()
+	if len(p.offsets) > 0 {
+		p.idle = make(chan struct{})
+		idle := p.idle
+		p.lock.Unlock()
+		select {
+		case <-idle:
+		case <-time.After(timeout):
+		}
+		p.lock.Lock()
+	}
+	defer p.lock.Unlock()
+	p.closed = true
+	if len(p.offsets) > 0 {
+		log.Printf("[warning] KafkaConsumer: Gave up waiting for %d flows from partition %d of topic '%s' to be acknowledged, they will be consumed again.", len(p.offsets), p.partition, p.topic)
+	}
 }
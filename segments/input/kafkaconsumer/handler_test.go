@@ -0,0 +1,145 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// A session recording the offsets marked in it.
+type markingSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	marked []int64
+}
+
+func (session *markingSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	session.marked = append(session.marked, offset)
+}
+
+func (session *markingSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	session.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (session *markingSession) Context() context.Context {
+	return session.ctx
+}
+
+// A claim of a single partition of the topic flows.
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (claim *fakeClaim) Topic() string                            { return "flows" }
+func (claim *fakeClaim) Partition() int32                         { return 0 }
+func (claim *fakeClaim) InitialOffset() int64                     { return 0 }
+func (claim *fakeClaim) HighWaterMarkOffset() int64               { return 5 }
+func (claim *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return claim.messages }
+
+// A client returning fixed offsets by time.
+type offsetsClient struct {
+	sarama.Client
+	offsets map[int64]int64
+}
+
+func (client *offsetsClient) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	if offset, ok := client.offsets[time]; ok {
+		return offset, nil
+	}
+	return -1, nil
+}
+
+func TestPendingOffsets(t *testing.T) {
+	session := &markingSession{}
+	pending := &pendingOffsets{session: session, topic: "flows", partition: 0}
+	first, second, third := pending.add(10), pending.add(11), pending.add(12)
+	pending.ack(second)
+	if len(session.marked) != 0 {
+		t.Errorf("Offsets %v were marked although the first message is pending.", session.marked)
+	}
+	pending.ack(first)
+	if len(session.marked) != 1 || session.marked[0] != 12 {
+		t.Errorf("Offsets %v were marked instead of the one after both acknowledged messages.", session.marked)
+	}
+	go pending.ack(third)
+	pending.wait(time.Second)
+	if len(session.marked) != 2 || session.marked[1] != 13 {
+		t.Errorf("Offsets %v were marked instead of the one after the last message.", session.marked)
+	}
+
+	// acknowledgements after the end of the session are ignored
+	late := pending.add(13)
+	pending.wait(time.Millisecond)
+	pending.ack(late)
+	if len(session.marked) != 2 {
+		t.Errorf("Offsets %v were marked after the session ended.", session.marked)
+	}
+}
+
+func TestHandler_ConsumeClaim_endAt(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	for _, test := range []struct {
+		name     string
+		endAt    time.Time
+		offsets  map[int64]int64
+		late     int64 // the first offset timestamped after the end
+		expected int
+	}{
+		{"offset", past, map[int64]int64{past.UnixMilli(): 3}, 5, 3},
+		{"timestamp", future, nil, 2, 2},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		session := &markingSession{ctx: ctx}
+		claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 5)}
+		for offset := int64(0); offset < 5; offset++ {
+			value, _ := proto.Marshal(&pb.EnrichedFlow{Bytes: uint64(offset)})
+			timestamp := test.endAt.Add(-time.Minute)
+			if offset >= test.late {
+				timestamp = test.endAt
+			}
+			claim.messages <- &sarama.ConsumerMessage{Topic: "flows", Offset: offset, Value: value, Timestamp: timestamp}
+		}
+		handler := &Handler{
+			flows:   make(chan consumedFlow),
+			formats: map[string]pb.Format{"flows": pb.FormatEnrichedFlow},
+			metrics: newConsumerMetrics(0),
+			client:  &offsetsClient{offsets: test.offsets},
+			endAt:   test.endAt,
+			ended:   make(chan struct{}),
+		}
+		handler.remaining.Store(1)
+		returned := make(chan struct{})
+		go func() {
+			handler.ConsumeClaim(session, claim)
+			close(returned)
+		}()
+
+		consumed := 0
+	receive:
+		for {
+			select {
+			case <-handler.flows:
+				consumed++
+			case <-handler.ended:
+				break receive
+			case <-time.After(time.Second):
+				t.Fatalf("Ending by %s: Claim did not end after %d flows.", test.name, consumed)
+			}
+		}
+		if consumed != test.expected || len(session.marked) != test.expected {
+			t.Errorf("Ending by %s: Claim ended after %d flows and marked %v, expected %d flows.", test.name, consumed, session.marked, test.expected)
+		}
+		select {
+		case <-returned:
+			t.Errorf("Ending by %s: Claim returned before the end of the session, which would end it.", test.name)
+		default:
+		}
+		cancel()
+		<-returned
+	}
+}
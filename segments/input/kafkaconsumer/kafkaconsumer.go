@@ -5,44 +5,57 @@ package kafkaconsumer
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
+	"github.com/bwNetFlow/flowpipeline/segments/internal/kafka"
 )
 
 // FIXME: clean up those todos
 type KafkaConsumer struct {
 	segments.BaseSegment
-	Server  string        // required
-	Topic   string        // required
-	Group   string        // required
-	User    string        // required if auth is true
-	Pass    string        // required if auth is true
-	Tls     bool          // optional, default is true
-	Auth    bool          // optional, default is true
-	StartAt string        // optional, one of "oldest" or "newest", default is "newest"
-	Timeout time.Duration // optional, default is 15s, any parsable duration
+	kafka.Connection
+	Server       string        // required
+	Topic        string        // required
+	Group        string        // required
+	StartAt      string        // optional, one of "oldest", "newest" or an RFC3339 timestamp, default is "newest"
+	EndAt        time.Time     // optional, default is zero which means consuming indefinitely
+	ResetOffsets bool          // optional, default is false, start at StartAt even if the consumer group has stored offsets
+	Timeout      time.Duration // optional, default is 15s, any parsable duration
+	Ack          bool          // optional, default is false, commit offsets only once flows are acknowledged
+	AckTimeout   time.Duration // optional, default is 30s, how long to wait for acknowledgements when a session ends
+	Format       string        // optional, default is enrichedflow, either one format for all topics or a comma separated list of one per topic
+	LagWarning   int64         // optional, default is 0 which means no warning, the number of messages a partition may lag behind before logging a warning
 
+	formats        map[string]pb.Format
+	metrics        *consumerMetrics
 	startingOffset int64
 	saramaConfig   *sarama.Config
+
+	saramaClient  sarama.Client
+	client        sarama.ConsumerGroup
+	handler       *Handler
+	handlerCancel context.CancelFunc
+	handlerWg     *sync.WaitGroup
+	predecessor   *KafkaConsumer // set if the consumer group is taken over on Run
+	retained      atomic.Bool    // set if the consumer group is kept after Run
 }
 
-func (segment KafkaConsumer) New(config map[string]string) segments.Segment {
+func (segment *KafkaConsumer) New(config map[string]string) (segments.Segment, error) {
 	var err error
 	newsegment := &KafkaConsumer{}
 	newsegment.saramaConfig = sarama.NewConfig()
 
 	if config["server"] == "" || config["topic"] == "" || config["group"] == "" {
-		log.Println("[error] KafkaConsumer: Missing required configuration parameters.")
-		return nil
+		return nil, &segments.ConfigError{Reason: "the parameters 'server', 'topic' and 'group' are required"}
 	} else {
 		newsegment.Server = config["server"]
 		newsegment.Topic = config["topic"]
@@ -53,91 +66,55 @@ func (segment KafkaConsumer) New(config map[string]string) segments.Segment {
 	// newsegment.saramaConfig.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
 	newsegment.saramaConfig.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.BalanceStrategySticky}
 
-	// TODO: parse and set kafka version
-	newsegment.saramaConfig.Version, err = sarama.ParseKafkaVersion("2.4.0")
-	if err != nil {
-		log.Panicf("Error parsing Kafka version: %v", err)
-	}
-
-	// parse config and setup TLS
-	var useTls bool = true
-	if config["tls"] != "" {
-		if parsedTls, err := strconv.ParseBool(config["tls"]); err == nil {
-			useTls = parsedTls
-		} else {
-			log.Println("[error] KafkaConsumer: Could not parse 'tls' parameter, using default true.")
-		}
-	} else {
-		log.Println("[info] KafkaConsumer: 'tls' set to default true.")
-	}
-	newsegment.Tls = useTls
-	if newsegment.Tls {
-		rootCAs, err := x509.SystemCertPool()
-		if err != nil {
-			log.Panicf("TLS Error: %v", err)
-		}
-		newsegment.saramaConfig.Net.TLS.Enable = true
-		newsegment.saramaConfig.Net.TLS.Config = &tls.Config{RootCAs: rootCAs}
-	} else {
-		log.Println("[info] KafkaConsumer: Disabled TLS, operating unencrypted.")
-	}
-
-	// parse config and setup auth
-	var useAuth bool = true
-	if config["auth"] != "" {
-		if parsedAuth, err := strconv.ParseBool(config["auth"]); err == nil {
-			useAuth = parsedAuth
-		} else {
-			log.Println("[error] KafkaConsumer: Could not parse 'auth' parameter, using default true.")
-		}
-	} else {
-		log.Println("[info] KafkaConsumer: 'auth' set to default true.")
-	}
-
-	// parse and configure credentials, if applicable
-	if useAuth && (config["user"] == "" || config["pass"] == "") {
-		log.Println("[error] KafkaConsumer: Missing required configuration parameters for auth.")
-		return nil
-	} else {
-		newsegment.User = config["user"]
-		newsegment.Pass = config["pass"]
-	}
-
-	// use these credentials
-	newsegment.Auth = useAuth
-	if newsegment.Auth {
-		newsegment.saramaConfig.Net.SASL.Enable = true
-		newsegment.saramaConfig.Net.SASL.User = newsegment.User
-		newsegment.saramaConfig.Net.SASL.Password = newsegment.Pass
-		log.Printf("[info] KafkaConsumer: Authenticating as user '%s'.", newsegment.User)
-	} else {
-		newsegment.saramaConfig.Net.SASL.Enable = false
-		log.Println("[info] KafkaConsumer: Disabled auth.")
-	}
-
-	// warn if we're leaking credentials
-	if newsegment.Auth && !newsegment.Tls {
-		log.Println("[warning] KafkaConsumer: Authentication will be done in plain text!")
+	// parse and set up the connection
+	if newsegment.Connection, err = kafka.NewConnection("KafkaConsumer", config, newsegment.saramaConfig); err != nil {
+		return nil, err
 	}
 
 	// parse and set starting point of fresh consumer groups
 	startAt := "newest"
 	var startingOffset int64 = sarama.OffsetNewest // see sarama const OffsetNewest
+	var startTime time.Time
 	if config["startat"] != "" {
 		if strings.ToLower(config["startat"]) == "oldest" {
 			startAt = "oldest"
 			startingOffset = sarama.OffsetOldest // see sarama const OffsetOldest
 			log.Println("[info] KafkaConsumer: Starting at oldest flows.")
+		} else if startTime, err = time.Parse(time.RFC3339, config["startat"]); err == nil {
+			startAt = config["startat"]
+			startingOffset = startTime.UnixMilli() // looked up by the handler
+			log.Printf("[info] KafkaConsumer: Starting at flows from %s on.", startTime)
 		} else if strings.ToLower(config["startat"]) != "newest" {
-			log.Println("[error] KafkaConsumer: Could not parse 'startat' parameter, using default 'newest'.")
+			log.Println("[error] KafkaConsumer: Could not parse 'startat' parameter as 'oldest', 'newest' or an RFC3339 timestamp, using default 'newest'.")
 		}
 	} else {
 		log.Println("[info] KafkaConsumer: 'startat' set to default 'newest'.")
 	}
 	newsegment.startingOffset = startingOffset
-	newsegment.saramaConfig.Consumer.Offsets.Initial = startingOffset
+	if startingOffset < 0 {
+		newsegment.saramaConfig.Consumer.Offsets.Initial = startingOffset
+	}
 	newsegment.StartAt = startAt
 
+	if config["endat"] != "" {
+		if newsegment.EndAt, err = time.Parse(time.RFC3339, config["endat"]); err != nil {
+			return nil, segments.NewConfigError("endat", "could not be parsed as an RFC3339 timestamp: %v", err)
+		}
+		if !startTime.IsZero() && !newsegment.EndAt.After(startTime) {
+			return nil, segments.NewConfigError("endat", "needs to be after startat")
+		}
+		log.Printf("[info] KafkaConsumer: Closing the pipeline once all flows before %s are consumed.", newsegment.EndAt)
+	}
+
+	if config["resetoffsets"] != "" {
+		if newsegment.ResetOffsets, err = strconv.ParseBool(config["resetoffsets"]); err != nil {
+			return nil, segments.NewConfigError("resetoffsets", "could not be parsed as a bool: %v", err)
+		}
+	}
+	if newsegment.ResetOffsets {
+		log.Printf("[warning] KafkaConsumer: Resetting the offsets of consumer group '%s' to '%s'.", newsegment.Group, newsegment.StartAt)
+	}
+
 	newsegment.Timeout = 15 * time.Second
 	if timeout, err := time.ParseDuration(config["timeout"]); err == nil {
 		newsegment.Timeout = timeout
@@ -150,33 +127,175 @@ func (segment KafkaConsumer) New(config map[string]string) segments.Segment {
 		}
 	}
 	newsegment.saramaConfig.Net.DialTimeout = newsegment.Timeout
-	return newsegment
+
+	if config["ack"] != "" {
+		if newsegment.Ack, err = strconv.ParseBool(config["ack"]); err != nil {
+			return nil, segments.NewConfigError("ack", "could not be parsed as a bool: %v", err)
+		}
+	}
+	newsegment.AckTimeout = 30 * time.Second
+	if config["acktimeout"] != "" {
+		if newsegment.AckTimeout, err = time.ParseDuration(config["acktimeout"]); err != nil {
+			return nil, segments.NewConfigError("acktimeout", "could not be parsed as a duration: %v", err)
+		}
+	}
+	if newsegment.Ack {
+		log.Println("[info] KafkaConsumer: Committing offsets only once flows are acknowledged.")
+	}
+
+	// parse the format of each topic
+	newsegment.Format = string(pb.FormatEnrichedFlow)
+	if config["format"] != "" {
+		newsegment.Format = config["format"]
+	}
+	topics := strings.Split(newsegment.Topic, ",")
+	formats := strings.Split(newsegment.Format, ",")
+	if len(formats) != 1 && len(formats) != len(topics) {
+		return nil, segments.NewConfigError("format", "lists %d formats for %d topics, use either a single format for all topics or one per topic", len(formats), len(topics))
+	}
+	newsegment.formats = make(map[string]pb.Format)
+	for i, topic := range topics {
+		format := pb.Format(formats[0])
+		if len(formats) > 1 {
+			format = pb.Format(formats[i])
+		}
+		if err := format.Check(); err != nil {
+			return nil, segments.NewConfigError("format", "%v", err)
+		}
+		newsegment.formats[topic] = format
+	}
+
+	if config["lagwarning"] != "" {
+		if newsegment.LagWarning, err = strconv.ParseInt(config["lagwarning"], 10, 64); err != nil {
+			return nil, segments.NewConfigError("lagwarning", "could not be parsed as an integer: %v", err)
+		}
+	}
+	newsegment.metrics = newConsumerMetrics(newsegment.LagWarning)
+	return newsegment, nil
+}
+
+// Requests the Pipeline to track flows if offsets are to be committed only
+// once flows are acknowledged.
+func (segment *KafkaConsumer) TracksFlows() bool {
+	return segment.Ack
+}
+
+// Takes over the consumer group session of the predecessor instead of
+// joining anew, which avoids a rebalance during a reload.
+func (segment *KafkaConsumer) Retain(predecessor segments.Segment) {
+	if predecessor, ok := predecessor.(*KafkaConsumer); ok {
+		predecessor.retained.Store(true)
+		segment.predecessor = predecessor
+		segment.metrics = predecessor.metrics // updated by the predecessor's handler
+	}
 }
 
 func (segment *KafkaConsumer) Run(wg *sync.WaitGroup) {
-	defer func() {
+	defer wg.Done()
+
+	if segment.predecessor != nil {
+		segment.saramaClient = segment.predecessor.saramaClient
+		segment.client = segment.predecessor.client
+		segment.handler = segment.predecessor.handler
+		segment.handlerCancel = segment.predecessor.handlerCancel
+		segment.handlerWg = segment.predecessor.handlerWg
+		segment.predecessor = nil
+		log.Println("[info] KafkaConsumer: Took over consumer group session from the previous configuration.")
+	} else if err := segment.startConsumerGroup(); err != nil {
+		segment.ShutdownParentPipelineWithError(err)
+		for msg := range segment.In { // keep passing flows until we are closed
+			segment.Out <- msg
+		}
 		close(segment.Out)
-		wg.Done()
-	}()
+		return
+	} else {
+		log.Println("[info] KafkaConsumer: Connected and operational.")
+	}
 
-	client, err := sarama.NewConsumerGroup(strings.Split(segment.Server, ","), segment.Group, segment.saramaConfig)
-	if err != nil {
-		if client == nil {
-			log.Fatalf("[error] KafkaConsumer: Creating Kafka client failed, this indicates an unreachable server, invalid credentials, or a SSL problem. Original error:\n  %v", err)
-		} else {
-			log.Fatalf("[error] KafkaConsumer: Creating Kafka consumer group failed while the connection was okay. Original error:\n  %v", err)
+	segment.receive()
+	// Close our output before the handler, such that the following
+	// segments pass on any flows in transit while it waits for their
+	// acknowledgements.
+	close(segment.Out)
+	if segment.retained.Load() {
+		return
+	}
+	segment.handlerCancel() // Trigger handler shutdown and cleanup
+	segment.handlerWg.Wait()
+	if err := segment.client.Close(); err != nil {
+		log.Panicf("[error] KafkaConsumer: Error closing Kafka consumer group: %v", err)
+	}
+	if err := segment.saramaClient.Close(); err != nil {
+		log.Panicf("[error] KafkaConsumer: Error closing Kafka client: %v", err)
+	}
+}
+
+// Passes on the flows received by the handler as well as those from our
+// input, until the latter is closed.
+func (segment *KafkaConsumer) receive() {
+	ended := segment.handler.ended
+	for {
+		select {
+		case <-ended:
+			segment.ShutdownParentPipeline()
+			ended = nil // keep passing flows until we are closed
+		case consumed, ok := <-segment.handler.flows:
+			if !ok {
+				// This will occur during a rebalance when the handler calls its Cleanup method
+				continue
+			}
+			if consumed.ack != nil {
+				segment.Track(consumed.msg, consumed.ack)
+			}
+			segment.Out <- consumed.msg
+		case msg, ok := <-segment.In:
+			if !ok {
+				return
+			} else {
+				segment.Out <- msg
+			}
 		}
 	}
+}
+
+// Joins the consumer group and starts consuming in the background. Returns
+// once the first session has been set up, or an error if the group could not
+// be joined.
+func (segment *KafkaConsumer) startConsumerGroup() error {
+	saramaClient, err := sarama.NewClient(strings.Split(segment.Server, ","), segment.saramaConfig)
+	if err != nil {
+		return fmt.Errorf("KafkaConsumer: Creating Kafka client failed, this indicates an unreachable server, invalid credentials, or a SSL problem: %w", err)
+	}
+	client, err := sarama.NewConsumerGroupFromClient(segment.Group, saramaClient)
+	if err != nil {
+		saramaClient.Close()
+		return fmt.Errorf("KafkaConsumer: Creating Kafka consumer group failed while the connection was okay: %w", err)
+	}
+	segment.saramaClient = saramaClient
+	segment.client = client
 
 	handlerCtx, handlerCancel := context.WithCancel(context.Background())
 	var handler = &Handler{
-		ready: make(chan bool),
-		flows: make(chan *pb.EnrichedFlow),
+		ready:      make(chan bool),
+		flows:      make(chan consumedFlow),
+		formats:    segment.formats,
+		ack:        segment.Ack,
+		ackTimeout: segment.AckTimeout,
+		metrics:    segment.metrics,
+		client:     saramaClient,
+		group:      segment.Group,
+		startAt:    segment.startingOffset,
+		reset:      segment.ResetOffsets,
+		wasReset:   make(map[topicPartition]bool),
+		endAt:      segment.EndAt,
+		ended:      make(chan struct{}),
 	}
-	handlerWg := sync.WaitGroup{}
-	handlerWg.Add(1)
+	segment.handler = handler
+	segment.handlerCancel = handlerCancel
+	segment.handlerWg = &sync.WaitGroup{}
+	segment.handlerWg.Add(1)
 	go func() {
-		defer handlerWg.Done()
+		defer segment.handlerWg.Done()
 		for {
 			// This loop ensures recreation of our consumer session when server-side rebalances happen.
 			if err := client.Consume(handlerCtx, strings.Split(segment.Topic, ","), handler); err != nil {
@@ -191,37 +310,36 @@ func (segment *KafkaConsumer) Run(wg *sync.WaitGroup) {
 			handler.ready = make(chan bool) // TODO: this is from the official example, not sure it is necessary in out case
 		}
 	}()
-	<-handler.ready
-	log.Println("[info] KafkaConsumer: Connected and operational.")
-
-	defer func() {
-		handlerWg.Wait()
-		if err = client.Close(); err != nil {
-			log.Panicf("[error] KafkaConsumer: Error closing Kafka client: %v", err)
-		}
+	segment.handlerWg.Add(1)
+	go func() {
+		defer segment.handlerWg.Done()
+		segment.metrics.watchHighWaterMarks(handlerCtx, saramaClient)
 	}()
-
-	// receive flows in a loop
-	for {
-		select {
-		case msg, ok := <-handler.flows:
-			if !ok {
-				// This will occur during a rebalance when the handler calls its Cleanup method
-				continue
-			}
-			segment.Out <- msg
-		case msg, ok := <-segment.In:
-			if !ok {
-				handlerCancel() // Trigger handler shutdown and cleanup
-				return
-			} else {
-				segment.Out <- msg
-			}
-		}
-	}
+	<-handler.ready
+	return nil
 }
 
 func init() {
+	params := []segments.Param{
+		{Name: "server", Required: true, Doc: "A comma separated list of Kafka brokers."},
+		{Name: "topic", Required: true, Doc: "The topic to consume from, or a comma separated list of topics."},
+		{Name: "group", Required: true, Doc: "The consumer group to use."},
+	}
+	params = append(params, kafka.Params...)
+	params = append(params,
+		segments.Param{Name: "startat", Default: "newest", Doc: "Where to start consuming if the consumer group has no stored offset, either newest, oldest or an RFC3339 timestamp."},
+		segments.Param{Name: "endat", Doc: "An RFC3339 timestamp to stop consuming at, closing the pipeline once all flows before it are consumed."},
+		segments.Param{Name: "resetoffsets", Type: segments.TypeBool, Default: "false", Doc: "Whether to start at startat even if the consumer group has stored offsets."},
+		segments.Param{Name: "timeout", Type: segments.TypeDuration, Default: "15s", Doc: "The timeout for connecting to Kafka."},
+		segments.Param{Name: "format", Default: "enrichedflow", Doc: "The format of the flows, either one for all topics or a comma separated list of one per topic. One of enrichedflow, bwnetflow-legacy, goflow2, json, or length-delimited."},
+		segments.Param{Name: "ack", Type: segments.TypeBool, Default: "false", Doc: "Whether to commit offsets only once flows have been fully processed by the pipeline."},
+		segments.Param{Name: "acktimeout", Type: segments.TypeDuration, Default: "30s", Doc: "How long to wait for flows to be acknowledged when partitions are revoked or on shutdown."},
+		segments.Param{Name: "lagwarning", Type: segments.TypeInt, Default: "0", Doc: "The number of messages a partition may lag behind before a warning is logged, 0 disables the warning."},
+	)
 	segment := &KafkaConsumer{}
 	segments.RegisterSegment("kafkaconsumer", segment)
+	segments.RegisterSchema("kafkaconsumer", segments.Schema{
+		Summary: "Consumes flows from a Kafka topic.",
+		Params:  params,
+	})
 }
@@ -2,27 +2,63 @@ package kafkaconsumer
 
 import (
 	"testing"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
 )
 
 func TestSegment_KafkaConsumer_instanciation(t *testing.T) {
 	kafkaConsumer := &KafkaConsumer{}
-	result := kafkaConsumer.New(map[string]string{})
-	if result != nil {
+	_, err := kafkaConsumer.New(map[string]string{})
+	if err == nil {
 		t.Error("Segment KafkaConsumer intiated successfully despite bad base config.")
 	}
 
-	result = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "tls": "1"})
-	if result != nil {
+	_, err = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "tls": "1"})
+	if err == nil {
 		t.Error("Segment KafkaConsumer intiated successfully despite bad auth config.")
 	}
 
-	result = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "tls": "4", "auth": "maybe"})
-	if result != nil {
+	_, err = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "tls": "4", "auth": "maybe"})
+	if err == nil {
 		t.Error("Segment KafkaConsumer intiated successfully despite bad booleans in config.")
 	}
 
-	result = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "auth": "0"})
-	if result == nil {
+	_, err = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "auth": "0"})
+	if err != nil {
 		t.Error("Segment KafkaConsumer did not initiate successfully.")
 	}
+
+	_, err = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh,dah", "group": "yolo", "auth": "0", "format": "goflow2,json,json"})
+	if err == nil {
+		t.Error("Segment KafkaConsumer intiated successfully despite more formats than topics.")
+	}
+
+	_, err = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "auth": "0", "format": "protobuf"})
+	if err == nil {
+		t.Error("Segment KafkaConsumer intiated successfully despite an unknown format.")
+	}
+
+	_, err = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "auth": "0", "startat": "2023-01-02T00:00:00Z", "endat": "2023-01-01T00:00:00Z"})
+	if err == nil {
+		t.Error("Segment KafkaConsumer intiated successfully despite ending before its start.")
+	}
+
+	segment, err := kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "auth": "0", "startat": "2023-01-01T00:00:00Z", "endat": "2023-01-01T01:00:00+01:00"})
+	if err == nil {
+		t.Error("Segment KafkaConsumer intiated successfully despite ending at its start.")
+	}
+
+	segment, err = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh", "group": "yolo", "auth": "0", "startat": "2023-01-01T00:00:00Z", "endat": "2023-01-01T01:00:00Z"})
+	if err != nil {
+		t.Error("Segment KafkaConsumer did not initiate successfully with startat and endat.")
+	} else if consumer := segment.(*KafkaConsumer); consumer.startingOffset != 1672531200000 || consumer.EndAt.Unix() != 1672534800 {
+		t.Errorf("Segment KafkaConsumer parsed timestamps as %d and %s.", consumer.startingOffset, consumer.EndAt)
+	}
+
+	segment, err = kafkaConsumer.New(map[string]string{"server": "doh", "topic": "duh,dah", "group": "yolo", "auth": "0", "format": "bwnetflow-legacy,enrichedflow"})
+	if err != nil {
+		t.Error("Segment KafkaConsumer did not initiate successfully with a format per topic.")
+	} else if formats := segment.(*KafkaConsumer).formats; formats["duh"] != pb.FormatLegacy || formats["dah"] != pb.FormatEnrichedFlow {
+		t.Errorf("Segment KafkaConsumer assigned wrong formats to topics: %v", formats)
+	}
 }
@@ -0,0 +1,240 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The interval at which the high-water marks of claimed partitions are looked
+// up, in addition to updating them for each message consumed.
+const highWaterMarkInterval = 10 * time.Second
+
+// The metrics of a consumer, which are kept across reloads along with its
+// consumer group.
+type consumerMetrics struct {
+	lagWarning int64 // the lag above which a warning is logged, 0 disables it
+
+	lock         sync.Mutex
+	partitions   map[topicPartition]*partitionMetrics // the partitions claimed currently
+	sessions     uint64
+	rebalances   uint64
+	decodeErrors map[string]uint64 // by topic
+}
+
+type partitionMetrics struct {
+	offset        int64 // the offset of the last message consumed
+	highWaterMark int64 // the offset of the next message produced to the partition
+	lagging       bool  // set while the lag exceeds the warning threshold
+}
+
+// Returns the number of messages produced to the partition after the one
+// consumed last.
+func (p *partitionMetrics) lag() int64 {
+	if lag := p.highWaterMark - p.offset - 1; lag > 0 {
+		return lag
+	}
+	return 0
+}
+
+func newConsumerMetrics(lagWarning int64) *consumerMetrics {
+	return &consumerMetrics{
+		lagWarning:   lagWarning,
+		partitions:   make(map[topicPartition]*partitionMetrics),
+		decodeErrors: make(map[string]uint64),
+	}
+}
+
+// Called at the start of each session, any session but the first one results
+// from a rebalance. Forgets about partitions which are not claimed anymore.
+func (m *consumerMetrics) sessionStarted(claims map[string][]int32) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.sessions > 0 {
+		m.rebalances++
+	}
+	m.sessions++
+	claimed := make(map[topicPartition]bool)
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			claimed[topicPartition{topic: topic, partition: partition}] = true
+		}
+	}
+	for key := range m.partitions {
+		if !claimed[key] {
+			delete(m.partitions, key)
+		}
+	}
+}
+
+// Called once a claim starts at a known offset, which makes its lag available
+// before any message is consumed from it.
+func (m *consumerMetrics) claimed(topic string, partition int32, initialOffset int64) {
+	if initialOffset < 0 { // oldest or newest, resolved on the first message
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := topicPartition{topic: topic, partition: partition}
+	if _, ok := m.partitions[key]; !ok {
+		m.partitions[key] = &partitionMetrics{offset: initialOffset - 1, highWaterMark: initialOffset}
+	}
+}
+
+// Called for each message consumed, logs a warning once the partition's lag
+// exceeds the configured threshold.
+func (m *consumerMetrics) consumed(topic string, partition int32, offset int64, highWaterMark int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := topicPartition{topic: topic, partition: partition}
+	p, ok := m.partitions[key]
+	if !ok {
+		p = &partitionMetrics{}
+		m.partitions[key] = p
+	}
+	p.offset, p.highWaterMark = offset, highWaterMark
+	m.checkLag(key, p)
+}
+
+// Looks up the high-water marks of all claimed partitions periodically until
+// the context is canceled. This keeps their lag current while no messages
+// are consumed, such as when the pipeline is stalled.
+func (m *consumerMetrics) watchHighWaterMarks(ctx context.Context, client sarama.Client) {
+	ticker := time.NewTicker(highWaterMarkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.refreshHighWaterMarks(client.GetOffset)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Updates the high-water marks of all claimed partitions using the given
+// lookup, which is called with sarama.OffsetNewest, and checks their lag.
+func (m *consumerMetrics) refreshHighWaterMarks(getOffset func(topic string, partition int32, at int64) (int64, error)) {
+	m.lock.Lock()
+	keys := make([]topicPartition, 0, len(m.partitions))
+	for key := range m.partitions {
+		keys = append(keys, key)
+	}
+	m.lock.Unlock()
+	for _, key := range keys { // without holding the lock during lookups
+		highWaterMark, err := getOffset(key.topic, key.partition, sarama.OffsetNewest)
+		if err != nil {
+			continue // retried on the next refresh
+		}
+		m.lock.Lock()
+		if p, ok := m.partitions[key]; ok && highWaterMark > p.highWaterMark {
+			p.highWaterMark = highWaterMark
+			m.checkLag(key, p)
+		}
+		m.lock.Unlock()
+	}
+}
+
+// Logs a warning once the partition's lag exceeds the configured threshold,
+// and a notice once it drops below it again. Requires the lock to be held.
+func (m *consumerMetrics) checkLag(key topicPartition, p *partitionMetrics) {
+	if m.lagWarning <= 0 {
+		return
+	}
+	if lag := p.lag(); lag > m.lagWarning && !p.lagging {
+		log.Printf("[warning] KafkaConsumer: Partition %d of topic '%s' lags behind by %d messages.", key.partition, key.topic, lag)
+		p.lagging = true
+	} else if lag <= m.lagWarning && p.lagging {
+		log.Printf("[info] KafkaConsumer: Partition %d of topic '%s' caught up to a lag of %d messages.", key.partition, key.topic, lag)
+		p.lagging = false
+	}
+}
+
+func (m *consumerMetrics) decodeFailed(topic string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.decodeErrors[topic]++
+}
+
+// Exposes the metrics of a consumer, see Collector.
+type consumerCollector struct {
+	metrics       *consumerMetrics
+	offset        *prometheus.Desc
+	highWaterMark *prometheus.Desc
+	lag           *prometheus.Desc
+	rebalances    *prometheus.Desc
+	decodeErrors  *prometheus.Desc
+}
+
+// Returns a collector of this segment's metrics, see segments.MetricsSource.
+func (segment *KafkaConsumer) Collector(labels prometheus.Labels) prometheus.Collector {
+	partitionLabels := []string{"topic", "partition"}
+	return &consumerCollector{
+		metrics: segment.metrics,
+		offset: prometheus.NewDesc(
+			"flowpipeline_kafkaconsumer_offset",
+			"Offset of the message consumed last from a partition.",
+			partitionLabels, labels,
+		),
+		highWaterMark: prometheus.NewDesc(
+			"flowpipeline_kafkaconsumer_high_water_mark",
+			"Offset of the next message produced to a partition.",
+			partitionLabels, labels,
+		),
+		lag: prometheus.NewDesc(
+			"flowpipeline_kafkaconsumer_lag",
+			"Number of messages in a partition which have not been consumed yet.",
+			partitionLabels, labels,
+		),
+		rebalances: prometheus.NewDesc(
+			"flowpipeline_kafkaconsumer_rebalances_total",
+			"Number of rebalances of the consumer group.",
+			nil, labels,
+		),
+		decodeErrors: prometheus.NewDesc(
+			"flowpipeline_kafkaconsumer_decode_errors_total",
+			"Number of messages from a topic which could not be decoded.",
+			[]string{"topic"}, labels,
+		),
+	}
+}
+
+func (c *consumerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.offset
+	ch <- c.highWaterMark
+	ch <- c.lag
+	ch <- c.rebalances
+	ch <- c.decodeErrors
+}
+
+func (c *consumerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.metrics.lock.Lock()
+	defer c.metrics.lock.Unlock()
+	keys := make([]topicPartition, 0, len(c.metrics.partitions))
+	for key := range c.metrics.partitions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].topic != keys[j].topic {
+			return keys[i].topic < keys[j].topic
+		}
+		return keys[i].partition < keys[j].partition
+	})
+	for _, key := range keys {
+		p := c.metrics.partitions[key]
+		partition := strconv.Itoa(int(key.partition))
+		ch <- prometheus.MustNewConstMetric(c.offset, prometheus.GaugeValue, float64(p.offset), key.topic, partition)
+		ch <- prometheus.MustNewConstMetric(c.highWaterMark, prometheus.GaugeValue, float64(p.highWaterMark), key.topic, partition)
+		ch <- prometheus.MustNewConstMetric(c.lag, prometheus.GaugeValue, float64(p.lag()), key.topic, partition)
+	}
+	ch <- prometheus.MustNewConstMetric(c.rebalances, prometheus.CounterValue, float64(c.metrics.rebalances))
+	for topic, count := range c.metrics.decodeErrors {
+		ch <- prometheus.MustNewConstMetric(c.decodeErrors, prometheus.CounterValue, float64(count), topic)
+	}
+}
@@ -0,0 +1,79 @@
+package kafkaconsumer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConsumerMetrics(t *testing.T) {
+	metrics := newConsumerMetrics(100)
+	metrics.sessionStarted(map[string][]int32{"flows": {0, 1}})
+	metrics.consumed("flows", 0, 41, 42)
+	metrics.consumed("flows", 1, 9, 210)
+	if !metrics.partitions[topicPartition{"flows", 1}].lagging {
+		t.Error("Partition 1 is not marked as lagging despite a lag of 200 messages.")
+	}
+	metrics.consumed("flows", 1, 150, 210)
+	if metrics.partitions[topicPartition{"flows", 1}].lagging {
+		t.Error("Partition 1 is still marked as lagging despite a lag of 59 messages.")
+	}
+	metrics.decodeFailed("flows")
+	metrics.sessionStarted(map[string][]int32{"flows": {1}}) // partition 0 was revoked
+
+	segment := &KafkaConsumer{metrics: metrics}
+	collector := segment.Collector(prometheus.Labels{"path": "0", "segment": "kafkaconsumer"})
+	expected := `
+# HELP flowpipeline_kafkaconsumer_decode_errors_total Number of messages from a topic which could not be decoded.
+# TYPE flowpipeline_kafkaconsumer_decode_errors_total counter
+flowpipeline_kafkaconsumer_decode_errors_total{path="0",segment="kafkaconsumer",topic="flows"} 1
+# HELP flowpipeline_kafkaconsumer_lag Number of messages in a partition which have not been consumed yet.
+# TYPE flowpipeline_kafkaconsumer_lag gauge
+flowpipeline_kafkaconsumer_lag{partition="1",path="0",segment="kafkaconsumer",topic="flows"} 59
+# HELP flowpipeline_kafkaconsumer_offset Offset of the message consumed last from a partition.
+# TYPE flowpipeline_kafkaconsumer_offset gauge
+flowpipeline_kafkaconsumer_offset{partition="1",path="0",segment="kafkaconsumer",topic="flows"} 150
+# HELP flowpipeline_kafkaconsumer_rebalances_total Number of rebalances of the consumer group.
+# TYPE flowpipeline_kafkaconsumer_rebalances_total counter
+flowpipeline_kafkaconsumer_rebalances_total{path="0",segment="kafkaconsumer"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"flowpipeline_kafkaconsumer_decode_errors_total",
+		"flowpipeline_kafkaconsumer_lag",
+		"flowpipeline_kafkaconsumer_offset",
+		"flowpipeline_kafkaconsumer_rebalances_total",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConsumerMetrics_refreshHighWaterMarks(t *testing.T) {
+	metrics := newConsumerMetrics(100)
+	metrics.sessionStarted(map[string][]int32{"flows": {0, 1}})
+	metrics.claimed("flows", 0, 42)
+	metrics.claimed("flows", 1, sarama.OffsetNewest)
+	if _, ok := metrics.partitions[topicPartition{"flows", 1}]; ok {
+		t.Error("Partition 1 is reported before its offset is known.")
+	}
+	highWaterMarks := map[int32]int64{0: 500, 1: 10}
+	metrics.refreshHighWaterMarks(func(topic string, partition int32, at int64) (int64, error) {
+		if at != sarama.OffsetNewest {
+			t.Errorf("High-water mark of partition %d was looked up at %d.", partition, at)
+		}
+		return highWaterMarks[partition], nil
+	})
+	p := metrics.partitions[topicPartition{"flows", 0}]
+	if p.lag() != 458 || !p.lagging {
+		t.Errorf("Partition 0 reports a lag of %d (lagging: %v) instead of 458 without consuming any messages.", p.lag(), p.lagging)
+	}
+	metrics.refreshHighWaterMarks(func(string, int32, int64) (int64, error) {
+		return 0, errors.New("unreachable")
+	})
+	if p.lag() != 458 {
+		t.Errorf("Partition 0 changed its lag to %d after a failed lookup.", p.lag())
+	}
+}
@@ -4,6 +4,7 @@
 package packet
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -49,8 +50,7 @@ func (c conf) parseOption(o opt) (error, string) {
 				log.Printf("[info] Packet: '%s' set to default '%s'.", o.Name, o.Default)
 				return nil, o.Default
 			} else {
-				log.Printf("[error] Packet: Field '%s' is required.", o.Name)
-				return fmt.Errorf("parse error"), ""
+				return segments.NewConfigError(o.Name, "is required"), ""
 			}
 		}
 		for _, option := range o.Options {
@@ -58,8 +58,7 @@ func (c conf) parseOption(o opt) (error, string) {
 				return nil, option
 			}
 		}
-		log.Printf("[error] Packet: Field '%s' must be set to a valid option: %s.", o.Name, strings.Join(o.Options, "|"))
-		return fmt.Errorf("parse error"), ""
+		return segments.NewConfigError(o.Name, "must be set to a valid option: %s", strings.Join(o.Options, "|")), ""
 	case "duration":
 		_, err := time.ParseDuration(c[o.Name])
 		if err != nil {
@@ -80,10 +79,9 @@ func (c conf) parseOption(o opt) (error, string) {
 					log.Printf("[info] Packet: '%s' set to default '%s'.", o.Name, o.Default)
 					return nil, o.Default
 				}
-				return err, ""
+				return segments.NewConfigError(o.Name, "file is not accessible: %v", err), ""
 			} else {
-				log.Printf("[error] Packet: Field '%s' is required.", o.Name)
-				return err, ""
+				return segments.NewConfigError(o.Name, "file is not accessible: %v", err), ""
 			}
 		}
 		return nil, c[o.Name]
@@ -93,41 +91,39 @@ func (c conf) parseOption(o opt) (error, string) {
 				log.Printf("[info] Packet: '%s' set to default '%s'.", o.Name, o.Default)
 				return nil, o.Default
 			} else {
-				log.Printf("[error] Packet: Field '%s' is required.", o.Name)
-				return fmt.Errorf("parse error"), ""
+				return segments.NewConfigError(o.Name, "is required"), ""
 			}
 		}
 		if _, err := net.InterfaceByName(c[o.Name]); err == nil {
 			return nil, c[o.Name]
 		}
-		log.Printf("[error] Packet: Field '%s' must be set to a valid interface.", o.Name)
-		return fmt.Errorf("parse error"), ""
+		return segments.NewConfigError(o.Name, "must be set to a valid interface"), ""
 	}
-	return fmt.Errorf("parse error"), ""
+	return segments.NewConfigError(o.Name, "unknown option type '%s'", o.Type), ""
 }
 
-func (segment Packet) New(config map[string]string) segments.Segment {
+func (segment Packet) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &Packet{}
 
 	// setup flow export
 	var err error
 	c := conf(config)
 	if err, newsegment.ActiveTimeout = c.parseOption(opt{"activetimeout", "30m", []string{}, "duration"}); err != nil {
-		return nil
+		return nil, err
 	}
 	if err, newsegment.InactiveTimeout = c.parseOption(opt{"inactivetimeout", "15s", []string{}, "duration"}); err != nil {
-		return nil
+		return nil, err
 	}
 	if err, newsegment.Method = c.parseOption(opt{"method", "pcapgo", []string{"pcapgo", "pcap", "pfring", "file"}, "option"}); err != nil {
-		return nil
+		return nil, err
 	}
 	if newsegment.Method == "file" {
 		if err, newsegment.Source = c.parseOption(opt{"source", "", []string{}, "rfile"}); err != nil {
-			return nil
+			return nil, err
 		}
 	} else {
 		if err, newsegment.Source = c.parseOption(opt{"source", "", []string{}, "iface"}); err != nil {
-			return nil
+			return nil, err
 		}
 	}
 
@@ -140,10 +136,9 @@ func (segment Packet) New(config map[string]string) segments.Segment {
 
 	newsegment.exporter, err = aggregate.NewFlowExporter(newsegment.ActiveTimeout, newsegment.InactiveTimeout)
 	if err != nil {
-		log.Printf("[error] Packet: error setting up exporter: %s", err)
-		return nil
+		return nil, &segments.ConfigError{Reason: fmt.Sprintf("error setting up exporter: %v", err)}
 	}
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *Packet) Run(wg *sync.WaitGroup) {
@@ -222,9 +217,9 @@ func (segment *Packet) Run(wg *sync.WaitGroup) {
 		segment.exporter.ConsumeFrom(pktsrc.Packets())
 		if segment.Method == "file" {
 			log.Println("[info] Packet: The pcap has ended.")
-			os.Exit(0)
+			segment.ShutdownParentPipeline()
 		} else {
-			log.Fatalln("[error] Packet: The packet stream has ended for an unknown reason.")
+			segment.ShutdownParentPipelineWithError(errors.New("Packet: The packet stream has ended for an unknown reason."))
 		}
 	}()
 
@@ -252,4 +247,14 @@ func (segment *Packet) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Packet{}
 	segments.RegisterSegment("packet", segment)
+	segments.RegisterSchema("packet", segments.Schema{
+		Summary: "Captures packets from an interface or file and emits flows from them.",
+		Params: []segments.Param{
+			{Name: "method", Default: "pcapgo", Options: []string{"pcapgo", "pcap", "pfring", "file"}, Doc: "The capture method to use."},
+			{Name: "source", Required: true, Doc: "The interface or, for method file, the file to capture from."},
+			{Name: "filter", Doc: "A BPF filter to apply to captured packets, requires CGO."},
+			{Name: "activetimeout", Type: segments.TypeDuration, Default: "30m", Doc: "The time after which active flows are exported."},
+			{Name: "inactivetimeout", Type: segments.TypeDuration, Default: "15s", Doc: "The time after which inactive flows are exported."},
+		},
+	})
 }
@@ -1,15 +1,16 @@
 // Receives flows from stdin in JSON format, as exported by the json segment.
-// This segment can also read from a file with flows in json format per each line
+// This segment can also read from a file with flows in json format per each line,
+// or with length-delimited flows in any of the binary formats.
 package stdin
 
 import (
-	"bufio"
+	"errors"
+	"io"
 	"log"
 	"strconv"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
-	"google.golang.org/protobuf/encoding/protojson"
 
 	"os"
 	"sync"
@@ -17,13 +18,14 @@ import (
 
 type StdIn struct {
 	segments.BaseSegment
-	scanner *bufio.Scanner
+	reader *pb.FlowReader
 
-	FileName  string // optional, default is empty which means read from stdin
-	EofCloses bool   // optional, default is false. Closes Pipeleine gracefully after input file was read
+	FileName  string    // optional, default is empty which means read from stdin
+	EofCloses bool      // optional, default is false. Closes Pipeleine gracefully after input file was read
+	Format    pb.Format // optional, default is json
 }
 
-func (segment StdIn) New(config map[string]string) segments.Segment {
+func (segment StdIn) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &StdIn{}
 
 	var filename string = "stdout"
@@ -33,8 +35,7 @@ func (segment StdIn) New(config map[string]string) segments.Segment {
 	if config["filename"] != "" {
 		file, err = os.Open(config["filename"])
 		if err != nil {
-			log.Printf("[error] StdIn: File specified in 'filename' is not accessible: %s", err)
-			return nil
+			return nil, segments.NewConfigError("filename", "file is not accessible: %v", err)
 		}
 		filename = config["filename"]
 		if config["eofcloses"] != "" {
@@ -50,12 +51,20 @@ func (segment StdIn) New(config map[string]string) segments.Segment {
 		file = os.Stdin
 		log.Println("[info] StdIn: 'filename' unset, using stdIn.")
 	}
-	newsegment.scanner = bufio.NewScanner(file)
+
+	newsegment.Format = pb.FormatJson
+	if config["format"] != "" {
+		newsegment.Format = pb.Format(config["format"])
+		if err := newsegment.Format.Check(); err != nil {
+			return nil, segments.NewConfigError("format", "%v", err)
+		}
+	}
+	newsegment.reader = pb.NewFlowReader(file, newsegment.Format)
 
 	newsegment.FileName = filename
 	newsegment.EofCloses = eofCloses
 
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *StdIn) Run(wg *sync.WaitGroup) {
@@ -63,25 +72,27 @@ func (segment *StdIn) Run(wg *sync.WaitGroup) {
 		close(segment.Out)
 		wg.Done()
 	}()
-	fromStdin := make(chan []byte)
+	fromStdin := make(chan *pb.EnrichedFlow)
 	go func() {
 		for {
-			scan := segment.scanner.Scan()
-			if err := segment.scanner.Err(); err != nil {
-				log.Printf("[warning] StdIn: Skipping a flow, could not read line from stdin: %v", err)
+			msg, err := segment.reader.Read()
+			if errors.Is(err, pb.ErrDecode) {
+				log.Printf("[warning] StdIn: Skipping a flow, failed to recode input to protobuf: %v", err)
 				continue
-			}
-			if segment.EofCloses && !scan && segment.scanner.Err() == nil {
-				log.Printf("[info] Reached eof of %s, closing pipeline", segment.FileName)
-				segment.ShutdownParentPipeline()
+			} else if err == io.EOF {
+				if segment.EofCloses {
+					log.Printf("[info] Reached eof of %s, closing pipeline", segment.FileName)
+					segment.ShutdownParentPipeline()
+				}
+				return
+			} else if err != nil {
+				log.Printf("[error] StdIn: Could not read from %s, no more flows will be read: %v", segment.FileName, err)
+				if segment.EofCloses {
+					segment.ShutdownParentPipelineWithError(err)
+				}
 				return
 			}
-			if len(segment.scanner.Text()) == 0 {
-				continue
-			}
-			// we need to get full representation of text and cast it to []byte
-			// because scanner.Bytes doesn't return all content.
-			fromStdin <- []byte(segment.scanner.Text())
+			fromStdin <- msg
 		}
 	}()
 	for {
@@ -91,19 +102,25 @@ func (segment *StdIn) Run(wg *sync.WaitGroup) {
 				return
 			}
 			segment.Out <- msg
-		case line := <-fromStdin:
-			msg := &pb.EnrichedFlow{}
-			err := protojson.Unmarshal(line, msg)
-			if err != nil {
-				log.Printf("[warning] StdIn: Skipping a flow, failed to recode input to protobuf: %v", err)
-				continue
-			}
+		case msg := <-fromStdin:
 			segment.Out <- msg
 		}
 	}
 }
 
 func init() {
+	var formats []string
+	for _, format := range pb.Formats {
+		formats = append(formats, string(format))
+	}
 	segment := &StdIn{}
 	segments.RegisterSegment("stdin", segment)
+	segments.RegisterSchema("stdin", segments.Schema{
+		Summary: "Reads flows from stdin or a file.",
+		Params: []segments.Param{
+			{Name: "filename", Doc: "The file to read from instead of stdin."},
+			{Name: "eofcloses", Type: segments.TypeBool, Default: "false", Doc: "Whether to shut down the pipeline after reading the file."},
+			{Name: "format", Default: "json", Options: formats, Doc: "The format of the flows, JSON is read line by line and any other format length-delimited."},
+		},
+	})
 }
@@ -1,7 +1,6 @@
 package stdin
 
 import (
-	"bufio"
 	"io/ioutil"
 	"log"
 	"os"
@@ -27,7 +26,7 @@ func BenchmarkStdin(b *testing.B) {
 	os.Stdout, _ = os.Open(os.DevNull)
 
 	segment := StdIn{
-		scanner: bufio.NewScanner(os.Stdin),
+		reader: pb.NewFlowReader(os.Stdin, pb.FormatJson),
 	}
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
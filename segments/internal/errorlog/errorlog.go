@@ -0,0 +1,65 @@
+// Provides a logger for errors which might recur for every flow, such as
+// runtime errors of user supplied code, which would flood the log otherwise.
+package errorlog
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The interval used unless configured otherwise.
+const DefaultInterval = time.Minute
+
+// Logs the first error in full and then only the number of further errors,
+// along with the latest one, at most once per interval.
+type Logger struct {
+	Prefix   string        // prepended to each line, for instance "[error] Script: "
+	Interval time.Duration // optional, default is DefaultInterval
+
+	lock     sync.Mutex
+	started  bool
+	reported time.Time // the time the count was last logged
+	count    int       // the errors not logged since
+	latest   string    // the latest one of these
+}
+
+// Logs an error, or counts it if one has been logged already.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	message := fmt.Sprintf(format, v...)
+	if !l.started {
+		l.started = true
+		l.reported = time.Now()
+		log.Printf("%s%s; further errors will be counted and not logged individually.", l.Prefix, message)
+		return
+	}
+	l.count++
+	l.latest = message
+	interval := l.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	if time.Since(l.reported) >= interval {
+		l.flush()
+	}
+}
+
+// Logs the number of errors not logged yet, if any. Segments call this once
+// they stop.
+func (l *Logger) Flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.flush()
+}
+
+func (l *Logger) flush() {
+	if l.count > 0 {
+		log.Printf("%s%d further errors occurred since %s, the latest one: %s", l.Prefix, l.count, l.reported.Format(time.RFC3339), l.latest)
+	}
+	l.reported = time.Now()
+	l.count = 0
+	l.latest = ""
+}
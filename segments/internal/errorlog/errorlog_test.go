@@ -0,0 +1,36 @@
+package errorlog
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	logger := &Logger{Prefix: "[error] Test: ", Interval: time.Hour}
+	for i := 1; i <= 3; i++ {
+		logger.Printf("error %d", i)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 || !strings.Contains(buf.String(), "[error] Test: error 1;") {
+		t.Errorf("Logger did not log only the first error, got:\n%s", buf.String())
+	}
+	logger.Flush()
+	if !strings.Contains(buf.String(), "2 further errors") || !strings.Contains(buf.String(), "the latest one: error 3") {
+		t.Errorf("Logger did not log the number of further errors, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	logger.Flush()
+	logger.Interval = time.Nanosecond
+	logger.Printf("error 4")
+	if !strings.Contains(buf.String(), "1 further errors") {
+		t.Errorf("Logger did not log the number of errors after its interval, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,231 @@
+// Provides the connection options shared by the kafkaconsumer and
+// kafkaproducer segments, which configure TLS, authentication and the
+// protocol version of their Sarama clients.
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"github.com/xdg-go/scram"
+)
+
+// The SASL mechanisms supported for authentication.
+const (
+	MechanismPlain       = "plain"
+	MechanismScramSha256 = "scram-sha-256"
+	MechanismScramSha512 = "scram-sha-512"
+)
+
+// The Kafka version used unless configured otherwise.
+const DefaultVersion = "2.4.0"
+
+// The options for connecting to Kafka, embedded by the segments using it.
+type Connection struct {
+	User               string // required if auth is true
+	Pass               string // required if auth is true
+	Tls                bool   // optional, default is true
+	Auth               bool   // optional, default is true
+	Mechanism          string // optional, one of "plain", "scram-sha-256" or "scram-sha-512", default is "plain"
+	CaFile             string // optional, default is empty which means the system's certificates
+	CertFile           string // optional, client certificate for authenticating via TLS, requires KeyFile
+	KeyFile            string // optional, key of the client certificate, requires CertFile
+	InsecureSkipVerify bool   // optional, default is false, skips the verification of the server certificate
+	Version            string // optional, default is 2.4.0
+	ClientId           string // optional, default is Sarama's default "sarama"
+}
+
+// The schema entries of the parameters parsed by NewConnection.
+var Params = []segments.Param{
+	{Name: "user", Doc: "The user to authenticate as, required if auth is enabled."},
+	{Name: "pass", Doc: "The password to authenticate with, required if auth is enabled."},
+	{Name: "tls", Type: segments.TypeBool, Default: "true", Doc: "Whether to use TLS."},
+	{Name: "auth", Type: segments.TypeBool, Default: "true", Doc: "Whether to use SASL authentication."},
+	{Name: "mechanism", Default: MechanismPlain, Options: []string{MechanismPlain, MechanismScramSha256, MechanismScramSha512}, Doc: "The SASL mechanism to authenticate with."},
+	{Name: "cafile", Doc: "A file of PEM encoded CA certificates to verify the server with instead of the system's certificates."},
+	{Name: "certfile", Doc: "A PEM encoded client certificate to authenticate with via TLS, requires keyfile."},
+	{Name: "keyfile", Doc: "The PEM encoded key of the client certificate, requires certfile."},
+	{Name: "insecureskipverify", Type: segments.TypeBool, Default: "false", Doc: "Whether to skip the verification of the server certificate."},
+	{Name: "version", Default: DefaultVersion, Doc: "The Kafka protocol version to use."},
+	{Name: "clientid", Default: "sarama", Doc: "The client id sent to Kafka with each request."},
+}
+
+// Parses the connection options from a segment's config and applies them to
+// the given Sarama config. The name is used to prefix any log messages.
+func NewConnection(name string, config map[string]string, saramaConfig *sarama.Config) (Connection, error) {
+	var err error
+	connection := Connection{}
+
+	connection.Version = DefaultVersion
+	if config["version"] != "" {
+		connection.Version = config["version"]
+	}
+	saramaConfig.Version, err = sarama.ParseKafkaVersion(connection.Version)
+	if err != nil {
+		return connection, segments.NewConfigError("version", "error parsing Kafka version: %v", err)
+	}
+
+	if config["clientid"] != "" {
+		saramaConfig.ClientID = config["clientid"]
+	}
+	connection.ClientId = saramaConfig.ClientID
+
+	// parse config and setup TLS
+	var useTls bool = true
+	if config["tls"] != "" {
+		if parsedTls, err := strconv.ParseBool(config["tls"]); err == nil {
+			useTls = parsedTls
+		} else {
+			log.Printf("[error] %s: Could not parse 'tls' parameter, using default true.", name)
+		}
+	} else {
+		log.Printf("[info] %s: 'tls' set to default true.", name)
+	}
+	connection.Tls = useTls
+	if config["insecureskipverify"] != "" {
+		if connection.InsecureSkipVerify, err = strconv.ParseBool(config["insecureskipverify"]); err != nil {
+			return connection, segments.NewConfigError("insecureskipverify", "could not be parsed as a bool: %v", err)
+		}
+	}
+	connection.CaFile = config["cafile"]
+	connection.CertFile = config["certfile"]
+	connection.KeyFile = config["keyfile"]
+	if (connection.CertFile == "") != (connection.KeyFile == "") {
+		return connection, segments.NewConfigError("certfile", "the parameters 'certfile' and 'keyfile' need to be set together")
+	}
+	if connection.Tls {
+		tlsConfig, err := connection.tlsConfig()
+		if err != nil {
+			return connection, err
+		}
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+		if connection.InsecureSkipVerify {
+			log.Printf("[warning] %s: Skipping the verification of the server certificate!", name)
+		}
+		if connection.CertFile != "" {
+			log.Printf("[info] %s: Authenticating with client certificate '%s'.", name, connection.CertFile)
+		}
+	} else if connection.CaFile != "" || connection.CertFile != "" || connection.InsecureSkipVerify {
+		return connection, segments.NewConfigError("tls", "the parameters 'cafile', 'certfile', 'keyfile' and 'insecureskipverify' require TLS")
+	} else {
+		log.Printf("[info] %s: Disabled TLS, operating unencrypted.", name)
+	}
+
+	// parse config and setup auth
+	var useAuth bool = true
+	if config["auth"] != "" {
+		if parsedAuth, err := strconv.ParseBool(config["auth"]); err == nil {
+			useAuth = parsedAuth
+		} else {
+			log.Printf("[error] %s: Could not parse 'auth' parameter, using default true.", name)
+		}
+	} else {
+		log.Printf("[info] %s: 'auth' set to default true.", name)
+	}
+
+	// parse and configure credentials, if applicable
+	if useAuth && (config["user"] == "" || config["pass"] == "") {
+		return connection, segments.NewConfigError("auth", "the parameters 'user' and 'pass' are required unless auth is disabled")
+	} else {
+		connection.User = config["user"]
+		connection.Pass = config["pass"]
+	}
+
+	// use these credentials
+	connection.Auth = useAuth
+	connection.Mechanism = MechanismPlain
+	if config["mechanism"] != "" {
+		connection.Mechanism = config["mechanism"]
+	}
+	if connection.Mechanism != MechanismPlain && connection.Mechanism != MechanismScramSha256 && connection.Mechanism != MechanismScramSha512 {
+		return connection, segments.NewConfigError("mechanism", "unknown SASL mechanism '%s', valid mechanisms are %s, %s and %s", connection.Mechanism, MechanismPlain, MechanismScramSha256, MechanismScramSha512)
+	}
+	if connection.Auth {
+		saramaConfig.Net.SASL.Enable = true
+		saramaConfig.Net.SASL.User = connection.User
+		saramaConfig.Net.SASL.Password = connection.Pass
+		switch connection.Mechanism {
+		case MechanismPlain:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case MechanismScramSha256:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hashGenerator: scram.SHA256}
+			}
+		case MechanismScramSha512:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hashGenerator: scram.SHA512}
+			}
+		}
+		log.Printf("[info] %s: Authenticating as user '%s' using %s.", name, connection.User, connection.Mechanism)
+	} else {
+		saramaConfig.Net.SASL.Enable = false
+		log.Printf("[info] %s: Disabled auth.", name)
+	}
+
+	// warn if we're leaking credentials
+	if connection.Auth && !connection.Tls {
+		log.Printf("[warning] %s: Authentication will be done in plain text!", name)
+	}
+	return connection, nil
+}
+
+// Builds the TLS config from the configured certificate files.
+func (connection Connection) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: connection.InsecureSkipVerify}
+	if connection.CaFile != "" {
+		pem, err := os.ReadFile(connection.CaFile)
+		if err != nil {
+			return nil, segments.NewConfigError("cafile", "file is not accessible: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, segments.NewConfigError("cafile", "file '%s' contains no PEM encoded certificates", connection.CaFile)
+		}
+	} else {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, segments.NewConfigError("tls", "could not load system certificates: %v", err)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if connection.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(connection.CertFile, connection.KeyFile)
+		if err != nil {
+			return nil, segments.NewConfigError("certfile", "could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Implements sarama.SCRAMClient using a conversation of the scram package.
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+func (client *scramClient) Begin(userName, password, authzID string) error {
+	newClient, err := client.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return fmt.Errorf("could not set up SCRAM client: %w", err)
+	}
+	client.conversation = newClient.NewConversation()
+	return nil
+}
+
+func (client *scramClient) Step(challenge string) (string, error) {
+	return client.conversation.Step(challenge)
+}
+
+func (client *scramClient) Done() bool {
+	return client.conversation.Done()
+}
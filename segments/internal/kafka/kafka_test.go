@@ -0,0 +1,56 @@
+package kafka
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestNewConnection(t *testing.T) {
+	saramaConfig := sarama.NewConfig()
+	connection, err := NewConnection("Test", map[string]string{"user": "u", "pass": "p", "mechanism": "scram-sha-512", "version": "3.3.1", "clientid": "flowpipeline"}, saramaConfig)
+	if err != nil {
+		t.Fatalf("Connection could not be set up: %v", err)
+	}
+	if !connection.Tls || !connection.Auth || connection.Mechanism != MechanismScramSha512 {
+		t.Errorf("Connection has unexpected options: %+v", connection)
+	}
+	if saramaConfig.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || saramaConfig.Net.SASL.SCRAMClientGeneratorFunc == nil {
+		t.Error("Connection did not configure SCRAM authentication.")
+	}
+	if saramaConfig.Version != sarama.V3_3_1_0 || saramaConfig.ClientID != "flowpipeline" {
+		t.Errorf("Connection did not configure version and client id, got %s and %s.", saramaConfig.Version, saramaConfig.ClientID)
+	}
+	if err := saramaConfig.Validate(); err != nil {
+		t.Errorf("Connection resulted in an invalid Sarama config: %v", err)
+	}
+
+	saramaConfig = sarama.NewConfig()
+	connection, err = NewConnection("Test", map[string]string{"auth": "false", "insecureskipverify": "true"}, saramaConfig)
+	if err != nil {
+		t.Fatalf("Connection could not be set up: %v", err)
+	}
+	if saramaConfig.Net.SASL.Enable || !saramaConfig.Net.TLS.Enable || !saramaConfig.Net.TLS.Config.InsecureSkipVerify {
+		t.Errorf("Connection has unexpected options: %+v", connection)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []map[string]string{
+		{"auth": "false", "version": "two"},
+		{"auth": "false", "certfile": "client.pem"},
+		{"auth": "false", "tls": "false", "cafile": empty},
+		{"auth": "false", "cafile": empty},
+		{"auth": "false", "cafile": filepath.Join(t.TempDir(), "missing.pem")},
+		{"user": "u", "pass": "p", "mechanism": "gssapi"},
+		{"mechanism": "scram-sha-256"},
+	} {
+		if _, err := NewConnection("Test", config, sarama.NewConfig()); err == nil {
+			t.Errorf("Connection was set up despite bad config %v.", config)
+		}
+	}
+}
@@ -30,7 +30,7 @@ type AddCid struct {
 	trieV6 ip_prefix_trie.TrieNode
 }
 
-func (segment AddCid) New(config map[string]string) segments.Segment {
+func (segment AddCid) New(config map[string]string) (segments.Segment, error) {
 	drop, err := strconv.ParseBool(config["dropunmatched"])
 	if err != nil {
 		log.Println("[info] AddCid: 'dropunmatched' set to default 'false'.")
@@ -40,15 +40,14 @@ func (segment AddCid) New(config map[string]string) segments.Segment {
 		log.Println("[info] AddCid: 'matchboth' set to default 'false'.")
 	}
 	if config["filename"] == "" {
-		log.Println("[error] AddCid: This segment requires a 'filename' parameter.")
-		return nil
+		return nil, segments.NewConfigError("filename", "is required")
 	}
 
 	return &AddCid{
 		FileName:      config["filename"],
 		DropUnmatched: drop,
 		MatchBoth:     both,
-	}
+	}, nil
 }
 
 func (segment *AddCid) Run(wg *sync.WaitGroup) {
@@ -69,6 +68,8 @@ func (segment *AddCid) Run(wg *sync.WaitGroup) {
 			default:
 				if !segment.DropUnmatched {
 					segment.Out <- msg
+				} else {
+					segment.Consumed(msg)
 				}
 				continue
 			}
@@ -82,6 +83,7 @@ func (segment *AddCid) Run(wg *sync.WaitGroup) {
 				msg.Cid = uint32(retCid)
 			}
 			if segment.DropUnmatched && msg.Cid == 0 {
+				segment.Consumed(msg)
 				continue
 			}
 		} else {
@@ -159,4 +161,12 @@ func (segment *AddCid) readPrefixList() {
 func init() {
 	segment := &AddCid{}
 	segments.RegisterSegment("addcid", segment)
+	segments.RegisterSchema("addcid", segments.Schema{
+		Summary: "Adds customer ids to flows based on a CSV file of prefixes.",
+		Params: []segments.Param{
+			{Name: "filename", Required: true, Doc: "The CSV file containing lines in the format 'prefix,cid'."},
+			{Name: "dropunmatched", Type: segments.TypeBool, Default: "false", Doc: "Whether to drop flows which could not be matched."},
+			{Name: "matchboth", Type: segments.TypeBool, Default: "false", Doc: "Whether to match both addresses instead of the remote address."},
+		},
+	})
 }
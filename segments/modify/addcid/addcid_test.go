@@ -57,7 +57,7 @@ func BenchmarkAddCid(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := AddCid{}.New(map[string]string{"filename": "../../../examples/enricher/customer_subnets.csv"})
+	segment, _ := AddCid{}.New(map[string]string{"filename": "../../../examples/enricher/customer_subnets.csv"})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
@@ -9,8 +9,8 @@ type AddrStrings struct {
 	segments.BaseSegment
 }
 
-func (segment AddrStrings) New(config map[string]string) segments.Segment {
-	return &AddrStrings{}
+func (segment AddrStrings) New(config map[string]string) (segments.Segment, error) {
+	return &AddrStrings{}, nil
 }
 
 func (segment *AddrStrings) Run(wg *sync.WaitGroup) {
@@ -52,4 +52,7 @@ func (segment *AddrStrings) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &AddrStrings{}
 	segments.RegisterSegment("addrstrings", segment)
+	segments.RegisterSchema("addrstrings", segments.Schema{
+		Summary: "Adds string representations of all IP and MAC address fields.",
+	})
 }
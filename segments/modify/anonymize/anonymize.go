@@ -20,11 +20,10 @@ type Anonymize struct {
 	anonymizer *cryptopan.Cryptopan
 }
 
-func (segments Anonymize) New(config map[string]string) segments.Segment {
+func (segment Anonymize) New(config map[string]string) (segments.Segment, error) {
 	var encryptionKey string
 	if config["key"] == "" {
-		log.Println("[error] Anonymize: Missing configuration parameter 'key'. Please set the key to use for anonymization of IP addresses.")
-		return nil
+		return nil, segments.NewConfigError("key", "is required, please set the key to use for anonymization of IP addresses")
 	} else {
 		encryptionKey = config["key"]
 	}
@@ -49,18 +48,16 @@ func (segments Anonymize) New(config map[string]string) segments.Segment {
 	anon, err := cryptopan.New(ekb)
 	if err != nil {
 		if _, ok := err.(cryptopan.KeySizeError); ok {
-			log.Printf("[error] Anonymize: Key has insufficient length %d, please specifiy one with more than 32 chars.", len(encryptionKey))
-		} else {
-			log.Printf("[error] Anonymize: error creating anonymizer: %e", err)
+			return nil, segments.NewConfigError("key", "insufficient length %d, please specify one with more than 32 chars", len(encryptionKey))
 		}
-		return nil
+		return nil, segments.NewConfigError("key", "error creating anonymizer: %v", err)
 	}
 
 	return &Anonymize{
 		EncryptionKey: encryptionKey,
 		anonymizer:    anon,
 		Fields:        fields,
-	}
+	}, nil
 }
 
 func (segment *Anonymize) Run(wg *sync.WaitGroup) {
@@ -101,4 +98,11 @@ func (segment *Anonymize) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Anonymize{}
 	segments.RegisterSegment("anonymize", segment)
+	segments.RegisterSchema("anonymize", segments.Schema{
+		Summary: "Anonymizes IP addresses using Crypto-PAn.",
+		Params: []segments.Param{
+			{Name: "key", Required: true, Doc: "The encryption key, at least 32 characters long."},
+			{Name: "fields", Default: "SrcAddr,DstAddr,SamplerAddress", Doc: "A comma separated list of address fields to anonymize."},
+		},
+	})
 }
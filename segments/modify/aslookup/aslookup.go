@@ -18,14 +18,13 @@ type AsLookup struct {
     asDatabase  database.Database
 }
 
-func (segment AsLookup) New(config map[string]string) segments.Segment {
+func (segment AsLookup) New(config map[string]string) (segments.Segment, error) {
 
     newSegment := &AsLookup{}
 
     // parse options
 	if config["filename"] == "" {
-		log.Println("[error] AsLookup: This segment requires a 'filename' parameter.")
-		return nil
+		return nil, segments.NewConfigError("filename", "is required")
 	}
     newSegment.FileName = config["filename"]
 
@@ -41,8 +40,7 @@ func (segment AsLookup) New(config map[string]string) segments.Segment {
     // open lookup file
 	lookupfile, err := os.OpenFile(config["filename"], os.O_RDONLY, 0)
 	if err != nil {
-		log.Printf("[error] AsLookup: Error opening lookup file: %s", err)
-		return nil
+		return nil, segments.NewConfigError("filename", "error opening lookup file: %v", err)
 	}
     defer lookupfile.Close()
 
@@ -71,7 +69,7 @@ func (segment AsLookup) New(config map[string]string) segments.Segment {
     }
 
 
-	return newSegment
+	return newSegment, nil
 }
 
 func (segment *AsLookup) Run(wg *sync.WaitGroup) {
@@ -107,4 +105,11 @@ func (segment *AsLookup) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &AsLookup{}
 	segments.RegisterSegment("aslookup", segment)
+	segments.RegisterSchema("aslookup", segments.Schema{
+		Summary: "Adds AS numbers to flows using a lookup database or MRT dump.",
+		Params: []segments.Param{
+			{Name: "filename", Required: true, Doc: "The lookup database or MRT file to use."},
+			{Name: "type", Default: "db", Options: []string{"db", "mrt"}, Doc: "The type of the lookup file."},
+		},
+	})
 }
@@ -23,23 +23,20 @@ type Bgp struct {
 	routeInfoServer routeinfo.RouteInfoServer
 }
 
-func (segment Bgp) New(config map[string]string) segments.Segment {
+func (segment Bgp) New(config map[string]string) (segments.Segment, error) {
 	rsconfig, err := ioutil.ReadFile(config["filename"])
 	if err != nil {
-		log.Printf("[error] Bgp: Error reading BGP session config file: %s", err)
-		return nil
+		return nil, segments.NewConfigError("filename", "error reading BGP session config file: %v", err)
 	}
 	var rs routeinfo.RouteInfoServer
 	err = yaml.Unmarshal(rsconfig, &rs)
 	if err != nil {
-		log.Printf("[error] Bgp: Error parsing BGP session configuration YAML: %v", err)
-		return nil
+		return nil, segments.NewConfigError("filename", "error parsing BGP session configuration YAML: %v", err)
 	}
 
 	if fallback, present := config["fallbackrouter"]; present {
 		if _, ok := rs.Routers[fallback]; !ok {
-			log.Printf("[error] Bgp: No fallback router named \"%s\" has been configured.", fallback)
-			return nil
+			return nil, segments.NewConfigError("fallbackrouter", "no fallback router named '%s' has been configured", fallback)
 		}
 	}
 
@@ -48,8 +45,7 @@ func (segment Bgp) New(config map[string]string) segments.Segment {
 		log.Println("[info] Bgp: 'usefallbackonly' set to default 'false'.")
 	}
 	if fallbackonly && config["fallbackrouter"] == "" {
-		log.Printf("[error] Bgp: Forcing fallback requires a fallbackrouter parameter.")
-		return nil
+		return nil, segments.NewConfigError("usefallbackonly", "forcing fallback requires a 'fallbackrouter' parameter")
 	}
 
 	newSegment := &Bgp{
@@ -58,7 +54,7 @@ func (segment Bgp) New(config map[string]string) segments.Segment {
 		UseFallbackOnly: fallbackonly,
 		routeInfoServer: rs,
 	}
-	return newSegment
+	return newSegment, nil
 }
 
 func (segment *Bgp) Run(wg *sync.WaitGroup) {
@@ -121,4 +117,12 @@ func (segment *Bgp) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Bgp{}
 	segments.RegisterSegment("bgp", segment)
+	segments.RegisterSchema("bgp", segments.Schema{
+		Summary: "Adds information from BGP sessions with the exporting routers to flows.",
+		Params: []segments.Param{
+			{Name: "filename", Required: true, Doc: "The BGP session config file."},
+			{Name: "fallbackrouter", Doc: "The router to use if no session with a flow's sampler is configured."},
+			{Name: "usefallbackonly", Type: segments.TypeBool, Default: "false", Doc: "Whether to always use the fallback router."},
+		},
+	})
 }
@@ -29,7 +29,7 @@ type DropFields struct {
 	Fields []string // required, determines which fields are kept/dropped
 }
 
-func (segment *DropFields) New(config map[string]string) segments.Segment {
+func (segment *DropFields) New(config map[string]string) (segments.Segment, error) {
 	var (
 		policy Policy
 		fields []string
@@ -42,19 +42,27 @@ func (segment *DropFields) New(config map[string]string) segments.Segment {
 	case "drop":
 		policy = PolicyDrop
 	default:
-		log.Fatalln("[error] DropFields: The 'policy' parameter is required to be either 'keep' or 'drop'.")
+		return nil, segments.NewConfigError("policy", "is required to be either 'keep' or 'drop'")
 	}
 
 	// parse fields
+	if strings.TrimSpace(config["fields"]) == "" {
+		return nil, segments.NewConfigError("fields", "can not be empty")
+	}
 	fields = FieldSplitRegex.Split(strings.TrimSpace(config["fields"]), -1)
-	if len(fields) == 0 {
-		log.Fatalln("[warning] DropFields: The 'fields' parameter can not be empty.")
+	if policy == PolicyKeep {
+		reflectedFlow := reflect.ValueOf(&pb.EnrichedFlow{}).Elem()
+		for _, fieldName := range fields {
+			if !reflectedFlow.FieldByName(fieldName).CanSet() {
+				return nil, segments.NewConfigError("fields", "field '%s' is not valid or can not be set", fieldName)
+			}
+		}
 	}
 
 	return &DropFields{
 		Policy: policy,
 		Fields: fields,
-	}
+	}, nil
 }
 
 func (segment *DropFields) Run(wg *sync.WaitGroup) {
@@ -77,6 +85,8 @@ func (segment *DropFields) Run(wg *sync.WaitGroup) {
 					log.Fatalf("[error] KeepFields: Field '%s' is not valid or can not be set.", fieldName)
 				}
 			}
+			segment.Copied(original, resultFlow)
+			segment.Consumed(original)
 			segment.Out <- resultFlow
 		case PolicyDrop:
 			for _, fieldName := range segment.Fields {
@@ -93,4 +103,11 @@ func (segment *DropFields) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &DropFields{}
 	segments.RegisterSegment("dropfields", segment)
+	segments.RegisterSchema("dropfields", segments.Schema{
+		Summary: "Drops or keeps a list of fields from all flows.",
+		Params: []segments.Param{
+			{Name: "policy", Required: true, Options: []string{"keep", "drop"}, Doc: "Whether to keep or to drop the listed fields."},
+			{Name: "fields", Required: true, Doc: "A list of field names, separated by commas or whitespace."},
+		},
+	})
 }
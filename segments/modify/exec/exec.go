@@ -0,0 +1,289 @@
+// Passes flows through an external program, which may modify or drop them.
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	minBackoff     = time.Second
+	maxBackoff     = time.Minute
+	maxMessageSize = 1 << 20 // for protobuf, larger ones indicate garbled output
+)
+
+type Exec struct {
+	segments.BaseFilterSegment
+	Command []string      // required, the program to run and its arguments
+	Format  string        // optional, one of "json" or "protobuf", default is "json"
+	Timeout time.Duration // optional, default is 1s, the time the program has to answer for each flow
+
+	running   *process // nil while the program is not running
+	startTime time.Time
+	restartAt time.Time
+	backoff   time.Duration
+}
+
+// A running instance of the program.
+type process struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	writer    *bufio.Writer
+	responses chan []byte // closed once the program's output ends
+}
+
+func (segment Exec) New(config map[string]string) (segments.Segment, error) {
+	newsegment := &Exec{
+		Command: strings.Fields(config["command"]),
+		Format:  "json",
+		Timeout: time.Second,
+		backoff: minBackoff,
+	}
+	if len(newsegment.Command) == 0 {
+		return nil, segments.NewConfigError("command", "is required")
+	}
+	if _, err := exec.LookPath(newsegment.Command[0]); err != nil {
+		return nil, segments.NewConfigError("command", "%v", err)
+	}
+	switch config["format"] {
+	case "", "json":
+	case "protobuf":
+		newsegment.Format = "protobuf"
+	default:
+		return nil, segments.NewConfigError("format", "needs to be one of 'json' or 'protobuf'")
+	}
+	if config["timeout"] != "" {
+		timeout, err := time.ParseDuration(config["timeout"])
+		if err != nil || timeout <= 0 {
+			return nil, segments.NewConfigError("timeout", "needs to be a positive duration")
+		}
+		newsegment.Timeout = timeout
+	}
+	return newsegment, nil
+}
+
+// Starts the program and a goroutine reading its responses.
+func (segment *Exec) start() error {
+	cmd := exec.Command(segment.Command[0], segment.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second // don't wait for any children holding on to the pipes
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p := &process{
+		cmd:       cmd,
+		stdin:     stdin,
+		writer:    bufio.NewWriter(stdin),
+		responses: make(chan []byte),
+	}
+	go func() {
+		defer close(p.responses)
+		reader := bufio.NewReader(stdout)
+		for {
+			response, err := segment.read(reader)
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+					log.Printf("[error] Exec: Could not read from %s: %v", segment.Command[0], err)
+				}
+				return
+			}
+			p.responses <- response
+		}
+	}()
+	segment.running = p
+	segment.startTime = time.Now()
+	return nil
+}
+
+// Stops the program and schedules its restart, the program is killed if it
+// does not exit within the timeout after closing its input.
+func (segment *Exec) stop(kill bool) {
+	p := segment.running
+	segment.running = nil
+	p.stdin.Close()
+	if kill {
+		p.cmd.Process.Kill()
+	}
+	timer := time.AfterFunc(segment.Timeout, func() { p.cmd.Process.Kill() })
+	err := p.cmd.Wait()
+	timer.Stop()
+	for range p.responses {
+		// discard any responses not waited for
+	}
+	if err != nil && !kill {
+		log.Printf("[warning] Exec: %s exited: %v", segment.Command[0], err)
+	}
+	if time.Since(segment.startTime) > maxBackoff {
+		segment.backoff = minBackoff // it ran fine for a while
+	}
+	segment.scheduleRestart()
+}
+
+// Delays the next start by the current backoff, which doubles each time.
+func (segment *Exec) scheduleRestart() {
+	segment.restartAt = time.Now().Add(segment.backoff)
+	segment.backoff *= 2
+	if segment.backoff > maxBackoff {
+		segment.backoff = maxBackoff
+	}
+}
+
+// Reads a single response, which is a line for json and a message prefixed
+// by its length as varint for protobuf.
+func (segment *Exec) read(reader *bufio.Reader) ([]byte, error) {
+	if segment.Format == "json" {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return line, err
+	}
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the maximum size", length)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return message, nil
+}
+
+func (segment *Exec) write(msg *pb.EnrichedFlow) error {
+	var data []byte
+	var err error
+	if segment.Format == "json" {
+		data, err = protojson.Marshal(msg)
+		data = append(data, '\n')
+	} else {
+		data, err = proto.Marshal(msg)
+		data = append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := segment.running.writer.Write(data); err != nil {
+		return err
+	}
+	return segment.running.writer.Flush()
+}
+
+// Decodes a response, returning nil if the flow is to be dropped.
+func (segment *Exec) decode(response []byte) (*pb.EnrichedFlow, error) {
+	msg := &pb.EnrichedFlow{}
+	if segment.Format == "json" {
+		response = bytes.TrimSpace(response)
+		if len(response) == 0 || string(response) == "null" {
+			return nil, nil
+		}
+		return msg, protojson.Unmarshal(response, msg)
+	}
+	if len(response) == 0 {
+		return nil, nil
+	}
+	return msg, proto.Unmarshal(response, msg)
+}
+
+// Passes a flow through the program and returns the result, which is nil if
+// the flow is to be dropped. Any failure passes the flow on unmodified.
+func (segment *Exec) process(msg *pb.EnrichedFlow, timer *time.Timer) *pb.EnrichedFlow {
+	if segment.running == nil {
+		if time.Now().Before(segment.restartAt) {
+			return msg
+		}
+		if err := segment.start(); err != nil {
+			log.Printf("[error] Exec: Could not start %s, passing on flows unmodified until retrying in %s: %v", segment.Command[0], segment.backoff, err)
+			segment.scheduleRestart()
+			return msg
+		}
+	}
+	if err := segment.write(msg); err != nil {
+		log.Printf("[error] Exec: Could not write to %s, restarting it: %v", segment.Command[0], err)
+		segment.stop(true)
+		return msg
+	}
+	timer.Reset(segment.Timeout)
+	select {
+	case response, ok := <-segment.running.responses:
+		if !timer.Stop() {
+			<-timer.C
+		}
+		if !ok {
+			log.Printf("[error] Exec: %s terminated, restarting it in %s", segment.Command[0], segment.backoff)
+			segment.stop(false)
+			return msg
+		}
+		result, err := segment.decode(response)
+		if err != nil {
+			log.Printf("[error] Exec: Passing on the flow unmodified, could not decode the response of %s: %v", segment.Command[0], err)
+			return msg
+		}
+		return result
+	case <-timer.C:
+		log.Printf("[error] Exec: %s did not respond within %s, restarting it in %s", segment.Command[0], segment.Timeout, segment.backoff)
+		segment.stop(true)
+		return msg
+	}
+}
+
+func (segment *Exec) Run(wg *sync.WaitGroup) {
+	defer func() {
+		if segment.running != nil {
+			segment.stop(false)
+		}
+		close(segment.Out)
+		wg.Done()
+	}()
+	timer := time.NewTimer(0)
+	<-timer.C
+	for msg := range segment.In {
+		if result := segment.process(msg, timer); result != nil {
+			if result != msg { // the flow is replaced by the decoded result
+				segment.Copied(msg, result)
+				segment.Consumed(msg)
+			}
+			segment.Out <- result
+		} else if segment.Drops != nil {
+			segment.Drops <- msg
+		}
+	}
+}
+
+func init() {
+	segment := &Exec{}
+	segments.RegisterSegment("exec", segment)
+	segments.RegisterSchema("exec", segments.Schema{
+		Summary: "Passes flows through an external program, which may modify or drop them.",
+		Params: []segments.Param{
+			{Name: "command", Required: true, Doc: "The program to run followed by its arguments, separated by spaces."},
+			{Name: "format", Default: "json", Options: []string{"json", "protobuf"}, Doc: "Whether to exchange flows as JSON lines or as protobuf messages prefixed by their length."},
+			{Name: "timeout", Type: segments.TypeDuration, Default: "1s", Doc: "The time the program has to respond to each flow before it is restarted."},
+		},
+	})
+}
@@ -0,0 +1,177 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// The test binary doubles as the external program, see helper.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv("EXEC_TEST_HELPER"); mode != "" {
+		helper(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Annotates flows with a note and drops UDP flows. The modes json and
+// protobuf select the format, crash exits after the first flow, and hang never
+// responds.
+func helper(mode string) {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		msg := &pb.EnrichedFlow{}
+		if mode == "protobuf" {
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			proto.Unmarshal(data, msg)
+		} else {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			protojson.Unmarshal(line, msg)
+		}
+		switch mode {
+		case "hang":
+			time.Sleep(time.Hour)
+		case "crash":
+			os.Exit(1)
+		case "protobuf":
+			if msg.Proto == 17 {
+				os.Stdout.Write([]byte{0})
+				continue
+			}
+			msg.Note = "seen"
+			data, _ := proto.Marshal(msg)
+			os.Stdout.Write(append(binary.AppendUvarint(nil, uint64(len(data))), data...))
+		default:
+			if msg.Proto == 17 {
+				os.Stdout.Write([]byte("null\n"))
+				continue
+			}
+			msg.Note = "seen"
+			data, _ := protojson.Marshal(msg)
+			os.Stdout.Write(append(data, '\n'))
+		}
+	}
+}
+
+// runs the segment with the given helper mode and collects all results
+func runHelper(t *testing.T, mode string, config map[string]string, flows ...*pb.EnrichedFlow) (out []*pb.EnrichedFlow, dropped int) {
+	t.Setenv("EXEC_TEST_HELPER", mode)
+	config["command"] = os.Args[0] + " -test.run=^$"
+	segment, err := Exec{}.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, outChan, drops := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, outChan)
+	segment.(*Exec).SubscribeDrops(drops)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	go func() {
+		for _, msg := range flows {
+			in <- msg
+		}
+		close(in)
+	}()
+	for {
+		select {
+		case msg, ok := <-outChan:
+			if !ok {
+				wg.Wait()
+				return out, dropped
+			}
+			out = append(out, msg)
+		case <-drops:
+			dropped++
+		}
+	}
+}
+
+func TestSegment_Exec_formats(t *testing.T) {
+	for _, format := range []string{"json", "protobuf"} {
+		out, dropped := runHelper(t, format, map[string]string{"format": format},
+			&pb.EnrichedFlow{Proto: 6, Bytes: 42},
+			&pb.EnrichedFlow{Proto: 17},
+			&pb.EnrichedFlow{Proto: 1},
+		)
+		if len(out) != 2 || dropped != 1 {
+			t.Fatalf("Segment Exec passed on %d and dropped %d flows using %s.", len(out), dropped, format)
+		}
+		if out[0].Note != "seen" || out[0].Bytes != 42 || out[1].Proto != 1 {
+			t.Errorf("Segment Exec did not return the modified flows using %s: %v", format, out)
+		}
+	}
+}
+
+func TestSegment_Exec_crash(t *testing.T) {
+	out, dropped := runHelper(t, "crash", map[string]string{},
+		&pb.EnrichedFlow{Proto: 6},
+		&pb.EnrichedFlow{Proto: 17},
+	)
+	// the second flow is passed on during the backoff
+	if len(out) != 2 || dropped != 0 || out[0].Note != "" {
+		t.Errorf("Segment Exec did not pass on flows unmodified after a crash: %v", out)
+	}
+}
+
+func TestSegment_Exec_timeout(t *testing.T) {
+	start := time.Now()
+	out, _ := runHelper(t, "hang", map[string]string{"timeout": "50ms"},
+		&pb.EnrichedFlow{Proto: 6},
+	)
+	if len(out) != 1 || out[0].Note != "" {
+		t.Errorf("Segment Exec did not pass on the flow unmodified after a timeout: %v", out)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Segment Exec took %s to handle the timeout.", time.Since(start))
+	}
+}
+
+func TestSegment_Exec_backoff(t *testing.T) {
+	segment := &Exec{backoff: minBackoff}
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		segment.scheduleRestart()
+		if segment.backoff != expected {
+			t.Errorf("Segment Exec backed off %s instead of %s.", segment.backoff, expected)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		segment.scheduleRestart()
+	}
+	if segment.backoff != maxBackoff {
+		t.Errorf("Segment Exec backed off %s beyond the maximum.", segment.backoff)
+	}
+}
+
+func TestSegment_Exec_config(t *testing.T) {
+	for _, config := range []map[string]string{
+		{},
+		{"command": "/nonexistent/program"},
+		{"command": "cat", "format": "xml"},
+		{"command": "cat", "timeout": "0s"},
+	} {
+		if _, err := (Exec{}).New(config); err == nil {
+			t.Errorf("Segment Exec accepted the invalid config %v.", config)
+		}
+	}
+}
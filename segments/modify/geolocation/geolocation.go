@@ -22,7 +22,7 @@ type GeoLocation struct {
 	dbHandle *maxmind.Reader
 }
 
-func (segment GeoLocation) New(config map[string]string) segments.Segment {
+func (segment GeoLocation) New(config map[string]string) (segments.Segment, error) {
 	drop, err := strconv.ParseBool(config["dropunmatched"])
 	if err != nil {
 		log.Println("[info] GeoLocation: 'dropunmatched' set to default 'false'.")
@@ -32,8 +32,7 @@ func (segment GeoLocation) New(config map[string]string) segments.Segment {
 		log.Println("[info] GeoLocation: 'matchboth' set to default 'false'.")
 	}
 	if config["filename"] == "" {
-		log.Println("[error] GeoLocation: This segment requires the 'filename' parameter.")
-		return nil
+		return nil, segments.NewConfigError("filename", "is required")
 	}
 	newSegment := &GeoLocation{
 		FileName:      config["filename"],
@@ -42,10 +41,9 @@ func (segment GeoLocation) New(config map[string]string) segments.Segment {
 	}
 	newSegment.dbHandle, err = maxmind.Open(segments.ContainerVolumePrefix + config["filename"])
 	if err != nil {
-		log.Printf("[error] GeoLocation: Could not open specified Maxmind DB file: %v", err)
-		return nil
+		return nil, segments.NewConfigError("filename", "could not open specified Maxmind DB file: %v", err)
 	}
-	return newSegment
+	return newSegment, nil
 }
 
 func (segment *GeoLocation) Run(wg *sync.WaitGroup) {
@@ -75,6 +73,8 @@ func (segment *GeoLocation) Run(wg *sync.WaitGroup) {
 			default:
 				if !segment.DropUnmatched {
 					segment.Out <- msg
+				} else {
+					segment.Consumed(msg)
 				}
 				continue
 			}
@@ -106,4 +106,12 @@ func (segment *GeoLocation) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &GeoLocation{}
 	segments.RegisterSegment("geolocation", segment)
+	segments.RegisterSchema("geolocation", segments.Schema{
+		Summary: "Adds country codes to flows using a MaxMind database.",
+		Params: []segments.Param{
+			{Name: "filename", Required: true, Doc: "The MaxMind database file."},
+			{Name: "dropunmatched", Type: segments.TypeBool, Default: "false", Doc: "Whether to drop flows which could not be matched."},
+			{Name: "matchboth", Type: segments.TypeBool, Default: "false", Doc: "Whether to match both addresses instead of the remote address."},
+		},
+	})
 }
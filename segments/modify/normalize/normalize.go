@@ -14,7 +14,7 @@ type Normalize struct {
 	Fallback uint64 // optional, default is no fallback, determines a assumed sampling rate of flows if none is found in a given flow
 }
 
-func (segment Normalize) New(config map[string]string) segments.Segment {
+func (segment Normalize) New(config map[string]string) (segments.Segment, error) {
 	var fallback uint64 = 0
 
 	if config["fallback"] != "" {
@@ -29,7 +29,7 @@ func (segment Normalize) New(config map[string]string) segments.Segment {
 
 	return &Normalize{
 		Fallback: fallback,
-	}
+	}, nil
 }
 
 func (segment *Normalize) Run(wg *sync.WaitGroup) {
@@ -55,4 +55,10 @@ func (segment *Normalize) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Normalize{}
 	segments.RegisterSegment("normalize", segment)
+	segments.RegisterSchema("normalize", segments.Schema{
+		Summary: "Multiplies byte and packet counts by the sampling rate.",
+		Params: []segments.Param{
+			{Name: "fallback", Type: segments.TypeUint, Default: "0", Doc: "The sampling rate to use for flows without one, 0 leaves them untouched."},
+		},
+	})
 }
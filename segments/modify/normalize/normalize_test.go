@@ -43,7 +43,7 @@ func BenchmarkNormalize(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := Normalize{}.New(map[string]string{})
+	segment, _ := Normalize{}.New(map[string]string{})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
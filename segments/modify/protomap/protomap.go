@@ -13,8 +13,8 @@ type Protomap struct {
 }
 
 // TODO make configurable to only add specific protocol names instead of all
-func (segment Protomap) New(config map[string]string) segments.Segment {
-	return &Protomap{}
+func (segment Protomap) New(config map[string]string) (segments.Segment, error) {
+	return &Protomap{}, nil
 }
 
 func (segment *Protomap) Run(wg *sync.WaitGroup) {
@@ -77,4 +77,7 @@ func ProtoNumToString(proto uint32) string {
 func init() {
 	segment := &Protomap{}
 	segments.RegisterSegment("protomap", segment)
+	segments.RegisterSchema("protomap", segments.Schema{
+		Summary: "Adds the protocol name to flows.",
+	})
 }
@@ -34,7 +34,7 @@ func BenchmarkProtomap(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := Protomap{}.New(map[string]string{})
+	segment, _ := Protomap{}.New(map[string]string{})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
@@ -51,24 +51,22 @@ type RemoteAddress struct {
 	trieV6 ip_prefix_trie.TrieNode
 }
 
-func (segment RemoteAddress) New(config map[string]string) segments.Segment {
+func (segment RemoteAddress) New(config map[string]string) (segments.Segment, error) {
 	if !(config["policy"] == "cidr" || config["policy"] == "border" || config["policy"] == "user" || config["policy"] == "clear") {
-		log.Println("[error] RemoteAddress: The 'policy' parameter is required to be one of 'cidr', 'border', 'user', or 'clear'.")
-		return nil
+		return nil, segments.NewConfigError("policy", "is required to be one of 'cidr', 'border', 'user', or 'clear'")
 	}
 	drop, err := strconv.ParseBool(config["dropunmatched"])
 	if err != nil {
 		log.Println("[info] RemoteAddress: 'dropunmatched' set to default 'false'.")
 	}
 	if config["policy"] == "cidr" && config["filename"] == "" {
-		log.Println("[error] AddCid: This segment requires a 'filename' parameter.")
-		return nil
+		return nil, segments.NewConfigError("filename", "is required by policy 'cidr'")
 	}
 	return &RemoteAddress{
 		Policy:        config["policy"],
 		FileName:      config["filename"],
 		DropUnmatched: drop,
-	}
+	}, nil
 }
 
 func (segment *RemoteAddress) Run(wg *sync.WaitGroup) {
@@ -175,4 +173,12 @@ func (segment *RemoteAddress) readPrefixList() {
 func init() {
 	segment := &RemoteAddress{}
 	segments.RegisterSegment("remoteaddress", segment)
+	segments.RegisterSchema("remoteaddress", segments.Schema{
+		Summary: "Determines which address of a flow is the remote address.",
+		Params: []segments.Param{
+			{Name: "policy", Required: true, Options: []string{"cidr", "border", "user", "clear"}, Doc: "The policy used to determine the remote address."},
+			{Name: "filename", Doc: "The CSV file used by policy cidr, see addcid."},
+			{Name: "dropunmatched", Type: segments.TypeBool, Default: "false", Doc: "Whether to drop flows which could not be matched by policy cidr."},
+		},
+	})
 }
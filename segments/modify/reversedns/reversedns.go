@@ -3,7 +3,6 @@ package reversedns
 
 import (
 	"context"
-	"log"
 	"strconv"
 	"sync"
 	"time"
@@ -16,11 +15,12 @@ type ReverseDns struct {
 	Cache           bool   // optional, default is true, disable to use a caching resolver directly
 	RefreshInterval string // optional, default is 5m, set another duration for cache refreshes
 
-	resolver *dnscache.Resolver
+	resolver        *dnscache.Resolver
+	refreshInterval time.Duration
 	segments.BaseSegment
 }
 
-func (segment ReverseDns) New(config map[string]string) segments.Segment {
+func (segment ReverseDns) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &ReverseDns{
 		resolver: &dnscache.Resolver{},
 	}
@@ -28,11 +28,11 @@ func (segment ReverseDns) New(config map[string]string) segments.Segment {
 	var cache bool = true
 	if config["cache"] != "" {
 		var err error
-		if cache, err = strconv.ParseBool(config["cache"]); err == nil {
-			log.Println("[error] ReverseDns: Invalid 'cache' parameter.")
-			return nil
+		if cache, err = strconv.ParseBool(config["cache"]); err != nil {
+			return nil, segments.NewConfigError("cache", "could not be parsed: %v", err)
 		}
 	}
+	newsegment.Cache = cache
 
 	if cache {
 		refresh := "5m"
@@ -41,18 +41,12 @@ func (segment ReverseDns) New(config map[string]string) segments.Segment {
 		}
 		duration, err := time.ParseDuration(refresh)
 		if err != nil {
-			log.Println("[error] ReverseDns: Invalid 'refreshinterval' parameter.")
-			return nil
+			return nil, segments.NewConfigError("refreshinterval", "could not be parsed: %v", err)
 		}
-		go func() {
-			t := time.NewTicker(duration)
-			defer t.Stop()
-			for range t.C {
-				newsegment.resolver.Refresh(true)
-			}
-		}()
+		newsegment.RefreshInterval = refresh
+		newsegment.refreshInterval = duration
 	}
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *ReverseDns) Run(wg *sync.WaitGroup) {
@@ -60,6 +54,22 @@ func (segment *ReverseDns) Run(wg *sync.WaitGroup) {
 		close(segment.Out)
 		wg.Done()
 	}()
+	if segment.Cache {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			t := time.NewTicker(segment.refreshInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					segment.resolver.Refresh(true)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
 	for msg := range segment.In {
 		hostnames, err := segment.resolver.LookupAddr(context.Background(), msg.SrcAddrObj().String())
 		if err == nil && len(hostnames) > 0 {
@@ -92,4 +102,11 @@ func (segment *ReverseDns) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &ReverseDns{}
 	segments.RegisterSegment("reversedns", segment)
+	segments.RegisterSchema("reversedns", segments.Schema{
+		Summary: "Adds reverse DNS names for all addresses to flows.",
+		Params: []segments.Param{
+			{Name: "cache", Type: segments.TypeBool, Default: "true", Doc: "Whether to cache lookup results."},
+			{Name: "refreshinterval", Type: segments.TypeDuration, Default: "5m", Doc: "The interval in which cached entries are refreshed."},
+		},
+	})
 }
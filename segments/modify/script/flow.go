@@ -0,0 +1,167 @@
+package script
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"go.starlark.net/starlark"
+)
+
+var (
+	flowType       = reflect.TypeOf(pb.EnrichedFlow{})
+	flowFields     = make(map[string][]int) // the indexes of all exported fields by name
+	flowFieldNames []string
+)
+
+func init() {
+	for i := 0; i < flowType.NumField(); i++ {
+		field := flowType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		flowFields[field.Name] = field.Index
+		flowFieldNames = append(flowFieldNames, field.Name)
+	}
+	sort.Strings(flowFieldNames)
+}
+
+// Exposes a flow to scripts, its fields are available as attributes of the
+// same name. Flows are released once the script call they were used in
+// returns, as they are passed on to other segments afterwards. Scripts keeping
+// them in their state can not access them anymore.
+type flow struct {
+	msg    *pb.EnrichedFlow // nil once released
+	frozen bool
+}
+
+var _ starlark.HasSetField = (*flow)(nil)
+
+func (f *flow) Type() string          { return "flow" }
+func (f *flow) Freeze()               { f.frozen = true }
+func (f *flow) Truth() starlark.Bool  { return starlark.True }
+func (f *flow) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: flow") }
+func (f *flow) AttrNames() []string   { return flowFieldNames }
+
+func (f *flow) String() string {
+	if f.msg == nil {
+		return "flow(released)"
+	}
+	return "flow(" + f.msg.String() + ")"
+}
+
+var errReleased = fmt.Errorf("the flow has been passed on already and can not be accessed anymore")
+
+func (f *flow) Attr(name string) (starlark.Value, error) {
+	if f.msg == nil {
+		return nil, errReleased
+	}
+	index, ok := flowFields[name]
+	if !ok {
+		return nil, nil // reported as a missing attribute by starlark
+	}
+	field := reflect.ValueOf(f.msg).Elem().FieldByIndex(index)
+	switch field.Kind() {
+	case reflect.Bool:
+		return starlark.Bool(field.Bool()), nil
+	case reflect.String:
+		return starlark.String(field.String()), nil
+	case reflect.Int32:
+		return starlark.MakeInt64(field.Int()), nil
+	case reflect.Uint32, reflect.Uint64:
+		return starlark.MakeUint64(field.Uint()), nil
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			return starlark.Bytes(field.Bytes()), nil
+		}
+		elems := make([]starlark.Value, field.Len())
+		for i := range elems {
+			elems[i] = starlark.MakeUint64(field.Index(i).Uint())
+		}
+		return starlark.NewList(elems), nil
+	}
+	return nil, fmt.Errorf("flow field %s is of unsupported type %s", name, field.Type())
+}
+
+func (f *flow) SetField(name string, value starlark.Value) error {
+	if f.msg == nil {
+		return errReleased
+	}
+	if f.frozen {
+		return fmt.Errorf("can not set flow field %s of a frozen flow", name)
+	}
+	index, ok := flowFields[name]
+	if !ok {
+		return starlark.NoSuchAttrError(fmt.Sprintf("flow has no field %s", name))
+	}
+	field := reflect.ValueOf(f.msg).Elem().FieldByIndex(index)
+	switch field.Kind() {
+	case reflect.Bool:
+		b, ok := value.(starlark.Bool)
+		if !ok {
+			return fmt.Errorf("flow field %s needs a bool, got %s", name, value.Type())
+		}
+		field.SetBool(bool(b))
+	case reflect.String:
+		s, ok := value.(starlark.String)
+		if !ok {
+			return fmt.Errorf("flow field %s needs a string, got %s", name, value.Type())
+		}
+		field.SetString(string(s))
+	case reflect.Int32:
+		var i int64
+		if err := starlark.AsInt(value, &i); err != nil || field.OverflowInt(i) {
+			return fmt.Errorf("flow field %s needs an int32, got %s", name, value)
+		}
+		field.SetInt(i)
+	case reflect.Uint32, reflect.Uint64:
+		u, err := toUint(value, field)
+		if err != nil {
+			return fmt.Errorf("flow field %s needs an unsigned %d bit int, got %s", name, field.Type().Bits(), value)
+		}
+		field.SetUint(u)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			b, ok := value.(starlark.Bytes)
+			if !ok {
+				return fmt.Errorf("flow field %s needs bytes, got %s", name, value.Type())
+			}
+			field.SetBytes([]byte(b))
+			return nil
+		}
+		iterable, ok := value.(starlark.Iterable)
+		if !ok {
+			return fmt.Errorf("flow field %s needs a list, got %s", name, value.Type())
+		}
+		slice := reflect.MakeSlice(field.Type(), 0, 0)
+		elemType := reflect.New(field.Type().Elem()).Elem()
+		iter := iterable.Iterate()
+		defer iter.Done()
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			u, err := toUint(elem, elemType)
+			if err != nil {
+				return fmt.Errorf("flow field %s needs a list of unsigned 32 bit ints, got %s", name, elem)
+			}
+			slice = reflect.Append(slice, reflect.ValueOf(uint32(u)))
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("flow field %s is of unsupported type %s", name, field.Type())
+	}
+	return nil
+}
+
+// Converts a starlark int to an unsigned int fitting into the given field.
+func toUint(value starlark.Value, field reflect.Value) (uint64, error) {
+	i, ok := value.(starlark.Int)
+	if !ok {
+		return 0, fmt.Errorf("not an int")
+	}
+	u, ok := i.Uint64()
+	if !ok || field.OverflowUint(u) {
+		return 0, fmt.Errorf("out of range")
+	}
+	return u, nil
+}
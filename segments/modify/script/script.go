@@ -0,0 +1,257 @@
+// Runs a user-supplied Starlark script for each flow, which may modify, drop,
+// or add flows.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"github.com/bwNetFlow/flowpipeline/segments/internal/errorlog"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"google.golang.org/protobuf/proto"
+)
+
+// The script's functions can not use any I/O or load other files, and
+// neither can they recurse. While loops are allowed, as the number of steps
+// and the time spent per call are limited anyway.
+var fileOptions = &syntax.FileOptions{Set: true, While: true, TopLevelControl: true}
+
+type Script struct {
+	segments.BaseFilterSegment
+	FileName string        // required, the Starlark script defining a process function
+	MaxSteps uint64        // optional, default is 100000, the maximum number of steps per call, 0 disables the limit
+	Timeout  time.Duration // optional, default is 100ms, the maximum time per call, 0 disables the limit
+
+	thread   *starlark.Thread
+	process  starlark.Callable
+	flows    []*flow // all flows used in the current call, to release them afterwards
+	errorLog *errorlog.Logger
+}
+
+func (segment Script) New(config map[string]string) (segments.Segment, error) {
+	newsegment := &Script{
+		FileName: config["filename"],
+		MaxSteps: 100000,
+		Timeout:  100 * time.Millisecond,
+		errorLog: &errorlog.Logger{Prefix: "[error] Script: "},
+	}
+	if newsegment.FileName == "" {
+		return nil, segments.NewConfigError("filename", "is required")
+	}
+	if config["maxsteps"] != "" {
+		maxSteps, err := strconv.ParseUint(config["maxsteps"], 10, 64)
+		if err != nil {
+			return nil, segments.NewConfigError("maxsteps", "could not be parsed: %v", err)
+		}
+		newsegment.MaxSteps = maxSteps
+	}
+	if config["timeout"] != "" {
+		timeout, err := time.ParseDuration(config["timeout"])
+		if err != nil || timeout < 0 {
+			return nil, segments.NewConfigError("timeout", "needs to be a positive duration")
+		}
+		newsegment.Timeout = timeout
+	}
+
+	src, err := os.ReadFile(segments.ContainerVolumePrefix + newsegment.FileName)
+	if err != nil {
+		return nil, segments.NewConfigError("filename", "could not be read: %v", err)
+	}
+	if err := newsegment.load(src); err != nil {
+		return nil, segments.NewConfigError("filename", "%v", err)
+	}
+	return newsegment, nil
+}
+
+// Compiles and initializes the script, which needs to define a function
+// named process taking a single flow.
+func (segment *Script) load(src []byte) error {
+	segment.thread = &starlark.Thread{
+		Name: "script",
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("[info] Script: %s", msg)
+		},
+	}
+	predeclared := starlark.StringDict{
+		"new_flow":  starlark.NewBuiltin("new_flow", segment.newFlow),
+		"copy_flow": starlark.NewBuiltin("copy_flow", segment.copyFlow),
+	}
+	_, program, err := starlark.SourceProgramOptions(fileOptions, segment.FileName, src, predeclared.Has)
+	if err != nil {
+		return err
+	}
+	var globals starlark.StringDict
+	err = segment.limit(func() error {
+		// the globals are not frozen, such that the script can keep
+		// state between calls in global lists and dicts
+		globals, err = program.Init(segment.thread, predeclared)
+		return err
+	})
+	if err != nil {
+		return formatError(err)
+	}
+	process, ok := globals["process"].(*starlark.Function)
+	if !ok {
+		return fmt.Errorf("%s does not define a function named process", segment.FileName)
+	}
+	if process.NumParams() != 1 {
+		return fmt.Errorf("%s: the process function needs to take exactly one parameter, the flow", process.Position())
+	}
+	segment.process = process
+	return nil
+}
+
+// Runs fn with the configured limits applied to the segment's thread.
+func (segment *Script) limit(fn func() error) error {
+	segment.thread.Uncancel()
+	segment.thread.Steps = 0
+	if segment.MaxSteps > 0 {
+		segment.thread.SetMaxExecutionSteps(segment.MaxSteps)
+	} else {
+		segment.thread.SetMaxExecutionSteps(math.MaxUint64)
+	}
+	if segment.Timeout > 0 {
+		timer := time.AfterFunc(segment.Timeout, func() {
+			segment.thread.Cancel(fmt.Sprintf("timeout of %s exceeded", segment.Timeout))
+		})
+		defer timer.Stop()
+	}
+	return fn()
+}
+
+// Includes the backtrace of errors raised at runtime, which lists the line
+// numbers involved.
+func formatError(err error) error {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return errors.New(evalErr.Backtrace())
+	}
+	return err
+}
+
+func (segment *Script) newFlow(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(builtin.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return segment.track(&pb.EnrichedFlow{}), nil
+}
+
+func (segment *Script) copyFlow(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var original *flow
+	if err := starlark.UnpackPositionalArgs(builtin.Name(), args, kwargs, 1, &original); err != nil {
+		return nil, err
+	}
+	if original.msg == nil {
+		return nil, errReleased
+	}
+	return segment.track(proto.Clone(original.msg).(*pb.EnrichedFlow)), nil
+}
+
+func (segment *Script) track(msg *pb.EnrichedFlow) *flow {
+	f := &flow{msg: msg}
+	segment.flows = append(segment.flows, f)
+	return f
+}
+
+// Calls the script's process function for a single flow and returns the flows
+// to pass on. The function may return None or True to pass on the flow, False
+// to drop it, or a list of flows to replace it with.
+func (segment *Script) call(msg *pb.EnrichedFlow) ([]*pb.EnrichedFlow, error) {
+	defer func() {
+		for _, f := range segment.flows {
+			f.msg = nil
+		}
+		segment.flows = segment.flows[:0]
+	}()
+	var result starlark.Value
+	err := segment.limit(func() error {
+		var err error
+		result, err = starlark.Call(segment.thread, segment.process, starlark.Tuple{segment.track(msg)}, nil)
+		return err
+	})
+	if err != nil {
+		return nil, formatError(err)
+	}
+	switch result := result.(type) {
+	case starlark.NoneType:
+		return []*pb.EnrichedFlow{msg}, nil
+	case starlark.Bool:
+		if result {
+			return []*pb.EnrichedFlow{msg}, nil
+		}
+		return nil, nil
+	case *starlark.List:
+		var flows []*pb.EnrichedFlow
+		seen := make(map[*pb.EnrichedFlow]bool)
+		for i := 0; i < result.Len(); i++ {
+			f, ok := result.Index(i).(*flow)
+			if !ok {
+				return nil, fmt.Errorf("process returned a list containing a %s instead of flows", result.Index(i).Type())
+			}
+			if f.msg == nil {
+				return nil, fmt.Errorf("process returned a flow from a previous call")
+			}
+			if seen[f.msg] { // returned twice, pass on a copy
+				flows = append(flows, proto.Clone(f.msg).(*pb.EnrichedFlow))
+				continue
+			}
+			seen[f.msg] = true
+			flows = append(flows, f.msg)
+		}
+		return flows, nil
+	default:
+		return nil, fmt.Errorf("process returned a %s instead of None, a bool, or a list of flows", result.Type())
+	}
+}
+
+func (segment *Script) Run(wg *sync.WaitGroup) {
+	defer func() {
+		segment.errorLog.Flush()
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		flows, err := segment.call(msg)
+		if err != nil {
+			segment.errorLog.Printf("Passing on the flow as is, %v", err)
+			segment.Out <- msg
+			continue
+		}
+		passed := false
+		for _, f := range flows {
+			if f == msg {
+				passed = true
+			} else {
+				segment.Copied(msg, f)
+			}
+		}
+		for _, f := range flows {
+			segment.Out <- f
+		}
+		if !passed && segment.Drops != nil {
+			segment.Drops <- msg
+		}
+	}
+}
+
+func init() {
+	segment := &Script{}
+	segments.RegisterSegment("script", segment)
+	segments.RegisterSchema("script", segments.Schema{
+		Summary: "Runs a Starlark script for each flow, which may modify, drop, or add flows.",
+		Params: []segments.Param{
+			{Name: "filename", Required: true, Doc: "The Starlark script, which needs to define a function process(flow)."},
+			{Name: "maxsteps", Type: segments.TypeUint, Default: "100000", Doc: "The maximum number of steps per call, 0 disables the limit."},
+			{Name: "timeout", Type: segments.TypeDuration, Default: "100ms", Doc: "The maximum time per call, 0 disables the limit."},
+		},
+	})
+}
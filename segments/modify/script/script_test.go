@@ -0,0 +1,198 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+func newScript(t *testing.T, src string, config map[string]string) (segments.Segment, error) {
+	filename := filepath.Join(t.TempDir(), "script.star")
+	if err := os.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if config == nil {
+		config = map[string]string{}
+	}
+	config["filename"] = filename
+	return Script{}.New(config)
+}
+
+// runs the segment for a single flow and collects its output and drops
+func runScript(segment segments.Segment, msg *pb.EnrichedFlow) (out []*pb.EnrichedFlow, dropped []*pb.EnrichedFlow) {
+	in, outChan, drops := make(chan *pb.EnrichedFlow, 1), make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow, 1)
+	segment.Rewire(in, outChan)
+	segment.(*Script).SubscribeDrops(drops)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	in <- msg
+	close(in)
+	for result := range outChan {
+		out = append(out, result)
+	}
+	wg.Wait()
+	close(drops)
+	for result := range drops {
+		dropped = append(dropped, result)
+	}
+	return out, dropped
+}
+
+func TestSegment_Script_modify(t *testing.T) {
+	segment, err := newScript(t, `
+def process(flow):
+    flow.Bytes = flow.Bytes * 2
+    flow.Note = "seen"
+    flow.ASPath = flow.ASPath + [553]
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := runScript(segment, &pb.EnrichedFlow{Bytes: 21, ASPath: []uint32{1}})
+	if len(out) != 1 || out[0].Bytes != 42 || out[0].Note != "seen" || len(out[0].ASPath) != 2 || out[0].ASPath[1] != 553 {
+		t.Errorf("Segment Script did not modify the flow correctly: %v", out)
+	}
+}
+
+func TestSegment_Script_dropAndEmit(t *testing.T) {
+	segment, err := newScript(t, `
+def process(flow):
+    if flow.Proto == 17:
+        return False
+    reply = copy_flow(flow)
+    reply.SrcPort, reply.DstPort = flow.DstPort, flow.SrcPort
+    extra = new_flow()
+    extra.Proto = 1
+    return [flow, reply, extra]
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, dropped := runScript(segment, &pb.EnrichedFlow{Proto: 17})
+	if len(out) != 0 || len(dropped) != 1 {
+		t.Errorf("Segment Script did not drop the flow: %v %v", out, dropped)
+	}
+
+	segment, _ = newScript(t, `
+def process(flow):
+    reply = copy_flow(flow)
+    reply.SrcPort, reply.DstPort = flow.DstPort, flow.SrcPort
+    extra = new_flow()
+    extra.Proto = 1
+    return [flow, reply, extra]
+`, nil)
+	out, dropped = runScript(segment, &pb.EnrichedFlow{Proto: 6, SrcPort: 1234, DstPort: 443})
+	if len(out) != 3 || len(dropped) != 0 {
+		t.Fatalf("Segment Script did not emit the additional flows: %v %v", out, dropped)
+	}
+	if out[0].SrcPort != 1234 || out[1].SrcPort != 443 || out[1].Proto != 6 || out[2].Proto != 1 {
+		t.Errorf("Segment Script emitted incorrect flows: %v", out)
+	}
+}
+
+func TestSegment_Script_state(t *testing.T) {
+	segment, err := newScript(t, `
+counts = {}
+
+def process(flow):
+    counts[flow.Proto] = counts.get(flow.Proto, 0) + 1
+    flow.Packets = counts[flow.Proto]
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := segment.(*Script)
+	for i := uint64(1); i <= 3; i++ {
+		out, err := script.call(&pb.EnrichedFlow{Proto: 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out[0].Packets != i {
+			t.Errorf("Segment Script did not keep state between calls, got %d instead of %d.", out[0].Packets, i)
+		}
+	}
+}
+
+func TestSegment_Script_errors(t *testing.T) {
+	for src, expected := range map[string]string{
+		"def process(flow)\n    pass\n":              "script.star:2:1",
+		"def transform(flow):\n    pass\n":           "does not define a function named process",
+		"def process(flow, other):\n    pass\n":      "exactly one parameter",
+		"x = 1 // 0\n\ndef process(flow):\n  pass\n": "script.star:1:7",
+		"load('other.star', 'x')\n":                  "load not implemented",
+	} {
+		_, err := newScript(t, src, nil)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Segment Script reported %v instead of an error containing %q.", err, expected)
+		}
+	}
+
+	segment, err := newScript(t, "def process(flow):\n    flow.Proto = -1\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = segment.(*Script).call(&pb.EnrichedFlow{})
+	if err == nil || !strings.Contains(err.Error(), "script.star:2:") {
+		t.Errorf("Segment Script reported %v instead of an error with a line number.", err)
+	}
+}
+
+func TestSegment_Script_limits(t *testing.T) {
+	segment, err := newScript(t, "def process(flow):\n    while True:\n        pass\n",
+		map[string]string{"maxsteps": "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := segment.(*Script).call(&pb.EnrichedFlow{}); err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("Segment Script did not enforce the step limit: %v", err)
+	}
+
+	segment, err = newScript(t, "def process(flow):\n    while True:\n        pass\n",
+		map[string]string{"maxsteps": "0", "timeout": "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := segment.(*Script).call(&pb.EnrichedFlow{}); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Segment Script did not enforce the timeout: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Segment Script enforced the timeout too late.")
+	}
+	// the next call is not affected by the previous cancellation
+	segment, _ = newScript(t, "def process(flow):\n    pass\n", map[string]string{"timeout": "10ms"})
+	script := segment.(*Script)
+	script.thread.Cancel("test")
+	if _, err := script.call(&pb.EnrichedFlow{}); err != nil {
+		t.Errorf("Segment Script did not reset the cancellation: %v", err)
+	}
+}
+
+func TestSegment_Script_release(t *testing.T) {
+	segment, err := newScript(t, `
+kept = []
+
+def process(flow):
+    if kept:
+        return [kept[0]]
+    kept.append(flow)
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := segment.(*Script)
+	if _, err := script.call(&pb.EnrichedFlow{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.call(&pb.EnrichedFlow{}); err == nil {
+		t.Error("Segment Script passed on a flow from a previous call.")
+	}
+}
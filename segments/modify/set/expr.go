@@ -0,0 +1,679 @@
+package set
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+)
+
+// The type of a value in an expression, which is determined when parsing.
+type kind int
+
+const (
+	kindInt kind = iota
+	kindString
+	kindBool
+	kindAddress
+	kindPrefix // only as the literal operand of 'in'
+)
+
+func (k kind) String() string {
+	return [...]string{"int", "string", "bool", "address", "prefix"}[k]
+}
+
+// Any node of a parsed expression. Values are represented as int64, string,
+// bool, net.IP, or *net.IPNet, according to their kind.
+type expr interface {
+	Kind() kind
+	Eval(msg *pb.EnrichedFlow) (interface{}, error)
+}
+
+type literal struct {
+	kind  kind
+	value interface{}
+}
+
+func (l *literal) Kind() kind                                     { return l.kind }
+func (l *literal) Eval(msg *pb.EnrichedFlow) (interface{}, error) { return l.value, nil }
+
+// Negation of ints or bools.
+type unary struct {
+	op      string
+	operand expr
+}
+
+func (u *unary) Kind() kind { return u.operand.Kind() }
+
+func (u *unary) Eval(msg *pb.EnrichedFlow) (interface{}, error) {
+	value, err := u.operand.Eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	if u.op == "not" {
+		return !value.(bool), nil
+	}
+	return -value.(int64), nil
+}
+
+type binary struct {
+	op          string
+	left, right expr
+	kind        kind
+}
+
+func (b *binary) Kind() kind { return b.kind }
+
+func (b *binary) Eval(msg *pb.EnrichedFlow) (interface{}, error) {
+	left, err := b.left.Eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	// short circuit, such that the right side may rely on the left one
+	switch b.op {
+	case "and":
+		if !left.(bool) {
+			return false, nil
+		}
+		return b.right.Eval(msg)
+	case "or":
+		if left.(bool) {
+			return true, nil
+		}
+		return b.right.Eval(msg)
+	}
+	right, err := b.right.Eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch left := left.(type) {
+	case int64:
+		right := right.(int64)
+		switch b.op {
+		case "+":
+			return left + right, nil
+		case "-":
+			return left - right, nil
+		case "*":
+			return left * right, nil
+		case "/", "%":
+			if right == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if b.op == "/" {
+				return left / right, nil
+			}
+			return left % right, nil
+		case "==":
+			return left == right, nil
+		case "!=":
+			return left != right, nil
+		case "<":
+			return left < right, nil
+		case "<=":
+			return left <= right, nil
+		case ">":
+			return left > right, nil
+		case ">=":
+			return left >= right, nil
+		}
+	case string:
+		right := right.(string)
+		switch b.op {
+		case "+":
+			return left + right, nil
+		case "in":
+			return strings.Contains(right, left), nil
+		case "==":
+			return left == right, nil
+		case "!=":
+			return left != right, nil
+		case "<":
+			return left < right, nil
+		case "<=":
+			return left <= right, nil
+		case ">":
+			return left > right, nil
+		case ">=":
+			return left >= right, nil
+		}
+	case bool:
+		switch b.op {
+		case "==":
+			return left == right.(bool), nil
+		case "!=":
+			return left != right.(bool), nil
+		}
+	case net.IP:
+		switch b.op {
+		case "in":
+			return right.(*net.IPNet).Contains(left), nil
+		case "==":
+			return left.Equal(right.(net.IP)), nil
+		case "!=":
+			return !left.Equal(right.(net.IP)), nil
+		}
+	}
+	return nil, fmt.Errorf("operator %s is not implemented for %T", b.op, left) // not reached, checked when parsing
+}
+
+type conditional struct {
+	condition, then, otherwise expr
+}
+
+func (c *conditional) Kind() kind { return c.then.Kind() }
+
+func (c *conditional) Eval(msg *pb.EnrichedFlow) (interface{}, error) {
+	condition, err := c.condition.Eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	if condition.(bool) {
+		return c.then.Eval(msg)
+	}
+	return c.otherwise.Eval(msg)
+}
+
+// An inline map indexed by a key, yielding its default if the key is not
+// contained. Without a default, the zero value of the map's values is used.
+type lookup struct {
+	entries   map[interface{}]expr
+	otherwise expr
+	key       expr
+	kind      kind
+}
+
+func (l *lookup) Kind() kind { return l.kind }
+
+func (l *lookup) Eval(msg *pb.EnrichedFlow) (interface{}, error) {
+	key, err := l.key.Eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := l.entries[key]; ok {
+		return value.Eval(msg)
+	}
+	return l.otherwise.Eval(msg)
+}
+
+// Converts ints and addresses to strings.
+type str struct {
+	operand expr
+}
+
+func (s *str) Kind() kind { return kindString }
+
+func (s *str) Eval(msg *pb.EnrichedFlow) (interface{}, error) {
+	value, err := s.operand.Eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch value := value.(type) {
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case net.IP:
+		if len(value) == 0 {
+			return "", nil
+		}
+		return value.String(), nil
+	}
+	return value, nil
+}
+
+// A token of an assignment, tokens of kind 'name' may consist of several
+// words, such as 'src port'.
+type token struct {
+	kind  string // one of name, keyword, int, string, address, prefix, op, or end
+	text  string
+	value interface{}
+	col   int
+}
+
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true,
+	"if": true, "then": true, "else": true,
+	"true": true, "false": true, "default": true, "str": true,
+}
+
+var twoCharOps = map[string]bool{"==": true, "!=": true, "<=": true, ">=": true}
+
+func isWordChar(r byte) bool {
+	return r == '_' || unicode.IsLetter(rune(r)) || unicode.IsDigit(rune(r))
+}
+
+func isAddressChar(r byte) bool {
+	return r == ':' || r == '.' || r == '/' || strings.IndexByte("0123456789abcdefABCDEF", r) >= 0
+}
+
+func tokenize(line string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(line[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("column %d: unterminated string", i+1)
+			}
+			text := line[i : i+end+2]
+			tokens = append(tokens, token{kind: "string", text: text, value: text[1 : len(text)-1], col: i + 1})
+			i += end + 2
+			continue
+		}
+		// addresses and prefixes, which may start like ints or words
+		end := i
+		for end < len(line) && isAddressChar(line[end]) {
+			end++
+		}
+		if text := line[i:end]; strings.ContainsAny(text, ".:") {
+			if _, prefix, err := net.ParseCIDR(text); err == nil {
+				tokens = append(tokens, token{kind: "prefix", text: text, value: prefix, col: i + 1})
+				i = end
+				continue
+			} else if addr := net.ParseIP(text); addr != nil {
+				tokens = append(tokens, token{kind: "address", text: text, value: addr, col: i + 1})
+				i = end
+				continue
+			}
+		}
+		switch c := line[i]; {
+		case unicode.IsDigit(rune(c)):
+			end := i
+			for end < len(line) && isWordChar(line[end]) {
+				end++
+			}
+			value, err := strconv.ParseInt(line[i:end], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("column %d: invalid number '%s'", i+1, line[i:end])
+			}
+			tokens = append(tokens, token{kind: "int", text: line[i:end], value: value, col: i + 1})
+			i = end
+		case isWordChar(c):
+			end := i
+			for end < len(line) && isWordChar(line[end]) {
+				end++
+			}
+			kind := "name"
+			if keywords[line[i:end]] {
+				kind = "keyword"
+			}
+			tokens = append(tokens, token{kind: kind, text: line[i:end], col: i + 1})
+			i = end
+		default:
+			op := line[i : i+1]
+			if i+1 < len(line) && twoCharOps[line[i:i+2]] {
+				op = line[i : i+2]
+			} else if !strings.ContainsAny(op, "=<>+-*/%(){}[]:,") {
+				return nil, fmt.Errorf("column %d: unexpected character '%s'", i+1, op)
+			}
+			tokens = append(tokens, token{kind: "op", text: op, col: i + 1})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: "end", text: "end of line", col: len(line) + 1}), nil
+}
+
+// A recursive descent parser for a single assignment. In order of increasing
+// precedence, expressions consist of conditionals, or, and, not, comparisons
+// including in, sums, products, negations, and finally literals, fields,
+// lookups, str calls, and parenthesized expressions.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != "end" {
+		p.pos++
+	}
+	return t
+}
+
+// Consumes the next token if it is the given keyword or operator.
+func (p *parser) accept(text string) bool {
+	if t := p.peek(); (t.kind == "keyword" || t.kind == "op") && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf(p.peek(), "expected '%s', got '%s'", text, p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", t.col, fmt.Sprintf(format, args...))
+}
+
+// Parses a field name, which needs to be the next token.
+func (p *parser) field() (*field, token, error) {
+	t := p.next()
+	if t.kind != "name" {
+		return nil, t, p.errorf(t, "expected a field, got '%s'", t.text)
+	}
+	if t.text != "src" && t.text != "dst" {
+		f, err := lookupField(t.text)
+		if err != nil {
+			return nil, t, p.errorf(t, "%v", err)
+		}
+		return f, t, nil
+	}
+	name := p.next()
+	if name.kind != "name" {
+		return nil, t, p.errorf(name, "expected a field after '%s', got '%s'", t.text, name.text)
+	}
+	if name.text == "iface" || name.text == "interface" {
+		name.text = "iface"
+		if next := p.peek(); next.kind == "name" && directionalFields["iface "+next.text] != [2]string{} {
+			name.text += " " + p.next().text
+		}
+	}
+	f, err := lookupDirectionalField(t.text, name.text)
+	if err != nil {
+		return nil, t, p.errorf(t, "%v", err)
+	}
+	return f, t, nil
+}
+
+func (p *parser) expr() (expr, error) {
+	start := p.peek()
+	if !p.accept("if") {
+		return p.or()
+	}
+	condition, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if condition.Kind() != kindBool {
+		return nil, p.errorf(start, "the condition needs to be a bool, got %s", condition.Kind())
+	}
+	if err := p.expect("then"); err != nil {
+		return nil, err
+	}
+	then, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("else"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if then.Kind() != otherwise.Kind() {
+		return nil, p.errorf(start, "both cases need to be of the same type, got %s and %s", then.Kind(), otherwise.Kind())
+	}
+	return &conditional{condition, then, otherwise}, nil
+}
+
+// Parses a chain of binary operators of the same precedence, checking the
+// types of their operands with the given function, which returns the
+// resulting kind.
+func (p *parser) binary(operand func() (expr, error), check func(op string, left, right kind) (kind, bool), ops ...string) (expr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op := ""
+		for _, candidate := range ops {
+			if p.accept(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		result, ok := check(op, left.Kind(), right.Kind())
+		if !ok {
+			return nil, p.errorf(t, "operator %s is not defined for %s and %s", op, left.Kind(), right.Kind())
+		}
+		left = &binary{op: op, left: left, right: right, kind: result}
+	}
+}
+
+func (p *parser) or() (expr, error) {
+	return p.binary(p.and, checkLogical, "or")
+}
+
+func (p *parser) and() (expr, error) {
+	return p.binary(p.not, checkLogical, "and")
+}
+
+func checkLogical(op string, left, right kind) (kind, bool) {
+	return kindBool, left == kindBool && right == kindBool
+}
+
+func (p *parser) not() (expr, error) {
+	t := p.peek()
+	if !p.accept("not") {
+		return p.comparison()
+	}
+	operand, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	if operand.Kind() != kindBool {
+		return nil, p.errorf(t, "operator not is not defined for %s", operand.Kind())
+	}
+	return &unary{"not", operand}, nil
+}
+
+func (p *parser) comparison() (expr, error) {
+	return p.binary(p.sum, func(op string, left, right kind) (kind, bool) {
+		switch op {
+		case "in":
+			return kindBool, left == kindString && right == kindString || left == kindAddress && right == kindPrefix
+		case "==", "!=":
+			return kindBool, left == right && left != kindPrefix
+		default:
+			return kindBool, left == right && (left == kindInt || left == kindString)
+		}
+	}, "==", "!=", "<=", ">=", "<", ">", "in")
+}
+
+func (p *parser) sum() (expr, error) {
+	return p.binary(p.product, func(op string, left, right kind) (kind, bool) {
+		return left, left == right && (left == kindInt || op == "+" && left == kindString)
+	}, "+", "-")
+}
+
+func (p *parser) product() (expr, error) {
+	return p.binary(p.negation, func(op string, left, right kind) (kind, bool) {
+		return kindInt, left == kindInt && right == kindInt
+	}, "*", "/", "%")
+}
+
+func (p *parser) negation() (expr, error) {
+	t := p.peek()
+	if !p.accept("-") {
+		return p.primary()
+	}
+	operand, err := p.negation()
+	if err != nil {
+		return nil, err
+	}
+	if operand.Kind() != kindInt {
+		return nil, p.errorf(t, "operator - is not defined for %s", operand.Kind())
+	}
+	return &unary{"-", operand}, nil
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == "int":
+		p.next()
+		return &literal{kindInt, t.value}, nil
+	case t.kind == "string":
+		p.next()
+		return &literal{kindString, t.value}, nil
+	case t.kind == "address":
+		p.next()
+		return &literal{kindAddress, t.value}, nil
+	case t.kind == "prefix":
+		p.next()
+		return &literal{kindPrefix, t.value}, nil
+	case t.kind == "name":
+		f, _, err := p.field()
+		return f, err
+	case p.accept("true"):
+		return &literal{kindBool, true}, nil
+	case p.accept("false"):
+		return &literal{kindBool, false}, nil
+	case p.accept("str"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		operand, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if operand.Kind() == kindPrefix || operand.Kind() == kindBool {
+			return nil, p.errorf(t, "str is not defined for %s", operand.Kind())
+		}
+		return &str{operand}, p.expect(")")
+	case p.accept("("):
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case p.accept("{"):
+		return p.lookup(t)
+	}
+	return nil, p.errorf(t, "unexpected '%s'", t.text)
+}
+
+// Parses an inline map followed by the key to look up, the opening brace
+// has been consumed already.
+func (p *parser) lookup(start token) (expr, error) {
+	l := &lookup{entries: make(map[interface{}]expr)}
+	keyKind, valueKind := kind(-1), kind(-1)
+	checkValue := func(t token, value expr) error {
+		if valueKind >= 0 && value.Kind() != valueKind {
+			return p.errorf(t, "all values need to be of the same type, got %s and %s", valueKind, value.Kind())
+		}
+		valueKind = value.Kind()
+		return nil
+	}
+	for !p.accept("}") {
+		if len(l.entries) > 0 || l.otherwise != nil {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept("}") { // trailing comma
+				break
+			}
+		}
+		t := p.next()
+		isDefault := t.kind == "keyword" && t.text == "default"
+		if !isDefault && t.kind != "int" && t.kind != "string" {
+			return nil, p.errorf(t, "expected an int or string key, got '%s'", t.text)
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		valueToken := p.peek()
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkValue(valueToken, value); err != nil {
+			return nil, err
+		}
+		if isDefault {
+			if l.otherwise != nil {
+				return nil, p.errorf(t, "duplicate default")
+			}
+			l.otherwise = value
+			continue
+		}
+		tokenKind := map[string]kind{"int": kindInt, "string": kindString}[t.kind]
+		if keyKind >= 0 && tokenKind != keyKind {
+			return nil, p.errorf(t, "all keys need to be of the same type, got %s and %s", keyKind, tokenKind)
+		}
+		keyKind = tokenKind
+		if _, ok := l.entries[t.value]; ok {
+			return nil, p.errorf(t, "duplicate key %s", t.text)
+		}
+		l.entries[t.value] = value
+	}
+	if len(l.entries) == 0 {
+		return nil, p.errorf(start, "the map needs at least one key")
+	}
+	l.kind = valueKind
+	if l.otherwise == nil {
+		l.otherwise = &literal{valueKind, map[kind]interface{}{
+			kindInt: int64(0), kindString: "", kindBool: false, kindAddress: net.IP(nil),
+		}[valueKind]}
+	}
+	t := p.peek()
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	key, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if key.Kind() != keyKind {
+		return nil, p.errorf(t, "the key needs to be of type %s, got %s", keyKind, key.Kind())
+	}
+	l.key = key
+	return l, p.expect("]")
+}
+
+// An assignment of an expression to a flow field.
+type assignment struct {
+	target *field
+	value  expr
+}
+
+func parseAssignment(line string) (*assignment, error) {
+	tokens, err := tokenize(line)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	target, t, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	if target.derived != nil {
+		return nil, p.errorf(t, "field '%s' is calculated and can not be assigned to", target.name)
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	valueToken := p.peek()
+	value, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if end := p.peek(); end.kind != "end" {
+		return nil, p.errorf(end, "unexpected '%s'", end.text)
+	}
+	if value.Kind() != target.Kind() {
+		return nil, p.errorf(valueToken, "field '%s' needs a value of type %s, got %s", target.name, target.Kind(), value.Kind())
+	}
+	return &assignment{target: target, value: value}, nil
+}
@@ -0,0 +1,178 @@
+package set
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+)
+
+// The flowfilter keywords referring to a flow field, in addition to the names
+// of the fields themselves. Directional ones need to be preceded by src or dst.
+var (
+	regularFields = map[string]string{
+		"bytes":        "Bytes",
+		"packets":      "Packets",
+		"proto":        "Proto",
+		"etype":        "Etype",
+		"iptos":        "IPTos",
+		"tcpflags":     "TCPFlags",
+		"status":       "ForwardingStatus",
+		"samplingrate": "SamplingRate",
+		"normalized":   "Normalized",
+		"direction":    "FlowDirection",
+		"router":       "SamplerAddress",
+		"nexthop":      "NextHop",
+		"nexthopasn":   "NextHopAS",
+		"med":          "Med",
+		"localpref":    "LocalPref",
+		"rpki":         "ValidationStatus",
+		"country":      "RemoteCountry",
+		"cid":          "Cid",
+		"vlan":         "VlanId",
+		"note":         "Note",
+	}
+	directionalFields = map[string][2]string{
+		"address":     {"SrcAddr", "DstAddr"},
+		"port":        {"SrcPort", "DstPort"},
+		"asn":         {"SrcAS", "DstAS"},
+		"netsize":     {"SrcNet", "DstNet"},
+		"cid":         {"SrcCid", "DstCid"},
+		"vlan":        {"SrcVlan", "DstVlan"},
+		"vrf":         {"IngressVrfID", "EgressVrfID"},
+		"iface":       {"InIf", "OutIf"},
+		"iface id":    {"InIf", "OutIf"},
+		"iface name":  {"SrcIfName", "DstIfName"},
+		"iface desc":  {"SrcIfDesc", "DstIfDesc"},
+		"iface speed": {"SrcIfSpeed", "DstIfSpeed"},
+	}
+	// calculated from other fields and thus read only
+	derivedFields = map[string]func(msg *pb.EnrichedFlow) int64{
+		"duration": duration,
+		"bps": func(msg *pb.EnrichedFlow) int64 {
+			return int64(msg.Bytes*8) / duration(msg)
+		},
+		"pps": func(msg *pb.EnrichedFlow) int64 {
+			return int64(msg.Packets) / duration(msg)
+		},
+	}
+)
+
+// Returns the flow's duration in seconds, but at least 1, as done by
+// flowfilter.
+func duration(msg *pb.EnrichedFlow) int64 {
+	duration := int64(msg.TimeFlowEnd) - int64(msg.TimeFlowStart)
+	if duration <= 0 {
+		return 1
+	}
+	return duration
+}
+
+// A flow field, as referred to in an expression.
+type field struct {
+	name    string
+	index   []int                            // nil for derived fields
+	derived func(msg *pb.EnrichedFlow) int64 // nil for regular fields
+	kind    kind
+}
+
+// Looks up a field by its flowfilter keyword or its name in pb.EnrichedFlow.
+func lookupField(name string) (*field, error) {
+	if derived, ok := derivedFields[name]; ok {
+		return &field{name: name, derived: derived, kind: kindInt}, nil
+	}
+	fieldName := name
+	if regular, ok := regularFields[name]; ok {
+		fieldName = regular
+	}
+	structField, ok := reflect.TypeOf(pb.EnrichedFlow{}).FieldByName(fieldName)
+	if !ok || !structField.IsExported() {
+		return nil, fmt.Errorf("unknown field '%s'", name)
+	}
+	f := &field{name: name, index: structField.Index}
+	switch structField.Type.Kind() {
+	case reflect.Bool:
+		f.kind = kindBool
+	case reflect.String:
+		f.kind = kindString
+	case reflect.Int32, reflect.Uint32, reflect.Uint64:
+		f.kind = kindInt
+	case reflect.Slice:
+		if structField.Type.Elem().Kind() != reflect.Uint8 {
+			return nil, fmt.Errorf("field '%s' is a list and can not be used", name)
+		}
+		f.kind = kindAddress
+	default:
+		return nil, fmt.Errorf("field '%s' is of unsupported type %s", name, structField.Type)
+	}
+	return f, nil
+}
+
+// Looks up a directional field, which is src or dst followed by a flowfilter
+// keyword.
+func lookupDirectionalField(direction string, name string) (*field, error) {
+	names, ok := directionalFields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field '%s %s'", direction, name)
+	}
+	fieldName := names[0]
+	if direction == "dst" {
+		fieldName = names[1]
+	}
+	f, err := lookupField(fieldName)
+	if err != nil {
+		return nil, err
+	}
+	f.name = direction + " " + name
+	return f, nil
+}
+
+func (f *field) Kind() kind { return f.kind }
+
+func (f *field) Eval(msg *pb.EnrichedFlow) (interface{}, error) {
+	if f.derived != nil {
+		return f.derived(msg), nil
+	}
+	value := reflect.ValueOf(msg).Elem().FieldByIndex(f.index)
+	switch value.Kind() {
+	case reflect.Bool:
+		return value.Bool(), nil
+	case reflect.String:
+		return value.String(), nil
+	case reflect.Int32:
+		return value.Int(), nil
+	case reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint()), nil
+	default:
+		return net.IP(value.Bytes()), nil
+	}
+}
+
+// Sets the field to the given value, which is of the field's kind.
+func (f *field) set(msg *pb.EnrichedFlow, v interface{}) error {
+	value := reflect.ValueOf(msg).Elem().FieldByIndex(f.index)
+	switch value.Kind() {
+	case reflect.Bool:
+		value.SetBool(v.(bool))
+	case reflect.String:
+		value.SetString(v.(string))
+	case reflect.Int32:
+		if value.OverflowInt(v.(int64)) {
+			return fmt.Errorf("value %d is out of range for field '%s'", v, f.name)
+		}
+		value.SetInt(v.(int64))
+	case reflect.Uint32, reflect.Uint64:
+		if v.(int64) < 0 || value.OverflowUint(uint64(v.(int64))) {
+			return fmt.Errorf("value %d is out of range for field '%s'", v, f.name)
+		}
+		value.SetUint(uint64(v.(int64)))
+	default:
+		addr := v.(net.IP)
+		if ipv4 := addr.To4(); ipv4 != nil {
+			addr = ipv4
+		}
+		value.SetBytes(append([]byte(nil), addr...))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Assigns the results of expressions to flow fields.
+package set
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"github.com/bwNetFlow/flowpipeline/segments/internal/errorlog"
+)
+
+type Set struct {
+	segments.BaseSegment
+	Assignments []string // required, lines of the form 'field = expression', applied in order
+
+	assignments []*assignment
+	errorLog    *errorlog.Logger
+}
+
+func (segment Set) New(config map[string]string) (segments.Segment, error) {
+	newsegment := &Set{errorLog: &errorlog.Logger{Prefix: "[error] Set: "}}
+	for i, line := range strings.Split(config["assignments"], "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		assignment, err := parseAssignment(line) // untrimmed to report the correct columns
+		if err != nil {
+			return nil, segments.NewConfigError("assignments", "line %d, %v", i+1, err)
+		}
+		newsegment.Assignments = append(newsegment.Assignments, trimmed)
+		newsegment.assignments = append(newsegment.assignments, assignment)
+	}
+	if len(newsegment.assignments) == 0 {
+		return nil, segments.NewConfigError("assignments", "needs at least one assignment")
+	}
+	return newsegment, nil
+}
+
+// Applies all assignments to a flow. Any assignment failing at runtime, for
+// instance due to a division by zero, leaves its field untouched.
+func (segment *Set) apply(msg *pb.EnrichedFlow) {
+	for i, assignment := range segment.assignments {
+		value, err := assignment.value.Eval(msg)
+		if err == nil {
+			err = assignment.target.set(msg, value)
+		}
+		if err != nil {
+			segment.errorLog.Printf("Skipping assignment '%s', %v", segment.Assignments[i], err)
+		}
+	}
+}
+
+func (segment *Set) Run(wg *sync.WaitGroup) {
+	defer func() {
+		segment.errorLog.Flush()
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		segment.apply(msg)
+		segment.Out <- msg
+	}
+}
+
+func init() {
+	segment := &Set{}
+	segments.RegisterSegment("set", segment)
+	segments.RegisterSchema("set", segments.Schema{
+		Summary: "Assigns the results of expressions to flow fields.",
+		Params: []segments.Param{
+			{Name: "assignments", Required: true, Doc: "One assignment of the form 'field = expression' per line, lines starting with # are ignored."},
+		},
+	})
+}
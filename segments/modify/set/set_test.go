@@ -0,0 +1,125 @@
+package set
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+)
+
+func TestSegment_Set_assignments(t *testing.T) {
+	result := segments.TestSegment("set", map[string]string{"assignments": `
+# comments and empty lines are ignored
+
+Note = if dst port == 443 or dst port == 80 then "web" else "port " + str(dst port)
+Cid = {10: 1001, 20: 1002, default: cid}[src vlan]
+NextHop = dst address
+SrcCid = if src address in 10.0.0.0/8 and not (proto == 17) then 42 else 0
+DstCid = (bytes * 8 + 1) / 2 % 1000 - -1
+RemoteCountry = {"web": "DE"}[note]
+`}, &pb.EnrichedFlow{
+		SrcAddr: net.ParseIP("10.0.0.1").To4(),
+		DstAddr: net.ParseIP("2001:db8::1"),
+		DstPort: 443,
+		SrcVlan: 20,
+		Cid:     7,
+		Proto:   6,
+		Bytes:   1000,
+	})
+	if result.Note != "web" {
+		t.Errorf("Segment Set assigned Note incorrectly: %s", result.Note)
+	}
+	if result.Cid != 1002 {
+		t.Errorf("Segment Set assigned Cid incorrectly: %d", result.Cid)
+	}
+	if !net.IP(result.NextHop).Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Segment Set assigned NextHop incorrectly: %v", result.NextHop)
+	}
+	if result.SrcCid != 42 {
+		t.Errorf("Segment Set assigned SrcCid incorrectly: %d", result.SrcCid)
+	}
+	if result.DstCid != (1000*8+1)/2%1000+1 {
+		t.Errorf("Segment Set assigned DstCid incorrectly: %d", result.DstCid)
+	}
+	if result.RemoteCountry != "DE" {
+		t.Errorf("Segment Set did not apply assignments in order: %s", result.RemoteCountry)
+	}
+}
+
+func TestSegment_Set_defaults(t *testing.T) {
+	result := segments.TestSegment("set", map[string]string{"assignments": `
+Note = if dst port == 443 then "web" else "port " + str(dst port)
+Cid = {10: 1001, 20: 1002, default: cid}[src vlan]
+SrcCid = {10: 1001}[src vlan]
+`}, &pb.EnrichedFlow{DstPort: 22, SrcVlan: 30, Cid: 7, SrcCid: 5})
+	if result.Note != "port 22" || result.Cid != 7 || result.SrcCid != 0 {
+		t.Errorf("Segment Set did not use the defaults correctly: %v", result)
+	}
+}
+
+func TestSegment_Set_runtimeErrors(t *testing.T) {
+	result := segments.TestSegment("set", map[string]string{"assignments": `
+Cid = 10 / bytes
+SrcCid = 0 - 1
+Note = "still applied"
+`}, &pb.EnrichedFlow{Cid: 7, SrcCid: 5})
+	if result.Cid != 7 || result.SrcCid != 5 || result.Note != "still applied" {
+		t.Errorf("Segment Set did not skip the failing assignments only: %v", result)
+	}
+}
+
+func TestSegment_Set_typeCheck(t *testing.T) {
+	for assignments, expected := range map[string]string{
+		"":                                    "at least one assignment",
+		"Note = 1":                            "line 1, column 8: field 'Note' needs a value of type string, got int",
+		"\n  Cid = \"1\"":                     "line 2, column 9",
+		"Cid = cid + note":                    "operator + is not defined for int and string",
+		"Note = if cid then \"a\" else \"b\"": "condition needs to be a bool",
+		"Note = if true then \"a\" else 1":    "same type",
+		"Cid = {1: 2, \"a\": 3}[cid]":         "all keys need to be of the same type",
+		"Cid = {1: 2, 2: \"a\"}[cid]":         "all values need to be of the same type",
+		"Cid = {1: 2}[note]":                  "the key needs to be of type int",
+		"Cid = {1: 2, 1: 3}[cid]":             "duplicate key",
+		"bps = 1":                             "can not be assigned to",
+		"Cid = foo":                           "unknown field 'foo'",
+		"Cid = src foo":                       "unknown field 'src foo'",
+		"ASPath = 1":                          "is a list",
+		"Cid = cid cid":                       "unexpected 'cid'",
+		"Note = \"open":                       "unterminated string",
+		"Cid = if src address in 10.0.0.1 then 1 else 0":  "operator in is not defined for address and address",
+		"Cid = if 10.0.0.0/8 == 10.0.0.0/8 then 1 else 0": "operator == is not defined for prefix and prefix",
+		"Cid = 1 $ 2": "unexpected character '$'",
+	} {
+		_, err := (&Set{}).New(map[string]string{"assignments": assignments})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Segment Set reported %v for %q instead of an error containing %q.", err, assignments, expected)
+		}
+	}
+}
+
+func TestSegment_Set_fields(t *testing.T) {
+	result := segments.TestSegment("set", map[string]string{"assignments": `
+SrcIfName = "in " + str(src iface) + " " + src interface desc
+DstIfDesc = str(router) + " " + str(nexthop)
+Note = str(duration) + " " + str(bps) + " " + str(pps)
+`}, &pb.EnrichedFlow{
+		InIf:           3,
+		SrcIfDesc:      "uplink",
+		SamplerAddress: net.ParseIP("192.0.2.1").To4(),
+		TimeFlowStart:  100,
+		TimeFlowEnd:    110,
+		Bytes:          1000,
+		Packets:        20,
+	})
+	if result.SrcIfName != "in 3 uplink" {
+		t.Errorf("Segment Set resolved directional fields incorrectly: %s", result.SrcIfName)
+	}
+	if result.DstIfDesc != "192.0.2.1 " {
+		t.Errorf("Segment Set converted addresses incorrectly: %s", result.DstIfDesc)
+	}
+	if result.Note != "10 800 2" {
+		t.Errorf("Segment Set calculated derived fields incorrectly: %s", result.Note)
+	}
+}
@@ -33,14 +33,13 @@ type SNMPInterface struct {
 	connLimitSemaphore chan struct{}
 }
 
-func (segment SNMPInterface) New(config map[string]string) segments.Segment {
+func (segment SNMPInterface) New(config map[string]string) (segments.Segment, error) {
 	var connLimit uint64 = 16
 	if config["connlimit"] != "" {
 		if parsedConnLimit, err := strconv.ParseUint(config["connlimit"], 10, 32); err == nil {
 			connLimit = parsedConnLimit
 			if connLimit == 0 {
-				log.Println("[error] SNMPInterface: Limiting connections to 0 will not work. Remove this segment or use a higher value (recommendation >= 16).")
-				return nil
+				return nil, segments.NewConfigError("connlimit", "limiting connections to 0 will not work, use a higher value (recommendation >= 16)")
 			}
 		} else {
 			log.Println("[error] SNMPInterface: Could not parse 'connlimit' parameter, using default 16.")
@@ -63,15 +62,14 @@ func (segment SNMPInterface) New(config map[string]string) segments.Segment {
 	}
 	compiledRegex, err := regexp.Compile(regex)
 	if err != nil {
-		log.Printf("[error] SNMPInterface: Configuration error, regex does not compile: %v", err)
-		return nil
+		return nil, segments.NewConfigError("regex", "does not compile: %v", err)
 	}
 	return &SNMPInterface{
 		Community:     community,
 		Regex:         regex,
 		ConnLimit:     connLimit,
 		compiledRegex: compiledRegex,
-	}
+	}, nil
 }
 
 func (segment *SNMPInterface) Run(wg *sync.WaitGroup) {
@@ -176,4 +174,12 @@ func (segment *SNMPInterface) fetchInterfaceData(router string, iface uint32) (s
 func init() {
 	segment := &SNMPInterface{}
 	segments.RegisterSegment("snmpinterface", segment)
+	segments.RegisterSchema("snmpinterface", segments.Schema{
+		Summary: "Adds interface names, descriptions and speeds to flows using SNMP.",
+		Params: []segments.Param{
+			{Name: "community", Default: "public", Doc: "The SNMPv2 community to use."},
+			{Name: "regex", Default: "^(.*)$", Doc: "A regex whose first match group is used as interface description."},
+			{Name: "connlimit", Type: segments.TypeUint, Default: "16", Doc: "The maximum number of concurrent SNMP connections."},
+		},
+	})
 }
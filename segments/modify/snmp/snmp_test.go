@@ -25,38 +25,38 @@ import (
 
 func TestSegment_SNMPInterface_instanciation(t *testing.T) {
 	snmpInterface := &SNMPInterface{}
-	result := snmpInterface.New(map[string]string{})
-	if result == nil {
+	_, err := snmpInterface.New(map[string]string{})
+	if err != nil {
 		t.Error("Segment SNMPInterface did not initiate despite good base config.")
 	}
 
 	snmpInterface = &SNMPInterface{}
-	result = snmpInterface.New(map[string]string{"connlimit": "42"})
-	if result == nil {
+	_, err = snmpInterface.New(map[string]string{"connlimit": "42"})
+	if err != nil {
 		t.Error("Segment SNMPInterface did not initiate despite good base config.")
 	}
 
 	snmpInterface = &SNMPInterface{}
-	result = snmpInterface.New(map[string]string{"community": "foo", "regex": ".*"})
-	if result == nil {
+	_, err = snmpInterface.New(map[string]string{"community": "foo", "regex": ".*"})
+	if err != nil {
 		t.Error("Segment SNMPInterface did not initiate despite good config.")
 	}
 
 	snmpInterface = &SNMPInterface{}
-	result = snmpInterface.New(map[string]string{"community": "foo", "regex": "("})
-	if result != nil {
+	_, err = snmpInterface.New(map[string]string{"community": "foo", "regex": "("})
+	if err == nil {
 		t.Error("Segment SNMPInterface did initiate despite bad regex config.")
 	}
 
 	snmpInterface = &SNMPInterface{}
-	result = snmpInterface.New(map[string]string{"connlimit": "-8"})
-	if result == nil {
+	_, err = snmpInterface.New(map[string]string{"connlimit": "-8"})
+	if err != nil {
 		t.Error("Segment SNMPInterface did not fallback to connlimit default config.")
 	}
 
 	snmpInterface = &SNMPInterface{}
-	result = snmpInterface.New(map[string]string{"connlimit": "0"})
-	if result != nil {
+	_, err = snmpInterface.New(map[string]string{"connlimit": "0"})
+	if err == nil {
 		t.Error("Segment SNMPInterface initiated despide bad config.")
 	}
 }
@@ -0,0 +1,378 @@
+// Runs a WebAssembly module for each flow, which may modify or drop it.
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/bwNetFlow/flowpipeline/segments"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"google.golang.org/protobuf/proto"
+)
+
+// The name of the module providing the host functions to guests.
+const hostModule = "flowpipeline"
+
+var (
+	i32 = api.ValueTypeI32
+	i64 = api.ValueTypeI64
+
+	// The functions a guest needs to export, in addition to its memory.
+	// The process function is configurable, but keeps its signature.
+	requiredExports = map[string][2][]api.ValueType{
+		"alloc":   {{i32}, {i32}},
+		"process": {{i32, i32}, {i64}},
+	}
+	optionalExports = map[string][2][]api.ValueType{
+		"free": {{i32, i32}, {}},
+	}
+)
+
+type Wasm struct {
+	segments.BaseFilterSegment
+	FileName  string        // required, the WebAssembly module to run
+	Function  string        // optional, default is "process", the name of the function to call for each flow
+	Instances int           // optional, default is 1, the number of module instances processing flows in parallel
+	Timeout   time.Duration // optional, default is 1s, the time each call of the function may take before the instance is replaced
+
+	wasm []byte
+
+	stateLock *sync.Mutex
+	state     map[string][]byte // shared by all instances
+}
+
+func (segment Wasm) New(config map[string]string) (segments.Segment, error) {
+	newsegment := &Wasm{
+		FileName:  config["filename"],
+		Function:  "process",
+		Instances: 1,
+		Timeout:   time.Second,
+		stateLock: &sync.Mutex{},
+		state:     make(map[string][]byte),
+	}
+	if newsegment.FileName == "" {
+		return nil, segments.NewConfigError("filename", "is required")
+	}
+	if config["function"] != "" {
+		newsegment.Function = config["function"]
+	}
+	if config["instances"] != "" {
+		instances, err := strconv.Atoi(config["instances"])
+		if err != nil || instances < 1 {
+			return nil, segments.NewConfigError("instances", "needs to be a positive number")
+		}
+		newsegment.Instances = instances
+	}
+	if config["timeout"] != "" {
+		timeout, err := time.ParseDuration(config["timeout"])
+		if err != nil || timeout <= 0 {
+			return nil, segments.NewConfigError("timeout", "needs to be a positive duration")
+		}
+		newsegment.Timeout = timeout
+	}
+
+	var err error
+	newsegment.wasm, err = os.ReadFile(segments.ContainerVolumePrefix + newsegment.FileName)
+	if err != nil {
+		return nil, segments.NewConfigError("filename", "could not be read: %v", err)
+	}
+	// compile once to report any problems with the module right away
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+	if _, err := newsegment.compile(ctx, runtime); err != nil {
+		return nil, segments.NewConfigError("filename", "%v", err)
+	}
+	return newsegment, nil
+}
+
+// Compiles the module and checks its imports and exports.
+func (segment *Wasm) compile(ctx context.Context, runtime wazero.Runtime) (wazero.CompiledModule, error) {
+	compiled, err := runtime.CompileModule(ctx, segment.wasm)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		return nil, fmt.Errorf("the module does not export its memory as 'memory'")
+	}
+	exports := compiled.ExportedFunctions()
+	check := func(name string, export string, signature [2][]api.ValueType, required bool) error {
+		definition, ok := exports[export]
+		if !ok {
+			if required {
+				return fmt.Errorf("the module does not export a function named '%s'", export)
+			}
+			return nil
+		}
+		if !equalTypes(definition.ParamTypes(), signature[0]) || !equalTypes(definition.ResultTypes(), signature[1]) {
+			return fmt.Errorf("the exported function '%s' needs to have the signature of %s", export, signatureString(name, signature))
+		}
+		return nil
+	}
+	for name, signature := range requiredExports {
+		export := name
+		if name == "process" {
+			export = segment.Function
+		}
+		if err := check(name, export, signature, true); err != nil {
+			return nil, err
+		}
+	}
+	for name, signature := range optionalExports {
+		if err := check(name, name, signature, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, imported := range compiled.ImportedFunctions() {
+		module, name, _ := imported.Import()
+		if module != hostModule && module != wasi_snapshot_preview1.ModuleName {
+			return nil, fmt.Errorf("the module imports '%s' from the unknown module '%s'", name, module)
+		}
+	}
+	return compiled, nil
+}
+
+func equalTypes(a, b []api.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func signatureString(name string, signature [2][]api.ValueType) string {
+	format := func(types []api.ValueType) string {
+		s := ""
+		for i, t := range types {
+			if i > 0 {
+				s += ", "
+			}
+			s += api.ValueTypeName(t)
+		}
+		return s
+	}
+	return fmt.Sprintf("%s(%s) -> (%s)", name, format(signature[0]), format(signature[1]))
+}
+
+// Provides logging and a key value store shared by all instances to guests.
+func (segment *Wasm) instantiateHostModule(ctx context.Context, runtime wazero.Runtime) error {
+	_, err := runtime.NewHostModuleBuilder(hostModule).
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, ptr, length uint32) {
+			if msg, ok := m.Memory().Read(ptr, length); ok {
+				log.Printf("[info] Wasm: %s", msg)
+			}
+		}).
+		Export("log").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, keyPtr, keyLen, valuePtr, valueCap uint32) int32 {
+			key, ok := m.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return -1
+			}
+			segment.stateLock.Lock()
+			value, ok := segment.state[string(key)]
+			segment.stateLock.Unlock()
+			if !ok {
+				return -1
+			}
+			if uint32(len(value)) <= valueCap {
+				m.Memory().Write(valuePtr, value)
+			}
+			return int32(len(value))
+		}).
+		Export("state_get").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, keyPtr, keyLen, valuePtr, valueLen uint32) {
+			key, ok := m.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return
+			}
+			value, ok := m.Memory().Read(valuePtr, valueLen)
+			if !ok {
+				return
+			}
+			segment.stateLock.Lock()
+			segment.state[string(key)] = append([]byte(nil), value...)
+			segment.stateLock.Unlock()
+		}).
+		Export("state_set").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, keyPtr, keyLen uint32) {
+			if key, ok := m.Memory().Read(keyPtr, keyLen); ok {
+				segment.stateLock.Lock()
+				delete(segment.state, string(key))
+				segment.stateLock.Unlock()
+			}
+		}).
+		Export("state_delete").
+		Instantiate(ctx)
+	return err
+}
+
+// A single instance of the module.
+type instance struct {
+	module  api.Module
+	alloc   api.Function
+	free    api.Function // nil if not exported
+	process api.Function
+}
+
+func (segment *Wasm) instantiate(ctx context.Context, runtime wazero.Runtime, compiled wazero.CompiledModule) (*instance, error) {
+	config := wazero.NewModuleConfig().
+		WithName(""). // allows for several instances
+		WithStartFunctions("_initialize").
+		WithStdout(os.Stderr).
+		WithStderr(os.Stderr)
+	module, err := runtime.InstantiateModule(ctx, compiled, config)
+	if err != nil {
+		return nil, err
+	}
+	return &instance{
+		module:  module,
+		alloc:   module.ExportedFunction("alloc"),
+		free:    module.ExportedFunction("free"),
+		process: module.ExportedFunction(segment.Function),
+	}, nil
+}
+
+// Passes a flow to the instance and returns the result, which is nil if the
+// flow is to be dropped. The guest's process function receives a pointer to
+// the serialized flow and its length, and returns the pointer to the
+// resulting flow in the upper and its length in the lower 32 bits, or 0 to
+// drop the flow.
+func (inst *instance) call(ctx context.Context, msg *pb.EnrichedFlow) (*pb.EnrichedFlow, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	results, err := inst.alloc.Call(ctx, uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(results[0])
+	if !inst.module.Memory().Write(ptr, data) {
+		return nil, fmt.Errorf("alloc returned an invalid pointer")
+	}
+	results, err = inst.process.Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	resultPtr, resultLen := uint32(results[0]>>32), uint32(results[0])
+	var result *pb.EnrichedFlow
+	if results[0] != 0 {
+		resultData, ok := inst.module.Memory().Read(resultPtr, resultLen)
+		if !ok {
+			return nil, fmt.Errorf("process returned an invalid pointer")
+		}
+		result = &pb.EnrichedFlow{}
+		if err := proto.Unmarshal(resultData, result); err != nil {
+			return nil, err
+		}
+	}
+	if inst.free != nil {
+		if _, err := inst.free.Call(ctx, uint64(ptr), uint64(len(data))); err != nil {
+			return nil, err
+		}
+		if results[0] != 0 && resultPtr != ptr {
+			if _, err := inst.free.Call(ctx, uint64(resultPtr), uint64(resultLen)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (segment *Wasm) Run(wg *sync.WaitGroup) {
+	ctx := context.Background()
+	// closes an instance once the context of a call is done, which ends
+	// guests running into the timeout
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	defer func() {
+		runtime.Close(ctx)
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+	compiled, err := segment.compile(ctx, runtime)
+	if err == nil {
+		err = segment.instantiateHostModule(ctx, runtime)
+	}
+	if err != nil {
+		segment.ShutdownParentPipelineWithError(fmt.Errorf("Wasm: %w", err))
+		for msg := range segment.In {
+			segment.Out <- msg
+		}
+		return
+	}
+
+	var instanceWg sync.WaitGroup
+	for i := 0; i < segment.Instances; i++ {
+		inst, err := segment.instantiate(ctx, runtime, compiled)
+		if err != nil {
+			segment.ShutdownParentPipelineWithError(fmt.Errorf("Wasm: %w", err))
+			break
+		}
+		instanceWg.Add(1)
+		go func() {
+			defer instanceWg.Done()
+			for msg := range segment.In {
+				callCtx, cancel := context.WithTimeout(ctx, segment.Timeout)
+				result, err := inst.call(callCtx, msg)
+				cancel()
+				if err != nil {
+					// the instance might be broken, for instance if
+					// the guest exited, thus replace it
+					log.Printf("[error] Wasm: Passing on the flow unmodified, %v", err)
+					inst.module.Close(ctx)
+					if inst, err = segment.instantiate(ctx, runtime, compiled); err != nil {
+						segment.ShutdownParentPipelineWithError(fmt.Errorf("Wasm: %w", err))
+						segment.Out <- msg
+						for msg := range segment.In {
+							segment.Out <- msg
+						}
+						return
+					}
+					segment.Out <- msg
+				} else if result != nil {
+					segment.Copied(msg, result)
+					segment.Consumed(msg)
+					segment.Out <- result
+				} else if segment.Drops != nil {
+					segment.Drops <- msg
+				}
+			}
+		}()
+	}
+	instanceWg.Wait()
+	for msg := range segment.In { // in case no instance could be started
+		segment.Out <- msg
+	}
+}
+
+func init() {
+	segment := &Wasm{}
+	segments.RegisterSegment("wasm", segment)
+	segments.RegisterSchema("wasm", segments.Schema{
+		Summary: "Runs a WebAssembly module for each flow, which may modify or drop it.",
+		Params: []segments.Param{
+			{Name: "filename", Required: true, Doc: "The WebAssembly module, which needs to export the functions alloc and process as well as its memory."},
+			{Name: "function", Default: "process", Doc: "The name of the exported function to call for each flow."},
+			{Name: "instances", Type: segments.TypeUint, Default: "1", Doc: "The number of module instances processing flows in parallel."},
+			{Name: "timeout", Type: segments.TypeDuration, Default: "1s", Doc: "The time the function has for each flow before its instance is replaced."},
+		},
+	})
+}
@@ -0,0 +1,170 @@
+package wasm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwNetFlow/flowpipeline/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Assembles a section of a WebAssembly binary from its id and contents.
+func section(id byte, contents ...byte) []byte {
+	return append([]byte{id, byte(len(contents))}, contents...)
+}
+
+// Builds a minimal module, which logs "hello", stores the flow in the state
+// under "k", drops UDP flows and changes the protocol of all others to 7.
+// The flow is expected to start with the protocol, i.e. to have no fields
+// with lower numbers set. Its function spin loops forever instead.
+func testModule() []byte {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(1, // types
+		4,
+		0x60, 2, 0x7f, 0x7f, 0, // (i32, i32) -> ()
+		0x60, 4, 0x7f, 0x7f, 0x7f, 0x7f, 0, // (i32, i32, i32, i32) -> ()
+		0x60, 1, 0x7f, 1, 0x7f, // (i32) -> (i32)
+		0x60, 2, 0x7f, 0x7f, 1, 0x7e, // (i32, i32) -> (i64)
+	)...)
+	module = append(module, section(2, // imports
+		2,
+		12, 'f', 'l', 'o', 'w', 'p', 'i', 'p', 'e', 'l', 'i', 'n', 'e', 3, 'l', 'o', 'g', 0, 0,
+		12, 'f', 'l', 'o', 'w', 'p', 'i', 'p', 'e', 'l', 'i', 'n', 'e', 9, 's', 't', 'a', 't', 'e', '_', 's', 'e', 't', 0, 1,
+	)...)
+	module = append(module, section(3, 3, 2, 3, 3)...) // functions
+	module = append(module, section(5, 1, 0, 1)...)    // memory
+
+	module = append(module, section(7, // exports
+		4,
+		6, 'm', 'e', 'm', 'o', 'r', 'y', 2, 0,
+		5, 'a', 'l', 'l', 'o', 'c', 0, 2,
+		7, 'p', 'r', 'o', 'c', 'e', 's', 's', 0, 3,
+		4, 's', 'p', 'i', 'n', 0, 4,
+	)...)
+	alloc := []byte{0, 0x41, 0x80, 0x08, 0x0b} // return 1024
+	process := []byte{0,
+		0x41, 0, 0x41, 5, 0x10, 0, // log(0, 5)
+		0x41, 8, 0x41, 1, 0x20, 0, 0x20, 1, 0x10, 1, // state_set(8, 1, ptr, len)
+		0x20, 0, 0x2d, 0, 2, 0x41, 17, 0x46, // mem[ptr+2] == 17
+		0x04, 0x40, 0x42, 0, 0x0f, 0x0b, // if { return 0 }
+		0x20, 0, 0x41, 7, 0x3a, 0, 2, // mem[ptr+2] = 7
+		0x20, 0, 0xad, 0x42, 32, 0x86, 0x20, 1, 0xad, 0x84, // ptr << 32 | len
+		0x0b,
+	}
+	spin := []byte{0,
+		0x03, 0x40, 0x0c, 0, 0x0b, // loop { br 0 }
+		0x42, 0, 0x0b,
+	}
+	code := []byte{3, byte(len(alloc))}
+	code = append(code, alloc...)
+	code = append(code, byte(len(process)))
+	code = append(code, process...)
+	code = append(code, byte(len(spin)))
+	code = append(code, spin...)
+	module = append(module, section(10, code...)...)
+	module = append(module, section(11, // data
+		1, 0, 0x41, 0, 0x0b, 9, 'h', 'e', 'l', 'l', 'o', 0, 0, 0, 'k',
+	)...)
+	return module
+}
+
+func writeModule(t *testing.T, module []byte) string {
+	filename := filepath.Join(t.TempDir(), "test.wasm")
+	if err := os.WriteFile(filename, module, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestSegment_Wasm_process(t *testing.T) {
+	segment, err := Wasm{}.New(map[string]string{"filename": writeModule(t, testModule()), "instances": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out, drops := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	segment.(*Wasm).SubscribeDrops(drops)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	go func() {
+		in <- &pb.EnrichedFlow{Proto: 6, Note: "kept"}
+		in <- &pb.EnrichedFlow{Proto: 17}
+		close(in)
+	}()
+	var results []*pb.EnrichedFlow
+	dropped := 0
+	for done := false; !done; {
+		select {
+		case msg, ok := <-out:
+			if !ok {
+				done = true
+				break
+			}
+			results = append(results, msg)
+		case <-drops:
+			dropped++
+		}
+	}
+	wg.Wait()
+	if len(results) != 1 || dropped != 1 {
+		t.Fatalf("Segment Wasm passed on %d and dropped %d flows.", len(results), dropped)
+	}
+	if results[0].Proto != 7 || results[0].Note != "kept" {
+		t.Errorf("Segment Wasm did not return the modified flow: %v", results[0])
+	}
+	state := &pb.EnrichedFlow{}
+	if err := proto.Unmarshal(segment.(*Wasm).state["k"], state); err != nil || state.Proto == 0 {
+		t.Errorf("Segment Wasm did not store state for the module: %v", err)
+	}
+}
+
+func TestSegment_Wasm_timeout(t *testing.T) {
+	segment, err := Wasm{}.New(map[string]string{"filename": writeModule(t, testModule()), "function": "spin", "timeout": "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	for i := 0; i < 2; i++ { // the second one runs on a replaced instance
+		in <- &pb.EnrichedFlow{Proto: 6}
+		select {
+		case msg := <-out:
+			if msg.Proto != 6 {
+				t.Errorf("Segment Wasm modified a flow it timed out on: %v", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Segment Wasm did not stop a function running into its timeout.")
+		}
+	}
+	close(in)
+	wg.Wait()
+}
+
+func TestSegment_Wasm_config(t *testing.T) {
+	module := testModule()
+	for name, config := range map[string]map[string]string{
+		"is required":             {},
+		"could not be read":       {"filename": "/nonexistent.wasm"},
+		"positive number":         {"filename": writeModule(t, module), "instances": "0"},
+		"positive duration":       {"filename": writeModule(t, module), "timeout": "0s"},
+		"named 'handle'":          {"filename": writeModule(t, module), "function": "handle"},
+		"signature":               {"filename": writeModule(t, module), "function": "alloc"},
+		"invalid magic number":    {"filename": writeModule(t, []byte("not wasm"))},
+		"from the unknown module": {"filename": writeModule(t, []byte(strings.Replace(string(module), "flowpipeline", "flowpipeliny", 1)))},
+	} {
+		_, err := Wasm{}.New(config)
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Segment Wasm reported %v for %v instead of an error containing %q.", err, config, name)
+		}
+	}
+}
@@ -9,10 +9,12 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
@@ -21,31 +23,34 @@ import (
 type Csv struct {
 	segments.BaseSegment
 	writer     *csv.Writer
+	file       *os.File // nil if writing to stdout
 	fieldNames []string
 
 	FileName string // optional, default is empty which means stdout
 	Fields   string // optional comma-separated list of fields to export, default is "", meaning all fields
+
+	path        string      // empty for stdout
+	predecessor *Csv        // set if the file is taken over on Run
+	retained    atomic.Bool // set if the file is kept open after Run
 }
 
-func (segment Csv) New(config map[string]string) segments.Segment {
+func (segment *Csv) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &Csv{}
 
 	var filename string = "stdout"
-	var file *os.File
-	var err error
 	if config["filename"] != "" {
-		file, err = os.Create(config["filename"])
-		if err != nil {
-			log.Printf("[error] Csv: File specified in 'filename' is not accessible: %s", err)
+		// the file is created on Run, as it might still be in use by a
+		// previous configuration
+		if _, err := os.Stat(filepath.Dir(config["filename"])); err != nil {
+			return nil, segments.NewConfigError("filename", "directory is not accessible: %v", err)
 		}
 		filename = config["filename"]
+		newsegment.path = filename
 	} else {
-		file = os.Stdout
 		log.Println("[info] Csv: 'filename' unset, using stdout.")
 	}
 	newsegment.FileName = filename
 
-	var heading []string
 	if config["fields"] != "" {
 		protofields := reflect.TypeOf(pb.EnrichedFlow{})
 		conffields := strings.Split(config["fields"], ",")
@@ -53,10 +58,8 @@ func (segment Csv) New(config map[string]string) segments.Segment {
 			field = strings.TrimSpace(field)
 			_, found := protofields.FieldByName(field)
 			if !found {
-				log.Printf("[error] Csv: Field specified in 'fields' does not exist.")
-				return nil
+				return nil, segments.NewConfigError("fields", "field '%s' does not exist", field)
 			}
-			heading = append(heading, field)
 			newsegment.fieldNames = append(newsegment.fieldNames, field)
 		}
 	} else {
@@ -66,28 +69,71 @@ func (segment Csv) New(config map[string]string) segments.Segment {
 		for i := 3; i < protofields.NumField(); i++ {
 			field := protofields.Field(i)
 			newsegment.fieldNames[i-3] = field.Name
-			heading = append(heading, field.Name)
 		}
 		newsegment.Fields = config["fields"]
 	}
 
-	newsegment.writer = csv.NewWriter(file)
-	if err := newsegment.writer.Write(heading); err != nil {
-		log.Println("[error] Csv: Failed to write to destination:", err)
-		return nil
+	return newsegment, nil
+}
+
+// Takes over the file of the predecessor instead of creating it anew, which
+// would discard anything written to it so far.
+func (segment *Csv) Retain(predecessor segments.Segment) {
+	if predecessor, ok := predecessor.(*Csv); ok {
+		predecessor.retained.Store(true)
+		segment.predecessor = predecessor
 	}
-	newsegment.writer.Flush()
+}
 
-	return newsegment
+// Creates the configured file, or uses stdout, and writes the heading.
+func (segment *Csv) open() error {
+	var file *os.File = os.Stdout
+	if segment.path != "" {
+		var err error
+		file, err = os.Create(segment.path)
+		if err != nil {
+			return err
+		}
+		segment.file = file
+	}
+	segment.writer = csv.NewWriter(file)
+	if err := segment.writer.Write(segment.fieldNames); err != nil {
+		return fmt.Errorf("failed to write to destination: %w", err)
+	}
+	segment.writer.Flush()
+	return nil
 }
 
 func (segment *Csv) Run(wg *sync.WaitGroup) {
 	defer func() {
-		segment.writer.Flush()
+		if segment.writer != nil {
+			segment.writer.Flush()
+		}
+		if segment.file != nil && !segment.retained.Load() {
+			if err := segment.file.Close(); err != nil {
+				log.Printf("[warning] Csv: Failed to close file %s: %v", segment.FileName, err)
+			}
+		}
 		close(segment.Out)
 		wg.Done()
 	}()
+
+	var openErr error
+	if segment.predecessor != nil {
+		segment.writer = segment.predecessor.writer
+		segment.file = segment.predecessor.file
+		segment.predecessor = nil
+		log.Printf("[info] Csv: Took over file %s from the previous configuration.", segment.FileName)
+	} else if openErr = segment.open(); openErr != nil {
+		segment.ShutdownParentPipelineWithError(fmt.Errorf("Csv: %w", openErr))
+	}
+
 	for msg := range segment.In {
+		if openErr != nil {
+			segment.DeadLetter(msg, "write", openErr)
+			segment.Consumed(msg)
+			continue
+		}
 		var record []string
 		values := reflect.ValueOf(msg).Elem()
 		for _, fieldname := range segment.fieldNames {
@@ -117,4 +163,11 @@ func (segment *Csv) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Csv{}
 	segments.RegisterSegment("csv", segment)
+	segments.RegisterSchema("csv", segments.Schema{
+		Summary: "Writes flows to stdout or a file in CSV format.",
+		Params: []segments.Param{
+			{Name: "filename", Doc: "The file to write to instead of stdout."},
+			{Name: "fields", Doc: "A comma separated list of fields to export, all fields are exported if empty."},
+		},
+	})
 }
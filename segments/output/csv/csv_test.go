@@ -27,7 +27,7 @@ func BenchmarkCsv(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := Csv{}.New(map[string]string{})
+	segment, _ := (&Csv{}).New(map[string]string{})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
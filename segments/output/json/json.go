@@ -5,10 +5,13 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/klauspost/compress/zstd"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/bwNetFlow/flowpipeline/segments"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -16,73 +19,141 @@ import (
 
 type Json struct {
 	segments.BaseSegment
-	writer *bufio.Writer
+	writer  *bufio.Writer
+	closers []io.Closer // the encoder and file behind writer, if any
 
 	FileName string // optional, default is empty which means stdout
+
+	path        string            // empty for stdout
+	zstdLevel   zstd.EncoderLevel // zero if uncompressed
+	predecessor *Json             // set if the file is taken over on Run
+	retained    atomic.Bool       // set if the file is kept open after Run
 }
 
-func (segment Json) New(config map[string]string) segments.Segment {
+func (segment *Json) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &Json{}
 
 	var filename string = "stdout"
-	var file *os.File
-	var err error
 	if config["filename"] != "" {
-		file, err = os.Create(config["filename"])
-		if err != nil {
-			log.Printf("[error] Json: File specified in 'filename' is not accessible: %s", err)
+		// the file is created on Run, as it might still be in use by a
+		// previous configuration
+		if _, err := os.Stat(filepath.Dir(config["filename"])); err != nil {
+			return nil, segments.NewConfigError("filename", "directory is not accessible: %v", err)
 		}
 		filename = config["filename"]
+		newsegment.path = filename
 	} else {
-		file = os.Stdout
 		log.Println("[info] Json: 'filename' unset, using stdout.")
 	}
 	// configure zstd compression
 	if config["zstd"] != "" {
 		rawLevel, err := strconv.Atoi(config["zstd"])
-		var level zstd.EncoderLevel
 		if err != nil {
 			log.Printf("[warning] Json: Unable to parse zstd option, using default: %s", err)
-			level = zstd.SpeedDefault
+			newsegment.zstdLevel = zstd.SpeedDefault
 		} else {
-			level = zstd.EncoderLevelFromZstd(rawLevel)
+			newsegment.zstdLevel = zstd.EncoderLevelFromZstd(rawLevel)
 		}
-		encoder, err := zstd.NewWriter(file, zstd.WithEncoderLevel(level))
+	}
+	newsegment.FileName = filename
+
+	return newsegment, nil
+}
+
+// Takes over the file of the predecessor instead of creating it anew, which
+// would discard anything written to it so far.
+func (segment *Json) Retain(predecessor segments.Segment) {
+	if predecessor, ok := predecessor.(*Json); ok {
+		predecessor.retained.Store(true)
+		segment.predecessor = predecessor
+	}
+}
+
+// Creates the configured file, or uses stdout, and sets up the writer.
+func (segment *Json) open() error {
+	var file *os.File = os.Stdout
+	if segment.path != "" {
+		var err error
+		file, err = os.Create(segment.path)
 		if err != nil {
-			log.Fatalf("[error] Json: error creating zstd encoder: %s", err)
+			return err
 		}
-		newsegment.writer = bufio.NewWriter(encoder)
-	} else {
+		segment.closers = append(segment.closers, file)
+	}
+	if segment.zstdLevel == 0 {
 		// no compression
-		newsegment.writer = bufio.NewWriter(file)
+		segment.writer = bufio.NewWriter(file)
+		return nil
 	}
-	newsegment.FileName = filename
+	encoder, err := zstd.NewWriter(file, zstd.WithEncoderLevel(segment.zstdLevel))
+	if err != nil {
+		segment.close()
+		return fmt.Errorf("error creating zstd encoder: %w", err)
+	}
+	segment.closers = append([]io.Closer{encoder}, segment.closers...)
+	segment.writer = bufio.NewWriter(encoder)
+	return nil
+}
 
-	return newsegment
+// Closes the encoder and file, if any.
+func (segment *Json) close() {
+	for _, closer := range segment.closers {
+		if err := closer.Close(); err != nil {
+			log.Printf("[warning] Json: Failed to close file %s: %v", segment.FileName, err)
+		}
+	}
+	segment.closers = nil
 }
 
 func (segment *Json) Run(wg *sync.WaitGroup) {
 	defer func() {
-		_ = segment.writer.Flush()
+		if segment.writer != nil {
+			_ = segment.writer.Flush()
+		}
+		if !segment.retained.Load() {
+			segment.close()
+		}
 		close(segment.Out)
 		wg.Done()
 	}()
+
+	var openErr error
+	if segment.predecessor != nil {
+		segment.writer = segment.predecessor.writer
+		segment.closers = segment.predecessor.closers
+		segment.predecessor = nil
+		log.Printf("[info] Json: Took over file %s from the previous configuration.", segment.FileName)
+	} else if openErr = segment.open(); openErr != nil {
+		segment.ShutdownParentPipelineWithError(fmt.Errorf("Json: %w", openErr))
+	}
+
 	for msg := range segment.In {
+		if openErr != nil {
+			segment.DeadLetter(msg, "write", openErr)
+			segment.Consumed(msg)
+			continue
+		}
 		data, err := protojson.Marshal(msg)
 		if err != nil {
 			log.Printf("[warning] Json: Skipping a flow, failed to recode protobuf as JSON: %v", err)
+			segment.DeadLetter(msg, "marshal", err)
+			segment.Consumed(msg)
 			continue
 		}
 
 		// use Fprintln because it adds an OS specific newline
 		_, err = fmt.Fprintln(segment.writer, string(data))
+		if err == nil {
+			// we need to flush here every time because we need full lines and can not wait
+			// in case of using this output as in input for other instances consuming flow data
+			err = segment.writer.Flush()
+		}
 		if err != nil {
 			log.Printf("[warning] Json: Skipping a flow, failed to write to file %s: %v", segment.FileName, err)
+			segment.DeadLetter(msg, "write", err)
+			segment.Consumed(msg)
 			continue
 		}
-		// we need to flush here every time because we need full lines and can not wait
-		// in case of using this output as in input for other instances consuming flow data
-		_ = segment.writer.Flush()
 		segment.Out <- msg
 	}
 }
@@ -90,4 +161,11 @@ func (segment *Json) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Json{}
 	segments.RegisterSegment("json", segment)
+	segments.RegisterSchema("json", segments.Schema{
+		Summary: "Writes flows to stdout or a file in JSON format.",
+		Params: []segments.Param{
+			{Name: "filename", Doc: "The file to write to instead of stdout."},
+			{Name: "zstd", Type: segments.TypeInt, Doc: "The zstd compression level, output is uncompressed if empty."},
+		},
+	})
 }
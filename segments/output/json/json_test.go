@@ -4,6 +4,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
@@ -25,7 +27,7 @@ func BenchmarkJson(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := Json{}.New(map[string]string{})
+	segment, _ := (&Json{}).New(map[string]string{})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
@@ -40,3 +42,43 @@ func BenchmarkJson(b *testing.B) {
 	}
 	close(in)
 }
+
+// Json Segment test, the file is created on Run and kept open for a successor
+func TestSegment_Json_retain(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "flows.json")
+	config := map[string]string{"filename": filename}
+	run := func(segment segments.Segment, bytes uint64) *sync.WaitGroup {
+		in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+		segment.Rewire(in, out)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go segment.Run(wg)
+		in <- &pb.EnrichedFlow{Bytes: bytes}
+		<-out
+		close(in)
+		return wg
+	}
+
+	predecessor, err := segments.NewSegment("json", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("Segment Json created its file on New: %v", err)
+	}
+	successor, err := segments.NewSegment("json", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	successor.(segments.Retainer).Retain(predecessor)
+	run(predecessor, 1).Wait()
+	run(successor, 2).Wait()
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 2 {
+		t.Errorf("Segment Json did not keep the flows written before a reload: %q", content)
+	}
+}
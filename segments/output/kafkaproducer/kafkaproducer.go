@@ -4,8 +4,8 @@
 package kafkaproducer
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"reflect"
 	"strconv"
@@ -16,6 +16,7 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/bwNetFlow/flowpipeline/pb"
 	"github.com/bwNetFlow/flowpipeline/segments"
+	"github.com/bwNetFlow/flowpipeline/segments/internal/kafka"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -33,25 +34,21 @@ import (
 // FIXME: use sarama directly here
 type KafkaProducer struct {
 	segments.BaseSegment
+	kafka.Connection
 	Server      string // required
 	Topic       string // required
 	TopicSuffix string // optional, default is empty
-	User        string // required if auth is true
-	Pass        string // required if auth is true
-	Tls         bool   // optional, default is true
-	Auth        bool   // optional, default is true
 
 	saramaConfig *sarama.Config
 }
 
-func (segment KafkaProducer) New(config map[string]string) segments.Segment {
+func (segment KafkaProducer) New(config map[string]string) (segments.Segment, error) {
 	var err error
 	newsegment := &KafkaProducer{}
 	newsegment.saramaConfig = sarama.NewConfig()
 
 	if config["server"] == "" || config["topic"] == "" {
-		log.Println("[error] KafkaProducer: Missing required configuration parameters.")
-		return nil
+		return nil, &segments.ConfigError{Reason: "the parameters 'server' and 'topic' are required"}
 	} else {
 		newsegment.Server = config["server"]
 		newsegment.Topic = config["topic"]
@@ -61,74 +58,12 @@ func (segment KafkaProducer) New(config map[string]string) segments.Segment {
 	newsegment.saramaConfig.Producer.RequiredAcks = sarama.WaitForLocal       // Only wait for the leader to ack
 	newsegment.saramaConfig.Producer.Compression = sarama.CompressionSnappy   // Compress messages
 	newsegment.saramaConfig.Producer.Flush.Frequency = 500 * time.Millisecond // Flush batches every 500ms
-	newsegment.saramaConfig.Producer.Return.Successes = false                 // this would block until we've read the ACK, just don't
-	newsegment.saramaConfig.Producer.Return.Errors = false                    // this would block until we've read the error, but we wouldn't retry anyways
+	newsegment.saramaConfig.Producer.Return.Successes = true                  // read by Run to release flows once they are sent
+	newsegment.saramaConfig.Producer.Return.Errors = true                     // read by Run to report flows which could not be sent
 
-	// TODO: parse and set kafka version
-	newsegment.saramaConfig.Version, err = sarama.ParseKafkaVersion("2.4.0")
-	if err != nil {
-		log.Panicf("Error parsing Kafka version: %v", err)
-	}
-
-	// parse config and setup TLS
-	var useTls bool = true
-	if config["tls"] != "" {
-		if parsedTls, err := strconv.ParseBool(config["tls"]); err == nil {
-			useTls = parsedTls
-		} else {
-			log.Println("[error] KafkaProducer: Could not parse 'tls' parameter, using default true.")
-		}
-	} else {
-		log.Println("[info] KafkaProducer: 'tls' set to default true.")
-	}
-	newsegment.Tls = useTls
-	if newsegment.Tls {
-		rootCAs, err := x509.SystemCertPool()
-		if err != nil {
-			log.Panicf("TLS Error: %v", err)
-		}
-		newsegment.saramaConfig.Net.TLS.Enable = true
-		newsegment.saramaConfig.Net.TLS.Config = &tls.Config{RootCAs: rootCAs}
-	} else {
-		log.Println("[info] KafkaProducer: Disabled TLS, operating unencrypted.")
-	}
-
-	// parse config and setup auth
-	var useAuth bool = true
-	if config["auth"] != "" {
-		if parsedAuth, err := strconv.ParseBool(config["auth"]); err == nil {
-			useAuth = parsedAuth
-		} else {
-			log.Println("[error] KafkaProducer: Could not parse 'auth' parameter, using default true.")
-		}
-	} else {
-		log.Println("[info] KafkaProducer: 'auth' set to default true.")
-	}
-
-	// parse and configure credentials, if applicable
-	if useAuth && (config["user"] == "" || config["pass"] == "") {
-		log.Println("[error] KafkaProducer: Missing required configuration parameters for auth.")
-		return nil
-	} else {
-		newsegment.User = config["user"]
-		newsegment.Pass = config["pass"]
-	}
-
-	// use these credentials
-	newsegment.Auth = useAuth
-	if newsegment.Auth {
-		newsegment.saramaConfig.Net.SASL.Enable = true
-		newsegment.saramaConfig.Net.SASL.User = newsegment.User
-		newsegment.saramaConfig.Net.SASL.Password = newsegment.Pass
-		log.Printf("[info] KafkaProducer: Authenticating as user '%s'.", newsegment.User)
-	} else {
-		newsegment.saramaConfig.Net.SASL.Enable = false
-		log.Println("[info] KafkaProducer: Disabled auth.")
-	}
-
-	// warn if we're leaking credentials
-	if newsegment.Auth && !newsegment.Tls {
-		log.Println("[warning] KafkaProducer: Authentication will be done in plain text!")
+	// parse and set up the connection
+	if newsegment.Connection, err = kafka.NewConnection("KafkaProducer", config, newsegment.saramaConfig); err != nil {
+		return nil, err
 	}
 
 	// parse special target topic handling information
@@ -136,20 +71,18 @@ func (segment KafkaProducer) New(config map[string]string) segments.Segment {
 		fmsg := reflect.ValueOf(pb.EnrichedFlow{})
 		field := fmsg.FieldByName(config["topicsuffix"])
 		if !field.IsValid() {
-			log.Println("[error] KafkaProducer: The 'topicsuffix' is not a valid FlowMessage field.")
-			return nil
+			return nil, segments.NewConfigError("topicsuffix", "'%s' is not a valid flow message field", config["topicsuffix"])
 		}
 		fieldtype := field.Type().String()
 		if fieldtype != "string" && fieldtype != "uint32" && fieldtype != "uint64" {
-			log.Println("[error] KafkaProducer: TopicSuffix must be of type uint or string.")
-			return nil
+			return nil, segments.NewConfigError("topicsuffix", "field '%s' must be of type uint or string", config["topicsuffix"])
 		}
 		newsegment.TopicSuffix = config["topicsuffix"]
 	} else {
 		log.Println("[info] KafkaProducer: 'topicsuffix' set to default disabled.")
 	}
 
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *KafkaProducer) Run(wg *sync.WaitGroup) {
@@ -159,19 +92,58 @@ func (segment *KafkaProducer) Run(wg *sync.WaitGroup) {
 	}()
 
 	producer, err := sarama.NewAsyncProducer(strings.Split(segment.Server, ","), segment.saramaConfig)
+	if err != nil {
+		segment.ShutdownParentPipelineWithError(fmt.Errorf("KafkaProducer: Creating Kafka producer failed, this indicates an unreachable server, invalid credentials, or a SSL problem: %w", err))
+		for msg := range segment.In { // keep passing flows until we are closed
+			segment.Out <- msg
+		}
+		return
+	}
+
+	successesDone := make(chan struct{})
+	go func() {
+		defer close(successesDone)
+		for producerMsg := range producer.Successes() {
+			producerMsg.Metadata.(func())()
+		}
+	}()
+	errorsDone := make(chan struct{})
+	go func() {
+		defer close(errorsDone)
+		failed := 0
+		for producerErr := range producer.Errors() {
+			if failed == 0 {
+				log.Printf("[error] KafkaProducer: Could not send a flow, further errors will not be logged: %v", producerErr.Err)
+			}
+			failed++
+			// recover the flow as it was sent, the original has been passed on already
+			msg := &pb.EnrichedFlow{}
+			if binary, err := producerErr.Msg.Value.Encode(); err == nil && proto.Unmarshal(binary, msg) == nil {
+				segment.DeadLetter(msg, "send", producerErr.Err)
+			}
+			producerErr.Msg.Metadata.(func())()
+		}
+		if failed > 0 {
+			log.Printf("[error] KafkaProducer: Could not send %d flows in total.", failed)
+		}
+	}()
 
 	for msg := range segment.In {
+		release := segment.Hold(msg) // once sent, using the message's metadata
 		segment.Out <- msg
 		var binary []byte
 		if binary, err = proto.Marshal(msg); err != nil {
 			log.Printf("[error] KafkaProducer: Error encoding protobuf. %s", err)
+			segment.DeadLetter(msg, "marshal", err)
+			release()
 			continue
 		}
 
 		if segment.TopicSuffix == "" {
 			producer.Input() <- &sarama.ProducerMessage{
-				Topic: segment.Topic,
-				Value: sarama.ByteEncoder(binary),
+				Topic:    segment.Topic,
+				Value:    sarama.ByteEncoder(binary),
+				Metadata: release,
 			}
 		} else {
 			fmsg := reflect.ValueOf(msg).Elem()
@@ -185,19 +157,31 @@ func (segment *KafkaProducer) Run(wg *sync.WaitGroup) {
 			case "string": // this is because doing nothing is also much faster than Sprint
 				suffix = field.Interface().(string)
 			default:
-				log.Println("[error] KafkaProducer: TopicSuffix must be of type uint or string.")
-				segment.ShutdownParentPipeline()
-				return
+				segment.ShutdownParentPipelineWithError(errors.New("KafkaProducer: TopicSuffix must be of type uint or string."))
+				release()
+				continue
 			}
 			producer.Input() <- &sarama.ProducerMessage{
-				Topic: segment.Topic + "-" + suffix,
-				Value: sarama.ByteEncoder(binary),
+				Topic:    segment.Topic + "-" + suffix,
+				Value:    sarama.ByteEncoder(binary),
+				Metadata: release,
 			}
 		}
 	}
+	producer.AsyncClose() // flushes any buffered messages, reporting any errors until done
+	<-successesDone
+	<-errorsDone
 }
 
 func init() {
 	segment := &KafkaProducer{}
 	segments.RegisterSegment("kafkaproducer", segment)
+	segments.RegisterSchema("kafkaproducer", segments.Schema{
+		Summary: "Produces flows to a Kafka topic.",
+		Params: append([]segments.Param{
+			{Name: "server", Required: true, Doc: "A comma separated list of Kafka brokers."},
+			{Name: "topic", Required: true, Doc: "The topic to produce to."},
+			{Name: "topicsuffix", Doc: "A flow field whose value is appended to the topic name."},
+		}, kafka.Params...),
+	})
 }
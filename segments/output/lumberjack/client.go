@@ -3,6 +3,7 @@ package lumberjack
 import (
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"github.com/bwNetFlow/flowpipeline/pb"
 	lumber "github.com/elastic/go-lumber/client/v2"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -106,6 +107,9 @@ func (c *resilientClient) Send(events []interface{}) {
 
 // SendNoRetry will try to send the given events to the server. If the connection fails, it will not retry.
 func (c *resilientClient) SendNoRetry(events []interface{}) (int, error) {
+	if c.sc == nil {
+		return 0, fmt.Errorf("not connected to server %s", c.ServerName)
+	}
 	return c.sc.Send(events)
 }
 
@@ -37,7 +37,13 @@ type Lumberjack struct {
 	BatchDebugPrintf    func(format string, v ...any)
 	QueueStatusInterval time.Duration
 	ReconnectWait       time.Duration
-	LumberjackOut       chan *pb.EnrichedFlow
+	LumberjackOut       chan QueuedFlow
+}
+
+// A flow queued for sending, along with the function releasing it once sent.
+type QueuedFlow struct {
+	Flow    *pb.EnrichedFlow
+	Release func()
 }
 
 func NoDebugPrintf(format string, v ...any) {}
@@ -45,7 +51,9 @@ func DoDebugPrintf(format string, v ...any) {
 	log.Printf(format, v...)
 }
 
-func (segment *Lumberjack) New(config map[string]string) segments.Segment {
+func (segment Lumberjack) New(config map[string]string) (segments.Segment, error) {
+	newsegment := &Lumberjack{}
+
 	var (
 		err                error
 		buflen             int
@@ -59,146 +67,146 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	} else {
 		defaultCompression, err = strconv.Atoi(defaultCompressionString)
 		if err != nil {
-			log.Fatalf("[error] Lumberjack: Failed to parse default compression level %s: %s", defaultCompressionString, err)
+			return nil, segments.NewConfigError("compression", "failed to parse default compression level %s: %v", defaultCompressionString, err)
 		}
 		if defaultCompression < 0 || defaultCompression > 9 {
-			log.Fatalf("[error] Lumberjack: Default compression level %d is out of range", defaultCompression)
+			return nil, segments.NewConfigError("compression", "default compression level %d is out of range", defaultCompression)
 		}
 	}
 
 	// parse server URLs
+	if strings.TrimSpace(config["servers"]) == "" {
+		return nil, segments.NewConfigError("servers", "no servers specified")
+	}
 	rawServerStrings := strings.Split(config["servers"], ",")
 	for idx, serverName := range rawServerStrings {
 		rawServerStrings[idx] = strings.TrimSpace(serverName)
 	}
-	if len(rawServerStrings) == 0 {
-		log.Fatal("[error] Lumberjack: No servers specified in 'servers' config option.")
-	} else {
-		segment.Servers = make(map[string]ServerOptions)
-		for _, rawServerString := range rawServerStrings {
-			serverURL, err := url.Parse(rawServerString)
+	newsegment.Servers = make(map[string]ServerOptions)
+	for _, rawServerString := range rawServerStrings {
+		serverURL, err := url.Parse(rawServerString)
+		if err != nil {
+			return nil, segments.NewConfigError("servers", "failed to parse server URL %s: %v", rawServerString, err)
+		}
+		urlQueryParams := serverURL.Query()
+
+		// parse TLS options
+		var useTLS, verifyTLS bool
+		switch serverURL.Scheme {
+		case "tcp":
+			useTLS = false
+			verifyTLS = false
+		case "tls":
+			useTLS = true
+			verifyTLS = true
+		case "tlsnoverify":
+			useTLS = true
+			verifyTLS = false
+		default:
+			return nil, segments.NewConfigError("servers", "unknown scheme %s in server URL %s", serverURL.Scheme, rawServerString)
+		}
+
+		// parse compression level
+		var compressionLevel int
+		compressionString := urlQueryParams.Get("compression")
+
+		if compressionString == "" {
+			// use global default if not specified
+			compressionLevel = defaultCompression
+		} else {
+			compressionLevel, err = strconv.Atoi(compressionString)
 			if err != nil {
-				log.Fatalf("[error] Lumberjack: Failed to parse server URL %s: %s", rawServerString, err)
-			}
-			urlQueryParams := serverURL.Query()
-
-			// parse TLS options
-			var useTLS, verifyTLS bool
-			switch serverURL.Scheme {
-			case "tcp":
-				useTLS = false
-				verifyTLS = false
-			case "tls":
-				useTLS = true
-				verifyTLS = true
-			case "tlsnoverify":
-				useTLS = true
-				verifyTLS = false
-			default:
-				log.Fatalf("[error] Lumberjack: Unknown scheme %s in server URL %s", serverURL.Scheme, rawServerString)
+				return nil, segments.NewConfigError("servers", "failed to parse compression level %s for host %s: %v", compressionString, serverURL.Host, err)
 			}
-
-			// parse compression level
-			var compressionLevel int
-			compressionString := urlQueryParams.Get("compression")
-
-			if compressionString == "" {
-				// use global default if not specified
-				compressionLevel = defaultCompression
-			} else {
-				compressionLevel, err = strconv.Atoi(compressionString)
-				if err != nil {
-					log.Fatalf("[error] Lumberjack: Failed to parse compression level %s for host %s: %s", compressionString, serverURL.Host, err)
-				}
-				if compressionLevel < 0 || compressionLevel > 9 {
-					log.Fatalf("[error] Lumberjack: Compression level %d out of range for host %s", compressionLevel, serverURL.Host)
-				}
+			if compressionLevel < 0 || compressionLevel > 9 {
+				return nil, segments.NewConfigError("servers", "compression level %d out of range for host %s", compressionLevel, serverURL.Host)
 			}
+		}
 
-			// parse count url argument
-			var numRoutines = 1
-			numRoutinesString := urlQueryParams.Get("count")
-			if numRoutinesString == "" {
+		// parse count url argument
+		var numRoutines = 1
+		numRoutinesString := urlQueryParams.Get("count")
+		if numRoutinesString == "" {
+			numRoutines = 1
+		} else {
+			numRoutines, err = strconv.Atoi(numRoutinesString)
+			switch {
+			case err != nil:
+				return nil, segments.NewConfigError("servers", "failed to parse count %s for host %s: %v", numRoutinesString, serverURL.Host, err)
+			case numRoutines < 1:
+				log.Printf("[warning] Lumberjack: count is smaller than 1, setting to 1")
 				numRoutines = 1
-			} else {
-				numRoutines, err = strconv.Atoi(numRoutinesString)
-				switch {
-				case err != nil:
-					log.Fatalf("[error] Lumberjack: Failed to parse count %s for host %s: %s", numRoutinesString, serverURL.Host, err)
-				case numRoutines < 1:
-					log.Printf("[warning] Lumberjack: count is smaller than 1, setting to 1")
-					numRoutines = 1
-				case numRoutines > runtime.NumCPU():
-					log.Printf("[warning] Lumberjack: count is larger than runtime.NumCPU (%d). This will most likely hurt performance.", runtime.NumCPU())
-				}
+			case numRoutines > runtime.NumCPU():
+				log.Printf("[warning] Lumberjack: count is larger than runtime.NumCPU (%d). This will most likely hurt performance.", runtime.NumCPU())
 			}
+		}
 
-			segment.Servers[serverURL.Host] = ServerOptions{
-				UseTLS:            useTLS,
-				VerifyCertificate: verifyTLS,
-				CompressionLevel:  compressionLevel,
-				Parallism:         numRoutines,
-			}
+		newsegment.Servers[serverURL.Host] = ServerOptions{
+			UseTLS:            useTLS,
+			VerifyCertificate: verifyTLS,
+			CompressionLevel:  compressionLevel,
+			Parallism:         numRoutines,
 		}
 	}
 
 	// parse batchSize option
-	segment.BatchSize = defaultBatchSize
+	newsegment.BatchSize = defaultBatchSize
 	if config["batchsize"] != "" {
-		segment.BatchSize, err = strconv.Atoi(strings.ReplaceAll(config["batchsize"], "_", ""))
+		newsegment.BatchSize, err = strconv.Atoi(strings.ReplaceAll(config["batchsize"], "_", ""))
 		if err != nil {
-			log.Fatalf("[error] Lumberjack: Failed to parse batchsize config option: %s", err)
+			return nil, segments.NewConfigError("batchsize", "could not be parsed: %v", err)
 		}
 	}
-	if segment.BatchSize < 0 {
-		segment.BatchSize = defaultBatchSize
+	if newsegment.BatchSize < 0 {
+		newsegment.BatchSize = defaultBatchSize
 	}
 	// parse batchtimeout option
-	segment.BatchTimeout = defaultTimeout
+	newsegment.BatchTimeout = defaultTimeout
 	if config["batchtimeout"] != "" {
-		segment.BatchTimeout, err = time.ParseDuration(config["batchtimeout"])
+		newsegment.BatchTimeout, err = time.ParseDuration(config["batchtimeout"])
 		if err != nil {
-			log.Fatalf("[error] Lumberjack: Failed to parse timeout config option: %s", err)
+			return nil, segments.NewConfigError("batchtimeout", "could not be parsed: %v", err)
 		}
 	}
 
-	if segment.BatchTimeout < minimalBatchTimeout {
-		log.Printf("[error] Lumberjack: timeout %s too small, using default %s", segment.BatchTimeout.String(), defaultTimeout.String())
-		segment.BatchTimeout = defaultTimeout
+	if newsegment.BatchTimeout < minimalBatchTimeout {
+		log.Printf("[error] Lumberjack: timeout %s too small, using default %s", newsegment.BatchTimeout.String(), defaultTimeout.String())
+		newsegment.BatchTimeout = defaultTimeout
 	}
-	if segment.BatchTimeout > time.Minute {
-		log.Printf("[error] Lumberjack: timeout %s too large, using default %s", segment.BatchTimeout.String(), defaultTimeout)
-		segment.BatchTimeout = defaultTimeout
+	if newsegment.BatchTimeout > time.Minute {
+		log.Printf("[error] Lumberjack: timeout %s too large, using default %s", newsegment.BatchTimeout.String(), defaultTimeout)
+		newsegment.BatchTimeout = defaultTimeout
 	}
 	// parse batchdebug option
+	newsegment.BatchDebugPrintf = NoDebugPrintf
 	if config["batchdebug"] != "" {
 		batchDebug, err := strconv.ParseBool(config["batchdebug"])
 		if err != nil {
-			log.Fatalf("[error] Lumberjack: Failed to parse batchdebug config option: %s", err)
+			return nil, segments.NewConfigError("batchdebug", "could not be parsed: %v", err)
 		}
 		// set proper BatchDebugPrintf function
 		if batchDebug {
-			segment.BatchDebugPrintf = DoDebugPrintf
+			newsegment.BatchDebugPrintf = DoDebugPrintf
 		} else {
-			segment.BatchDebugPrintf = NoDebugPrintf
+			newsegment.BatchDebugPrintf = NoDebugPrintf
 		}
 	}
 
 	// parse reconnectwait option
-	segment.ReconnectWait = defaultReconnectWait
+	newsegment.ReconnectWait = defaultReconnectWait
 	if config["reconnectwait"] != "" {
-		segment.ReconnectWait, err = time.ParseDuration(config["reconnectwait"])
+		newsegment.ReconnectWait, err = time.ParseDuration(config["reconnectwait"])
 		if err != nil {
-			log.Fatalf("[error] Lumberjack: Failed to parse reconnectwait config option: %s", err)
+			return nil, segments.NewConfigError("reconnectwait", "could not be parsed: %v", err)
 		}
 	}
 
 	// parse queueStatusInterval option
-	segment.QueueStatusInterval = defaultQueueStatusInterval
+	newsegment.QueueStatusInterval = defaultQueueStatusInterval
 	if config["queuestatusinterval"] != "" {
-		segment.QueueStatusInterval, err = time.ParseDuration(config["queuestatusinterval"])
+		newsegment.QueueStatusInterval, err = time.ParseDuration(config["queuestatusinterval"])
 		if err != nil {
-			log.Fatalf("[error] Lumberjack: Failed to parse queuestatussnterval config option: %s", err)
+			return nil, segments.NewConfigError("queuestatusinterval", "could not be parsed: %v", err)
 		}
 	}
 
@@ -206,7 +214,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["queuesize"] != "" {
 		buflen, err = strconv.Atoi(strings.ReplaceAll(config["queuesize"], "_", ""))
 		if err != nil {
-			log.Fatalf("[error] Lumberjack: Failed to parse queuesize config option: %s", err)
+			return nil, segments.NewConfigError("queuesize", "could not be parsed: %v", err)
 		}
 	} else {
 		buflen = defaultQueueSize
@@ -215,9 +223,9 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 		log.Printf("[error] Lumberjack: queuesize too small, using default %d", defaultQueueSize)
 		buflen = defaultQueueSize
 	}
-	segment.LumberjackOut = make(chan *pb.EnrichedFlow, buflen)
+	newsegment.LumberjackOut = make(chan QueuedFlow, buflen)
 
-	return segment
+	return newsegment, nil
 }
 
 func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
@@ -253,6 +261,7 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 				log.Printf("[info] Lumberjack: Connected to %s (TLS: %v, VerifyTLS: %v, Compression: %d, number %d/%d)", server, options.UseTLS, options.VerifyCertificate, options.CompressionLevel, numServer+1, options.Parallism)
 
 				flowInterface := make([]interface{}, segment.BatchSize)
+				held := make([]func(), segment.BatchSize) // releases the flows in the batch once sent
 				idx := 0
 
 				// see https://stackoverflow.com/questions/66037676/go-reset-a-timer-newtimer-within-select-loop for timer mechanics
@@ -270,15 +279,24 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 							count, err := client.SendNoRetry(flowInterface[:idx])
 							if err != nil {
 								log.Printf("[error] Lumberjack: Failed to send final flow batch upon exit to %s: %s", server, err)
+								// not released, such that inputs waiting for
+								// acknowledgements consume them again later on
+								for _, flow := range flowInterface[:idx] {
+									segment.DeadLetter(flow.(*pb.EnrichedFlow), "send", err)
+								}
 							} else {
 								segment.BatchDebugPrintf("[debug] Lumberjack: %s Sent final batch (%d)", server, count)
+								for _, release := range held[:idx] {
+									release()
+								}
 							}
 							wg.Done()
 							return
 						}
 
 						// append flow to batch
-						flowInterface[idx] = flow
+						flowInterface[idx] = flow.Flow
+						held[idx] = flow.Release
 						idx++
 
 						// send batch if full
@@ -293,8 +311,11 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 								timerSet = false
 							}
 
-							client.Send(flowInterface)
+							client.Send(flowInterface) // retries until sent
 							segment.BatchDebugPrintf("[debug] Lumberjack: %s Sent full batch (%d)", server, segment.BatchSize)
+							for _, release := range held {
+								release()
+							}
 
 							// reset idx
 							idx = 0
@@ -309,7 +330,10 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 						// timer expired, send batch
 						if idx > 0 {
 							segment.BatchDebugPrintf("[debug] Lumberjack: %s Sending incomplete batch (%d/%d)", server, idx, segment.BatchSize)
-							client.Send(flowInterface[:idx])
+							client.Send(flowInterface[:idx]) // retries until sent
+							for _, release := range held[:idx] {
+								release()
+							}
 							idx = 0
 						} else {
 							segment.BatchDebugPrintf("[debug] Lumberjack: %s Timer expired with empty batch", server)
@@ -325,7 +349,7 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 
 	// forward flows to lumberjack servers and to the next segment
 	for msg := range segment.In {
-		segment.LumberjackOut <- msg
+		segment.LumberjackOut <- QueuedFlow{Flow: msg, Release: segment.Hold(msg)}
 		segment.Out <- msg
 	}
 }
@@ -334,4 +358,17 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Lumberjack{}
 	segments.RegisterSegment("lumberjack", segment)
+	segments.RegisterSchema("lumberjack", segments.Schema{
+		Summary: "Sends flows to elastic beats servers using the lumberjack protocol.",
+		Params: []segments.Param{
+			{Name: "servers", Required: true, Doc: "A comma separated list of server URLs using the schemes tcp, tls or tlsnoverify."},
+			{Name: "compression", Type: segments.TypeInt, Default: "0", Doc: "The default compression level from 0 to 9."},
+			{Name: "batchsize", Default: "64", Doc: "The number of flows sent at once, '_' may be used as digit separator."},
+			{Name: "queuesize", Default: "65536", Doc: "The number of flows buffered for sending, '_' may be used as digit separator."},
+			{Name: "batchtimeout", Type: segments.TypeDuration, Default: "5s", Doc: "The maximum time flows are buffered before sending."},
+			{Name: "reconnectwait", Type: segments.TypeDuration, Default: "1s", Doc: "The time to wait between reconnection attempts."},
+			{Name: "batchdebug", Type: segments.TypeBool, Default: "false", Doc: "Whether to log debug messages about batch operations."},
+			{Name: "queuestatusinterval", Type: segments.TypeDuration, Default: "0s", Doc: "The interval in which the queue status is logged, 0 disables it."},
+		},
+	})
 }
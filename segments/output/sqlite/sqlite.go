@@ -36,17 +36,15 @@ type Sqlite struct {
 
 // Every Segment must implement a New method, even if there isn't any config
 // it is interested in.
-func (segment Sqlite) New(config map[string]string) segments.Segment {
+func (segment Sqlite) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &Sqlite{}
 
 	if config["filename"] == "" {
-		log.Println("[error] Sqlite: This segment requires a 'filename' parameter.")
-		return nil
+		return nil, segments.NewConfigError("filename", "is required")
 	}
 	_, err := sql.Open("sqlite3", config["filename"])
 	if err != nil {
-		log.Printf("[error] Sqlite: Could not open DB file at %s.", config["filename"])
-		return nil
+		return nil, segments.NewConfigError("filename", "could not open DB file at %s: %v", config["filename"], err)
 	}
 	newsegment.FileName = config["filename"]
 
@@ -54,8 +52,7 @@ func (segment Sqlite) New(config map[string]string) segments.Segment {
 	if config["batchsize"] != "" {
 		if parsedBatchSize, err := strconv.ParseUint(config["batchsize"], 10, 32); err == nil {
 			if parsedBatchSize == 0 {
-				log.Println("[error] Sqlite: Batch size 0 is not allowed. Set this in relation to the expected flows per second.")
-				return nil
+				return nil, segments.NewConfigError("batchsize", "0 is not allowed, set this in relation to the expected flows per second")
 			}
 			newsegment.BatchSize = int(parsedBatchSize)
 		} else {
@@ -72,8 +69,7 @@ func (segment Sqlite) New(config map[string]string) segments.Segment {
 		for _, field := range conffields {
 			protofield, found := protofields.FieldByName(field)
 			if !found {
-				log.Printf("[error] Csv: Field specified in 'fields' does not exist.")
-				return nil
+				return nil, segments.NewConfigError("fields", "field '%s' does not exist", field)
 			}
 			newsegment.fieldNames = append(newsegment.fieldNames, field)
 			newsegment.fieldTypes = append(newsegment.fieldTypes, protofield.Type.String())
@@ -113,7 +109,7 @@ func (segment Sqlite) New(config map[string]string) segments.Segment {
 	valueStrings = append(valueStrings, fmt.Sprintf("(%s)", strings.Join(qmList, ",")))
 	newsegment.insertStatement = fmt.Sprintf("INSERT INTO flows (%s) VALUES %s", strings.Join(newsegment.fieldNames, ","), strings.Join(valueStrings, ","))
 
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *Sqlite) Run(wg *sync.WaitGroup) {
@@ -140,29 +136,42 @@ func (segment *Sqlite) Run(wg *sync.WaitGroup) {
 	tx.Commit()
 
 	var unsaved []*pb.EnrichedFlow
+	var held []func() // releases the unsaved flows once they are inserted
 
 	for msg := range segment.In {
 		unsaved = append(unsaved, msg)
+		held = append(held, segment.Hold(msg))
 		if len(unsaved) >= segment.BatchSize {
-			err := segment.bulkInsert(unsaved)
-			if err != nil {
-				log.Printf("[error] %s", err)
-			}
+			segment.bulkInsert(unsaved)
 			unsaved = []*pb.EnrichedFlow{}
+			for _, release := range held {
+				release()
+			}
+			held = held[:0]
 		}
 		segment.Out <- msg
 	}
 	segment.bulkInsert(unsaved)
+	for _, release := range held {
+		release()
+	}
 }
 
-func (segment Sqlite) bulkInsert(unsavedFlows []*pb.EnrichedFlow) error {
+// Inserts a batch of flows, reporting any flows which could not be inserted
+// using DeadLetter.
+func (segment Sqlite) bulkInsert(unsavedFlows []*pb.EnrichedFlow) {
 	if len(unsavedFlows) == 0 {
-		return nil
+		return
 	}
 	tx, err := segment.db.Begin()
 	if err != nil {
 		log.Printf("[error] Sqlite: Error starting transaction for current batch of %d flows: %+v", len(unsavedFlows), err)
+		for _, msg := range unsavedFlows {
+			segment.DeadLetter(msg, "insert", err)
+		}
+		return
 	}
+	var inserted []*pb.EnrichedFlow
 	for _, msg := range unsavedFlows {
 		valueArgs := make([]interface{}, 0, len(segment.fieldNames))
 		values := reflect.ValueOf(msg).Elem()
@@ -184,13 +193,28 @@ func (segment Sqlite) bulkInsert(unsavedFlows []*pb.EnrichedFlow) error {
 		_, err := tx.Exec(segment.insertStatement, valueArgs...)
 		if err != nil {
 			log.Printf("[error] Sqlite: Error inserting flow into transaction: %+v", err)
+			segment.DeadLetter(msg, "insert", err)
+			continue
+		}
+		inserted = append(inserted, msg)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[error] Sqlite: Error committing transaction for current batch of %d flows: %+v", len(unsavedFlows), err)
+		for _, msg := range inserted {
+			segment.DeadLetter(msg, "insert", err)
 		}
 	}
-	tx.Commit()
-	return nil
 }
 
 func init() {
 	segment := &Sqlite{}
 	segments.RegisterSegment("sqlite", segment)
+	segments.RegisterSchema("sqlite", segments.Schema{
+		Summary: "Writes flows to a SQLite database.",
+		Params: []segments.Param{
+			{Name: "filename", Required: true, Doc: "The database file."},
+			{Name: "fields", Doc: "A comma separated list of fields to export, all fields are exported if empty."},
+			{Name: "batchsize", Type: segments.TypeUint, Default: "1000", Doc: "The number of flows to insert at once."},
+		},
+	})
 }
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 
@@ -21,7 +22,7 @@ func TestSegment_Sqlite_passthrough(t *testing.T) {
 	// if result == nil {
 	// 	t.Error("Segment Sqlite is not passing through flows.")
 	// }
-	segment := Sqlite{}.New(map[string]string{"filename": "test.sqlite"})
+	segment, _ := Sqlite{}.New(map[string]string{"filename": filepath.Join(t.TempDir(), "test.sqlite")})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
@@ -42,7 +43,7 @@ func BenchmarkSqlite_1000(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := Sqlite{}.New(map[string]string{"filename": "bench.sqlite"})
+	segment, _ := Sqlite{}.New(map[string]string{"filename": filepath.Join(b.TempDir(), "bench.sqlite")})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
@@ -63,7 +64,7 @@ func BenchmarkSqlite_10000(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := Sqlite{}.New(map[string]string{"filename": "bench.sqlite", "batchsize": "10000"})
+	segment, _ := Sqlite{}.New(map[string]string{"filename": filepath.Join(b.TempDir(), "bench.sqlite"), "batchsize": "10000"})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
@@ -84,7 +85,7 @@ func BenchmarkSqlite_100000(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	os.Stdout, _ = os.Open(os.DevNull)
 
-	segment := Sqlite{}.New(map[string]string{"filename": "bench.sqlite", "batchsize": "100000"})
+	segment, _ := Sqlite{}.New(map[string]string{"filename": filepath.Join(b.TempDir(), "bench.sqlite"), "batchsize": "100000"})
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
 	segment.Rewire(in, out)
@@ -16,16 +16,18 @@ type Pass struct {
 }
 
 // Every Segment must implement a New method, even if there isn't any config
-// it is interested in.
-func (segment Pass) New(config map[string]string) segments.Segment {
-	// do config stuff here, add it to fields maybe
-	return &Pass{}
+// it is interested in. Any problem with the config should be returned as an
+// error, preferably a *segments.ConfigError naming the offending parameter.
+func (segment Pass) New(config map[string]string) (segments.Segment, error) {
+	// do config stuff here, add it to fields maybe, and return any
+	// problems using segments.NewConfigError("param", "reason")
+	return &Pass{}, nil
 }
 
 // The main goroutine of any Segment. Any Run method must:
 // 1. close(segment.Out) when the In channel is closed by the previous segment or the Pipeline itself
 // 2. call wg.Done() before exiting
-// 3. if exiting for any other reason, use segment.ShutdownParentPipeline() or just continue to pass from In to Out
+// 3. if exiting for any other reason, use segment.ShutdownParentPipeline() or segment.ShutdownParentPipelineWithError(err), and continue to pass from In to Out until In is closed
 //
 // Usually, when using a range over In in combination with below defer, nothing
 // will go wrong. However, some segments have a legitimate use case for using
@@ -46,7 +48,9 @@ func (segment *Pass) Run(wg *sync.WaitGroup) {
 
 // Every Segment needs an init() function of some form in its file to be
 // callable from config. An unregistered Segment will only be available using
-// the API.
+// the API. Segments should also declare their parameters using
+// segments.RegisterSchema, which enables validation of their config and the
+// -describe flag. This template does not, as it ignores any config it gets.
 func init() {
 	segment := &Pass{}
 	segments.RegisterSegment("pass", segment)
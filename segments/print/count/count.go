@@ -16,10 +16,10 @@ type Count struct {
 	Prefix string // optional, default is empty, a string which is printed along with the result
 }
 
-func (segment Count) New(config map[string]string) segments.Segment {
+func (segment Count) New(config map[string]string) (segments.Segment, error) {
 	return &Count{
 		Prefix: config["prefix"],
-	}
+	}, nil
 }
 
 func (segment *Count) Run(wg *sync.WaitGroup) {
@@ -38,4 +38,10 @@ func (segment *Count) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Count{}
 	segments.RegisterSegment("count", segment)
+	segments.RegisterSchema("count", segments.Schema{
+		Summary: "Counts flows and prints the result on shutdown.",
+		Params: []segments.Param{
+			{Name: "prefix", Doc: "A prefix for the printed result."},
+		},
+	})
 }
@@ -15,7 +15,7 @@ type PrintDots struct {
 	FlowsPerDot uint64 // optional, default is 5000
 }
 
-func (segment PrintDots) New(config map[string]string) segments.Segment {
+func (segment PrintDots) New(config map[string]string) (segments.Segment, error) {
 	var fpd uint64 = 5000
 	if parsedFpd, err := strconv.ParseUint(config["flowsperdot"], 10, 32); err == nil {
 		fpd = parsedFpd
@@ -28,7 +28,7 @@ func (segment PrintDots) New(config map[string]string) segments.Segment {
 	}
 	return &PrintDots{
 		FlowsPerDot: fpd,
-	}
+	}, nil
 }
 
 func (segment *PrintDots) Run(wg *sync.WaitGroup) {
@@ -49,4 +49,10 @@ func (segment *PrintDots) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &PrintDots{}
 	segments.RegisterSegment("printdots", segment)
+	segments.RegisterSchema("printdots", segments.Schema{
+		Summary: "Prints a dot for every n flows.",
+		Params: []segments.Param{
+			{Name: "flowsperdot", Type: segments.TypeUint, Default: "5000", Doc: "The number of flows per dot."},
+		},
+	})
 }
@@ -9,7 +9,7 @@ import (
 
 // PrintDots Segment test, passthrough test only
 func TestSegment_PrintDots_passthrough(t *testing.T) {
-	result := segments.TestSegment("printdots", map[string]string{"flowsPerDot": "100"},
+	result := segments.TestSegment("printdots", map[string]string{"flowsperdot": "100"},
 		&pb.EnrichedFlow{})
 	if result == nil {
 		t.Error("Segment PrintDots is not passing through flows.")
@@ -18,20 +18,20 @@ func TestSegment_PrintDots_passthrough(t *testing.T) {
 
 func TestSegment_PrintDots_instanciation(t *testing.T) {
 	printDots := &PrintDots{}
-	result := printDots.New(map[string]string{})
-	if result == nil {
+	_, err := printDots.New(map[string]string{})
+	if err != nil {
 		t.Error("Segment PrintDots did not intiate despite good base config.")
 	}
 
 	printDots = &PrintDots{}
-	result = printDots.New(map[string]string{"flowsperdot": "twelve"})
-	if result == nil {
+	_, err = printDots.New(map[string]string{"flowsperdot": "twelve"})
+	if err != nil {
 		t.Error("Segment PrintDots did not fallback from bad base config.")
 	}
 
 	printDots = &PrintDots{}
-	result = printDots.New(map[string]string{"flowsperdot": "12"})
-	if result == nil {
+	_, err = printDots.New(map[string]string{"flowsperdot": "12"})
+	if err != nil {
 		t.Error("Segment PrintDots did not intiate despite good base config.")
 	}
 }
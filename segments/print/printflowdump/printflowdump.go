@@ -37,7 +37,7 @@ func (segment *PrintFlowdump) Run(wg *sync.WaitGroup) {
 	}
 }
 
-func (segment PrintFlowdump) New(config map[string]string) segments.Segment {
+func (segment PrintFlowdump) New(config map[string]string) (segments.Segment, error) {
 	var useProtoname bool = true
 	if config["useprotoname"] != "" {
 		if parsedUseProtoname, err := strconv.ParseBool(config["useprotoname"]); err == nil {
@@ -71,7 +71,7 @@ func (segment PrintFlowdump) New(config map[string]string) segments.Segment {
 		log.Println("[info] PrintFlowdump: 'highlight' set to default false.")
 	}
 
-	return &PrintFlowdump{UseProtoname: useProtoname, Verbose: verbose, Highlight: highlight}
+	return &PrintFlowdump{UseProtoname: useProtoname, Verbose: verbose, Highlight: highlight}, nil
 
 }
 
@@ -231,4 +231,12 @@ func (segment PrintFlowdump) format_flow(flowmsg *pb.EnrichedFlow) string {
 func init() {
 	segment := &PrintFlowdump{}
 	segments.RegisterSegment("printflowdump", segment)
+	segments.RegisterSchema("printflowdump", segments.Schema{
+		Summary: "Prints a tcpdump-style line for every flow.",
+		Params: []segments.Param{
+			{Name: "useprotoname", Type: segments.TypeBool, Default: "true", Doc: "Whether to print protocol names instead of numbers."},
+			{Name: "verbose", Type: segments.TypeBool, Default: "false", Doc: "Whether to print additional details."},
+			{Name: "highlight", Type: segments.TypeBool, Default: "false", Doc: "Whether to print in red."},
+		},
+	})
 }
@@ -3,11 +3,14 @@ package toptalkers
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/asecurityteam/rolling"
@@ -24,6 +27,7 @@ type Record struct {
 type TopTalkers struct {
 	segments.BaseSegment
 	writer *bufio.Writer
+	file   *os.File // nil if writing to stdout
 
 	Window         int    // optional, default is 60, sets the number of seconds used as a sliding window size
 	ReportInterval int    // optional, default is 10, sets the number of seconds between report printing
@@ -32,9 +36,12 @@ type TopTalkers struct {
 	ThresholdBps   uint64 // optional, default is 0, only log talkers with an average bits per second rate higher than this value
 	ThresholdPps   uint64 // optional, default is 0, only log talkers with an average packets per second rate higher than this value
 	TopN           uint64 // optional, default is 10, sets the number of top talkers per report
+
+	predecessor *TopTalkers // set if the file is taken over on Run
+	retained    atomic.Bool // set if the file is kept open after Run
 }
 
-func (segment TopTalkers) New(config map[string]string) segments.Segment {
+func (segment *TopTalkers) New(config map[string]string) (segments.Segment, error) {
 	newsegment := &TopTalkers{
 		Window:         60,
 		ReportInterval: 10,
@@ -47,8 +54,7 @@ func (segment TopTalkers) New(config map[string]string) segments.Segment {
 		if parsedWindow, err := strconv.ParseInt(config["window"], 10, 64); err == nil {
 			newsegment.Window = int(parsedWindow)
 			if newsegment.Window <= 0 {
-				log.Println("[error] TopTalkers: Window has to be >0.")
-				return nil
+				return nil, segments.NewConfigError("window", "has to be >0")
 			}
 		} else {
 			log.Println("[error] TopTalkers: Could not parse 'window' parameter, using default 60.")
@@ -61,8 +67,7 @@ func (segment TopTalkers) New(config map[string]string) segments.Segment {
 		if parsedReportInterval, err := strconv.ParseInt(config["reportinterval"], 10, 64); err == nil {
 			newsegment.ReportInterval = int(parsedReportInterval)
 			if newsegment.ReportInterval <= 0 {
-				log.Println("[error] TopTalkers: Reportinterval has to be >0.")
-				return nil
+				return nil, segments.NewConfigError("reportinterval", "has to be >0")
 			}
 		} else {
 			log.Println("[error] TopTalkers: Could not parse 'reportinterval' parameter, using default 60.")
@@ -72,14 +77,12 @@ func (segment TopTalkers) New(config map[string]string) segments.Segment {
 	}
 
 	if config["filename"] != "" {
-		file, err := os.Create(config["filename"])
-		if err != nil {
-			log.Printf("[error] Json: File specified in 'filename' is not accessible: %s", err)
+		// the file is created on Run, as it might still be in use by a
+		// previous configuration
+		if _, err := os.Stat(filepath.Dir(config["filename"])); err != nil {
+			return nil, segments.NewConfigError("filename", "directory is not accessible: %v", err)
 		}
-		newsegment.FileName = config["filename"]
-		newsegment.writer = bufio.NewWriter(file)
 	} else {
-		newsegment.writer = bufio.NewWriter(os.Stdout)
 		log.Println("[info] TopTalkers: Parameter 'filename' empty, output goes to StdOut by default.")
 	}
 
@@ -107,8 +110,7 @@ func (segment TopTalkers) New(config map[string]string) segments.Segment {
 		if parsedTopN, err := strconv.ParseUint(config["topn"], 10, 64); err == nil {
 			newsegment.TopN = parsedTopN
 			if newsegment.TopN <= 0 {
-				log.Println("[error] TopTalkers: TopN has to be >0.")
-				return nil
+				return nil, segments.NewConfigError("topn", "has to be >0")
 			}
 		} else {
 			log.Println("[error] TopTalkers: Could not parse 'topn' parameter, using default 10.")
@@ -117,15 +119,47 @@ func (segment TopTalkers) New(config map[string]string) segments.Segment {
 		log.Println("[info] TopTalkers: 'topn' set to default 10.")
 	}
 
-	return newsegment
+	return newsegment, nil
+}
+
+// Takes over the file of the predecessor instead of creating it anew, which
+// would discard any reports written to it so far.
+func (segment *TopTalkers) Retain(predecessor segments.Segment) {
+	if predecessor, ok := predecessor.(*TopTalkers); ok {
+		predecessor.retained.Store(true)
+		segment.predecessor = predecessor
+	}
 }
 
 func (segment *TopTalkers) Run(wg *sync.WaitGroup) {
 	defer func() {
 		segment.writer.Flush()
+		if segment.file != nil && !segment.retained.Load() {
+			if err := segment.file.Close(); err != nil {
+				log.Printf("[warning] TopTalkers: Failed to close file %s: %v", segment.FileName, err)
+			}
+		}
 		close(segment.Out)
 		wg.Done()
 	}()
+
+	if segment.predecessor != nil {
+		segment.writer = segment.predecessor.writer
+		segment.file = segment.predecessor.file
+		segment.predecessor = nil
+		log.Printf("[info] TopTalkers: Took over file %s from the previous configuration.", segment.FileName)
+	} else if segment.FileName != "" {
+		file, err := os.Create(segment.FileName)
+		if err != nil {
+			segment.ShutdownParentPipelineWithError(fmt.Errorf("TopTalkers: %w", err))
+			segment.writer = bufio.NewWriter(io.Discard)
+		} else {
+			segment.file = file
+			segment.writer = bufio.NewWriter(file)
+		}
+	} else {
+		segment.writer = bufio.NewWriter(os.Stdout)
+	}
 	database := map[string]*Record{}
 
 	ticker := time.NewTicker(time.Duration(segment.ReportInterval) * time.Second)
@@ -192,4 +226,16 @@ func (segment *TopTalkers) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &TopTalkers{}
 	segments.RegisterSegment("toptalkers", segment)
+	segments.RegisterSchema("toptalkers", segments.Schema{
+		Summary: "Periodically prints the destination addresses receiving the most traffic.",
+		Params: []segments.Param{
+			{Name: "window", Type: segments.TypeUint, Default: "60", Doc: "The size of the sliding window in seconds."},
+			{Name: "reportinterval", Type: segments.TypeUint, Default: "10", Doc: "The interval between reports in seconds."},
+			{Name: "filename", Doc: "The file to write reports to instead of stdout."},
+			{Name: "logprefix", Doc: "A prefix for every line of a report."},
+			{Name: "thresholdbps", Type: segments.TypeUint, Default: "0", Doc: "Only report addresses exceeding this many bits per second."},
+			{Name: "thresholdpps", Type: segments.TypeUint, Default: "0", Doc: "Only report addresses exceeding this many packets per second."},
+			{Name: "topn", Type: segments.TypeUint, Default: "10", Doc: "The number of addresses per report."},
+		},
+	})
 }
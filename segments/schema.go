@@ -0,0 +1,186 @@
+package segments
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var registeredSchemas = make(map[string]Schema)
+
+// The type of a config parameter, it determines which values are considered
+// valid for it.
+type ParamType string
+
+const (
+	TypeString   ParamType = "string"
+	TypeBool     ParamType = "bool"     // anything accepted by strconv.ParseBool
+	TypeInt      ParamType = "int"      // anything accepted by strconv.ParseInt
+	TypeUint     ParamType = "uint"     // anything accepted by strconv.ParseUint
+	TypeFloat    ParamType = "float"    // anything accepted by strconv.ParseFloat
+	TypeDuration ParamType = "duration" // anything accepted by time.ParseDuration
+)
+
+// Describes a single config parameter a Segment accepts.
+type Param struct {
+	Name     string    // the config key
+	Type     ParamType // optional, default is TypeString
+	Default  string    // optional, filled in if the parameter is unset
+	Required bool      // optional, default is false
+	Options  []string  // optional, the only values allowed for this parameter, matched regardless of case
+	Doc      string    // a short description, preferably a single sentence
+}
+
+// Checks whether a given value is valid for this parameter.
+func (p Param) Check(value string) error {
+	var err error
+	switch p.Type {
+	case TypeBool:
+		_, err = strconv.ParseBool(value)
+	case TypeInt:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case TypeUint:
+		_, err = strconv.ParseUint(value, 10, 64)
+	case TypeFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case TypeDuration:
+		_, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return NewConfigError(p.Name, "value '%s' is not a valid %s", value, p.Type)
+	}
+	if _, ok := p.option(value); len(p.Options) > 0 && !ok {
+		return NewConfigError(p.Name, "value '%s' is not one of %s", value, strings.Join(p.Options, ", "))
+	}
+	return nil
+}
+
+// Returns the option matching a given value regardless of case, spelled as
+// declared in Options.
+func (p Param) option(value string) (string, bool) {
+	for _, option := range p.Options {
+		if strings.EqualFold(value, option) {
+			return option, true
+		}
+	}
+	return "", false
+}
+
+// Describes a Segment and all the config parameters it accepts. Segments with
+// a registered Schema have their config validated by NewSegment before it is
+// passed to their New method.
+type Schema struct {
+	Summary string  // a short description of the Segment
+	Params  []Param // all accepted parameters, in order of importance
+}
+
+// Returns the Param with the given name.
+func (s Schema) Param(name string) (Param, bool) {
+	for _, param := range s.Params {
+		if param.Name == name {
+			return param, true
+		}
+	}
+	return Param{}, false
+}
+
+// Validates a config against this Schema and returns a copy with any unset
+// parameters filled in using their defaults, and any options spelled as
+// declared, such that Segments can compare them exactly. The first problem
+// found is returned as a *ConfigError, unknown parameters are considered a
+// problem as well.
+func (s Schema) Validate(config map[string]string) (map[string]string, error) {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := s.Param(key); ok {
+			continue
+		}
+		if len(s.Params) == 0 {
+			return nil, NewConfigError(key, "is unknown, this segment has no parameters")
+		}
+		var names []string
+		for _, param := range s.Params {
+			names = append(names, param.Name)
+		}
+		return nil, NewConfigError(key, "is unknown, valid parameters are %s", strings.Join(names, ", "))
+	}
+
+	validated := make(map[string]string, len(s.Params))
+	for _, param := range s.Params {
+		value := config[param.Name]
+		if value == "" {
+			if param.Required {
+				return nil, NewConfigError(param.Name, "is required")
+			}
+			if param.Default != "" {
+				validated[param.Name] = param.Default
+			} else if _, ok := config[param.Name]; ok {
+				validated[param.Name] = value // keep empty values for segments checking presence
+			}
+			continue
+		}
+		if err := param.Check(value); err != nil {
+			return nil, err
+		}
+		if option, ok := param.option(value); ok {
+			value = option
+		}
+		validated[param.Name] = value
+	}
+	return validated, nil
+}
+
+// Used by Segments to declare their config parameters in their init()
+// functions, usually right after RegisterSegment. Errors and exits immediately
+// on conflicts or if a default value is invalid.
+func RegisterSchema(name string, schema Schema) {
+	if err := schema.checkDefaults(name); err != nil {
+		log.Fatalf("[error] Segments: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := registeredSchemas[name]; ok {
+		log.Fatalf("[error] Segments: Tried to register conflicting schema for segment '%s'.", name)
+	}
+	registeredSchemas[name] = schema
+}
+
+// Checks whether all default values are valid for their parameter.
+func (schema Schema) checkDefaults(name string) error {
+	for _, param := range schema.Params {
+		if param.Default == "" {
+			continue
+		}
+		if err := param.Check(param.Default); err != nil {
+			return fmt.Errorf("tried to register schema for segment '%s' with invalid default: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the Schema registered for the given segment name, if there is one.
+func LookupSchema(name string) (Schema, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	schema, ok := registeredSchemas[name]
+	return schema, ok
+}
+
+// Returns the names of all registered segments in alphabetical order.
+func ListSegments() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	names := make([]string, 0, len(registeredSegments))
+	for name := range registeredSegments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
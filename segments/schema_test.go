@@ -0,0 +1,44 @@
+package segments
+
+import (
+	"testing"
+)
+
+func TestSchema_Validate(t *testing.T) {
+	schema := Schema{
+		Params: []Param{
+			{Name: "required", Required: true},
+			{Name: "count", Type: TypeUint, Default: "10"},
+			{Name: "mode", Default: "fast", Options: []string{"fast", "slow"}},
+			{Name: "optional"},
+		},
+	}
+
+	config, err := schema.Validate(map[string]string{"required": "yes"})
+	if err != nil {
+		t.Fatalf("Schema did not validate a valid config: %v", err)
+	}
+	if config["count"] != "10" || config["mode"] != "fast" {
+		t.Errorf("Schema did not fill in defaults: %v", config)
+	}
+	if _, ok := config["optional"]; ok {
+		t.Error("Schema added an unset parameter without default.")
+	}
+
+	config, err = schema.Validate(map[string]string{"required": "yes", "mode": "Slow"})
+	if err != nil || config["mode"] != "slow" {
+		t.Errorf("Schema did not pass on the option as declared, got '%s': %v", config["mode"], err)
+	}
+
+	for key, config := range map[string]map[string]string{
+		"required": {"count": "1"},
+		"count":    {"required": "yes", "count": "-1"},
+		"mode":     {"required": "yes", "mode": "medium"},
+		"typo":     {"required": "yes", "typo": "1"},
+	} {
+		_, err := schema.Validate(config)
+		if configErr, ok := err.(*ConfigError); !ok || configErr.Key != key {
+			t.Errorf("Schema did not reject parameter '%s': %v", key, err)
+		}
+	}
+}
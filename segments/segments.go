@@ -5,11 +5,12 @@
 package segments
 
 import (
+	"fmt"
 	"log"
 	"sync"
-	"syscall"
 
 	"github.com/bwNetFlow/flowpipeline/pb"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -19,34 +20,103 @@ var (
 )
 
 // Used by Segments to register themselves in their init() functions. Errors
-// and exits immediately on conflicts.
+// and exits immediately on conflicts or if the provided Segment does not
+// implement either the Constructor or the LegacyConstructor interface.
 func RegisterSegment(name string, s Segment) {
-	_, ok := registeredSegments[name]
-	if ok {
-		log.Fatalf("[error] Segments: Tried to register conflicting segment name '%s'.", name)
+	if err := Register(name, s, nil); err != nil {
+		log.Fatalf("[error] Segments: %v", err)
+	}
+}
+
+// Registers a Segment along with its Schema, which may be nil. In contrast to
+// RegisterSegment and RegisterSchema, problems are returned instead of
+// exiting, which allows programs using flowpipeline as a library to register
+// their own Segments at runtime. Nothing is registered if an error is
+// returned.
+func Register(name string, s Segment, schema *Schema) error {
+	switch s.(type) {
+	case Constructor, LegacyConstructor:
+	default:
+		return fmt.Errorf("tried to register segment '%s' without a suitable New method", name)
+	}
+	if schema != nil {
+		if err := schema.checkDefaults(name); err != nil {
+			return err
+		}
 	}
 	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := registeredSegments[name]; ok {
+		return fmt.Errorf("tried to register conflicting segment name '%s'", name)
+	}
+	if schema != nil {
+		if _, ok := registeredSchemas[name]; ok {
+			return fmt.Errorf("tried to register conflicting schema for segment '%s'", name)
+		}
+		registeredSchemas[name] = *schema
+	}
 	registeredSegments[name] = s
-	lock.Unlock()
+	return nil
 }
 
 // Used by the pipeline package to convert segment names in configuration to
 // actual Segment objects.
-func LookupSegment(name string) Segment {
+func LookupSegment(name string) (Segment, error) {
 	lock.RLock()
 	segment, ok := registeredSegments[name]
 	lock.RUnlock()
 	if !ok {
-		log.Fatalf("[error] Segments: Could not find a segment named '%s'.", name)
+		return nil, fmt.Errorf("could not find a segment named '%s'", name)
 	}
-	return segment
+	return segment, nil
+}
+
+// Looks up the segment registered under the given name and creates a new
+// instance from the provided config. If a Schema was registered for this
+// segment, the config is validated against it first. Any error returned by
+// a Segment's New method is a *ConfigError with its Segment field set to the
+// given name.
+func NewSegment(name string, config map[string]string) (Segment, error) {
+	segmentTemplate, err := LookupSegment(name)
+	if err != nil {
+		return nil, err
+	}
+	if schema, ok := LookupSchema(name); ok {
+		config, err = schema.Validate(config)
+		if err != nil {
+			if configErr, ok := err.(*ConfigError); ok {
+				configErr.Segment = name
+			}
+			return nil, err
+		}
+	}
+	switch segmentTemplate := segmentTemplate.(type) {
+	case Constructor:
+		segment, err := segmentTemplate.New(config)
+		if err != nil {
+			configErr, ok := err.(*ConfigError)
+			if !ok {
+				configErr = &ConfigError{Reason: err.Error()}
+			}
+			if configErr.Segment == "" {
+				configErr.Segment = name
+			}
+			return nil, configErr
+		}
+		return segment, nil
+	case LegacyConstructor:
+		if segment := segmentTemplate.New(config); segment != nil {
+			return segment, nil
+		}
+	}
+	return nil, &ConfigError{Segment: name, Reason: "could not be initialized properly, see previous messages"}
 }
 
 // Used by the tests to run single flow messages through a segment.
 func TestSegment(name string, config map[string]string, msg *pb.EnrichedFlow) *pb.EnrichedFlow {
-	segment := LookupSegment(name).New(config)
-	if segment == nil {
-		log.Fatalf("[error] Configured segment '%s' could not be initialized properly, see previous messages.", name)
+	segment, err := NewSegment(name, config)
+	if err != nil {
+		log.Fatalf("[error] Configured segment could not be initialized properly: %v", err)
 	}
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
@@ -66,20 +136,147 @@ func TestSegment(name string, config map[string]string, msg *pb.EnrichedFlow) *p
 
 // This interface is central to an Pipeline object, as it operates on a list of
 // them. In general, Segments should embed the BaseSegment to provide the
-// Rewire function and the associated vars.
+// Rewire function and the associated vars. Additionally, any Segment needs to
+// implement the Constructor interface to be usable with RegisterSegment.
 type Segment interface {
-	New(config map[string]string) Segment                       // for reading the provided config
 	Run(wg *sync.WaitGroup)                                     // goroutine, must close(segment.Out) when segment.In is closed
 	Rewire(in chan *pb.EnrichedFlow, out chan *pb.EnrichedFlow) // embed this using BaseSegment
 	ShutdownParentPipeline()                                    // shut down Parent Pipeline gracefully
 }
 
+// Implemented by BaseSegment. The pipeline package uses it to let Segments
+// request the end of the Pipeline they are running in.
+type Shutdowner interface {
+	SetShutdownFunc(shutdown func(err error)) // called by the Pipeline before starting the Segment
+	ShutdownParentPipelineWithError(err error)
+}
+
+// Implemented by BaseFilterSegment. Segments which drop flows, as opposed to
+// forwarding them, need to implement this interface to have their dropped flows
+// passed on by the Pipeline, for instance to the else branch of a
+// controlflow/branch segment using them as a condition. This applies to plugins
+// as well, which usually embed BaseFilterSegment to this end. Dropped flows are
+// to be sent to the subscribed channel if it is not nil.
+type DropSubscriber interface {
+	SubscribeDrops(drops chan<- *pb.EnrichedFlow)
+}
+
+// Implemented by BaseSegment. The pipeline package uses it to collect flows
+// Segments failed to process, such as flows an output segment could not write,
+// and to pass them on to the dead letter pipeline if one is configured.
+type DeadLetterer interface {
+	SetDeadLetterFunc(deadLetter func(msg *pb.EnrichedFlow, reason string, err error)) // called by the Pipeline before starting the Segment
+}
+
+// Implemented by BaseSegment. The pipeline package uses it to let Segments
+// take part in tracking flows whose source needs to know once they have been
+// fully processed, see Track.
+type Tracked interface {
+	SetFlowTracker(tracker FlowTracker) // called by the Pipeline before starting the Segment
+}
+
+// Implemented by the pipeline package. Segments use it by means of the
+// methods of BaseSegment, which document each of these.
+type FlowTracker interface {
+	Track(msg *pb.EnrichedFlow, ack func())
+	Copied(msg *pb.EnrichedFlow, copy *pb.EnrichedFlow)
+	Hold(msg *pb.EnrichedFlow) (release func())
+	Done(msg *pb.EnrichedFlow)
+}
+
+// Segments passing flows into the Pipeline which need to be acknowledged
+// using Track implement this interface. Flows are only tracked if any Segment
+// of a Pipeline requests it, as doing so has a cost for every flow.
+type TrackingSource interface {
+	TracksFlows() bool
+}
+
+// Segments declaring flows as done before the flows they emit in their place
+// are, such as aggregated ones, implement this interface. A configuration
+// using these in a Pipeline tracking flows is rejected, as flows would be
+// acknowledged before the results are fully processed.
+type EarlyConsumer interface {
+	ConsumesEarly()
+}
+
+// Segments collecting metrics of their own implement this interface. If the
+// Pipeline is instrumented, it collects these along with the metrics of all
+// segments, using a collector whose metrics carry the given labels, which are
+// the Segment's path and name.
+type MetricsSource interface {
+	Collector(labels prometheus.Labels) prometheus.Collector
+}
+
+// The New method creates a new, configured instance of a Segment. It is called
+// on the instance a Segment was registered with.
+type Constructor interface {
+	New(config map[string]string) (Segment, error) // for reading the provided config, return a *ConfigError on failure
+}
+
+// This is the former signature of a Segment's New method, which signals
+// problems by returning nil and logging them. It is still supported for
+// existing plugins, new Segments should implement Constructor instead.
+type LegacyConstructor interface {
+	New(config map[string]string) Segment
+}
+
+// Segments holding resources which are costly to recreate, such as listening
+// sockets or Kafka consumer group memberships, can implement this interface
+// to hand them over to an identically configured successor when a pipeline is
+// reloaded.
+type Retainer interface {
+	// Called on a new instance before it is started, while its predecessor
+	// of the same type is still running. The predecessor must keep its
+	// resources once its Run method returns, and the new instance takes
+	// them over when its own Run method is called.
+	Retain(predecessor Segment)
+}
+
+// Segments serving resources which can only exist once per config, such as an
+// HTTP endpoint, can implement this interface to use those of another
+// instance created from the same config, as done for multiple workers and for
+// the copies of a subpipeline within a shard segment.
+type Sharer interface {
+	// Called on a new instance before it is started, along with the first
+	// instance created from the same config. The new instance uses the
+	// resources of the first one instead of creating its own.
+	Share(first Segment)
+}
+
+// Describes why a Segment could not be created from a given config.
+type ConfigError struct {
+	Segment string // the name the Segment is registered as, set by NewSegment
+	Key     string // the offending config key, empty if not specific to one
+	Reason  string
+}
+
+func (e *ConfigError) Error() string {
+	msg := e.Reason
+	if e.Key != "" {
+		msg = fmt.Sprintf("parameter '%s': %s", e.Key, msg)
+	}
+	if e.Segment != "" {
+		msg = fmt.Sprintf("%s: %s", e.Segment, msg)
+	}
+	return msg
+}
+
+// Convenience function for Segment constructors to return a *ConfigError
+// regarding a specific config key.
+func NewConfigError(key string, format string, a ...any) *ConfigError {
+	return &ConfigError{Key: key, Reason: fmt.Sprintf(format, a...)}
+}
+
 // Serves as a basis for any Segment implementations. Segments embedding this
 // type only need the New and the Run methods to be compliant to the Segment
 // interface.
 type BaseSegment struct {
 	In  <-chan *pb.EnrichedFlow
 	Out chan<- *pb.EnrichedFlow
+
+	shutdown   func(err error)                                      // set by the Pipeline, see ShutdownParentPipeline
+	deadLetter func(msg *pb.EnrichedFlow, reason string, err error) // set by the Pipeline, see DeadLetter
+	tracker    FlowTracker                                          // set by the Pipeline, see Track
 }
 
 // An extended basis for Segment implementations in the filter group. It
@@ -91,8 +288,9 @@ type BaseFilterSegment struct {
 
 // Set a return channel for dropped flow messages. Segments need to be wary of
 // this channel closing when producing messages to this channel. This method is
-// only called by the flowpipeline tool from the controlflow/branch segment to
-// implement the then/else branches, otherwise this functionality is unused.
+// called by the pipeline package if anyone is interested in dropped flows, for
+// instance the controlflow/branch segment to implement the then/else branches,
+// otherwise this functionality is unused.
 func (segment *BaseFilterSegment) SubscribeDrops(drops chan<- *pb.EnrichedFlow) {
 	segment.Drops = drops
 }
@@ -108,8 +306,98 @@ func (segment *BaseSegment) Rewire(in chan *pb.EnrichedFlow, out chan *pb.Enrich
 	segment.Out = out
 }
 
-// This functions shutdown Parent Pipeline segments on the given syscall.
-// It is used for intended termination within pipeline function, e.g. end pipeline on read from file.
+// Sets the function used by ShutdownParentPipeline. This is called by the
+// Pipeline this Segment is part of.
+func (segment *BaseSegment) SetShutdownFunc(shutdown func(err error)) {
+	segment.shutdown = shutdown
+}
+
+// Requests the Pipeline this Segment is part of to shut down gracefully. It is
+// used for intended termination within pipeline function, e.g. end pipeline on
+// read from file. The Segment needs to keep working as usual until its In
+// channel is closed.
 func (segment *BaseSegment) ShutdownParentPipeline() {
-	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	segment.ShutdownParentPipelineWithError(nil)
+}
+
+// Requests the Pipeline this Segment is part of to shut down gracefully due
+// to the given error, which makes it end unsuccessfully. As with
+// ShutdownParentPipeline, the Segment needs to keep working until its In
+// channel is closed.
+func (segment *BaseSegment) ShutdownParentPipelineWithError(err error) {
+	if segment.shutdown == nil {
+		log.Printf("[warning] Segments: Shutdown requested outside of a pipeline, ignoring it. Reason: %v", err)
+		return
+	}
+	segment.shutdown(err)
+}
+
+// Sets the function used by DeadLetter. This is called by the Pipeline this
+// Segment is part of.
+func (segment *BaseSegment) SetDeadLetterFunc(deadLetter func(msg *pb.EnrichedFlow, reason string, err error)) {
+	segment.deadLetter = deadLetter
+}
+
+// Reports a flow this Segment failed to process, which would otherwise be lost
+// without a trace. The reason is a short description of the failed operation,
+// such as "marshal" or "send", and is used to count failures, so it must not
+// contain any details specific to the flow or the error. These belong into
+// err instead. The Pipeline passes a copy of the flow on to its dead letter
+// pipeline, if one is configured, so the Segment is free to keep using the
+// flow. This may block until the dead letter pipeline accepts the flow, and
+// may be called from any goroutine of the Segment until its Run method
+// returns.
+func (segment *BaseSegment) DeadLetter(msg *pb.EnrichedFlow, reason string, err error) {
+	if segment.deadLetter != nil {
+		segment.deadLetter(msg, reason, err)
+	}
+}
+
+// Sets the FlowTracker used by Track and the related methods. This is called
+// by the Pipeline this Segment is part of.
+func (segment *BaseSegment) SetFlowTracker(tracker FlowTracker) {
+	segment.tracker = tracker
+}
+
+// Registers a flow this Segment is about to pass on, such that ack is called
+// once the flow has been fully processed. This is the case once it has left
+// the Pipeline, has been dropped, or has been discarded otherwise, and once
+// any copies made of it and any holds on it are done as well. Calls to ack
+// may come from any goroutine. If the Pipeline does not track flows, ack is
+// called right away. Segments doing this need to implement TrackingSource.
+func (segment *BaseSegment) Track(msg *pb.EnrichedFlow, ack func()) {
+	if segment.tracker == nil {
+		ack()
+		return
+	}
+	segment.tracker.Track(msg, ack)
+}
+
+// Declares a new flow to be derived from msg, such that msg is not considered
+// fully processed until copy is as well. This needs to be called before
+// passing on either of them.
+func (segment *BaseSegment) Copied(msg *pb.EnrichedFlow, copy *pb.EnrichedFlow) {
+	if segment.tracker != nil {
+		segment.tracker.Copied(msg, copy)
+	}
+}
+
+// Keeps msg from being considered fully processed until the returned function
+// is called, which output Segments use to hold flows until they have been
+// written durably. This needs to be called before passing on msg, and the
+// returned function must be called exactly once.
+func (segment *BaseSegment) Hold(msg *pb.EnrichedFlow) (release func()) {
+	if segment.tracker == nil {
+		return func() {}
+	}
+	return segment.tracker.Hold(msg)
+}
+
+// Declares a flow to be fully processed by this Segment although it is
+// neither passed on nor dropped, for instance because it has been aggregated
+// or could not be written.
+func (segment *BaseSegment) Consumed(msg *pb.EnrichedFlow) {
+	if segment.tracker != nil {
+		segment.tracker.Done(msg)
+	}
 }
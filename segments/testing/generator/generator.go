@@ -11,8 +11,8 @@ type Generator struct {
 	segments.BaseSegment
 }
 
-func (segment Generator) New(config map[string]string) segments.Segment {
-	return &Generator{}
+func (segment Generator) New(config map[string]string) (segments.Segment, error) {
+	return &Generator{}, nil
 }
 
 func (segment *Generator) Run(wg *sync.WaitGroup) {
@@ -37,4 +37,7 @@ func (segment *Generator) Run(wg *sync.WaitGroup) {
 func init() {
 	segment := &Generator{}
 	segments.RegisterSegment("generator", segment)
+	segments.RegisterSchema("generator", segments.Schema{
+		Summary: "Emits test flows as fast as possible.",
+	})
 }